@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/covid19cz/erouska-backend/internal/constants"
+	"github.com/covid19cz/erouska-backend/internal/counters"
+	"github.com/covid19cz/erouska-backend/internal/firebase"
+	"github.com/covid19cz/erouska-backend/internal/firebase/structs"
+	"github.com/covid19cz/erouska-backend/internal/logging"
+	"github.com/covid19cz/erouska-backend/internal/store"
+)
+
+const usage = `Seeds the sharded counters from the legacy ones, which the functions no longer update. Run it once after
+deploying the sharded counters; running it again adds nothing.
+
+Usage:
+  counters-backfill [<counter>...]    backfill the counters (all by default): %v
+`
+
+// legacySource Loads rollups of a legacy counter, by key.
+type legacySource func(ctx context.Context, name string) (map[string]interface{}, error)
+
+var sources = map[string]legacySource{
+	constants.CounterUsers:      realtimeDB(func() interface{} { return &structs.UserCounter{} }),
+	constants.CounterPublishers: realtimeDB(func() interface{} { return &structs.PublisherCounter{} }),
+	constants.CounterEfgs:       realtimeDB(func() interface{} { return &structs.EfgsCounter{} }),
+	// notifications were counted in Firestore collection named as the counter
+	constants.CounterNotifications: firestoreCollection(func() interface{} { return &structs.NotificationCounter{} }),
+}
+
+var names = []string{constants.CounterUsers, constants.CounterPublishers, constants.CounterEfgs, constants.CounterNotifications}
+
+func main() {
+	flag.Usage = func() { fmt.Fprintf(flag.CommandLine.Output(), usage, names) }
+	flag.Parse()
+
+	ctx := context.Background()
+	logger := logging.FromContext(ctx).Named("counters-backfill.main")
+
+	selected := names
+	if flag.NArg() > 0 {
+		selected = flag.Args()
+	}
+
+	client := counters.Client{Store: store.Client{}}
+
+	for _, name := range selected {
+		source, ok := sources[name]
+		if !ok {
+			logger.Errorf("Unknown counter '%v'", name)
+			flag.Usage()
+			os.Exit(2)
+		}
+
+		legacy, err := source(ctx, name)
+		if err != nil {
+			logger.Errorf("Could not load legacy counter %v: %v", name, err)
+			os.Exit(1)
+		}
+
+		added, err := counters.Backfill(ctx, client, name, legacy)
+		fmt.Printf("Backfilled %v rollups %v\n", name, added)
+		if err != nil {
+			logger.Errorf("%v", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// realtimeDB Source of counters kept in Realtime DB, at path named as the counter.
+func realtimeDB(newRollup func() interface{}) legacySource {
+	return func(ctx context.Context, name string) (map[string]interface{}, error) {
+		var raw map[string]json.RawMessage
+		if err := firebase.FirebaseDbClient.NewRef(name).Get(ctx, &raw); err != nil {
+			return nil, err
+		}
+
+		legacy := make(map[string]interface{})
+		for key, data := range raw {
+			rollup := newRollup()
+			if err := json.Unmarshal(data, rollup); err != nil {
+				return nil, fmt.Errorf("Invalid rollup %v: %v", key, err)
+			}
+			legacy[key] = rollup
+		}
+
+		return legacy, nil
+	}
+}
+
+// firestoreCollection Source of counters kept in Firestore, as documents of collection named as the counter.
+func firestoreCollection(newRollup func() interface{}) legacySource {
+	return func(ctx context.Context, name string) (map[string]interface{}, error) {
+		snaps, err := firebase.FirestoreClient.Collection(name).Documents(ctx).GetAll()
+		if err != nil {
+			return nil, err
+		}
+
+		legacy := make(map[string]interface{})
+		for _, snap := range snaps {
+			rollup := newRollup()
+			if err := snap.DataTo(rollup); err != nil {
+				return nil, fmt.Errorf("Invalid rollup %v: %v", snap.Ref.ID, err)
+			}
+			legacy[snap.Ref.ID] = rollup
+		}
+
+		return legacy, nil
+	}
+}
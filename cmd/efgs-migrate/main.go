@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	efgsdatabase "github.com/covid19cz/erouska-backend/internal/functions/efgs/database"
+	"github.com/covid19cz/erouska-backend/internal/logging"
+)
+
+const usage = `Applies or inspects migrations of the EFGS database schema.
+
+Usage:
+  efgs-migrate status             list migrations and whether they were applied
+  efgs-migrate up [<version>]     apply migrations up to the version (the latest by default)
+  efgs-migrate down <version>     revert migrations above the version (the baseline 1 can't be reverted)
+`
+
+func main() {
+	flag.Usage = func() { fmt.Fprint(flag.CommandLine.Output(), usage) }
+	flag.Parse()
+
+	ctx := context.Background()
+	logger := logging.FromContext(ctx).Named("efgs-migrate.main")
+
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	migrator := efgsdatabase.NewMigrator()
+	defer migrator.Close()
+
+	if err := run(ctx, migrator, flag.Arg(0), flag.Args()[1:]); err != nil {
+		logger.Errorf("%v", err)
+		migrator.Close()
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, migrator *efgsdatabase.Migrator, command string, args []string) error {
+	switch command {
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, status := range statuses {
+			applied := "not applied"
+			if status.AppliedAt != nil {
+				applied = "applied at " + status.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%4d  %-28s  %s\n", status.Version, applied, status.Description)
+		}
+		return nil
+
+	case "up":
+		target := migrator.LatestVersion()
+		if len(args) > 0 {
+			version, err := strconv.Atoi(args[0])
+			if err != nil {
+				return fmt.Errorf("Invalid version '%v'", args[0])
+			}
+			target = version
+		}
+
+		versions, err := migrator.Migrate(ctx, target)
+		fmt.Printf("Applied migrations %v\n", versions)
+		return err
+
+	case "down":
+		if len(args) < 1 {
+			return fmt.Errorf("Version to revert to is required")
+		}
+
+		target, err := strconv.Atoi(args[0])
+		if err != nil || target < 0 {
+			return fmt.Errorf("Invalid version '%v'", args[0])
+		}
+
+		versions, err := migrator.Rollback(ctx, target)
+		fmt.Printf("Reverted migrations %v\n", versions)
+		return err
+
+	default:
+		return fmt.Errorf("Unknown command '%v'\n%v", command, usage)
+	}
+}
@@ -1,15 +1,94 @@
 package main
 
 import (
+	"net/http"
+	"os"
+
+	functions "github.com/covid19cz/erouska-backend"
+	"github.com/covid19cz/erouska-backend/internal/constants"
+	efgsconstants "github.com/covid19cz/erouska-backend/internal/functions/efgs/constants"
+	"github.com/covid19cz/erouska-backend/internal/httpserver"
 	"github.com/covid19cz/erouska-backend/internal/logging"
+	"github.com/covid19cz/erouska-backend/internal/pubsub"
 	"github.com/sethvargo/go-signalcontext"
 )
 
-func main() {
+const defaultPort = "8080"
+
+// All HTTP functions, mounted under the same names as they are deployed to Cloud Functions.
+var routes = map[string]http.HandlerFunc{
+	"RegisterEhrid":                    functions.RegisterEhrid,
+	"IsEhridActive":                    functions.IsEhridActive,
+	"ChangePushToken":                  functions.ChangePushToken,
+	"RegisterNotification":             functions.RegisterNotification,
+	"DownloadCovidDataTotal":           functions.DownloadCovidDataTotal,
+	"DownloadAndCountVaccinations":     functions.DownloadAndCountVaccinations,
+	"GetCovidData":                     functions.GetCovidData,
+	"PrepareNewMetricsVersion":         functions.PrepareNewMetricsVersion,
+	"DownloadMetrics":                  functions.DownloadMetrics,
+	"SendWakeUpSignal":                 functions.SendWakeUpSignal,
+	"RelayOutbox":                      functions.RelayOutbox,
+	"PublishKeys":                      functions.PublishKeys,
+	"EfgsUploadKeys":                   functions.EfgsUploadKeys,
+	"EfgsDownloadKeys":                 functions.EfgsDownloadKeys,
+	"EfgsDownloadYesterdaysKeys":       functions.EfgsDownloadYesterdaysKeys,
+	"EfgsRemoveOldKeys":                functions.EfgsRemoveOldKeys,
+	"EfgsIssueTestingVerificationCode": functions.EfgsIssueTestingVerificationCode,
+	"EfgsBatchCallback":                functions.EfgsBatchCallback,
+	"EfgsManageCallback":               functions.EfgsManageCallback,
+	"EfgsReplayBatches":                functions.EfgsReplayBatches,
+	"EfgsRequeueImports":               functions.EfgsRequeueImports,
+	"EfgsCheckCertificates":            functions.EfgsCheckCertificates,
+}
 
+// All PubSub-triggered functions, by the topic they are subscribed to.
+var subscriptions = map[string]pubsub.Subscriber{
+	constants.TopicRegisterUser:                         functions.RegisterEhridAfterMath,
+	constants.TopicRegisterNotification:                 functions.RegisterNotificationAfterMath,
+	constants.TopicPublishKeys:                          functions.PublishKeysAfterMath,
+	efgsconstants.TopicNameImportKeys:                   functions.EfgsImportKeys,
+	efgsconstants.TopicNameContinueYesterdayDownloading: functions.EfgsDownloadYesterdaysKeysPostponed,
+	efgsconstants.TopicNamePersistKeys:                  functions.EfgsPersistKeys,
+	efgsconstants.TopicNameDownloadBatch:                functions.EfgsDownloadAnnouncedBatch,
+}
+
+func main() {
 	ctx, done := signalcontext.OnInterrupt()
 	defer done()
 
-	_ = logging.FromContext(ctx)
+	logger := logging.FromContext(ctx).Named("erouska.main")
+
+	port, ok := os.LookupEnv("PORT")
+	if !ok {
+		port = defaultPort
+	}
+
+	if os.Getenv("LOCAL_PUBSUB") == "true" {
+		logger.Info("Delivering PubSub messages in-process")
+
+		localClient := pubsub.NewLocalClient()
+		for topic, subscriber := range subscriptions {
+			logger.Debugf("Subscribing to topic %v", topic)
+			localClient.Subscribe(topic, subscriber, pubsub.SubscriptionConfig{})
+		}
+
+		pubsub.EnableLocalDelivery(localClient)
+	}
+
+	mux := http.NewServeMux()
+	for name, handler := range routes {
+		logger.Debugf("Mounting function %v", name)
+		mux.Handle("/"+name, handler)
+	}
+
+	srv, err := httpserver.New(port)
+	if err != nil {
+		logger.Fatalf("Could not create server: %v", err)
+	}
+
+	if err := srv.ServeHTTPHandler(ctx, mux); err != nil {
+		logger.Fatalf("Server has failed: %v", err)
+	}
 
+	logger.Info("Successful shutdown")
 }
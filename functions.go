@@ -10,6 +10,7 @@ import (
 	"github.com/covid19cz/erouska-backend/internal/functions/publishkeys"
 	"github.com/covid19cz/erouska-backend/internal/functions/registerehrid"
 	"github.com/covid19cz/erouska-backend/internal/functions/registernotification"
+	"github.com/covid19cz/erouska-backend/internal/functions/relayoutbox"
 	"github.com/covid19cz/erouska-backend/internal/functions/wakeup"
 	"github.com/covid19cz/erouska-backend/internal/pubsub"
 	"net/http"
@@ -75,6 +76,11 @@ func SendWakeUpSignal(w http.ResponseWriter, r *http.Request) {
 	wakeup.SendWakeUpSignal(w, r)
 }
 
+//RelayOutbox handler.
+func RelayOutbox(w http.ResponseWriter, r *http.Request) {
+	relayoutbox.RelayOutbox(w, r)
+}
+
 // ***************
 // EFGS functions:
 // ***************
@@ -84,6 +90,16 @@ func PublishKeys(w http.ResponseWriter, r *http.Request) {
 	publishkeys.PublishKeys(w, r)
 }
 
+//PublishKeysAfterMath Updates counters and saves keys for EFGS after keys were published by device.
+func PublishKeysAfterMath(ctx context.Context, m pubsub.Message) error {
+	return publishkeys.AfterMath(ctx, m)
+}
+
+//EfgsPersistKeys Saves keys published by device for upload to EFGS
+func EfgsPersistKeys(ctx context.Context, m pubsub.Message) error {
+	return publishkeys.PersistKeysForEfgs(ctx, m)
+}
+
 //EfgsUploadKeys handler.
 func EfgsUploadKeys(w http.ResponseWriter, r *http.Request) {
 	efgs.UploadBatch(w, r)
@@ -104,16 +120,46 @@ func EfgsDownloadYesterdaysKeysPostponed(ctx context.Context, m pubsub.Message)
 	return efgs.DownloadAndSaveYesterdaysKeysPostponed(ctx, m)
 }
 
+//EfgsBatchCallback Handles EFGS notification about new batch
+func EfgsBatchCallback(w http.ResponseWriter, r *http.Request) {
+	efgs.BatchCallback(w, r)
+}
+
+//EfgsDownloadAnnouncedBatch Downloads batch announced by EFGS
+func EfgsDownloadAnnouncedBatch(ctx context.Context, m pubsub.Message) error {
+	return efgs.DownloadAnnouncedBatch(ctx, m)
+}
+
+//EfgsManageCallback Registers or unregisters our callback in EFGS
+func EfgsManageCallback(w http.ResponseWriter, r *http.Request) {
+	efgs.ManageCallback(w, r)
+}
+
+//EfgsReplayBatches Detects gaps in EFGS download ledger or re-downloads and re-imports EFGS batches
+func EfgsReplayBatches(w http.ResponseWriter, r *http.Request) {
+	efgs.ReplayBatches(w, r)
+}
+
 //EfgsImportKeys Imports given keys
 func EfgsImportKeys(ctx context.Context, m pubsub.Message) error {
 	return efgs.ImportKeysToKeyServer(ctx, m)
 }
 
+//EfgsRequeueImports Enqueues again failed imports of EFGS keys
+func EfgsRequeueImports(w http.ResponseWriter, r *http.Request) {
+	efgs.RequeueImports(w, r)
+}
+
 //EfgsRemoveOldKeys handler.
 func EfgsRemoveOldKeys(w http.ResponseWriter, r *http.Request) {
 	efgs.CleanupDatabase(w, r)
 }
 
+//EfgsCheckCertificates handler.
+func EfgsCheckCertificates(w http.ResponseWriter, r *http.Request) {
+	efgs.CheckCertificates(w, r)
+}
+
 //EfgsIssueTestingVerificationCode handler.
 func EfgsIssueTestingVerificationCode(w http.ResponseWriter, r *http.Request) {
 	efgs.IssueTestingVerificationCode(w, r)
@@ -0,0 +1,127 @@
+package certificate
+
+import (
+	"context"
+	"fmt"
+	"github.com/covid19cz/erouska-backend/internal/utils"
+	"github.com/covid19cz/erouska-backend/internal/utils/errors"
+	"github.com/covid19cz/erouska-backend/pkg/api/v1"
+	"github.com/dgrijalva/jwt-go"
+	keyserverapi "github.com/google/exposure-notifications-server/pkg/api/v1"
+	"net/http"
+	"time"
+)
+
+// Timeout of fetching the public keys.
+const fetchTimeout = 5 * time.Second
+
+//Claims Verified claims of the verification certificate, issued by the Verification server for the published keys.
+type Claims struct {
+	keyserverapi.VerificationClaims
+	// TestDateInterval Interval of the day of the test; only issued by Verification servers which support it.
+	TestDateInterval uint32 `json:"testDateInterval,omitempty"`
+}
+
+//SymptomOnset Gets day of symptom onset, when the certificate contains it.
+func (c *Claims) SymptomOnset() (time.Time, bool) {
+	return dayOfInterval(c.SymptomOnsetInterval)
+}
+
+//TestDate Gets day of the test, when the certificate contains it.
+func (c *Claims) TestDate() (time.Time, bool) {
+	return dayOfInterval(c.TestDateInterval)
+}
+
+//DeviceReportType Gets report type of the keys by the test type the certificate was issued for, in values sent by
+//devices.
+func (c *Claims) DeviceReportType() v1.ReportType {
+	switch c.ReportType {
+	case keyserverapi.ReportTypeClinical:
+		return v1.ConfirmedClinicalDiagnosis
+	case keyserverapi.ReportTypeNegative:
+		return v1.Revoked
+	default:
+		return v1.ConfirmedTest
+	}
+}
+
+func dayOfInterval(interval uint32) (time.Time, bool) {
+	if interval == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(interval)*600, 0).UTC().Truncate(24 * time.Hour), true
+}
+
+//Verifier Verifies certificates issued by the Verification server, by its public keys.
+type Verifier struct {
+	issuer   string
+	audience string
+	keys     *keySet
+	now      func() time.Time
+}
+
+//NewVerifier Creates verifier of certificates by the config; the public keys are fetched when they're needed.
+func NewVerifier(config *utils.VerificationCertificateConfig) *Verifier {
+	return &Verifier{
+		issuer:   config.Issuer,
+		audience: config.Audience,
+		keys:     newKeySet(config.JwksURL, &http.Client{Timeout: fetchTimeout}),
+		now:      time.Now,
+	}
+}
+
+//Verify Verifies signature, issuer, audience and expiration of the certificate and gets its claims. Returns
+//InvalidVerificationCertificateError when the certificate is not valid, UpstreamUnavailableError when the public keys
+//couldn't be fetched.
+func (v *Verifier) Verify(ctx context.Context, certificate string) (*Claims, errors.ErouskaError) {
+	now := v.now()
+
+	var keysErr error
+
+	// standard claims are verified below, against our clock
+	parser := jwt.Parser{ValidMethods: []string{jwt.SigningMethodES256.Name}, SkipClaimsValidation: true}
+
+	var claims Claims
+	_, err := parser.ParseWithClaims(certificate, &claims, func(token *jwt.Token) (interface{}, error) {
+		keyID, ok := token.Header[keyserverapi.KeyIDHeader].(string)
+		if !ok {
+			return nil, fmt.Errorf("missing key ID")
+		}
+
+		key, err := v.keys.get(ctx, keyID, now)
+		if err != nil {
+			keysErr = err
+			return nil, err
+		}
+		if key == nil {
+			return nil, fmt.Errorf("unknown key ID '%v'", keyID)
+		}
+
+		return key, nil
+	})
+
+	switch {
+	case keysErr != nil:
+		return nil, &errors.UpstreamUnavailableError{Msg: fmt.Sprintf("Could not verify certificate: %v", keysErr)}
+	case err != nil:
+		return nil, invalid("%v", err)
+	case !claims.VerifyIssuer(v.issuer, true):
+		return nil, invalid("unexpected issuer '%v'", claims.Issuer)
+	case !claims.VerifyAudience(v.audience, true):
+		return nil, invalid("unexpected audience '%v'", claims.Audience)
+	case !claims.VerifyExpiresAt(now.Unix(), true):
+		return nil, invalid("expired or without expiration")
+	case !claims.VerifyNotBefore(now.Unix(), false):
+		return nil, invalid("not valid yet")
+	}
+
+	if err := claims.CustomClaimsValid(); err != nil {
+		return nil, invalid("%v", err)
+	}
+
+	return &claims, nil
+}
+
+func invalid(format string, args ...interface{}) errors.ErouskaError {
+	return &errors.InvalidVerificationCertificateError{Msg: "Invalid verification certificate: " + fmt.Sprintf(format, args...)}
+}
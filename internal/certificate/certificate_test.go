@@ -0,0 +1,306 @@
+package certificate
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/covid19cz/erouska-backend/internal/utils"
+	"github.com/covid19cz/erouska-backend/internal/utils/errors"
+	"github.com/covid19cz/erouska-backend/pkg/api/v1"
+	"github.com/dgrijalva/jwt-go"
+	keyserverapi "github.com/google/exposure-notifications-server/pkg/api/v1"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuer   = "cz.covid19cz.erouska"
+	testAudience = "exposure-notifications-server"
+)
+
+// fakeJwks Serves public keys like the Verification server does.
+type fakeJwks struct {
+	mutex    sync.Mutex
+	keys     map[string]*ecdsa.PrivateKey
+	failing  bool
+	requests int
+}
+
+func newFakeJwks(t *testing.T, keyIDs ...string) *fakeJwks {
+	j := &fakeJwks{keys: make(map[string]*ecdsa.PrivateKey)}
+	for _, keyID := range keyIDs {
+		j.addKey(t, keyID)
+	}
+	return j
+}
+
+func (j *fakeJwks) addKey(t *testing.T, keyID string) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.keys[keyID] = key
+
+	return key
+}
+
+func (j *fakeJwks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.requests++
+
+	if j.failing {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	var keys []jwk
+	for keyID, key := range j.keys {
+		keys = append(keys, jwk{
+			KeyType: "EC",
+			KeyID:   keyID,
+			Curve:   "P-256",
+			X:       base64.RawURLEncoding.EncodeToString(key.X.Bytes()),
+			Y:       base64.RawURLEncoding.EncodeToString(key.Y.Bytes()),
+		})
+	}
+
+	_ = json.NewEncoder(w).Encode(keys)
+}
+
+func sign(t *testing.T, key interface{}, method jwt.SigningMethod, keyID string, claims *Claims) string {
+	token := jwt.NewWithClaims(method, claims)
+	token.Header[keyserverapi.KeyIDHeader] = keyID
+
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func validClaims(now time.Time) *Claims {
+	claims := &Claims{TestDateInterval: 2662992}
+	claims.Issuer = testIssuer
+	claims.Audience = testAudience
+	claims.IssuedAt = now.Unix()
+	claims.ExpiresAt = now.Add(15 * time.Minute).Unix()
+	claims.ReportType = keyserverapi.ReportTypeConfirmed
+	claims.SymptomOnsetInterval = 2662848
+	return claims
+}
+
+func newTestVerifier(url string, now *time.Time) *Verifier {
+	verifier := NewVerifier(&utils.VerificationCertificateConfig{JwksURL: url, Issuer: testIssuer, Audience: testAudience})
+	verifier.now = func() time.Time { return *now }
+	return verifier
+}
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2020, 12, 10, 15, 0, 0, 0, time.UTC)
+
+	jwks := newFakeJwks(t, "v1")
+	server := httptest.NewServer(jwks)
+	defer server.Close()
+
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		token   func() string
+		invalid bool
+	}{
+		{
+			name:  "valid",
+			token: func() string { return sign(t, jwks.keys["v1"], jwt.SigningMethodES256, "v1", validClaims(now)) },
+		},
+		{
+			name:    "signed by other key",
+			token:   func() string { return sign(t, otherKey, jwt.SigningMethodES256, "v1", validClaims(now)) },
+			invalid: true,
+		},
+		{
+			name:    "unknown key ID",
+			token:   func() string { return sign(t, jwks.keys["v1"], jwt.SigningMethodES256, "v2", validClaims(now)) },
+			invalid: true,
+		},
+		{
+			name:    "HMAC signed",
+			token:   func() string { return sign(t, []byte("hello-world"), jwt.SigningMethodHS256, "v1", validClaims(now)) },
+			invalid: true,
+		},
+		{
+			name: "other issuer",
+			token: func() string {
+				claims := validClaims(now)
+				claims.Issuer = "other"
+				return sign(t, jwks.keys["v1"], jwt.SigningMethodES256, "v1", claims)
+			},
+			invalid: true,
+		},
+		{
+			name: "other audience",
+			token: func() string {
+				claims := validClaims(now)
+				claims.Audience = "other"
+				return sign(t, jwks.keys["v1"], jwt.SigningMethodES256, "v1", claims)
+			},
+			invalid: true,
+		},
+		{
+			name: "expired",
+			token: func() string {
+				claims := validClaims(now)
+				claims.ExpiresAt = now.Add(-time.Second).Unix()
+				return sign(t, jwks.keys["v1"], jwt.SigningMethodES256, "v1", claims)
+			},
+			invalid: true,
+		},
+		{
+			name: "without expiration",
+			token: func() string {
+				claims := validClaims(now)
+				claims.ExpiresAt = 0
+				return sign(t, jwks.keys["v1"], jwt.SigningMethodES256, "v1", claims)
+			},
+			invalid: true,
+		},
+		{
+			name: "unknown report type",
+			token: func() string {
+				claims := validClaims(now)
+				claims.ReportType = "self_report"
+				return sign(t, jwks.keys["v1"], jwt.SigningMethodES256, "v1", claims)
+			},
+			invalid: true,
+		},
+		{
+			name:    "not a JWT",
+			token:   func() string { return "not a JWT" },
+			invalid: true,
+		},
+	}
+
+	verifier := newTestVerifier(server.URL, &now)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := verifier.Verify(ctx, tt.token())
+
+			if !tt.invalid {
+				if err != nil {
+					t.Fatalf("Verify() error = %v", err)
+				}
+				if claims.SymptomOnsetInterval != 2662848 || claims.TestDateInterval != 2662992 || claims.ReportType != keyserverapi.ReportTypeConfirmed {
+					t.Fatalf("Verify() claims = %+v", claims)
+				}
+				return
+			}
+
+			if _, ok := err.(*errors.InvalidVerificationCertificateError); !ok {
+				t.Fatalf("Verify() error = %v (%T), want InvalidVerificationCertificateError", err, err)
+			}
+		})
+	}
+}
+
+func TestVerifyRotatedKeys(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2020, 12, 10, 15, 0, 0, 0, time.UTC)
+
+	jwks := newFakeJwks(t, "v1")
+	server := httptest.NewServer(jwks)
+	defer server.Close()
+
+	verifier := newTestVerifier(server.URL, &now)
+
+	if _, err := verifier.Verify(ctx, sign(t, jwks.keys["v1"], jwt.SigningMethodES256, "v1", validClaims(now))); err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+
+	// the keys are cached
+	if _, err := verifier.Verify(ctx, sign(t, jwks.keys["v1"], jwt.SigningMethodES256, "v1", validClaims(now))); err != nil || jwks.requests != 1 {
+		t.Fatalf("Verify() error = %v, %v requests for keys, want 1", err, jwks.requests)
+	}
+
+	newKey := jwks.addKey(t, "v2")
+
+	// unknown key doesn't refresh the keys too often
+	now = now.Add(10 * time.Second)
+	if _, err := verifier.Verify(ctx, sign(t, newKey, jwt.SigningMethodES256, "v2", validClaims(now))); err == nil || jwks.requests != 1 {
+		t.Fatalf("Verify() error = %v, %v requests for keys, want refused by cached keys", err, jwks.requests)
+	}
+
+	now = now.Add(minKeysRefreshInterval)
+	if _, err := verifier.Verify(ctx, sign(t, newKey, jwt.SigningMethodES256, "v2", validClaims(now))); err != nil || jwks.requests != 2 {
+		t.Fatalf("Verify() error = %v, %v requests for keys, want 2", err, jwks.requests)
+	}
+
+	// the old keys are used when the new ones can't be fetched
+	jwks.failing = true
+	now = now.Add(keysCacheTTL)
+	if _, err := verifier.Verify(ctx, sign(t, jwks.keys["v1"], jwt.SigningMethodES256, "v1", validClaims(now))); err != nil || jwks.requests != 3 {
+		t.Fatalf("Verify() error = %v, %v requests for keys, want 3", err, jwks.requests)
+	}
+}
+
+func TestVerifyWithoutKeys(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2020, 12, 10, 15, 0, 0, 0, time.UTC)
+
+	jwks := newFakeJwks(t, "v1")
+	jwks.failing = true
+	server := httptest.NewServer(jwks)
+	defer server.Close()
+
+	verifier := newTestVerifier(server.URL, &now)
+
+	_, err := verifier.Verify(ctx, sign(t, jwks.keys["v1"], jwt.SigningMethodES256, "v1", validClaims(now)))
+	if _, ok := err.(*errors.UpstreamUnavailableError); !ok {
+		t.Fatalf("Verify() error = %v (%T), want UpstreamUnavailableError", err, err)
+	}
+}
+
+func TestClaims(t *testing.T) {
+	claims := &Claims{TestDateInterval: 2662992 + 70}
+	claims.SymptomOnsetInterval = 2662848
+
+	if onset, found := claims.SymptomOnset(); !found || !onset.Equal(time.Date(2020, 8, 18, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("SymptomOnset() = %v, %v", onset, found)
+	}
+
+	if testDate, found := claims.TestDate(); !found || !testDate.Equal(time.Date(2020, 8, 19, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("TestDate() = %v, %v", testDate, found)
+	}
+
+	if _, found := (&Claims{}).SymptomOnset(); found {
+		t.Errorf("SymptomOnset() found without the claim")
+	}
+
+	reportTypes := map[string]v1.ReportType{
+		keyserverapi.ReportTypeConfirmed: v1.ConfirmedTest,
+		keyserverapi.ReportTypeClinical:  v1.ConfirmedClinicalDiagnosis,
+		keyserverapi.ReportTypeNegative:  v1.Revoked,
+	}
+
+	for testType, want := range reportTypes {
+		claims.ReportType = testType
+		if got := claims.DeviceReportType(); got != want {
+			t.Errorf("DeviceReportType() of %v = %v, want %v", testType, got, want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package certificate
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How long the fetched public keys are used before they're fetched again.
+const keysCacheTTL = time.Hour
+
+// minKeysRefreshInterval Keys are fetched at most this often - on unknown key ID (the keys were rotated) too, so invalid
+// certificates or unavailable Verification server can't make us hammer it.
+const minKeysRefreshInterval = time.Minute
+
+// jwk Public key in JWK format; only EC keys are used by the Verification server.
+type jwk struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+// keySet Public keys of the Verification server, by key ID. They're fetched when they're needed and cached.
+type keySet struct {
+	url    string
+	client *http.Client
+
+	mutex       sync.Mutex
+	keys        map[string]*ecdsa.PublicKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+	fetchErr    error
+}
+
+func newKeySet(url string, client *http.Client) *keySet {
+	return &keySet{url: url, client: client}
+}
+
+// get Gets the key of given ID. Returns nil key when there's no such key, error when keys couldn't be fetched.
+func (s *keySet) get(ctx context.Context, keyID string, now time.Time) (*ecdsa.PublicKey, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	expired := now.Sub(s.fetchedAt) >= keysCacheTTL
+	rotated := s.keys[keyID] == nil
+
+	if (expired || rotated) && now.Sub(s.attemptedAt) >= minKeysRefreshInterval {
+		s.attemptedAt = now
+
+		keys, err := s.fetch(ctx)
+		if err == nil {
+			s.keys = keys
+			s.fetchedAt = now
+		}
+		s.fetchErr = err
+	}
+
+	// the old keys are better than none
+	if s.keys == nil && s.fetchErr != nil {
+		return nil, s.fetchErr
+	}
+
+	return s.keys[keyID], nil
+}
+
+func (s *keySet) fetch(ctx context.Context) (map[string]*ecdsa.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Could not fetch public keys: %v", err)
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read public keys: %v", err)
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Could not fetch public keys: HTTP %v", response.StatusCode)
+	}
+
+	return parseKeys(body)
+}
+
+// parseKeys Parses keys served by the Verification server (plain array of JWKs) or in the standard JWKS format.
+func parseKeys(data []byte) (map[string]*ecdsa.PublicKey, error) {
+	var jwks []jwk
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		var set struct {
+			Keys []jwk `json:"keys"`
+		}
+		if err := json.Unmarshal(data, &set); err != nil {
+			return nil, fmt.Errorf("Could not parse public keys: %v", err)
+		}
+		jwks = set.Keys
+	}
+
+	keys := make(map[string]*ecdsa.PublicKey)
+
+	for _, key := range jwks {
+		if key.KeyType != "EC" || key.Curve != "P-256" {
+			continue // can't be used for ES256
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(key.X)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid public key '%v': %v", key.KeyID, err)
+		}
+
+		y, err := base64.RawURLEncoding.DecodeString(key.Y)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid public key '%v': %v", key.KeyID, err)
+		}
+
+		publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+			return nil, fmt.Errorf("Invalid public key '%v': not on curve", key.KeyID)
+		}
+
+		keys[key.KeyID] = publicKey
+	}
+
+	return keys, nil
+}
@@ -9,9 +9,6 @@ const CollectionRegistrationsV1 = "registrations"
 //CollectionDailyNotificationAttemptsEhrid Name of the collection.
 const CollectionDailyNotificationAttemptsEhrid = "dailyNotificationAttemptsEhrid"
 
-//CollectionNotificationCounters Name of the collection.
-const CollectionNotificationCounters = "notificationCounters"
-
 //CollectionCovidDataTotal Name of the collection.
 const CollectionCovidDataTotal = "covidDataTotal"
 
@@ -21,17 +18,47 @@ const CollectionVaccinations = "vaccinations"
 //CollectionMetrics Name of the collection.
 const CollectionMetrics = "metrics"
 
+//CollectionCounterShards Name of the collection.
+const CollectionCounterShards = "counterShards"
+
+//CollectionCounterEvents Name of the collection.
+const CollectionCounterEvents = "counterEvents"
+
+//CollectionProcessedMessages Name of the collection.
+const CollectionProcessedMessages = "processedMessages"
+
+//CollectionOutbox Name of the collection.
+const CollectionOutbox = "outbox"
+
+//CollectionEfgsQuarantinedBatches Name of the collection.
+const CollectionEfgsQuarantinedBatches = "efgsQuarantinedBatches"
+
+//CollectionEfgsQuarantinedKeys Name of the collection.
+const CollectionEfgsQuarantinedKeys = "efgsQuarantinedKeys"
+
+//CollectionEfgsTrustList Name of the collection.
+const CollectionEfgsTrustList = "efgsTrustList"
+
+//CollectionEfgsUploadPolicy Name of the collection.
+const CollectionEfgsUploadPolicy = "efgsUploadPolicy"
+
 //TopicRegisterNotification Name of the topic.
 const TopicRegisterNotification = "notification-registered"
 
 //TopicRegisterUser Name of the topic.
 const TopicRegisterUser = "user-registered"
 
-//DbUserCountersPrefix Prefix of user counters data in Realtime DB.
-const DbUserCountersPrefix = "userCounters/"
+//TopicPublishKeys Name of the topic.
+const TopicPublishKeys = "keys-published"
+
+//CounterUsers Name of the users counter.
+const CounterUsers = "userCounters"
+
+//CounterNotifications Name of the notifications counter.
+const CounterNotifications = "notificationCounters"
 
-//DbPublisherCountersPrefix Prefix of publisher counters data in Realtime DB.
-const DbPublisherCountersPrefix = "publisherCounters/"
+//CounterPublishers Name of the publishers counter.
+const CounterPublishers = "publisherCounters"
 
-//DbEfgsCountersPrefix Prefix of EFGS counters data in Realtime DB.
-const DbEfgsCountersPrefix = "efgsCounters/"
+//CounterEfgs Name of the EFGS counter.
+const CounterEfgs = "efgsCounters"
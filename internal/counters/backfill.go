@@ -0,0 +1,51 @@
+package counters
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/covid19cz/erouska-backend/internal/logging"
+)
+
+// Backfill adds rollups of a legacy counter (by key - date in YYYYMMDD format or KeyTotal) to the counter with given
+// name. Every rollup is added once, so the backfill may be run again, e.g. when it fails in the middle. Rollups with
+// other keys are skipped. Returns keys of the added rollups.
+func Backfill(ctx context.Context, c Counters, name string, legacy map[string]interface{}) ([]string, error) {
+	logger := logging.FromContext(ctx).Named("counters.Backfill")
+
+	var keys []string
+	for key := range legacy {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var added []string
+
+	for _, key := range keys {
+		if !isRollupKey(key) {
+			logger.Warnf("Skipping unknown rollup %v of legacy counter %v", key, name)
+			continue
+		}
+
+		logger.Debugf("Adding legacy rollup %v of counter %v: %+v", key, name, legacy[key])
+
+		if err := c.Add(ctx, name, key, "legacy_"+key, legacy[key]); err != nil {
+			return added, fmt.Errorf("Could not add legacy rollup %v of counter %v: %v", key, name, err)
+		}
+
+		added = append(added, key)
+	}
+
+	return added, nil
+}
+
+func isRollupKey(key string) bool {
+	if key == KeyTotal {
+		return true
+	}
+
+	_, err := time.Parse("20060102", key)
+	return err == nil
+}
@@ -0,0 +1,177 @@
+package counters
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/covid19cz/erouska-backend/internal/constants"
+	"github.com/covid19cz/erouska-backend/internal/logging"
+	"github.com/covid19cz/erouska-backend/internal/store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// NumShards Number of shards every counter is split into.
+const NumShards = 10
+
+// KeyTotal Key of the rollup over the whole history of the counter.
+const KeyTotal = "total"
+
+// Counters is a counters abstraction layer interface
+type Counters interface {
+	Increment(ctx context.Context, name string, eventID string, at time.Time, delta interface{}) error
+	Add(ctx context.Context, name string, key string, eventID string, delta interface{}) error
+	Get(ctx context.Context, name string, key string, dst interface{}) error
+}
+
+// Client keeps sharded counters in storage. Every counter has daily rollups (keyed by date in YYYYMMDD format)
+// and a total rollup (keyed by KeyTotal).
+type Client struct {
+	Store store.Storer
+}
+
+type counterEvent struct {
+	Name      string `json:"name"`
+	CreatedAt int64  `json:"createdAt"`
+}
+
+// Increment adds the delta to both daily (for the date of `at`) and total rollups of the counter. The delta is a struct
+// with integer fields, e.g. structs.UserCounter. The increment is idempotent: an event with already counted eventID
+// is ignored.
+func (c Client) Increment(ctx context.Context, name string, eventID string, at time.Time, delta interface{}) error {
+	return c.add(ctx, name, eventID, at, delta, at.Format("20060102"), KeyTotal)
+}
+
+// Add adds the delta to the single rollup with given key (date in YYYYMMDD format or KeyTotal) only, e.g. when the
+// counted values come from elsewhere already rolled up. It's idempotent the same way as Increment.
+func (c Client) Add(ctx context.Context, name string, key string, eventID string, delta interface{}) error {
+	return c.add(ctx, name, eventID, time.Now(), delta, key)
+}
+
+func (c Client) add(ctx context.Context, name string, eventID string, at time.Time, delta interface{}, keys ...string) error {
+	logger := logging.FromContext(ctx).Named("counters.add")
+
+	if eventID == "" {
+		return fmt.Errorf("Missing event ID for counter %v", name)
+	}
+
+	values, err := toValues(delta)
+	if err != nil {
+		return fmt.Errorf("Could not convert delta for counter %v: %v", name, err)
+	}
+
+	shard := shardFor(eventID)
+	eventDocID := name + "_" + eventID
+
+	return c.Store.RunTransaction(ctx, func(ctx context.Context, tx store.Transaction) error {
+		err := tx.Get(constants.CollectionCounterEvents, eventDocID, nil)
+		if err == nil {
+			logger.Debugf("Event %v was already counted in %v, skipping", eventID, name)
+			return nil
+		}
+		if status.Code(err) != codes.NotFound {
+			return fmt.Errorf("Error while querying storage: %v", err)
+		}
+
+		shards := make(map[string]map[string]int)
+		for _, key := range keys {
+			id := shardID(name, key, shard)
+
+			rollup, err := getShard(tx, id)
+			if err != nil {
+				return err
+			}
+
+			add(rollup, values)
+			shards[id] = rollup
+		}
+
+		if err := tx.Set(constants.CollectionCounterEvents, eventDocID, counterEvent{Name: name, CreatedAt: at.Unix()}); err != nil {
+			return err
+		}
+
+		for id, rollup := range shards {
+			logger.Debugf("Saving updated counter shard %v: %+v", id, rollup)
+
+			if err := tx.Set(constants.CollectionCounterShards, id, rollup); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Get sums all shards of the counter rollup with given key (date in YYYYMMDD format or KeyTotal) into dst. Missing
+// counter is reported as zero, not as an error.
+func (c Client) Get(ctx context.Context, name string, key string, dst interface{}) error {
+	sum := make(map[string]int)
+
+	for shard := 0; shard < NumShards; shard++ {
+		var values map[string]int
+
+		if err := c.Store.Get(ctx, constants.CollectionCounterShards, shardID(name, key, shard), &values); err != nil {
+			if status.Code(err) == codes.NotFound {
+				continue
+			}
+
+			return fmt.Errorf("Error while querying storage: %v", err)
+		}
+
+		add(sum, values)
+	}
+
+	bytes, err := json.Marshal(sum)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(bytes, dst)
+}
+
+func getShard(tx store.Transaction, id string) (map[string]int, error) {
+	values := make(map[string]int)
+
+	if err := tx.Get(constants.CollectionCounterShards, id, &values); err != nil {
+		if status.Code(err) != codes.NotFound {
+			return nil, fmt.Errorf("Error while querying storage: %v", err)
+		}
+
+		return make(map[string]int), nil
+	}
+
+	return values, nil
+}
+
+func toValues(delta interface{}) (map[string]int, error) {
+	bytes, err := json.Marshal(delta)
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]int
+	if err := json.Unmarshal(bytes, &values); err != nil {
+		return nil, err
+	}
+
+	return values, nil
+}
+
+func add(dst map[string]int, values map[string]int) {
+	for field, value := range values {
+		dst[field] += value
+	}
+}
+
+func shardFor(eventID string) int {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(eventID))
+	return int(hash.Sum32() % NumShards)
+}
+
+func shardID(name string, key string, shard int) string {
+	return fmt.Sprintf("%v_%v_%d", name, key, shard)
+}
@@ -0,0 +1,128 @@
+package counters
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/covid19cz/erouska-backend/internal/firebase/structs"
+	"github.com/covid19cz/erouska-backend/internal/store"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestIncrement(t *testing.T) {
+
+	ctx := context.Background()
+
+	client := Client{Store: store.NewMemoryClient()}
+
+	today := time.Date(2020, 11, 20, 10, 0, 0, 0, time.UTC)
+	yesterday := today.Add(-24 * time.Hour)
+
+	events := []struct {
+		id    string
+		at    time.Time
+		delta structs.PublisherCounter
+	}{
+		{"event-1", yesterday, structs.PublisherCounter{PublishersCount: 1, KeysCount: 10}},
+		{"event-2", today, structs.PublisherCounter{PublishersCount: 1, KeysCount: 5}},
+		{"event-3", today, structs.PublisherCounter{PublishersCount: 1, KeysCount: 7}},
+		{"event-2", today, structs.PublisherCounter{PublishersCount: 1, KeysCount: 5}}, // redelivered
+	}
+
+	for _, event := range events {
+		if err := client.Increment(ctx, "test", event.id, event.at, event.delta); err != nil {
+			t.Fatalf("increment no error expected: %v", err)
+		}
+	}
+
+	tables := []struct {
+		key      string
+		expected structs.PublisherCounter
+	}{
+		{yesterday.Format("20060102"), structs.PublisherCounter{PublishersCount: 1, KeysCount: 10}},
+		{today.Format("20060102"), structs.PublisherCounter{PublishersCount: 2, KeysCount: 12}},
+		{KeyTotal, structs.PublisherCounter{PublishersCount: 3, KeysCount: 22}},
+		{"20200101", structs.PublisherCounter{}},
+	}
+
+	for _, table := range tables {
+		var actual structs.PublisherCounter
+		if err := client.Get(ctx, "test", table.key, &actual); err != nil {
+			t.Fatalf("get no error expected: %v", err)
+		}
+
+		diff := cmp.Diff(table.expected, actual)
+		if diff != "" {
+			t.Fatalf("counter %v mismatch (-want +got):\n%v", table.key, diff)
+		}
+	}
+}
+
+func TestIncrementSpreadsOverShards(t *testing.T) {
+
+	used := make(map[int]bool)
+
+	for i := 0; i < 100; i++ {
+		used[shardFor(fmt.Sprintf("event-%d", i))] = true
+	}
+
+	if len(used) != NumShards {
+		t.Fatalf("expected all %v shards to be used, got %v", NumShards, len(used))
+	}
+}
+
+func TestBackfill(t *testing.T) {
+
+	ctx := context.Background()
+
+	client := Client{Store: store.NewMemoryClient()}
+
+	legacy := map[string]interface{}{
+		"20201119": structs.UserCounter{UsersCount: 40},
+		"20201120": structs.UserCounter{UsersCount: 2},
+		KeyTotal:   structs.UserCounter{UsersCount: 1000},
+		"unknown":  structs.UserCounter{UsersCount: 7},
+	}
+
+	// counted by the new code since the deploy
+	if err := client.Increment(ctx, "test", "event-1", time.Date(2020, 11, 20, 10, 0, 0, 0, time.UTC), structs.UserCounter{UsersCount: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	for run := 0; run < 2; run++ {
+		added, err := Backfill(ctx, client, "test", legacy)
+		if err != nil {
+			t.Fatalf("backfill no error expected: %v", err)
+		}
+
+		diff := cmp.Diff([]string{"20201119", "20201120", KeyTotal}, added)
+		if diff != "" {
+			t.Fatalf("added rollups mismatch (-want +got):\n%v", diff)
+		}
+	}
+
+	tables := []struct {
+		key      string
+		expected structs.UserCounter
+	}{
+		{"20201119", structs.UserCounter{UsersCount: 40}},
+		{"20201120", structs.UserCounter{UsersCount: 3}},
+		{KeyTotal, structs.UserCounter{UsersCount: 1001}},
+		{"unknown", structs.UserCounter{}},
+	}
+
+	for _, table := range tables {
+		var actual structs.UserCounter
+		if err := client.Get(ctx, "test", table.key, &actual); err != nil {
+			t.Fatalf("get no error expected: %v", err)
+		}
+
+		diff := cmp.Diff(table.expected, actual)
+		if diff != "" {
+			t.Fatalf("counter %v mismatch (-want +got):\n%v", table.key, diff)
+		}
+	}
+}
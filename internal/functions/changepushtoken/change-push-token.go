@@ -1,11 +1,9 @@
 package changepushtoken
 
 import (
-	"cloud.google.com/go/firestore"
 	"context"
 	"fmt"
 	"github.com/covid19cz/erouska-backend/internal/utils"
-	"google.golang.org/api/iterator"
 	"net/http"
 	"regexp"
 
@@ -65,12 +63,11 @@ func ChangePushToken(w http.ResponseWriter, r *http.Request) {
 func handleForEhrid(ctx context.Context, storeClient store.Storer, ehrid string, pushToken string) error {
 	logger := logging.FromContext(ctx).Named("change-push-token.handleForEhrid")
 
-	doc := storeClient.Doc(constants.CollectionRegistrations, ehrid)
-
 	logger.Debugf("Trying to find registration for %v in %v", ehrid, constants.CollectionRegistrations)
 
-	return storeClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
-		rec, err := tx.Get(doc)
+	return storeClient.RunTransaction(ctx, func(ctx context.Context, tx store.Transaction) error {
+		var registration structs.Registration
+		err := tx.Get(constants.CollectionRegistrations, ehrid, &registration)
 
 		if err != nil {
 			if status.Code(err) != codes.NotFound {
@@ -80,19 +77,13 @@ func handleForEhrid(ctx context.Context, storeClient store.Storer, ehrid string,
 
 			return fmt.Errorf("Could not find registration for %v: %v", ehrid, err)
 		}
-
-		var registration structs.Registration
-		err = rec.DataTo(&registration)
-		if err != nil {
-			return fmt.Errorf("Error while querying Firestore: %v", err)
-		}
 		logger.Debugf("Found registration: %+v", registration)
 
 		registration.PushRegistrationToken = pushToken
 
 		logger.Debugf("Saving updated push token: %+v", registration)
 
-		return tx.Set(doc, registration)
+		return tx.Set(constants.CollectionRegistrations, ehrid, registration)
 	})
 }
 
@@ -101,13 +92,14 @@ func handleForFUID(ctx context.Context, storeClient store.Storer, fuid string, p
 
 	logger.Debugf("Looking for FUID %v in collection %v", fuid, constants.CollectionRegistrationsV1)
 
-	doc, err := findDocByFUID(ctx, storeClient, fuid)
+	id, err := findDocByFUID(ctx, storeClient, fuid)
 	if err != nil {
 		return err
 	}
 
-	return storeClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
-		rec, err := tx.Get(doc)
+	return storeClient.RunTransaction(ctx, func(ctx context.Context, tx store.Transaction) error {
+		var registration structs.RegistrationV1
+		err := tx.Get(constants.CollectionRegistrationsV1, id, &registration)
 
 		if err != nil {
 			if status.Code(err) != codes.NotFound {
@@ -117,42 +109,25 @@ func handleForFUID(ctx context.Context, storeClient store.Storer, fuid string, p
 
 			return fmt.Errorf("Could not find registration for %v: %v", fuid, err)
 		}
-
-		var registration structs.RegistrationV1
-		err = rec.DataTo(&registration)
-		if err != nil {
-			return fmt.Errorf("Error while querying Firestore: %v", err)
-		}
 		logger.Debugf("Found registration: %+v", registration)
 
 		registration.PushRegistrationToken = pushToken
 
 		logger.Debugf("Saving updated push token: %+v", registration)
 
-		return tx.Set(doc, registration)
+		return tx.Set(constants.CollectionRegistrationsV1, id, registration)
 	})
 }
 
-func findDocByFUID(ctx context.Context, storeClient store.Storer, fuid string) (*firestore.DocumentRef, error) {
-	it := storeClient.Find(constants.CollectionRegistrationsV1, "fuid", fuid).Snapshots(ctx)
-
-	resp, err := it.Next()
-	if err == iterator.Done || (resp != nil && resp.Size == 0) {
-		return nil, fmt.Errorf("Could not find record for FUID %v: resp=%v %v", fuid, resp, err)
-	}
-
+func findDocByFUID(ctx context.Context, storeClient store.Storer, fuid string) (string, error) {
+	id, err := storeClient.Find(ctx, constants.CollectionRegistrationsV1, "fuid", fuid)
 	if err != nil {
-		return nil, err
-	}
-
-	snap, err := resp.Documents.Next()
-	if err == iterator.Done || snap == nil {
-		return nil, fmt.Errorf("Could not find record for FUID %v: snap=%v %v", fuid, snap, err)
-	}
+		if status.Code(err) == codes.NotFound {
+			return "", fmt.Errorf("Could not find record for FUID %v: %v", fuid, err)
+		}
 
-	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	return snap.Ref, nil
+	return id, nil
 }
@@ -0,0 +1,97 @@
+package changepushtoken
+
+import (
+	"context"
+	"testing"
+
+	"github.com/covid19cz/erouska-backend/internal/constants"
+	"github.com/covid19cz/erouska-backend/internal/firebase/structs"
+	"github.com/covid19cz/erouska-backend/internal/store"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHandleForEhrid(t *testing.T) {
+
+	ctx := context.Background()
+
+	store := store.NewMemoryClient()
+
+	registration := structs.Registration{
+		Platform:              "android",
+		PlatformVersion:       "10.2",
+		Manufacturer:          "Samsung",
+		Model:                 "Yololo",
+		Locale:                "en_US",
+		PushRegistrationToken: "old-token",
+		CreatedAt:             1596000000,
+	}
+
+	if err := store.Set(ctx, constants.CollectionRegistrations, "eABCDEF123", registration); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := handleForEhrid(ctx, store, "eABCDEF123", "new-token"); err != nil {
+		t.Fatalf("handleForEhrid no error expected: %v", err)
+	}
+
+	var saved structs.Registration
+	if err := store.Get(ctx, constants.CollectionRegistrations, "eABCDEF123", &saved); err != nil {
+		t.Fatal(err)
+	}
+
+	registration.PushRegistrationToken = "new-token"
+
+	diff := cmp.Diff(registration, saved)
+	if diff != "" {
+		t.Fatalf("saved registration mismatch (-want +got):\n%v", diff)
+	}
+
+	if err := handleForEhrid(ctx, store, "eGHIJKL456", "new-token"); err == nil {
+		t.Fatalf("handleForEhrid of unknown eHrid error expected")
+	}
+
+	if err := store.Get(ctx, constants.CollectionRegistrations, "eGHIJKL456", nil); err == nil {
+		t.Fatalf("registration of unknown eHrid created")
+	}
+}
+
+func TestHandleForFUID(t *testing.T) {
+
+	ctx := context.Background()
+
+	store := store.NewMemoryClient()
+
+	registrations := map[string]structs.RegistrationV1{
+		"doc-1": {FUID: "fuid-1", Platform: "ios", PushRegistrationToken: "token-1"},
+		"doc-2": {FUID: "fuid-2", Platform: "android", PushRegistrationToken: "token-2"},
+	}
+
+	for id, registration := range registrations {
+		if err := store.Set(ctx, constants.CollectionRegistrationsV1, id, registration); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := handleForFUID(ctx, store, "fuid-2", "new-token"); err != nil {
+		t.Fatalf("handleForFUID no error expected: %v", err)
+	}
+
+	want := map[string]string{"doc-1": "token-1", "doc-2": "new-token"}
+
+	for id, token := range want {
+		var saved structs.RegistrationV1
+		if err := store.Get(ctx, constants.CollectionRegistrationsV1, id, &saved); err != nil {
+			t.Fatal(err)
+		}
+
+		diff := cmp.Diff(token, saved.PushRegistrationToken)
+		if diff != "" {
+			t.Fatalf("push token of %v mismatch (-want +got):\n%v", id, diff)
+		}
+	}
+
+	if err := handleForFUID(ctx, store, "fuid-3", "new-token"); err == nil {
+		t.Fatalf("handleForFUID of unknown FUID error expected")
+	}
+}
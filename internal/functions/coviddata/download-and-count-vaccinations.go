@@ -118,12 +118,12 @@ func fetchVaccinationsData(ctx context.Context, client HTTPClient) (*Vaccination
 	return &lastDateVaccinations, nil
 }
 
-func persistVaccinationsData(ctx context.Context, client store.Client, data *VaccinationsAggregatedData) error {
+func persistVaccinationsData(ctx context.Context, client store.Storer, data *VaccinationsAggregatedData) error {
 	logger := logging.FromContext(ctx).Named("PersistVaccinationsData")
 
 	date := data.Date
 
-	if _, err := client.Doc(constants.CollectionVaccinations, date).Set(ctx, *data); err != nil {
+	if err := client.Set(ctx, constants.CollectionVaccinations, date, *data); err != nil {
 		return err
 	}
 
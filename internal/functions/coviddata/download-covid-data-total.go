@@ -90,7 +90,7 @@ func DownloadCovidDataTotal(w http.ResponseWriter, r *http.Request) {
 
 	date := totalsData.Date
 
-	_, err = client.Doc(constants.CollectionCovidDataTotal, date).Set(ctx, *totalsData)
+	err = client.Set(ctx, constants.CollectionCovidDataTotal, date, *totalsData)
 
 	if err != nil {
 		logger.Warnf("Cannot handle request due to unknown error: %+v", err.Error())
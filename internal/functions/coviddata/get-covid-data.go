@@ -17,10 +17,12 @@ import (
 	"google.golang.org/grpc/status"
 )
 
-func fetchTotals(ctx context.Context, client store.Client, date string) (*TotalsData, error) {
+func fetchTotals(ctx context.Context, client store.Storer, date string) (*TotalsData, error) {
 	logger := logging.FromContext(ctx)
 
-	snap, err := client.Doc(constants.CollectionCovidDataTotal, date).Get(ctx)
+	var totals TotalsData
+
+	err := client.Get(ctx, constants.CollectionCovidDataTotal, date, &totals)
 
 	if err != nil {
 		if status.Code(err) == codes.NotFound {
@@ -30,23 +32,17 @@ func fetchTotals(ctx context.Context, client store.Client, date string) (*Totals
 		return nil, fmt.Errorf("Error while querying Firestore: %v", err)
 	}
 
-	logger.Infof("fetched firestore data: %+v", snap.Data())
-
-	var totals TotalsData
-
-	if err := snap.DataTo(&totals); err != nil {
-		panic(fmt.Sprintf("could not parse input: %s", err))
-	}
-
 	logger.Infof("fetched data: %+v", totals)
 
 	return &totals, nil
 }
 
-func fetchVaccinations(ctx context.Context, client store.Client, date string) (*VaccinationsAggregatedData, error) {
+func fetchVaccinations(ctx context.Context, client store.Storer, date string) (*VaccinationsAggregatedData, error) {
 	logger := logging.FromContext(ctx).Named("fetchVaccinations")
 
-	snap, err := client.Doc(constants.CollectionVaccinations, date).Get(ctx)
+	var vaccinationData VaccinationsAggregatedData
+
+	err := client.Get(ctx, constants.CollectionVaccinations, date, &vaccinationData)
 
 	if err != nil {
 		if status.Code(err) == codes.NotFound {
@@ -56,12 +52,6 @@ func fetchVaccinations(ctx context.Context, client store.Client, date string) (*
 		return nil, fmt.Errorf("Error while querying Firestore: %v", err)
 	}
 
-	var vaccinationData VaccinationsAggregatedData
-
-	if err := snap.DataTo(&vaccinationData); err != nil {
-		panic(fmt.Sprintf("could not parse input: %s", err))
-	}
-
 	logger.Infof("fetched vaccinations data: %+v", vaccinationData)
 
 	return &vaccinationData, nil
@@ -3,7 +3,9 @@ package api
 import (
 	"context"
 	"encoding/base64"
+	"fmt"
 	"github.com/covid19cz/erouska-backend/internal/logging"
+	"github.com/covid19cz/erouska-backend/pkg/api/v1"
 	keyserverapi "github.com/google/exposure-notifications-server/pkg/api/v1"
 	verifserverapi "github.com/google/exposure-notifications-verification-server/pkg/api"
 	"strconv"
@@ -23,6 +25,18 @@ type IssueCodeRequest = verifserverapi.IssueCodeRequest
 //IssueCodeResponse Issue code response from the Verification server
 type IssueCodeResponse = verifserverapi.IssueCodeResponse
 
+//BatchIssueCodeRequest Request for issuing more codes at once, by batch-issue API of the Verification server.
+type BatchIssueCodeRequest struct {
+	Codes []*IssueCodeRequest `json:"codes"`
+}
+
+//BatchIssueCodeResponse Response of batch-issue API of the Verification server; codes are in the order of the request.
+type BatchIssueCodeResponse struct {
+	Codes     []*IssueCodeResponse `json:"codes"`
+	Error     string               `json:"error,omitempty"`
+	ErrorCode string               `json:"errorCode,omitempty"`
+}
+
 //VerifyRequest  Verify request to the Verification server
 type VerifyRequest = verifserverapi.VerifyCodeRequest
 
@@ -58,6 +72,48 @@ var mapReportTypeString = map[string]ReportType{
 	"REVOKED":                      ReportType_REVOKED,
 }
 
+var mapDeviceReportType = map[v1.ReportType]ReportType{
+	v1.ConfirmedTest:              ReportType_CONFIRMED_TEST,
+	v1.ConfirmedClinicalDiagnosis: ReportType_CONFIRMED_CLINICAL_DIAGNOSIS,
+	v1.SelfReport:                 ReportType_SELF_REPORT,
+	v1.Recursive:                  ReportType_RECURSIVE,
+	v1.Revoked:                    ReportType_REVOKED,
+}
+
+//ReportTypeFromDevice Maps report type sent by the device to the EFGS one. Devices which don't send any (or send an
+//unknown one) publish keys verified by a confirmed test, so those are CONFIRMED_TEST.
+func ReportTypeFromDevice(reportType v1.ReportType) ReportType {
+	if mapped, found := mapDeviceReportType[reportType]; found {
+		return mapped
+	}
+	return ReportType_CONFIRMED_TEST
+}
+
+// Test types of the Verification server.
+const (
+	//TestTypeConfirmed Keys of users with confirmed test.
+	TestTypeConfirmed = "confirmed"
+	//TestTypeLikely Keys of users with clinical diagnosis.
+	TestTypeLikely = "likely"
+	//TestTypeNegative Revision of previously published keys, after the user was tested negative.
+	TestTypeNegative = "negative"
+)
+
+//TestTypeOf Gets test type the key is to be imported to the Key server with. Self-reported and recursive keys have
+//no test type in the Verification server, so they can't be imported.
+func TestTypeOf(reportType ReportType) (string, bool) {
+	switch reportType {
+	case ReportType_UNKNOWN, ReportType_CONFIRMED_TEST:
+		return TestTypeConfirmed, true
+	case ReportType_CONFIRMED_CLINICAL_DIAGNOSIS:
+		return TestTypeLikely, true
+	case ReportType_REVOKED:
+		return TestTypeNegative, true
+	default:
+		return "", false
+	}
+}
+
 //UnmarshalJSON Accepts ReportType in both integer and string form.
 func (s *ReportType) UnmarshalJSON(data []byte) error {
 	str := strings.TrimLeft(strings.TrimRight(string(data), "\""), "\"")
@@ -81,6 +137,27 @@ type UploadBatchResponse struct {
 	Success    []int `json:"201"`
 }
 
+//AuditEntry Audit information about one uploaded batch contained in a download batch.
+type AuditEntry struct {
+	Country                   string    `json:"country"`
+	UploadedTime              time.Time `json:"uploadedTime"`
+	UploaderThumbprint        string    `json:"uploaderThumbprint"`
+	UploaderSigningThumbprint string    `json:"uploaderSigningThumbprint"`
+	SigningCertificate        string    `json:"signingCertificate"`
+	Amount                    int       `json:"amount"`
+	BatchSignature            string    `json:"batchSignature"`
+}
+
+//DownloadedBatch Keys of downloaded batch along with the batch metadata.
+type DownloadedBatch struct {
+	BatchTag string
+	// NextBatchTag Tag of the following batch; empty when it's the last batch of the day (so far).
+	NextBatchTag string
+	Keys         []DiagnosisKey
+	// Quarantined The batch failed signature verification; its keys were quarantined and removed.
+	Quarantined bool
+}
+
 //BatchDownloadParams Struct holding download input data.
 type BatchDownloadParams struct {
 	Date     string `json:"date" validate:"required"`
@@ -91,6 +168,90 @@ type BatchDownloadParams struct {
 type BatchImportParams struct {
 	HAID string      `json:"haid"`
 	Keys ExpKeyBatch `json:"keys"`
+	// ID Identifier of the import, see ImportID.
+	ID string `json:"id,omitempty"`
+	// Date, BatchTag (of the origin EFGS batch), Country and Part identify the import in the download ledger.
+	Date     string `json:"date,omitempty"`
+	BatchTag string `json:"batchTag,omitempty"`
+	Country  string `json:"country,omitempty"`
+	Part     int    `json:"part,omitempty"`
+	// TestType Verification server test type the keys are imported with; empty means confirmed. Keys of negative test
+	// type revise (revoke) previously imported keys.
+	TestType string `json:"testType,omitempty"`
+	// Attempt Number of previous failed attempts to import the keys.
+	Attempt int `json:"attempt,omitempty"`
+}
+
+//ImportID Builds identifier of import of part of the downloaded batch for one country.
+func ImportID(date string, batchTag string, country string, part int) string {
+	return fmt.Sprintf("%v_%v_%v_%v", date, batchTag, country, part)
+}
+
+//ImportStatus Status of import of downloaded keys to our Key server.
+type ImportStatus string
+
+const (
+	//ImportStatusEnqueued Keys were enqueued for import.
+	ImportStatusEnqueued ImportStatus = "enqueued"
+	//ImportStatusImported Keys were imported to the Key server.
+	ImportStatusImported ImportStatus = "imported"
+	//ImportStatusFailed Keys could not be enqueued for import.
+	ImportStatusFailed ImportStatus = "failed"
+	//ImportStatusRetrying Import has failed and the keys will be enqueued again.
+	ImportStatusRetrying ImportStatus = "retrying"
+	//ImportStatusDeadLettered Import has failed too many times and the keys were moved to the dead-letter topic.
+	ImportStatusDeadLettered ImportStatus = "dead-lettered"
+)
+
+//DownloadedBatchRecord Record of batch downloaded from EFGS, kept in EFGS database.
+type DownloadedBatchRecord struct {
+	tableName    struct{}  `pg:"efgs_downloaded_batches,alias:b"`
+	Date         string    `pg:",pk" json:"date"`
+	BatchTag     string    `pg:",pk" json:"batchTag"`
+	NextBatchTag string    `json:"nextBatchTag"`
+	First        bool      `pg:",use_zero" json:"first"`
+	KeysCount    int       `pg:",use_zero" json:"keysCount"`
+	Quarantined  bool      `pg:",use_zero" json:"quarantined"`
+	DownloadedAt time.Time `pg:"default:now()" json:"downloadedAt"`
+	// Imports Imports of keys from the batch, loaded separately.
+	Imports []*BatchImportRecord `pg:"-" json:"imports,omitempty"`
+}
+
+//BatchImportRecord Record of import of part of the downloaded batch for one country, kept in EFGS database.
+type BatchImportRecord struct {
+	tableName struct{}     `pg:"efgs_batch_imports,alias:i"`
+	Date      string       `pg:",pk" json:"date"`
+	BatchTag  string       `pg:",pk" json:"batchTag"`
+	Country   string       `pg:",pk" json:"country"`
+	Part      int          `pg:",pk,use_zero" json:"part"`
+	KeysCount int          `pg:",use_zero" json:"keysCount"`
+	TestType  string       `json:"testType,omitempty"`
+	Status    ImportStatus `pg:",notnull" json:"status"`
+	Error     string       `json:"error,omitempty"`
+	// Inserted, Rejected and ErrorCode Result of the last attempt, as reported by the Key server.
+	Inserted      int       `pg:",use_zero" json:"inserted"`
+	Rejected      int       `pg:",use_zero" json:"rejected"`
+	ErrorCode     string    `json:"errorCode,omitempty"`
+	Attempts      int       `pg:",use_zero" json:"attempts"`
+	NextAttemptAt time.Time `json:"nextAttemptAt,omitempty"`
+	// RevisionToken Token returned by the Key server for the imported keys, needed for their revision.
+	RevisionToken string `json:"-"`
+	// Payload JSON of BatchImportParams to be enqueued again, while retrying.
+	Payload    string    `json:"-"`
+	EnqueuedAt time.Time `pg:"default:now()" json:"enqueuedAt"`
+	UpdatedAt  time.Time `pg:"default:now()" json:"updatedAt"`
+}
+
+//ImportedKeyRecord Key imported to the Key server, kept in EFGS database to find the import (and its revision token)
+//when the key is revoked.
+type ImportedKeyRecord struct {
+	tableName  struct{}  `pg:"efgs_imported_keys,alias:ik"`
+	KeyData    string    `pg:",pk" json:"keyData"`
+	Date       string    `pg:",notnull" json:"date"`
+	BatchTag   string    `pg:",notnull" json:"batchTag"`
+	Country    string    `pg:",notnull" json:"country"`
+	Part       int       `pg:",use_zero" json:"part"`
+	ImportedAt time.Time `pg:"default:now()" json:"importedAt"`
 }
 
 //DiagnosisKeyWrapper map json response from EFGS to local DiagnosisKey structure
@@ -108,6 +269,8 @@ type DiagnosisKeyWrapper struct {
 	DaysSinceOnsetOfSymptoms   int32      `pg:",use_zero" json:"days_since_onset_of_symptoms,omitempty"`
 	Retries                    int        `pg:"default:0,use_zero" json:"retries,omitempty"`
 	IsUploaded                 bool       `pg:"default:False,notnull,use_zero" json:"isUploaded,omitempty"`
+	// PolicyVersion Version of the upload policy the key was prepared by.
+	PolicyVersion string `json:"policyVersion,omitempty"`
 }
 
 //ToData convert struct from DiagnosisKeyWrapper to DiagnosisKey.
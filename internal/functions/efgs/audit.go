@@ -0,0 +1,287 @@
+package efgs
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	b64 "encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/covid19cz/erouska-backend/internal/constants"
+	efgsapi "github.com/covid19cz/erouska-backend/internal/functions/efgs/api"
+	efgsutils "github.com/covid19cz/erouska-backend/internal/functions/efgs/utils"
+	"github.com/covid19cz/erouska-backend/internal/logging"
+	"go.mozilla.org/pkcs7"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// quarantinedKeysPerPart Keys stored in one document of quarantined keys, so it stays well below the 1 MiB limit of
+// Firestore documents.
+const quarantinedKeysPerPart = 1000
+
+//QuarantinedBatch Downloaded batch which failed signature verification and was not imported. Its keys are stored in
+//Parts documents of QuarantinedKeys.
+type QuarantinedBatch struct {
+	Date          string    `firestore:"date" json:"date"`
+	BatchTag      string    `firestore:"batchTag" json:"batchTag"`
+	Reason        string    `firestore:"reason" json:"reason"`
+	KeysCount     int       `firestore:"keysCount" json:"keysCount"`
+	Parts         int       `firestore:"parts" json:"parts"`
+	QuarantinedAt time.Time `firestore:"quarantinedAt" json:"quarantinedAt"`
+}
+
+//QuarantinedKeys Part of keys of a quarantined batch, as JSON.
+type QuarantinedKeys struct {
+	Date     string `firestore:"date" json:"date"`
+	BatchTag string `firestore:"batchTag" json:"batchTag"`
+	Part     int    `firestore:"part" json:"part"`
+	Keys     string `firestore:"keys" json:"keys"`
+}
+
+// downloadVerifiedKeys Downloads the batch and verifies its signatures. Keys of a batch which fails the verification
+// are quarantined and the batch is returned without keys, so it's treated as processed.
+func downloadVerifiedKeys(ctx context.Context, config *downloadConfig, date string, batchTag string) (*efgsapi.DownloadedBatch, error) {
+	batch, err := downloadKeys(ctx, config, date, batchTag)
+	if err != nil || batch == nil {
+		return batch, err
+	}
+
+	return verifyDownloadedBatch(ctx, config, date, batch)
+}
+
+// verifyDownloadedBatch Verifies signatures of the batch, quarantining its keys when the verification fails.
+func verifyDownloadedBatch(ctx context.Context, config *downloadConfig, date string, batch *efgsapi.DownloadedBatch) (*efgsapi.DownloadedBatch, error) {
+	logger := logging.FromContext(ctx).Named("efgs.verifyDownloadedBatch")
+
+	if len(batch.Keys) == 0 || !config.VerifyBatchSignatures {
+		return batch, nil
+	}
+
+	entries, err := downloadAudit(ctx, config, date, batch.BatchTag)
+	if err != nil {
+		logger.Debugf("Could not download audit of batch '%v': %v", batch.BatchTag, err)
+		return nil, err
+	}
+
+	if err = verifyBatch(batch.Keys, entries, config.TrustList); err != nil {
+		logger.Errorf("Batch '%v' from %v failed verification, going to quarantine it: %v", batch.BatchTag, date, err)
+
+		if err = quarantineBatch(ctx, config, date, batch.BatchTag, batch.Keys, err.Error()); err != nil {
+			return nil, err
+		}
+
+		batch.Keys = []efgsapi.DiagnosisKey{}
+		batch.Quarantined = true
+		return batch, nil
+	}
+
+	logger.Debugf("Successfully verified %v keys from %v uploaded batches", len(batch.Keys), len(entries))
+
+	return batch, nil
+}
+
+func downloadAudit(ctx context.Context, config *downloadConfig, date string, batchTag string) ([]efgsapi.AuditEntry, error) {
+	logger := logging.FromContext(ctx).Named("efgs.downloadAudit")
+
+	url := *config.URL
+	url.Path = fmt.Sprintf("diagnosiskeys/audit/download/%v/%v", date, batchTag)
+
+	req, err := http.NewRequest("GET", url.String(), nil)
+	if err != nil {
+		logger.Error("Error creating audit request")
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/json; version=1.0")
+
+	if config.Env == efgsutils.EnvLocal {
+		logger.Debugf("Setting up LOCAL EFGS headers")
+
+		fingerprint, err := efgsutils.GetCertificateFingerprint(ctx, config.NBTLSPair)
+		if err != nil {
+			return nil, err
+		}
+		subject, err := efgsutils.GetCertificateSubject(ctx, config.NBTLSPair)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-SSL-Client-SHA256", fingerprint)
+		req.Header.Set("X-SSL-Client-DN", subject)
+	}
+
+	resp, err := config.Client.Do(req)
+	if err != nil {
+		logger.Errorf("Error while downloading audit: %v", err)
+		return nil, err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := resp.Body.Close(); err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("HTTP %v: %v", resp.StatusCode, string(body))
+	}
+
+	var entries []efgsapi.AuditEntry
+
+	if err = json.Unmarshal(body, &entries); err != nil {
+		logger.Debugf("Audit response parsing error: %v, body: %v", err, string(body))
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// verifyBatch Checks that the downloaded keys are exactly the keys covered by the audit entries and that each uploaded
+// batch is signed by a certificate trusted for its country. Keys are matched to the audit entries by their content:
+// the keys of an entry are the run of keys of its country, which are signed by its signature. EFGS keeps keys of one
+// upload together, but neither the order of the uploads nor the order of keys in them.
+func verifyBatch(keys []efgsapi.DiagnosisKey, entries []efgsapi.AuditEntry, trusted efgsutils.CertificateTrust) error {
+	keysByCountry := make(map[string][]*efgsapi.DiagnosisKey)
+	for i := range keys {
+		country := strings.ToUpper(keys[i].Origin)
+		keysByCountry[country] = append(keysByCountry[country], &keys[i])
+	}
+
+	for i, entry := range entries {
+		country := strings.ToUpper(entry.Country)
+		countryKeys := keysByCountry[country]
+
+		if country == czCode && len(countryKeys) == 0 {
+			continue // our own upload, EFGS doesn't send it back to us
+		}
+
+		if entry.Amount > len(countryKeys) {
+			return fmt.Errorf("Audit entry %v expects %v keys from %v, only %v left", i, entry.Amount, country, len(countryKeys))
+		}
+
+		p7, signer, err := parseBatchSignature(entry, trusted)
+		if err != nil {
+			return fmt.Errorf("Audit entry %v from %v: %v", i, country, err)
+		}
+
+		start := -1
+		for candidate := 0; candidate+entry.Amount <= len(countryKeys); candidate++ {
+			if isSignedBatch(p7, countryKeys[candidate:candidate+entry.Amount]) {
+				start = candidate
+				break
+			}
+		}
+
+		if start < 0 {
+			return fmt.Errorf("Audit entry %v from %v: no %v keys match the batch signature of %v", i, country, entry.Amount, efgsutils.CertificateThumbprint(signer))
+		}
+
+		rest := make([]*efgsapi.DiagnosisKey, 0, len(countryKeys)-entry.Amount)
+		rest = append(rest, countryKeys[:start]...)
+		keysByCountry[country] = append(rest, countryKeys[start+entry.Amount:]...)
+	}
+
+	for country, countryKeys := range keysByCountry {
+		if len(countryKeys) > 0 {
+			return fmt.Errorf("%v keys from %v are not covered by any audit entry", len(countryKeys), country)
+		}
+	}
+
+	return nil
+}
+
+// parseBatchSignature Parses signature of the uploaded batch and checks its signer is trusted for the country.
+func parseBatchSignature(entry efgsapi.AuditEntry, trusted efgsutils.CertificateTrust) (*pkcs7.PKCS7, *x509.Certificate, error) {
+	signature, err := b64.StdEncoding.DecodeString(entry.BatchSignature)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not decode batch signature: %v", err)
+	}
+
+	p7, err := efgsutils.ParsePKCS7(signature)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Could not parse batch signature: %v", err)
+	}
+
+	signer := p7.GetOnlySigner()
+	if signer == nil {
+		return nil, nil, fmt.Errorf("Batch signature must have exactly one signer")
+	}
+
+	if !trusted.IsTrusted(entry.Country, signer) {
+		return nil, nil, fmt.Errorf("Signing certificate %v is not trusted for %v", efgsutils.CertificateThumbprint(signer), entry.Country)
+	}
+
+	if block, _ := pem.Decode([]byte(entry.SigningCertificate)); block != nil && !bytes.Equal(block.Bytes, signer.Raw) {
+		return nil, nil, fmt.Errorf("Batch is not signed by the signing certificate from audit")
+	}
+
+	return p7, signer, nil
+}
+
+// isSignedBatch Whether the signature is valid for the keys. Digest of the keys is compared before the signature
+// itself is verified, so checking keys which don't match is cheap.
+func isSignedBatch(p7 *pkcs7.PKCS7, keys []*efgsapi.DiagnosisKey) bool {
+	// uploader signs keys sorted by their bytes representation, the order is not preserved by EFGS
+	sortedKeys := make([]*efgsapi.DiagnosisKey, len(keys))
+	copy(sortedKeys, keys)
+	sortDiagnosisKey(sortedKeys)
+
+	batch := makeBatch(sortedKeys)
+	p7.Content = batchToBytes(&batch)
+
+	return p7.Verify() == nil
+}
+
+// quarantineBatch Stores the keys of the batch in parts, then the batch itself, so a quarantined batch always has all
+// its keys stored.
+func quarantineBatch(ctx context.Context, config *downloadConfig, date string, batchTag string, keys []efgsapi.DiagnosisKey, reason string) error {
+	logger := logging.FromContext(ctx).Named("efgs.quarantineBatch")
+
+	docID := date + "_" + batchTag
+	parts := 0
+
+	for start := 0; start < len(keys); start += quarantinedKeysPerPart {
+		end := start + quarantinedKeysPerPart
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		rawKeys, err := json.Marshal(keys[start:end])
+		if err != nil {
+			return err
+		}
+
+		part := QuarantinedKeys{Date: date, BatchTag: batchTag, Part: parts, Keys: string(rawKeys)}
+
+		if err = config.StoreClient.Set(ctx, constants.CollectionEfgsQuarantinedKeys, fmt.Sprintf("%v_%d", docID, parts), part); err != nil {
+			logger.Errorf("Could not quarantine keys of batch '%v': %v", batchTag, err)
+			return fmt.Errorf("Error while saving to Firestore: %v", err)
+		}
+
+		parts++
+	}
+
+	quarantined := QuarantinedBatch{
+		Date:          date,
+		BatchTag:      batchTag,
+		Reason:        reason,
+		KeysCount:     len(keys),
+		Parts:         parts,
+		QuarantinedAt: time.Now(),
+	}
+
+	if err := config.StoreClient.Set(ctx, constants.CollectionEfgsQuarantinedBatches, docID, quarantined); err != nil {
+		logger.Errorf("Could not quarantine batch '%v': %v", batchTag, err)
+		return fmt.Errorf("Error while saving to Firestore: %v", err)
+	}
+
+	logger.Infof("Batch '%v' from %v with %v keys was quarantined", batchTag, date, len(keys))
+
+	return nil
+}
@@ -0,0 +1,330 @@
+package efgs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	b64 "encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/covid19cz/erouska-backend/internal/constants"
+	efgsapi "github.com/covid19cz/erouska-backend/internal/functions/efgs/api"
+	efgsutils "github.com/covid19cz/erouska-backend/internal/functions/efgs/utils"
+	"github.com/covid19cz/erouska-backend/internal/store"
+	"go.mozilla.org/pkcs7"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	urlutils "net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type trustedThumbprints map[string][]string
+
+func (t trustedThumbprints) IsTrusted(country string, cert *x509.Certificate) bool {
+	for _, thumbprint := range t[country] {
+		if thumbprint == efgsutils.CertificateThumbprint(cert) {
+			return true
+		}
+	}
+	return false
+}
+
+type signingCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newSigningCert(t *testing.T, country string) signingCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "NBBS " + country, Country: []string{country}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signingCert{cert: cert, key: key}
+}
+
+// auditEntry Signs the keys the same way signBatch does.
+func (s signingCert) auditEntry(t *testing.T, country string, keys []efgsapi.DiagnosisKey) efgsapi.AuditEntry {
+	ptrs := make([]*efgsapi.DiagnosisKey, len(keys))
+	for i := range keys {
+		ptrs[i] = &keys[i]
+	}
+	sortDiagnosisKey(ptrs)
+	batch := makeBatch(ptrs)
+
+	signedBatch, err := pkcs7.NewSignedData(batchToBytes(&batch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = signedBatch.AddSigner(s.cert, s.key, pkcs7.SignerInfoConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	signedBatch.Detach()
+	signature, err := signedBatch.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return efgsapi.AuditEntry{
+		Country:            country,
+		Amount:             len(keys),
+		BatchSignature:     b64.StdEncoding.EncodeToString(signature),
+		SigningCertificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.cert.Raw})),
+	}
+}
+
+func newAuditKeys(origin string, count int) []efgsapi.DiagnosisKey {
+	keys := make([]efgsapi.DiagnosisKey, count)
+	for i := range keys {
+		keys[i] = efgsapi.DiagnosisKey{
+			KeyData:                    []byte(fmt.Sprintf("%v-key-%02d-padding", origin, i)),
+			RollingStartIntervalNumber: uint32(2680000 + i*144),
+			RollingPeriod:              144,
+			TransmissionRiskLevel:      2,
+			VisitedCountries:           []string{"DE", "AT", "CZ"},
+			Origin:                     origin,
+			ReportType:                 efgsapi.ReportType_CONFIRMED_TEST,
+			DaysSinceOnsetOfSymptoms:   int32(i),
+		}
+	}
+	return keys
+}
+
+// downloadedKeys Simulates the download response: keys of all uploads concatenated, in reversed order.
+func downloadedKeys(batches ...[]efgsapi.DiagnosisKey) []efgsapi.DiagnosisKey {
+	var count int
+	for _, batch := range batches {
+		count += len(batch)
+	}
+
+	keys := make([]efgsapi.DiagnosisKey, count)
+	next := 0
+	for _, batch := range batches {
+		for i := len(batch) - 1; i >= 0; i-- {
+			k := &batch[i]
+			keys[next] = efgsapi.DiagnosisKey{
+				KeyData:                    k.KeyData,
+				RollingStartIntervalNumber: k.RollingStartIntervalNumber,
+				RollingPeriod:              k.RollingPeriod,
+				TransmissionRiskLevel:      k.TransmissionRiskLevel,
+				VisitedCountries:           k.VisitedCountries,
+				Origin:                     k.Origin,
+				ReportType:                 k.ReportType,
+				DaysSinceOnsetOfSymptoms:   k.DaysSinceOnsetOfSymptoms,
+			}
+			next++
+		}
+	}
+	return keys
+}
+
+func TestVerifyBatch(t *testing.T) {
+	de := newSigningCert(t, "DE")
+	at := newSigningCert(t, "AT")
+	rogue := newSigningCert(t, "DE")
+
+	trusted := trustedThumbprints{
+		"DE": {efgsutils.CertificateThumbprint(de.cert)},
+		"AT": {efgsutils.CertificateThumbprint(at.cert)},
+	}
+
+	deKeys := newAuditKeys("DE", 5)
+	deKeys2 := newAuditKeys("DE", 2)[1:]
+	atKeys := newAuditKeys("AT", 3)
+	czEntry := efgsapi.AuditEntry{Country: "CZ", Amount: 10}
+
+	tampered := downloadedKeys(deKeys, atKeys)
+	tampered[2].TransmissionRiskLevel = 8
+
+	tests := []struct {
+		name    string
+		keys    []efgsapi.DiagnosisKey
+		entries []efgsapi.AuditEntry
+		wantErr bool
+	}{
+		{
+			name:    "valid",
+			keys:    downloadedKeys(deKeys, atKeys, deKeys2),
+			entries: []efgsapi.AuditEntry{de.auditEntry(t, "DE", deKeys), czEntry, at.auditEntry(t, "AT", atKeys), de.auditEntry(t, "DE", deKeys2)},
+		},
+		{
+			name:    "uploads in other order than audit entries",
+			keys:    downloadedKeys(deKeys2, atKeys, deKeys),
+			entries: []efgsapi.AuditEntry{de.auditEntry(t, "DE", deKeys), at.auditEntry(t, "AT", atKeys), de.auditEntry(t, "DE", deKeys2)},
+		},
+		{
+			name:    "uploads of the same size swapped",
+			keys:    downloadedKeys(deKeys[3:], deKeys[:2]),
+			entries: []efgsapi.AuditEntry{de.auditEntry(t, "DE", deKeys[:2]), de.auditEntry(t, "DE", deKeys[3:])},
+		},
+		{
+			name:    "keys of uploads interleaved",
+			keys:    downloadedKeys(deKeys[0:1], deKeys[2:3], deKeys[1:2], deKeys[3:4]),
+			entries: []efgsapi.AuditEntry{de.auditEntry(t, "DE", deKeys[:2]), de.auditEntry(t, "DE", deKeys[2:4])},
+			wantErr: true,
+		},
+		{
+			name:    "tampered key",
+			keys:    tampered,
+			entries: []efgsapi.AuditEntry{de.auditEntry(t, "DE", deKeys), at.auditEntry(t, "AT", atKeys)},
+			wantErr: true,
+		},
+		{
+			name:    "untrusted certificate",
+			keys:    downloadedKeys(deKeys),
+			entries: []efgsapi.AuditEntry{rogue.auditEntry(t, "DE", deKeys)},
+			wantErr: true,
+		},
+		{
+			name:    "certificate of other country",
+			keys:    downloadedKeys(atKeys),
+			entries: []efgsapi.AuditEntry{de.auditEntry(t, "AT", atKeys)},
+			wantErr: true,
+		},
+		{
+			name:    "keys not covered by audit",
+			keys:    downloadedKeys(deKeys, atKeys),
+			entries: []efgsapi.AuditEntry{de.auditEntry(t, "DE", deKeys)},
+			wantErr: true,
+		},
+		{
+			name:    "missing keys",
+			keys:    downloadedKeys(deKeys[1:]),
+			entries: []efgsapi.AuditEntry{de.auditEntry(t, "DE", deKeys)},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := verifyBatch(tt.keys, tt.entries, trusted); (err != nil) != tt.wantErr {
+				t.Fatalf("verifyBatch() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDownloadVerifiedKeysQuarantinesInvalidBatch(t *testing.T) {
+	de := newSigningCert(t, "DE")
+	rogue := newSigningCert(t, "DE")
+
+	keys := newAuditKeys("DE", 4)
+
+	audits := map[string][]efgsapi.AuditEntry{
+		"20201210-1": {de.auditEntry(t, "DE", keys)},
+		"20201210-2": {rogue.auditEntry(t, "DE", keys)},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var response interface{}
+
+		if r.URL.Path == "/diagnosiskeys/download/2020-12-10" {
+			response = efgsapi.DownloadBatchResponse{Keys: downloadedKeys(keys)}
+		} else {
+			response = audits[strings.TrimPrefix(r.URL.Path, "/diagnosiskeys/audit/download/2020-12-10/")]
+		}
+
+		_ = json.NewEncoder(w).Encode(response)
+	}))
+	defer server.Close()
+
+	url, _ := urlutils.Parse(server.URL)
+	storeClient := store.NewMemoryClient()
+
+	config := &downloadConfig{
+		Client:                server.Client(),
+		URL:                   url,
+		StoreClient:           storeClient,
+		TrustList:             trustedThumbprints{"DE": {efgsutils.CertificateThumbprint(de.cert)}},
+		VerifyBatchSignatures: true,
+	}
+
+	ctx := context.Background()
+
+	verified, err := downloadVerifiedKeys(ctx, config, "2020-12-10", "20201210-1")
+	if err != nil || len(verified.Keys) != len(keys) {
+		t.Fatalf("downloadVerifiedKeys() = %+v, error %v; want %v keys", verified, err, len(keys))
+	}
+
+	quarantined, err := downloadVerifiedKeys(ctx, config, "2020-12-10", "20201210-2")
+	if err != nil || quarantined == nil || len(quarantined.Keys) != 0 {
+		t.Fatalf("downloadVerifiedKeys() = %v, error %v; want empty batch", quarantined, err)
+	}
+
+	var batch QuarantinedBatch
+	if err = storeClient.Get(ctx, constants.CollectionEfgsQuarantinedBatches, "2020-12-10_20201210-2", &batch); err != nil {
+		t.Fatalf("Batch was not quarantined: %v", err)
+	}
+
+	if batch.KeysCount != len(keys) || batch.BatchTag != "20201210-2" {
+		t.Fatalf("Unexpected quarantined batch: %+v", batch)
+	}
+
+	if err = storeClient.Get(ctx, constants.CollectionEfgsQuarantinedBatches, "2020-12-10_20201210-1", nil); err == nil {
+		t.Fatalf("Valid batch was quarantined")
+	}
+}
+
+func TestQuarantineBatchInParts(t *testing.T) {
+	ctx := context.Background()
+
+	storeClient := store.NewMemoryClient()
+	config := &downloadConfig{StoreClient: storeClient}
+
+	keys := newAuditKeys("DE", 2*quarantinedKeysPerPart+1)
+
+	if err := quarantineBatch(ctx, config, "2020-12-10", "20201210-1", keys, "Invalid batch signature"); err != nil {
+		t.Fatalf("quarantineBatch() error = %v", err)
+	}
+
+	var batch QuarantinedBatch
+	if err := storeClient.Get(ctx, constants.CollectionEfgsQuarantinedBatches, "2020-12-10_20201210-1", &batch); err != nil {
+		t.Fatalf("Batch was not quarantined: %v", err)
+	}
+
+	if batch.KeysCount != len(keys) || batch.Parts != 3 {
+		t.Fatalf("Quarantined batch = %+v, want %v keys in 3 parts", batch, len(keys))
+	}
+
+	count := 0
+	for part := 0; part < batch.Parts; part++ {
+		var quarantined QuarantinedKeys
+		if err := storeClient.Get(ctx, constants.CollectionEfgsQuarantinedKeys, fmt.Sprintf("2020-12-10_20201210-1_%d", part), &quarantined); err != nil {
+			t.Fatalf("Part %v was not stored: %v", part, err)
+		}
+
+		var partKeys []*efgsapi.DiagnosisKey
+		if err := json.Unmarshal([]byte(quarantined.Keys), &partKeys); err != nil {
+			t.Fatal(err)
+		}
+		count += len(partKeys)
+	}
+
+	if count != len(keys) {
+		t.Fatalf("%v keys were quarantined, want %v", count, len(keys))
+	}
+}
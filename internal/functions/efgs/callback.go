@@ -0,0 +1,249 @@
+package efgs
+
+import (
+	"context"
+	"fmt"
+	efgsapi "github.com/covid19cz/erouska-backend/internal/functions/efgs/api"
+	efgsconstants "github.com/covid19cz/erouska-backend/internal/functions/efgs/constants"
+	efgsutils "github.com/covid19cz/erouska-backend/internal/functions/efgs/utils"
+	"github.com/covid19cz/erouska-backend/internal/logging"
+	"github.com/covid19cz/erouska-backend/internal/pubsub"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//BatchCallback Handles EFGS notification about new batch. The batch is enqueued for download.
+func BatchCallback(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.FromContext(ctx).Named("efgs.BatchCallback")
+
+	config, err := loadCallbackConfig(ctx)
+	if err != nil {
+		logger.Errorf("Could not load config: %+v", err)
+		http.Error(w, fmt.Sprintf("Error: %v", err), 500)
+		return
+	}
+
+	status, err := handleBatchCallback(ctx, config, r)
+	if err != nil {
+		logger.Warnf("Could not handle EFGS callback: %+v", err)
+		http.Error(w, fmt.Sprintf("Error: %v", err), status)
+		return
+	}
+
+	w.WriteHeader(status)
+}
+
+func handleBatchCallback(ctx context.Context, config *callbackConfig, r *http.Request) (int, error) {
+	logger := logging.FromContext(ctx).Named("efgs.handleBatchCallback")
+
+	subject, ok := callerSubject(ctx, config, r)
+	if !ok {
+		return http.StatusUnauthorized, fmt.Errorf("Missing client certificate")
+	}
+
+	if subject != config.AllowedSubject {
+		return http.StatusForbidden, fmt.Errorf("Client certificate subject '%v' is not allowed", subject)
+	}
+
+	query := r.URL.Query()
+
+	batch := efgsapi.BatchDownloadParams{
+		Date:     query.Get("date"),
+		BatchTag: query.Get("batchTag"),
+	}
+
+	if _, err := time.Parse("2006-01-02", batch.Date); err != nil {
+		return http.StatusBadRequest, fmt.Errorf("Invalid date '%v'", batch.Date)
+	}
+
+	if batch.BatchTag == "" {
+		return http.StatusBadRequest, fmt.Errorf("Missing batchTag")
+	}
+
+	logger.Infof("EFGS has announced new batch: %+v", batch)
+
+	if err := config.PubSubClient.Publish(efgsconstants.TopicNameDownloadBatch, batch); err != nil {
+		return http.StatusInternalServerError, fmt.Errorf("Could not enqueue batch for download: %v", err)
+	}
+
+	return http.StatusAccepted, nil
+}
+
+// callerSubject Gets subject of the client certificate. Cloud Functions don't terminate mTLS, so the callback is invoked
+// by a proxy which does: the subject is taken from the same header EFGS itself uses, but only when the request is signed
+// by the proxy service account. The proxy must overwrite the header with the subject it has verified.
+func callerSubject(ctx context.Context, config *callbackConfig, r *http.Request) (string, bool) {
+	logger := logging.FromContext(ctx).Named("efgs.callerSubject")
+
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return r.TLS.PeerCertificates[0].Subject.ToRDNSequence().String(), true
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || config.ProxyAccount == "" {
+		return "", false
+	}
+
+	// the audience is checked by Cloud Functions, which let only the invokers in
+	payload, err := config.ValidateToken(ctx, token, "")
+	if err != nil {
+		logger.Debugf("Invalid proxy token: %v", err)
+		return "", false
+	}
+
+	if email, _ := payload.Claims["email"].(string); email != config.ProxyAccount {
+		logger.Debugf("Request signed by '%v' instead of the proxy", email)
+		return "", false
+	}
+
+	subject := r.Header.Get("X-SSL-Client-DN")
+	return subject, subject != ""
+}
+
+//DownloadAnnouncedBatch Downloads batch announced by EFGS callback.
+func DownloadAnnouncedBatch(ctx context.Context, m pubsub.Message) error {
+	logger := logging.FromContext(ctx).Named("efgs.DownloadAnnouncedBatch")
+
+	var batch efgsapi.BatchDownloadParams
+
+	if decodeErr := pubsub.DecodeJSONEvent(m, &batch); decodeErr != nil {
+		err := fmt.Errorf("Error while parsing event payload: %v", decodeErr)
+		logger.Error(err)
+		return err
+	}
+
+	config, err := loadDownloadConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	return downloadAnnouncedBatch(ctx, config, time.Now(), batch)
+}
+
+func downloadAnnouncedBatch(ctx context.Context, config *downloadConfig, now time.Time, batch efgsapi.BatchDownloadParams) error {
+	logger := logging.FromContext(ctx).Named("efgs.downloadAnnouncedBatch")
+
+	recorded, err := isDownloadedBatch(ctx, config, batch.Date, batch.BatchTag, batch.BatchTag)
+	if err != nil || recorded {
+		return err
+	}
+
+	downloaded, err := downloadVerifiedKeys(ctx, config, batch.Date, batch.BatchTag)
+	if err != nil {
+		logger.Debugf("Could not download batch from EFGS: %v", err)
+		return err
+	}
+
+	if downloaded == nil {
+		return fmt.Errorf("Announced batch %v doesn't exist", batch.BatchTag)
+	}
+
+	keysCount := len(downloaded.Keys)
+
+	czKeys, err := importDownloadedBatch(ctx, config, now, batch.Date, batch.BatchTag, downloaded)
+	if err != nil {
+		logger.Debugf("Could not enqueue batch from EFGS for import: %v", err)
+		return err
+	}
+
+	if keysCount == 0 {
+		logger.Debugf("Batch %v is empty", batch.BatchTag)
+		return nil
+	}
+
+	logger.Infof("Successfully enqueued %v downloaded keys for import to our Key server", keysCount)
+
+	if err := updateDownloadedCounters(ctx, config, now, batch.Date, batch.BatchTag, czKeys, keysCount); err != nil {
+		logger.Warnf("Could not update EFGS download counters: %v", err)
+	}
+
+	return nil
+}
+
+//ManageCallback Registers (PUT) or unregisters (DELETE) our callback URL in EFGS.
+func ManageCallback(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.FromContext(ctx).Named("efgs.ManageCallback")
+
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		http.Error(w, "Only PUT and DELETE are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	config, err := loadCallbackRegistrationConfig(ctx)
+	if err != nil {
+		logger.Errorf("Could not load config: %+v", err)
+		http.Error(w, fmt.Sprintf("Error: %v", err), 500)
+		return
+	}
+
+	if err = manageCallback(ctx, config, r.Method); err != nil {
+		logger.Errorf("Could not manage EFGS callback: %+v", err)
+		http.Error(w, fmt.Sprintf("Error: %v", err), 500)
+		return
+	}
+
+	http.Error(w, "ok", 200)
+}
+
+func manageCallback(ctx context.Context, config *callbackRegistrationConfig, method string) error {
+	logger := logging.FromContext(ctx).Named("efgs.manageCallback")
+
+	url := *config.URL
+	url.Path = "diagnosiskeys/callback/" + config.CallbackID
+
+	if method == http.MethodPut {
+		query := url.Query()
+		query.Set("url", config.CallbackURL)
+		url.RawQuery = query.Encode()
+
+		logger.Infof("Registering callback '%v' with URL %v", config.CallbackID, config.CallbackURL)
+	} else {
+		logger.Infof("Unregistering callback '%v'", config.CallbackID)
+	}
+
+	req, err := http.NewRequest(method, url.String(), nil)
+	if err != nil {
+		logger.Error("Error creating callback request")
+		return err
+	}
+
+	if config.Env == efgsutils.EnvLocal {
+		logger.Debugf("Setting up LOCAL EFGS headers")
+
+		fingerprint, err := efgsutils.GetCertificateFingerprint(ctx, config.NBTLSPair)
+		if err != nil {
+			return err
+		}
+		subject, err := efgsutils.GetCertificateSubject(ctx, config.NBTLSPair)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-SSL-Client-SHA256", fingerprint)
+		req.Header.Set("X-SSL-Client-DN", subject)
+	}
+
+	resp, err := config.Client.Do(req)
+	if err != nil {
+		logger.Errorf("Error while calling EFGS: %v", err)
+		return err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if err := resp.Body.Close(); err != nil {
+		return err
+	}
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("HTTP %v: %v", resp.StatusCode, string(body))
+	}
+
+	return nil
+}
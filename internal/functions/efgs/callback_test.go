@@ -0,0 +1,92 @@
+package efgs
+
+import (
+	"context"
+	"fmt"
+	efgsapi "github.com/covid19cz/erouska-backend/internal/functions/efgs/api"
+	efgsconstants "github.com/covid19cz/erouska-backend/internal/functions/efgs/constants"
+	"google.golang.org/api/idtoken"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+type recordingPublisher struct {
+	mutex    sync.Mutex
+	topics   []string
+	messages []interface{}
+}
+
+func (p *recordingPublisher) Publish(topic string, msg interface{}) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.topics = append(p.topics, topic)
+	p.messages = append(p.messages, msg)
+	return nil
+}
+
+func TestHandleBatchCallback(t *testing.T) {
+	const (
+		allowedSubject = "CN=efgs-callback,O=EFGS,C=EU"
+		proxyAccount   = "efgs-callback-proxy@project.iam.gserviceaccount.com"
+	)
+
+	// tokens are named by the account which signed them
+	validateToken := func(ctx context.Context, token string, audience string) (*idtoken.Payload, error) {
+		if token == "forged" {
+			return nil, fmt.Errorf("invalid signature")
+		}
+		return &idtoken.Payload{Claims: map[string]interface{}{"email": token}}, nil
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		subject    string
+		query      string
+		wantStatus int
+	}{
+		{"valid", proxyAccount, allowedSubject, "?date=2020-12-10&batchTag=20201210-42", http.StatusAccepted},
+		{"not signed by proxy", "", allowedSubject, "?date=2020-12-10&batchTag=20201210-42", http.StatusUnauthorized},
+		{"signed by other account", "someone@project.iam.gserviceaccount.com", allowedSubject, "?date=2020-12-10&batchTag=20201210-42", http.StatusUnauthorized},
+		{"forged token", "forged", allowedSubject, "?date=2020-12-10&batchTag=20201210-42", http.StatusUnauthorized},
+		{"missing subject", proxyAccount, "", "?date=2020-12-10&batchTag=20201210-42", http.StatusUnauthorized},
+		{"foreign subject", proxyAccount, "CN=someone,C=CZ", "?date=2020-12-10&batchTag=20201210-42", http.StatusForbidden},
+		{"invalid date", proxyAccount, allowedSubject, "?date=10.12.2020&batchTag=20201210-42", http.StatusBadRequest},
+		{"missing batch tag", proxyAccount, allowedSubject, "?date=2020-12-10", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			publisher := &recordingPublisher{}
+			config := &callbackConfig{PubSubClient: publisher, AllowedSubject: allowedSubject, ProxyAccount: proxyAccount, ValidateToken: validateToken}
+
+			r := httptest.NewRequest("GET", "/EfgsBatchCallback"+tt.query, nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			if tt.subject != "" {
+				r.Header.Set("X-SSL-Client-DN", tt.subject)
+			}
+
+			status, _ := handleBatchCallback(context.Background(), config, r)
+			if status != tt.wantStatus {
+				t.Fatalf("handleBatchCallback() status = %v, want %v", status, tt.wantStatus)
+			}
+
+			if tt.wantStatus != http.StatusAccepted {
+				if len(publisher.messages) != 0 {
+					t.Fatalf("handleBatchCallback() published %v, want nothing", publisher.messages)
+				}
+				return
+			}
+
+			want := efgsapi.BatchDownloadParams{Date: "2020-12-10", BatchTag: "20201210-42"}
+			if len(publisher.messages) != 1 || publisher.topics[0] != efgsconstants.TopicNameDownloadBatch || publisher.messages[0] != want {
+				t.Fatalf("handleBatchCallback() published %v to %v, want %v", publisher.messages, publisher.topics, want)
+			}
+		})
+	}
+}
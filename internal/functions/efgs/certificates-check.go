@@ -0,0 +1,81 @@
+package efgs
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	efgsutils "github.com/covid19cz/erouska-backend/internal/functions/efgs/utils"
+	"github.com/covid19cz/erouska-backend/internal/logging"
+	"net/http"
+	"time"
+)
+
+//CheckCertificates Alerts when our NBTLS/NBBS certificates are about to expire or are missing in EFGS trust list.
+func CheckCertificates(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.FromContext(ctx).Named("efgs.CheckCertificates")
+
+	now := time.Now()
+
+	config, err := loadCertificatesCheckConfig(ctx, now)
+	if err != nil {
+		logger.Errorf("Could not load config: %+v", err)
+		http.Error(w, fmt.Sprintf("Error: %v", err), 500)
+		return
+	}
+
+	problems := checkCertificates(ctx, config, now)
+
+	for _, problem := range problems {
+		// logged as error so it's picked up by the alerting
+		logger.Errorf("EFGS certificate problem: %v", problem)
+	}
+
+	http.Error(w, fmt.Sprintf("ok, %v problems found", len(problems)), 200)
+}
+
+func checkCertificates(ctx context.Context, config *certificatesCheckConfig, now time.Time) []string {
+	logger := logging.FromContext(ctx).Named("efgs.checkCertificates")
+
+	var problems []string
+
+	pairs := []struct {
+		certType     efgsutils.CertType
+		trustType    efgsutils.TrustListCertType
+		certificates *efgsutils.X509KeyPair
+	}{
+		{efgsutils.NBTLS, efgsutils.TrustListAuthentication, config.NBTLSPair},
+		{efgsutils.NBBS, efgsutils.TrustListSigning, config.NBBSPair},
+	}
+
+	for _, pair := range pairs {
+		certBlock, _ := pem.Decode(pair.certificates.Cert)
+		if certBlock == nil {
+			problems = append(problems, fmt.Sprintf("%v certificate is not a PEM certificate", pair.certType))
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(certBlock.Bytes)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%v certificate can't be parsed: %v", pair.certType, err))
+			continue
+		}
+
+		thumbprint := efgsutils.CertificateThumbprint(cert)
+		daysLeft := int(cert.NotAfter.Sub(now).Hours() / 24)
+
+		logger.Debugf("%v certificate %v expires in %v days (%v)", pair.certType, thumbprint, daysLeft, cert.NotAfter)
+
+		if daysLeft < config.ExpiryAlertDays {
+			problems = append(problems, fmt.Sprintf("%v certificate %v expires in %v days (%v)", pair.certType, thumbprint, daysLeft, cert.NotAfter))
+		}
+
+		// after rotation, the new certificate can't be used until EFGS lists it
+		if trusted, found := config.TrustList.Lookup(czCode, thumbprint); !found || trusted.Type != pair.trustType {
+			problems = append(problems, fmt.Sprintf("%v certificate %v is not listed in EFGS trust list as %v", pair.certType, thumbprint, pair.trustType))
+		}
+	}
+
+	return problems
+}
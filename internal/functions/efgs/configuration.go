@@ -4,57 +4,108 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/covid19cz/erouska-backend/internal/counters"
 	efgsdatabase "github.com/covid19cz/erouska-backend/internal/functions/efgs/database"
 	"github.com/covid19cz/erouska-backend/internal/functions/efgs/redis"
 	"github.com/covid19cz/erouska-backend/internal/functions/efgs/redismutex"
 	efgsutils "github.com/covid19cz/erouska-backend/internal/functions/efgs/utils"
 	"github.com/covid19cz/erouska-backend/internal/logging"
 	"github.com/covid19cz/erouska-backend/internal/pubsub"
-	"github.com/covid19cz/erouska-backend/internal/realtimedb"
 	"github.com/covid19cz/erouska-backend/internal/secrets"
+	"github.com/covid19cz/erouska-backend/internal/store"
 	"github.com/covid19cz/erouska-backend/internal/utils"
 	httputils "github.com/covid19cz/erouska-backend/internal/utils/http"
 	"github.com/sethvargo/go-envconfig"
+	"google.golang.org/api/idtoken"
 	"net/http"
 	urlutils "net/url"
 	"os"
 	"strconv"
+	"time"
 )
 
 type uploadConfig struct {
-	URL              *urlutils.URL
-	Env              efgsutils.Environment
-	NBTLSPair        *efgsutils.X509KeyPair
-	Client           *http.Client
-	Database         *efgsdatabase.Connection
-	RealtimeDBClient *realtimedb.Client
-	BatchSizeLimit   int
-	KeyValidityDays  int
-	BatchTag         string
+	URL             *urlutils.URL
+	Env             efgsutils.Environment
+	NBTLSPair       *efgsutils.X509KeyPair
+	NBBSPair        *efgsutils.X509KeyPair
+	Client          *http.Client
+	Database        *efgsdatabase.Connection
+	CountersClient  counters.Counters
+	BatchSizeLimit  int
+	KeyValidityDays int
+	BatchTag        string
 }
 
 type publishConfig struct {
 	VerificationServer *utils.VerificationServerConfig
 	KeyServer          *utils.KeyServerConfig
 	Client             *http.Client
-	MaxKeysOnPublish   int `env:"MAX_KEYS_ON_PUBLISH,default=30"`
-	MaxIntervalAge     int `env:"MAX_INTERVAL_AGE_ON_PUBLISH,default=15"`
+	Ledger             downloadLedger
+	PubSubClient       pubsub.EventPublisher
+	MaxKeysOnPublish   int           `env:"MAX_KEYS_ON_PUBLISH,default=30"`
+	MaxIntervalAge     int           `env:"MAX_INTERVAL_AGE_ON_PUBLISH,default=15"`
+	MaxImportAttempts  int           `env:"EFGS_IMPORT_MAX_ATTEMPTS,default=5"`
+	ImportRetryBackoff time.Duration `env:"EFGS_IMPORT_RETRY_BACKOFF,default=5m"`
+	TokenPool          *verificationTokenPool
+	// VerificationPoolSize Count of verification tokens issued at once, when the pool is empty.
+	VerificationPoolSize    int           `env:"EFGS_VERIFICATION_POOL_SIZE,default=20"`
+	VerificationConcurrency int           `env:"EFGS_VERIFICATION_CONCURRENCY,default=5"`
+	VerificationRateLimit   int           `env:"EFGS_VERIFICATION_RATE_LIMIT,default=5"`
+	VerificationTokenMaxAge time.Duration `env:"EFGS_VERIFICATION_TOKEN_MAX_AGE,default=30m"`
+	VerificationBatchIssue  bool          `env:"EFGS_VERIFICATION_BATCH_ISSUE,default=false"`
+}
+
+type requeueImportsConfig struct {
+	Ledger       downloadLedger
+	PubSubClient pubsub.EventPublisher
 }
 
 type downloadConfig struct {
-	Env                               efgsutils.Environment
-	Client                            *http.Client
-	URL                               *urlutils.URL
-	NBTLSPair                         *efgsutils.X509KeyPair
-	HaidMappings                      map[string]string
-	PubSubClient                      pubsub.EventPublisher
-	RedisClient                       redis.Client
-	MutexManager                      redismutex.MutexManager
-	RealtimeDBClient                  *realtimedb.Client
-	MaxKeysOnPublish                  int `env:"MAX_KEYS_ON_PUBLISH,default=30"`
-	MaxIntervalAge                    int `env:"MAX_INTERVAL_AGE_ON_PUBLISH,default=15"`
-	MaxSameStartIntervalKeys          int `env:"MAX_SAME_START_INTERVAL_KEYS,default=15"`
-	MaxDownloadYesterdaysKeysPartSize int `env:"MAX_YESTERDAYS_KEYS_PART_SIZE"`
+	Env                      efgsutils.Environment
+	Client                   *http.Client
+	URL                      *urlutils.URL
+	NBTLSPair                *efgsutils.X509KeyPair
+	HaidMappings             map[string]string
+	PubSubClient             pubsub.EventPublisher
+	RedisClient              redis.Client
+	MutexManager             redismutex.MutexManager
+	CountersClient           counters.Counters
+	StoreClient              store.Storer
+	Ledger                   downloadLedger
+	TrustList                efgsutils.CertificateTrust
+	VerifyBatchSignatures    bool `env:"EFGS_VERIFY_BATCH_SIGNATURES,default=true"`
+	MaxKeysOnPublish         int  `env:"MAX_KEYS_ON_PUBLISH,default=30"`
+	MaxIntervalAge           int  `env:"MAX_INTERVAL_AGE_ON_PUBLISH,default=15"`
+	MaxSameStartIntervalKeys int  `env:"MAX_SAME_START_INTERVAL_KEYS,default=15"`
+	// DownloadConcurrency Count of batches read, verified and enqueued for import at once.
+	DownloadConcurrency int `env:"EFGS_DOWNLOAD_CONCURRENCY,default=4"`
+	// DownloadProtobuf Download batches in protobuf instead of JSON.
+	DownloadProtobuf bool `env:"EFGS_DOWNLOAD_PROTOBUF,default=true"`
+}
+
+type certificatesCheckConfig struct {
+	NBTLSPair       *efgsutils.X509KeyPair
+	NBBSPair        *efgsutils.X509KeyPair
+	TrustList       *efgsutils.TrustList
+	ExpiryAlertDays int `env:"EFGS_CERT_EXPIRY_ALERT_DAYS,default=30"`
+}
+
+type callbackConfig struct {
+	PubSubClient   pubsub.EventPublisher
+	AllowedSubject string
+	// ProxyAccount Service account of the proxy terminating mTLS of EFGS callbacks, the only invoker of the callback.
+	ProxyAccount  string `env:"EFGS_CALLBACK_PROXY_ACCOUNT,required"`
+	ValidateToken func(ctx context.Context, token string, audience string) (*idtoken.Payload, error)
+}
+
+type callbackRegistrationConfig struct {
+	Env         efgsutils.Environment
+	Client      *http.Client
+	URL         *urlutils.URL
+	NBTLSPair   *efgsutils.X509KeyPair
+	CallbackID  string `env:"EFGS_CALLBACK_ID,default=erouska"`
+	CallbackURL string `env:"EFGS_CALLBACK_URL,required"`
 }
 
 func loadUploadConfig(ctx context.Context) (*uploadConfig, error) {
@@ -67,10 +118,10 @@ func loadUploadConfig(ctx context.Context) (*uploadConfig, error) {
 
 	var err error
 	config := uploadConfig{
-		URL:              url,
-		Env:              efgsEnv,
-		Database:         &efgsdatabase.Database,
-		RealtimeDBClient: &realtimedb.Client{},
+		URL:            url,
+		Env:            efgsEnv,
+		Database:       &efgsdatabase.Database,
+		CountersClient: counters.Client{Store: store.Client{}},
 	}
 
 	config.Env = efgsEnv
@@ -81,6 +132,12 @@ func loadUploadConfig(ctx context.Context) (*uploadConfig, error) {
 		return nil, err
 	}
 
+	config.NBBSPair, err = efgsutils.LoadX509KeyPair(ctx, efgsEnv, efgsutils.NBBS)
+	if err != nil {
+		logger.Debug("Error loading signing certificate")
+		return nil, err
+	}
+
 	efgsClient, err := efgsutils.NewEFGSClient(ctx, config.NBTLSPair)
 	if err != nil {
 		logger.Debug("Could not create EFGS client")
@@ -142,10 +199,20 @@ func loadPublishConfig(ctx context.Context) (*publishConfig, error) {
 
 	clientLogger := logging.FromContext(ctx).Named("efgs.publish-client")
 	config.Client = httputils.NewThrottlingAwareClient(&http.Client{}, clientLogger.Debugf)
+	config.Ledger = efgsdatabase.Database
+	config.PubSubClient = pubsub.Client{}
+	config.TokenPool = sharedTokenPool
 
 	return &config, nil
 }
 
+func loadRequeueImportsConfig() *requeueImportsConfig {
+	return &requeueImportsConfig{
+		Ledger:       efgsdatabase.Database,
+		PubSubClient: pubsub.Client{},
+	}
+}
+
 func loadDownloadConfig(ctx context.Context) (*downloadConfig, error) {
 	logger := logging.FromContext(ctx).Named("efgs.download-batch.loadDownloadConfig")
 
@@ -183,13 +250,149 @@ func loadDownloadConfig(ctx context.Context) (*downloadConfig, error) {
 	clientLogger := logging.FromContext(ctx).Named("efgs.efgs-client")
 	config.Client = httputils.NewThrottlingAwareClient(efgsClient, clientLogger.Debugf)
 
+	if config.VerifyBatchSignatures {
+		trustListConfig, err := loadTrustListConfig(ctx, env, config.Client, url, nbtlsPair)
+		if err != nil {
+			return nil, err
+		}
+
+		config.TrustList, err = loadTrustList(ctx, trustListConfig, time.Now())
+		if err != nil {
+			logger.Debugf("Error loading trust list: %v", err)
+			return nil, err
+		}
+	}
+
 	config.Env = env
 	config.URL = url
 	config.NBTLSPair = nbtlsPair
 	config.PubSubClient = pubsub.Client{}
 	config.MutexManager = redismutex.ClientImpl{}
 	config.RedisClient = redis.ClientImpl{}
-	config.RealtimeDBClient = &realtimedb.Client{}
+	config.CountersClient = counters.Client{Store: store.Client{}}
+	config.StoreClient = store.Client{}
+	config.Ledger = efgsdatabase.Database
+
+	return &config, nil
+}
+
+func loadTrustListConfig(ctx context.Context, env efgsutils.Environment, client *http.Client, url *urlutils.URL, nbtlsPair *efgsutils.X509KeyPair) (*trustListConfig, error) {
+	var config trustListConfig
+	if err := envconfig.Process(ctx, &config); err != nil {
+		return nil, err
+	}
+
+	trustAnchor, err := efgsutils.LoadTrustAnchor(ctx, env)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading trust anchor: %v", err)
+	}
+
+	config.Env = env
+	config.Client = client
+	config.URL = url
+	config.NBTLSPair = nbtlsPair
+	config.StoreClient = store.Client{}
+	config.TrustAnchor = trustAnchor
+
+	return &config, nil
+}
+
+func loadCertificatesCheckConfig(ctx context.Context, now time.Time) (*certificatesCheckConfig, error) {
+	logger := logging.FromContext(ctx).Named("efgs.loadCertificatesCheckConfig")
+
+	env := efgsutils.GetEfgsEnvironmentOrFail()
+
+	var config certificatesCheckConfig
+	if err := envconfig.Process(ctx, &config); err != nil {
+		return nil, err
+	}
+
+	var err error
+
+	config.NBTLSPair, err = efgsutils.LoadX509KeyPair(ctx, env, efgsutils.NBTLS)
+	if err != nil {
+		logger.Debugf("Error loading authentication certificate: %v", err)
+		return nil, err
+	}
+
+	config.NBBSPair, err = efgsutils.LoadX509KeyPair(ctx, env, efgsutils.NBBS)
+	if err != nil {
+		logger.Debugf("Error loading signing certificate: %v", err)
+		return nil, err
+	}
+
+	efgsClient, err := efgsutils.NewEFGSClient(ctx, config.NBTLSPair)
+	if err != nil {
+		logger.Debugf("Could not create EFGS client: %v", err)
+		return nil, err
+	}
+
+	clientLogger := logging.FromContext(ctx).Named("efgs.efgs-client")
+	client := httputils.NewThrottlingAwareClient(efgsClient, clientLogger.Debugf)
+
+	trustListConfig, err := loadTrustListConfig(ctx, env, client, efgsutils.GetEfgsURLOrFail(env), config.NBTLSPair)
+	if err != nil {
+		return nil, err
+	}
+
+	config.TrustList, err = loadTrustList(ctx, trustListConfig, now)
+	if err != nil {
+		logger.Debugf("Error loading trust list: %v", err)
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+func loadCallbackConfig(ctx context.Context) (*callbackConfig, error) {
+	env := efgsutils.GetEfgsEnvironmentOrFail()
+
+	var config callbackConfig
+	if err := envconfig.Process(ctx, &config); err != nil {
+		return nil, err
+	}
+
+	secretsClient := secrets.Client{}
+	subject, err := secretsClient.Get(fmt.Sprintf("efgs-%v-callback-subject", env))
+	if err != nil {
+		return nil, err
+	}
+
+	config.AllowedSubject = string(subject)
+	config.PubSubClient = pubsub.Client{}
+	config.ValidateToken = idtoken.Validate
+
+	return &config, nil
+}
+
+func loadCallbackRegistrationConfig(ctx context.Context) (*callbackRegistrationConfig, error) {
+	logger := logging.FromContext(ctx).Named("efgs.loadCallbackRegistrationConfig")
+
+	env := efgsutils.GetEfgsEnvironmentOrFail()
+
+	var config callbackRegistrationConfig
+	if err := envconfig.Process(ctx, &config); err != nil {
+		return nil, err
+	}
+
+	nbtlsPair, err := efgsutils.LoadX509KeyPair(ctx, env, efgsutils.NBTLS)
+	if err != nil {
+		logger.Debugf("Error loading authentication certificate: %v", err)
+		return nil, err
+	}
+
+	efgsClient, err := efgsutils.NewEFGSClient(ctx, nbtlsPair)
+	if err != nil {
+		logger.Debugf("Could not create EFGS client: %v", err)
+		return nil, err
+	}
+
+	clientLogger := logging.FromContext(ctx).Named("efgs.efgs-client")
+	config.Client = httputils.NewThrottlingAwareClient(efgsClient, clientLogger.Debugf)
+
+	config.Env = env
+	config.URL = efgsutils.GetEfgsURLOrFail(env)
+	config.NBTLSPair = nbtlsPair
 
 	return &config, nil
 }
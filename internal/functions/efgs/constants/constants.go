@@ -3,11 +3,20 @@ package constants
 //TopicNameImportKeys Topic for enqueuing keys to be imported.
 const TopicNameImportKeys = "efgs-import-keys"
 
+//TopicNameImportKeysDeadLetter Topic for keys which could not be imported even after retries.
+const TopicNameImportKeysDeadLetter = "efgs-import-keys-dead-letter"
+
 //TopicNameContinueYesterdayDownloading Topic for postponing download of yesterdays keys.
 const TopicNameContinueYesterdayDownloading = "efgs-postponed-yesterdays-downloading"
 
+//TopicNameDownloadBatch Topic for batches announced by EFGS callback, to be downloaded.
+const TopicNameDownloadBatch = "efgs-download-batch"
+
+//TopicNamePersistKeys Topic for keys published by our users, to be saved for upload to EFGS.
+const TopicNamePersistKeys = "efgs-persist-keys"
+
 //MutexNameDownloadAndSaveKeys Name for mutex for EFGS keys downloading.
 const MutexNameDownloadAndSaveKeys = "download-and-save-keys"
 
-//RedisKeyNextBatch Key for next download batch metadata.
+//RedisKeyNextBatch Key for download cursor - position in the chain of batches.
 const RedisKeyNextBatch = "nextDownloadBatch"
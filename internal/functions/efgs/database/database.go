@@ -10,7 +10,6 @@ import (
 	"github.com/covid19cz/erouska-backend/internal/logging"
 	"github.com/covid19cz/erouska-backend/internal/secrets"
 	"github.com/go-pg/pg/v10"
-	"github.com/go-pg/pg/v10/orm"
 	"go.uber.org/zap"
 	"net"
 	"regexp"
@@ -31,43 +30,51 @@ type Connection struct {
 
 var regexErrNo = regexp.MustCompile(`#[0-9]+`)
 
+// connect Connects to the database by credentials in secret manager.
+func connect() *pg.DB {
+	secretsClient := secrets.Client{}
+
+	efgsDatabaseName, err := secretsClient.Get("efgs-database-name")
+	if err != nil {
+		panic(fmt.Sprintf("Connection to secret manager failed: %s", err))
+	}
+	efgsDatabasePassword, err := secretsClient.Get("efgs-database-password")
+	if err != nil {
+		panic(fmt.Sprintf("Connection to secret manager failed: %s", err))
+	}
+	efgsDatabaseUser, err := secretsClient.Get("efgs-database-login")
+	if err != nil {
+		panic(fmt.Sprintf("Connection to secret manager failed: %s", err))
+	}
+	efgsDatabaseConnectionName, err := secretsClient.Get("efgs-database-connection-name")
+	if err != nil {
+		panic(fmt.Sprintf("Connection to secret manager failed: %s", err))
+	}
+
+	return pg.Connect(&pg.Options{
+		Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return proxy.Dial(string(efgsDatabaseConnectionName))
+		},
+		User:     string(efgsDatabaseUser),
+		Password: string(efgsDatabasePassword),
+		Database: string(efgsDatabaseName),
+	})
+}
+
 //Create new (lazy) database connection pool. Credentials must be specified in secret manager.
 func init() {
 	connectToDatabase := func() *pg.DB {
 		ctx := context.Background()
 		logger := logging.FromContext(ctx).Named("efgs.database.connectToDatabase")
-		secretsClient := secrets.Client{}
 
 		logger.Debug("Initializing EFGS database connection")
 
-		efgsDatabaseName, err := secretsClient.Get("efgs-database-name")
-		if err != nil {
-			panic(fmt.Sprintf("Connection to secret manager failed: %s", err))
-		}
-		efgsDatabasePassword, err := secretsClient.Get("efgs-database-password")
-		if err != nil {
-			panic(fmt.Sprintf("Connection to secret manager failed: %s", err))
-		}
-		efgsDatabaseUser, err := secretsClient.Get("efgs-database-login")
-		if err != nil {
-			panic(fmt.Sprintf("Connection to secret manager failed: %s", err))
-		}
-		efgsDatabaseConnectionName, err := secretsClient.Get("efgs-database-connection-name")
-		if err != nil {
-			panic(fmt.Sprintf("Connection to secret manager failed: %s", err))
-		}
-
-		connection := pg.Connect(&pg.Options{
-			Dialer: func(ctx context.Context, network, addr string) (net.Conn, error) {
-				return proxy.Dial(string(efgsDatabaseConnectionName))
-			},
-			User:     string(efgsDatabaseUser),
-			Password: string(efgsDatabasePassword),
-			Database: string(efgsDatabaseName),
-		})
+		connection := connect()
 
-		if err := createSchema(connection); err != nil {
-			panic(fmt.Sprintf("Error while creating DB schema: %s", err))
+		// the schema is migrated by efgs-migrate before deploying, the running code only checks it's at its version
+		migrator := &Migrator{db: connection, migrations: schemaMigrations}
+		if err := migrator.Check(ctx); err != nil {
+			panic(fmt.Sprintf("Error while checking DB schema: %s", err))
 		}
 
 		logger.Debug("EFGS database initialized")
@@ -93,8 +100,9 @@ func init() {
 	}
 }
 
-//PersistDiagnosisKeys Save array of DiagnosisKey to database.
-func (db Connection) PersistDiagnosisKeys(keys []*efgsapi.DiagnosisKey) error {
+//PersistDiagnosisKeys Save array of DiagnosisKey to database, along with version of the upload policy the keys were
+//prepared by.
+func (db Connection) PersistDiagnosisKeys(keys []*efgsapi.DiagnosisKey, policyVersion string) error {
 	logger := db.logger.Named("PersistDiagnosisKeys")
 	connection := db.inner().Conn()
 	defer connection.Close()
@@ -102,6 +110,7 @@ func (db Connection) PersistDiagnosisKeys(keys []*efgsapi.DiagnosisKey) error {
 	//Persisting MUST be done per key because when is there any duplication, whole batch is rejected.
 	for _, key := range keys {
 		wrappedKey := key.ToWrapper() // diagnosisKey must wrapped - keyData converted to base64
+		wrappedKey.PolicyVersion = policyVersion
 
 		if _, err := connection.Model(wrappedKey).Returning("*").Insert(); err != nil {
 			errorNumber := regexErrNo.Find([]byte(err.Error()))
@@ -120,6 +129,42 @@ func (db Connection) PersistDiagnosisKeys(keys []*efgsapi.DiagnosisKey) error {
 	return nil
 }
 
+//ReviseDiagnosisKeys Saves keys revised by the device, along with version of the upload policy the keys were prepared
+//by. Report type and TRL of keys already in the DB are updated and the keys are uploaded again - EFGS deduplicates
+//uploaded keys by their whole payload, so it accepts the revised ones. Revoked keys which were not uploaded yet won't be
+//uploaded at all.
+func (db Connection) ReviseDiagnosisKeys(keys []*efgsapi.DiagnosisKey, policyVersion string) error {
+	logger := db.logger.Named("ReviseDiagnosisKeys")
+	connection := db.inner().Conn()
+	defer connection.Close()
+
+	for _, key := range keys {
+		wrappedKey := key.ToWrapper()
+		wrappedKey.PolicyVersion = policyVersion
+		// revoked key which was never persisted has never reached EFGS either, there's nothing to revoke
+		wrappedKey.IsUploaded = key.ReportType == efgsapi.ReportType_REVOKED
+
+		_, err := connection.Model(wrappedKey).
+			OnConflict("(key_data) DO UPDATE").
+			Set("report_type = EXCLUDED.report_type").
+			Set("transmission_risk_level = EXCLUDED.transmission_risk_level").
+			Set("policy_version = EXCLUDED.policy_version").
+			Set("retries = 0").
+			// revocation is uploaded only for keys which were uploaded before, other revisions are uploaded always
+			Set("is_uploaded = CASE WHEN EXCLUDED.report_type = ? THEN NOT dk.is_uploaded ELSE false END", int32(efgsapi.ReportType_REVOKED)).
+			Insert()
+		if err != nil {
+			return err
+		}
+
+		if efgsutils.EfgsExtendedLogging {
+			logger.Debugf("Saved revised key to EFGS DB: %v", wrappedKey)
+		}
+	}
+
+	return nil
+}
+
 //GetNotUploadedDiagnosisKeys Get keys from the DB that are not older than dateUntil and NOT IN EFGS.
 func (db Connection) GetNotUploadedDiagnosisKeys(dateUntil time.Time) ([]*efgsapi.DiagnosisKeyWrapper, error) {
 	logger := db.logger.Named("GetNotUploadedDiagnosisKeys")
@@ -209,25 +254,196 @@ func (db Connection) RemoveOldKeys(dateFrom string) error {
 		return err
 	}
 
+	// the imported keys have expired in the Key server too, they can't be revoked anymore
+	_, err = connection.Model(new(efgsapi.ImportedKeyRecord)).Where("imported_at < ?", dateFrom).Delete()
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
-func createSchema(cpool *pg.DB) error {
-	connection := cpool.Conn()
+//SaveDownloadedBatch Saves record of downloaded batch to the download ledger, replacing previous record of the same batch.
+func (db Connection) SaveDownloadedBatch(batch *efgsapi.DownloadedBatchRecord) error {
+	logger := db.logger.Named("SaveDownloadedBatch")
+	connection := db.inner().Conn()
+	defer connection.Close()
+
+	logger.Debugf("Saving downloaded batch '%v' from %v to EFGS DB", batch.BatchTag, batch.Date)
+
+	_, err := connection.Model(batch).
+		OnConflict("(date, batch_tag) DO UPDATE").
+		Set("next_batch_tag = EXCLUDED.next_batch_tag").
+		Set("first = b.first OR EXCLUDED.first").
+		Set("keys_count = EXCLUDED.keys_count").
+		Set("quarantined = EXCLUDED.quarantined").
+		Set("downloaded_at = EXCLUDED.downloaded_at").
+		Insert()
+
+	return err
+}
+
+//GetDownloadedBatch Gets record of the downloaded batch, without its imports; nil when the batch wasn't downloaded.
+func (db Connection) GetDownloadedBatch(date string, batchTag string) (*efgsapi.DownloadedBatchRecord, error) {
+	connection := db.inner().Conn()
 	defer connection.Close()
 
-	models := []interface{}{
-		(*efgsapi.DiagnosisKeyWrapper)(nil),
+	batch := &efgsapi.DownloadedBatchRecord{Date: date, BatchTag: batchTag}
+	if err := connection.Model(batch).WherePK().Select(); err != nil {
+		if err == pg.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
 	}
 
-	for _, model := range models {
-		err := connection.Model(model).CreateTable(&orm.CreateTableOptions{
-			IfNotExists: true,
-		})
-		if err != nil {
-			return err
+	return batch, nil
+}
+
+//SaveBatchImports Saves records of imports of downloaded batch, replacing previous records of the same imports.
+func (db Connection) SaveBatchImports(imports []*efgsapi.BatchImportRecord) error {
+	if len(imports) == 0 {
+		return nil
+	}
+
+	connection := db.inner().Conn()
+	defer connection.Close()
+
+	_, err := connection.Model(&imports).
+		OnConflict("(date, batch_tag, country, part) DO UPDATE").
+		Set("keys_count = EXCLUDED.keys_count").
+		Set("test_type = EXCLUDED.test_type").
+		Set("status = EXCLUDED.status").
+		Set("error = EXCLUDED.error").
+		Set("inserted = EXCLUDED.inserted").
+		Set("rejected = EXCLUDED.rejected").
+		Set("error_code = EXCLUDED.error_code").
+		Set("attempts = EXCLUDED.attempts").
+		Set("next_attempt_at = EXCLUDED.next_attempt_at").
+		Set("payload = EXCLUDED.payload").
+		Set("enqueued_at = EXCLUDED.enqueued_at").
+		Set("updated_at = EXCLUDED.updated_at").
+		Insert()
+
+	return err
+}
+
+//UpdateBatchImport Updates status of import of downloaded batch.
+func (db Connection) UpdateBatchImport(record *efgsapi.BatchImportRecord) error {
+	logger := db.logger.Named("UpdateBatchImport")
+	connection := db.inner().Conn()
+	defer connection.Close()
+
+	logger.Debugf("Updating import of batch '%v' from %v for %v (part %v) to %v", record.BatchTag, record.Date, record.Country, record.Part, record.Status)
+
+	_, err := connection.Model(record).
+		Column("status", "error", "inserted", "rejected", "error_code", "attempts", "next_attempt_at", "revision_token", "payload", "updated_at").
+		WherePK().
+		Update()
+
+	return err
+}
+
+//GetDueImportRetries Gets imports waiting for retry whose next attempt is due.
+func (db Connection) GetDueImportRetries(now time.Time) ([]*efgsapi.BatchImportRecord, error) {
+	connection := db.inner().Conn()
+	defer connection.Close()
+
+	var imports []*efgsapi.BatchImportRecord
+	if err := connection.Model(&imports).
+		Where("status = ?", efgsapi.ImportStatusRetrying).
+		Where("next_attempt_at <= ?", now).
+		Order("next_attempt_at").
+		Select(); err != nil {
+		return nil, err
+	}
+
+	return imports, nil
+}
+
+//SaveImportedKeys Saves records of keys imported to the Key server. Key imported again is linked to the latest import.
+func (db Connection) SaveImportedKeys(keys []*efgsapi.ImportedKeyRecord) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	connection := db.inner().Conn()
+	defer connection.Close()
+
+	_, err := connection.Model(&keys).
+		OnConflict("(key_data) DO UPDATE").
+		Set("date = EXCLUDED.date").
+		Set("batch_tag = EXCLUDED.batch_tag").
+		Set("country = EXCLUDED.country").
+		Set("part = EXCLUDED.part").
+		Set("imported_at = EXCLUDED.imported_at").
+		Insert()
+
+	return err
+}
+
+//GetRevisionTokens Gets revision tokens of imports of the keys, by key data. Keys which weren't imported are missing.
+func (db Connection) GetRevisionTokens(keys []string) (map[string]string, error) {
+	if len(keys) == 0 {
+		return map[string]string{}, nil
+	}
+
+	connection := db.inner().Conn()
+	defer connection.Close()
+
+	var rows []struct {
+		KeyData       string
+		RevisionToken string
+	}
+
+	if _, err := connection.Query(&rows, `
+		SELECT ik.key_data, i.revision_token
+		FROM efgs_imported_keys ik
+		JOIN efgs_batch_imports i USING (date, batch_tag, country, part)
+		WHERE ik.key_data IN (?) AND i.revision_token <> ''`, pg.In(keys)); err != nil {
+		return nil, err
+	}
+
+	tokens := make(map[string]string, len(rows))
+	for _, row := range rows {
+		tokens[row.KeyData] = row.RevisionToken
+	}
+
+	return tokens, nil
+}
+
+//GetDownloadedBatches Gets records of batches downloaded between dateFrom and dateTo (both inclusive), with their imports.
+func (db Connection) GetDownloadedBatches(dateFrom string, dateTo string) ([]*efgsapi.DownloadedBatchRecord, error) {
+	connection := db.inner().Conn()
+	defer connection.Close()
+
+	var batches []*efgsapi.DownloadedBatchRecord
+	if err := connection.Model(&batches).
+		Where("date >= ?", dateFrom).
+		Where("date <= ?", dateTo).
+		Order("date", "downloaded_at").
+		Select(); err != nil {
+		return nil, err
+	}
+
+	var imports []*efgsapi.BatchImportRecord
+	if err := connection.Model(&imports).
+		Where("date >= ?", dateFrom).
+		Where("date <= ?", dateTo).
+		Order("country", "part").
+		Select(); err != nil {
+		return nil, err
+	}
+
+	byBatch := make(map[string]*efgsapi.DownloadedBatchRecord)
+	for _, batch := range batches {
+		byBatch[batch.Date+"/"+batch.BatchTag] = batch
+	}
+
+	for _, record := range imports {
+		if batch, exists := byBatch[record.Date+"/"+record.BatchTag]; exists {
+			batch.Imports = append(batch.Imports, record)
 		}
 	}
 
-	return nil
+	return batches, nil
 }
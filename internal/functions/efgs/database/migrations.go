@@ -0,0 +1,299 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-pg/pg/v10"
+	"github.com/go-pg/pg/v10/orm"
+	"sort"
+	"time"
+)
+
+// migrationsLockID Key of the advisory lock held while a migration is applied, so concurrently starting instances
+// don't apply the same migration twice.
+const migrationsLockID = 7315028
+
+// migration Versioned change of the schema, applied in its own transaction. Down reverts Up; migration without Down
+// is irreversible. Migration with NoTransaction runs its statements one by one, outside a transaction, as some of
+// them can't run inside one (e.g. CREATE INDEX CONCURRENTLY); its statements must be safe to run again when it fails
+// in the middle.
+type migration struct {
+	Version       int
+	Description   string
+	Up            []string
+	Down          []string
+	NoTransaction bool
+}
+
+//MigrationStatus State of a migration of the schema in the database.
+type MigrationStatus struct {
+	Version     int
+	Description string
+	// AppliedAt When the migration was applied; nil when it wasn't.
+	AppliedAt *time.Time
+}
+
+// schemaMigrationRecord Applied migration, recorded in the database.
+type schemaMigrationRecord struct {
+	tableName   struct{}  `pg:"schema_migrations"`
+	Version     int       `pg:",pk"`
+	Description string    `pg:",notnull"`
+	AppliedAt   time.Time `pg:"default:now()"`
+}
+
+//Migrator Applies and inspects migrations of the EFGS database schema. Database never migrates the schema, it only
+//checks the schema was migrated to the version of the running code (see Check).
+type Migrator struct {
+	db         *pg.DB
+	migrations []migration
+}
+
+//NewMigrator Connects to the EFGS database by credentials in secret manager.
+func NewMigrator() *Migrator {
+	return &Migrator{db: connect(), migrations: schemaMigrations}
+}
+
+//Close Closes the connection.
+func (m *Migrator) Close() error {
+	return m.db.Close()
+}
+
+//LatestVersion Version of the last known migration.
+func (m *Migrator) LatestVersion() int {
+	return latestVersion(m.migrations)
+}
+
+//Status Gets all known migrations, with time they were applied at.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, len(m.migrations))
+	for i, migration := range m.migrations {
+		statuses[i] = MigrationStatus{Version: migration.Version, Description: migration.Description}
+		if record, found := applied[migration.Version]; found {
+			appliedAt := record.AppliedAt
+			statuses[i].AppliedAt = &appliedAt
+		}
+	}
+
+	return statuses, nil
+}
+
+//Check Fails when any known migration wasn't applied, e.g. when it wasn't applied before deploying the code or it was
+//reverted since. Migrations unknown to the running code (applied for a newer version of it) are fine.
+func (m *Migrator) Check(ctx context.Context) error {
+	applied, err := m.appliedRecords(ctx)
+	if err != nil {
+		return err
+	}
+
+	var missing []int
+	for _, migration := range pendingMigrations(m.migrations, applied, -1) {
+		missing = append(missing, migration.Version)
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("DB schema lacks migrations %v, expected version is %v", missing, m.LatestVersion())
+	}
+
+	return nil
+}
+
+//Migrate Applies migrations which weren't applied yet, up to the target version. Returns versions of the applied
+//migrations.
+func (m *Migrator) Migrate(ctx context.Context, target int) ([]int, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []int
+
+	for _, migration := range pendingMigrations(m.migrations, applied, target) {
+		done, err := m.apply(ctx, migration, true)
+		if err != nil {
+			return versions, fmt.Errorf("Migration %v (%v) has failed: %v", migration.Version, migration.Description, err)
+		}
+		if done {
+			versions = append(versions, migration.Version)
+		}
+	}
+
+	return versions, nil
+}
+
+//Rollback Reverts applied migrations above the target version, the last one first. Returns versions of the reverted
+//migrations. Nothing is reverted when any of them is irreversible.
+func (m *Migrator) Rollback(ctx context.Context, target int) ([]int, error) {
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reverted := revertedMigrations(m.migrations, applied, target)
+	if err := checkReversible(reverted); err != nil {
+		return nil, err
+	}
+
+	var versions []int
+
+	for _, migration := range reverted {
+		done, err := m.apply(ctx, migration, false)
+		if err != nil {
+			return versions, fmt.Errorf("Rollback of migration %v (%v) has failed: %v", migration.Version, migration.Description, err)
+		}
+		if done {
+			versions = append(versions, migration.Version)
+		}
+	}
+
+	return versions, nil
+}
+
+// applied Gets the applied migrations, by version; creates the table of migrations when missing.
+func (m *Migrator) applied(ctx context.Context) (map[int]*schemaMigrationRecord, error) {
+	if _, err := m.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS "schema_migrations" ("version" bigint, "description" text NOT NULL, "applied_at" timestamptz DEFAULT now(), PRIMARY KEY ("version"))`); err != nil {
+		return nil, fmt.Errorf("Could not create table of migrations: %v", err)
+	}
+
+	return m.appliedRecords(ctx)
+}
+
+// appliedRecords Gets the applied migrations, by version, from the existing table of migrations.
+func (m *Migrator) appliedRecords(ctx context.Context) (map[int]*schemaMigrationRecord, error) {
+	var records []*schemaMigrationRecord
+	if err := m.db.ModelContext(ctx, &records).Select(); err != nil {
+		return nil, fmt.Errorf("Could not get applied migrations: %v", err)
+	}
+
+	applied := make(map[int]*schemaMigrationRecord)
+	for _, record := range records {
+		applied[record.Version] = record
+	}
+
+	return applied, nil
+}
+
+// apply Applies (up) or reverts (down) the migration and records it. It's skipped when other instance has done it
+// in the meantime; returns whether it was done.
+func (m *Migrator) apply(ctx context.Context, migration migration, up bool) (bool, error) {
+	if migration.NoTransaction {
+		return m.applyWithoutTransaction(ctx, migration, up)
+	}
+
+	done := false
+
+	err := m.db.RunInTransaction(ctx, func(tx *pg.Tx) error {
+		if _, err := tx.Exec("SELECT pg_advisory_xact_lock(?)", migrationsLockID); err != nil {
+			return err
+		}
+
+		var err error
+		done, err = runMigration(tx, migration, up)
+		return err
+	})
+
+	return done, err
+}
+
+// applyWithoutTransaction Same as apply, for migration with NoTransaction. The lock is held by the session instead.
+func (m *Migrator) applyWithoutTransaction(ctx context.Context, migration migration, up bool) (bool, error) {
+	conn := m.db.Conn().WithContext(ctx)
+	defer conn.Close()
+
+	if _, err := conn.Exec("SELECT pg_advisory_lock(?)", migrationsLockID); err != nil {
+		return false, err
+	}
+	defer func() {
+		_, _ = conn.Exec("SELECT pg_advisory_unlock(?)", migrationsLockID)
+	}()
+
+	return runMigration(conn, migration, up)
+}
+
+// runMigration Runs statements of the migration and records it, unless it's already done. Returns whether it was done.
+func runMigration(db orm.DB, migration migration, up bool) (bool, error) {
+	applied, err := db.Model((*schemaMigrationRecord)(nil)).Where("version = ?", migration.Version).Exists()
+	if err != nil {
+		return false, err
+	}
+	if applied == up {
+		return false, nil
+	}
+
+	statements := migration.Down
+	if up {
+		statements = migration.Up
+	}
+
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			return false, err
+		}
+	}
+
+	if up {
+		_, err = db.Model(&schemaMigrationRecord{Version: migration.Version, Description: migration.Description}).Insert()
+	} else {
+		_, err = db.Model((*schemaMigrationRecord)(nil)).Where("version = ?", migration.Version).Delete()
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// pendingMigrations Migrations to apply to get to the target version, in order; negative target means the latest one.
+func pendingMigrations(migrations []migration, applied map[int]*schemaMigrationRecord, target int) []migration {
+	var pending []migration
+	for _, migration := range sortedMigrations(migrations) {
+		if _, found := applied[migration.Version]; !found && (target < 0 || migration.Version <= target) {
+			pending = append(pending, migration)
+		}
+	}
+	return pending
+}
+
+// revertedMigrations Migrations to revert to get back to the target version, the last one first.
+func revertedMigrations(migrations []migration, applied map[int]*schemaMigrationRecord, target int) []migration {
+	sorted := sortedMigrations(migrations)
+
+	var reverted []migration
+	for i := len(sorted) - 1; i >= 0; i-- {
+		if _, found := applied[sorted[i].Version]; found && sorted[i].Version > target {
+			reverted = append(reverted, sorted[i])
+		}
+	}
+	return reverted
+}
+
+// checkReversible Fails when any of the migrations is irreversible.
+func checkReversible(migrations []migration) error {
+	for _, migration := range migrations {
+		if len(migration.Down) == 0 {
+			return fmt.Errorf("Migration %v (%v) is irreversible", migration.Version, migration.Description)
+		}
+	}
+	return nil
+}
+
+func sortedMigrations(migrations []migration) []migration {
+	sorted := make([]migration, len(migrations))
+	copy(sorted, migrations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Version < sorted[j].Version })
+	return sorted
+}
+
+func latestVersion(migrations []migration) int {
+	latest := 0
+	for _, migration := range migrations {
+		if migration.Version > latest {
+			latest = migration.Version
+		}
+	}
+	return latest
+}
@@ -0,0 +1,82 @@
+package database
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSchemaMigrations(t *testing.T) {
+	for i, migration := range schemaMigrations {
+		if migration.Version != i+1 {
+			t.Errorf("Migration #%v has version %v, want %v", i, migration.Version, i+1)
+		}
+		if migration.Description == "" || len(migration.Up) == 0 {
+			t.Errorf("Migration %v lacks description or up: %+v", migration.Version, migration)
+		}
+		// only the baseline mustn't be reverted, it would drop the data
+		if (migration.Version == 1) != (len(migration.Down) == 0) {
+			t.Errorf("Migration %v has down %v", migration.Version, migration.Down)
+		}
+		for _, statement := range append(migration.Up, migration.Down...) {
+			// go-pg would take it for a parameter
+			if strings.Contains(statement, "?") {
+				t.Errorf("Migration %v contains '?': %v", migration.Version, statement)
+			}
+			// Postgres refuses it in a transaction
+			if strings.Contains(statement, "CONCURRENTLY") && !migration.NoTransaction {
+				t.Errorf("Migration %v runs in a transaction: %v", migration.Version, statement)
+			}
+		}
+	}
+
+	if latestVersion(schemaMigrations) != len(schemaMigrations) {
+		t.Errorf("latestVersion() = %v, want %v", latestVersion(schemaMigrations), len(schemaMigrations))
+	}
+}
+
+func TestMigrationsPlan(t *testing.T) {
+	migrations := []migration{{Version: 3}, {Version: 1}, {Version: 2}, {Version: 4}}
+
+	versions := func(migrations []migration) []int {
+		var result []int
+		for _, migration := range migrations {
+			result = append(result, migration.Version)
+		}
+		return result
+	}
+
+	applied := map[int]*schemaMigrationRecord{1: {Version: 1}, 2: {Version: 2}}
+
+	tests := []struct {
+		name string
+		got  []migration
+		want []int
+	}{
+		{name: "up to latest", got: pendingMigrations(migrations, applied, -1), want: []int{3, 4}},
+		{name: "up to version", got: pendingMigrations(migrations, applied, 3), want: []int{3}},
+		{name: "up to applied version", got: pendingMigrations(migrations, applied, 2), want: nil},
+		{name: "up on empty database", got: pendingMigrations(migrations, nil, -1), want: []int{1, 2, 3, 4}},
+		{name: "down to version", got: revertedMigrations(migrations, applied, 1), want: []int{2}},
+		{name: "down to nothing", got: revertedMigrations(migrations, applied, 0), want: []int{2, 1}},
+		{name: "down to later version", got: revertedMigrations(migrations, applied, 3), want: nil},
+	}
+
+	for _, tt := range tests {
+		if got := versions(tt.got); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIrreversibleBaseline(t *testing.T) {
+	applied := map[int]*schemaMigrationRecord{1: {Version: 1}, 2: {Version: 2}, 3: {Version: 3}}
+
+	if err := checkReversible(revertedMigrations(schemaMigrations, applied, 1)); err != nil {
+		t.Errorf("Rollback to baseline refused: %v", err)
+	}
+
+	if err := checkReversible(revertedMigrations(schemaMigrations, applied, 0)); err == nil {
+		t.Errorf("Rollback of baseline allowed")
+	}
+}
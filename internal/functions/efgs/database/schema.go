@@ -0,0 +1,37 @@
+package database
+
+// schemaMigrations Migrations of the EFGS database schema. New migration is appended with the next version; applied
+// migrations must never be changed, as they won't run again. The baseline has no Down, its tables hold the data.
+// Indexes of the big tables are built concurrently, so they don't block writes; this can't be done in a transaction.
+var schemaMigrations = []migration{
+	{
+		Version:     1,
+		Description: "baseline schema, as created before the migrations existed",
+		Up: []string{
+			`CREATE TABLE IF NOT EXISTS "diagnosis_keys" ("id" serial, "created_at" timestamptz DEFAULT now(), "key_data" text NOT NULL UNIQUE, "rolling_start_interval_number" bigint, "rolling_period" bigint, "transmission_risk_level" integer, "visited_countries" jsonb, "origin" text DEFAULT 'CZ', "report_type" integer, "days_since_onset_of_symptoms" integer, "retries" bigint DEFAULT 0, "is_uploaded" boolean NOT NULL DEFAULT False, "policy_version" text, PRIMARY KEY ("id"), UNIQUE ("key_data"))`,
+			`CREATE TABLE IF NOT EXISTS "efgs_downloaded_batches" ("date" text, "batch_tag" text, "next_batch_tag" text, "first" boolean, "keys_count" bigint, "quarantined" boolean, "downloaded_at" timestamptz DEFAULT now(), PRIMARY KEY ("date", "batch_tag"))`,
+			`CREATE TABLE IF NOT EXISTS "efgs_batch_imports" ("date" text, "batch_tag" text, "country" text, "part" bigserial, "keys_count" bigint, "test_type" text, "status" text NOT NULL, "error" text, "inserted" bigint, "rejected" bigint, "error_code" text, "attempts" bigint, "next_attempt_at" timestamptz, "revision_token" text, "payload" text, "enqueued_at" timestamptz DEFAULT now(), "updated_at" timestamptz DEFAULT now(), PRIMARY KEY ("date", "batch_tag", "country", "part"))`,
+			`CREATE TABLE IF NOT EXISTS "efgs_imported_keys" ("key_data" text, "date" text NOT NULL, "batch_tag" text NOT NULL, "country" text NOT NULL, "part" bigint, "imported_at" timestamptz DEFAULT now(), PRIMARY KEY ("key_data"))`,
+			// tables created by older versions lack these
+			`ALTER TABLE "diagnosis_keys" ADD COLUMN IF NOT EXISTS "policy_version" text`,
+			`ALTER TABLE "efgs_batch_imports" ADD COLUMN IF NOT EXISTS "test_type" text`,
+			`ALTER TABLE "efgs_batch_imports" ADD COLUMN IF NOT EXISTS "revision_token" text`,
+		},
+	},
+	{
+		Version:     2,
+		Description: "index keys by creation, for selecting keys to upload",
+		// an index left invalid by failed attempt is dropped first
+		Up:            []string{`DROP INDEX CONCURRENTLY IF EXISTS "diagnosis_keys_created_at_idx"`, `CREATE INDEX CONCURRENTLY "diagnosis_keys_created_at_idx" ON "diagnosis_keys" ("created_at")`},
+		Down:          []string{`DROP INDEX CONCURRENTLY IF EXISTS "diagnosis_keys_created_at_idx"`},
+		NoTransaction: true,
+	},
+	{
+		Version:     3,
+		Description: "index keys by upload state, for selecting keys to upload",
+		// an index left invalid by failed attempt is dropped first
+		Up:            []string{`DROP INDEX CONCURRENTLY IF EXISTS "diagnosis_keys_is_uploaded_idx"`, `CREATE INDEX CONCURRENTLY "diagnosis_keys_is_uploaded_idx" ON "diagnosis_keys" ("is_uploaded")`},
+		Down:          []string{`DROP INDEX CONCURRENTLY IF EXISTS "diagnosis_keys_is_uploaded_idx"`},
+		NoTransaction: true,
+	},
+}
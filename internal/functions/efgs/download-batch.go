@@ -3,7 +3,6 @@ package efgs
 import (
 	"context"
 	"encoding/json"
-	"firebase.google.com/go/db"
 	"fmt"
 	"github.com/covid19cz/erouska-backend/internal/constants"
 	"github.com/covid19cz/erouska-backend/internal/firebase/structs"
@@ -12,14 +11,14 @@ import (
 	efgsutils "github.com/covid19cz/erouska-backend/internal/functions/efgs/utils"
 	"github.com/covid19cz/erouska-backend/internal/logging"
 	"github.com/covid19cz/erouska-backend/internal/pubsub"
-	"github.com/covid19cz/erouska-backend/internal/realtimedb"
 	redisclient "github.com/go-redis/redis/v8"
 	keyserverapi "github.com/google/exposure-notifications-server/pkg/api/v1"
 	"github.com/stretchr/stew/slice"
+	"io"
 	"io/ioutil"
 	"net/http"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -68,6 +67,7 @@ func DownloadAndSaveYesterdaysKeys(w http.ResponseWriter, r *http.Request) {
 }
 
 //DownloadAndSaveYesterdaysKeysPostponed Continue in downloading yesterdays key, according to received batch params.
+//Whole day is downloaded in one run, so the download is postponed only when it fails.
 func DownloadAndSaveYesterdaysKeysPostponed(ctx context.Context, m pubsub.Message) error {
 	logger := logging.FromContext(ctx).Named("efgs.DownloadAndSaveYesterdaysKeysPostponed")
 
@@ -101,199 +101,284 @@ func DownloadAndSaveYesterdaysKeysPostponed(ctx context.Context, m pubsub.Messag
 }
 
 func downloadAndSaveKeys(ctx context.Context, config *downloadConfig, now time.Time) error {
-	logger := logging.FromContext(ctx).Named("efgs.downloadAndSaveKeys")
-
 	mutex, err := config.MutexManager.Lock(efgsconstants.MutexNameDownloadAndSaveKeys)
 	if err != nil {
 		return fmt.Errorf("Could not acquire '%v' mutex: %v", efgsconstants.MutexNameDownloadAndSaveKeys, err)
 	}
 	defer mutex.Unlock()
 
-	// Default params:
+	return downloadNextBatch(ctx, config, now)
+}
 
-	batchParams := efgsapi.BatchDownloadParams{
-		Date:     now.Format("2006-01-02"),
-		BatchTag: now.Format("20060102") + "-1",
-	}
+// downloadCursor Position in the chain of today's batches, kept in Redis between runs. JSON of the next batch is
+// compatible with BatchDownloadParams.
+type downloadCursor struct {
+	Date string `json:"date"`
+	// NextBatchTag Tag of the batch to be downloaded; empty means the first batch of the day unless LastBatchTag is set.
+	NextBatchTag string `json:"batchTag"`
+	// LastBatchTag Tag of the last downloaded batch, whose successor wasn't known at the time of download.
+	LastBatchTag string `json:"lastBatchTag,omitempty"`
+}
+
+// downloadNextBatch Downloads the batch the cursor points to and moves the cursor to its successor.
+func downloadNextBatch(ctx context.Context, config *downloadConfig, now time.Time) error {
+	logger := logging.FromContext(ctx).Named("efgs.downloadNextBatch")
 
-	// Load params for downloading:
+	today := now.Format("2006-01-02")
 
-	loadedBatchParams, err := loadBatchParams(config)
+	cursor, err := loadDownloadCursor(config)
 	if err != nil {
 		return err
 	}
 
-	if loadedBatchParams != nil {
-		if loadedBatchParams.Date == batchParams.Date {
-			logger.Debugf("Batch params found: %v", batchParams)
-			batchParams = *loadedBatchParams
-		} else {
-			logger.Debugf("Found batch params from another day, discarding and using the default: %v", batchParams)
+	switch {
+	case cursor == nil:
+		cursor = &downloadCursor{Date: today}
+		logger.Debugf("Download cursor not found, starting with the first batch of %v", today)
+	case cursor.Date != today:
+		logger.Debugf("Found download cursor from another day (%+v), starting with the first batch of %v", *cursor, today)
+		cursor = &downloadCursor{Date: today}
+	default:
+		logger.Debugf("Download cursor found: %+v", *cursor)
+	}
+
+	if cursor.NextBatchTag == "" && cursor.LastBatchTag != "" {
+		// the chain has ended last time; look whether it has been extended since then
+		last, err := downloadKeys(ctx, config, cursor.Date, cursor.LastBatchTag)
+		if err != nil {
+			logger.Debugf("Could not download batch from EFGS: %v", err)
+			return err
 		}
-	} else {
-		logger.Debugf("Batch params not found, using the default: %v", batchParams)
+
+		if last == nil || last.NextBatchTag == "" {
+			logger.Debugf("No batch after '%v' yet", cursor.LastBatchTag)
+			return nil
+		}
+
+		cursor.NextBatchTag = last.NextBatchTag
 	}
 
 	// Download keys:
 
-	keys, err := downloadKeys(ctx, config, batchParams.Date, batchParams.BatchTag)
+	batch, err := downloadVerifiedKeys(ctx, config, cursor.Date, cursor.NextBatchTag)
 	if err != nil {
 		logger.Debugf("Could not download batch from EFGS: %v", err)
 		return err
 	}
 
-	if keys == nil {
-		logger.Debugf("Batch %v doesn't exist yet", batchParams.BatchTag)
+	if batch == nil {
+		logger.Debugf("Batch '%v' doesn't exist yet", cursor.NextBatchTag)
 		return nil
 	}
 
-	// The batch was found, yet it still may be empty.
-	// Enqueue downloaded keys, if any:
+	// The batch was found, yet it still may be empty or already imported when it was announced by callback.
+	// Record it and enqueue downloaded keys, if any:
 
-	keysCount := len(keys)
+	recorded, err := isDownloadedBatch(ctx, config, cursor.Date, cursor.NextBatchTag, batch.BatchTag)
+	if err != nil {
+		return err
+	}
 
-	if keysCount > 0 {
-		logger.Infof("Successfully downloaded %v keys from EFGS, going to enqueue them", keysCount)
+	if !recorded {
+		keysCount := len(batch.Keys)
+
+		if keysCount > 0 {
+			logger.Infof("Successfully downloaded %v keys from EFGS, going to enqueue them", keysCount)
+		}
 
-		if _, err = enqueueForImport(ctx, config, keys); err != nil {
+		czKeys, err := importDownloadedBatch(ctx, config, now, cursor.Date, cursor.NextBatchTag, batch)
+		if err != nil {
 			logger.Debugf("Could not enqueue batch from EFGS for import: %v", err)
 			return err
 		}
 
-		logger.Infof("Successfully enqueued %v downloaded keys for import to our Key server", keysCount)
+		if keysCount > 0 {
+			logger.Infof("Successfully enqueued %v downloaded keys for import to our Key server", keysCount)
+
+			if err := updateDownloadedCounters(ctx, config, now, cursor.Date, batch.BatchTag, czKeys, keysCount); err != nil {
+				logger.Warnf("Could not update EFGS download counters: %v", err)
+			}
+		}
+	}
+
+	// Save cursor for next run:
+
+	cursor = &downloadCursor{Date: cursor.Date, NextBatchTag: batch.NextBatchTag}
+	if batch.NextBatchTag == "" {
+		cursor.LastBatchTag = batch.BatchTag
 	}
 
-	// Save params for next run:
+	logger.Debugf("Next download cursor will be: %+v", *cursor)
 
-	nextBatch := nextBatchParams(ctx, now, batchParams)
-	logger.Debugf("Next batch will be: %+v", nextBatch)
-	bytes, err := json.Marshal(nextBatch)
+	bytes, err := json.Marshal(cursor)
 	if err != nil {
 		return err
 	}
 
 	if err = config.RedisClient.Set(efgsconstants.RedisKeyNextBatch, string(bytes), 0); err != nil {
-		logger.Errorf("Could not save next batch params to Redis: %+v", err)
+		logger.Errorf("Could not save download cursor to Redis: %+v", err)
 		return err
 	}
 
 	return nil
 }
 
+// downloadAllRecursively Downloads all available keys, following the chain of batches starting with batch in
+// `nextBatch`. The chain is walked sequentially as the tag of the next batch comes in response headers; bodies of the
+// batches are read, verified and enqueued for import by a bounded pool of workers, so there's at most
+// DownloadConcurrency batches in memory at once.
 func downloadAllRecursively(ctx context.Context, config *downloadConfig, now time.Time, nextBatch efgsapi.BatchDownloadParams) error {
 	logger := logging.FromContext(ctx).Named("efgs.downloadAllRecursively")
 
-	var keys []efgsapi.DiagnosisKey
-	var batchToPostpone *efgsapi.BatchDownloadParams
+	downloadCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	moreKeysAvailable := true
+	var mutex sync.Mutex
+	var firstErr error
+	keysCount := 0
 
-	// Download all available keys, starting with batch in `nextBatch`
+	fail := func(err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
 
-	for moreKeysAvailable {
-		moreKeys, err := downloadKeys(ctx, config, nextBatch.Date, nextBatch.BatchTag)
-		if err != nil {
-			return err
+		if firstErr == nil {
+			firstErr = err
+			cancel() // stops the walking as well as the other workers
 		}
+	}
 
-		moreKeysAvailable = moreKeys != nil
+	workers := config.DownloadConcurrency
+	if workers < 1 {
+		workers = 1
+	}
 
-		// This ends once
-		if moreKeysAvailable {
-			keys = append(keys, moreKeys...)
-			nextBatch = nextBatchParams(ctx, now, nextBatch)
-		} else {
-			logger.Infof("Batch %v doesn't exist, stopping", nextBatch.BatchTag)
-			break
-		}
+	pending := make(chan *pendingBatch)
+	var wg sync.WaitGroup
 
-		if len(keys) >= config.MaxDownloadYesterdaysKeysPartSize {
-			// There's too much of keys; let's process only part and prevent timeout.
-			logger.Infof("There's too much of keys, about to postpone processing of the rest")
-			batchToPostpone = &nextBatch
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
 
-			// now break the downloading and enqueue what we've got so far
-			break
-		}
-	}
+		go func() {
+			defer wg.Done()
 
-	// Enqueue downloaded keys:
+			for response := range pending {
+				if downloadCtx.Err() != nil {
+					_ = response.Body.Close()
+					continue
+				}
 
-	keysCount := len(keys)
+				batchKeys, batchCzKeys, err := processPendingBatch(downloadCtx, config, now, response)
+				if err != nil {
+					logger.Errorf("Could not process batch '%v' from EFGS: %v", response.BatchTag, err)
+					fail(err)
+					continue
+				}
 
-	if keysCount > 0 {
-		logger.Infof("Successfully downloaded %v keys from EFGS, going to enqueue them", keysCount)
+				mutex.Lock()
+				keysCount += batchKeys
+				mutex.Unlock()
 
-		czKeys, err := enqueueForImport(ctx, config, keys)
+				if batchKeys > 0 {
+					if err := updateDownloadedCounters(ctx, config, now, response.Date, response.BatchTag, batchCzKeys, batchKeys); err != nil {
+						logger.Warnf("Could not update EFGS download counters: %v", err)
+					}
+				}
+			}
+		}()
+	}
 
+	for downloadCtx.Err() == nil {
+		response, err := requestBatch(downloadCtx, config, nextBatch.Date, nextBatch.BatchTag)
 		if err != nil {
-			logger.Errorf("Could not download batch from EFGS: %v", err)
-			return err
+			if downloadCtx.Err() == nil {
+				fail(err)
+			}
+			break
 		}
 
-		logger.Infof("Successfully enqueued %v downloaded keys for import to our Key server", keysCount)
+		if response == nil {
+			logger.Infof("Batch '%v' doesn't exist, stopping", nextBatch.BatchTag)
+			break
+		}
+
+		pending <- response
 
-		if err := updateDownloadedCounters(ctx, config, now, czKeys, keysCount); err != nil {
-			logger.Warnf("Could not update EFGS download counters: %v", err)
+		if response.NextBatchTag == "" {
+			logger.Infof("Batch '%v' is the last one, stopping", response.BatchTag)
+			break
 		}
+
+		nextBatch = efgsapi.BatchDownloadParams{Date: nextBatch.Date, BatchTag: response.NextBatchTag}
 	}
 
-	if batchToPostpone != nil {
-		if err := postponeRest(ctx, config, *batchToPostpone); err != nil {
-			logger.Warnf("Could not postpone processing of the rest: %v", err)
-			return err
-		}
+	close(pending)
+	wg.Wait()
+
+	if keysCount > 0 {
+		logger.Infof("Successfully enqueued %v downloaded keys for import to our Key server", keysCount)
 	}
 
-	return nil
+	return firstErr
 }
 
-func nextBatchParams(ctx context.Context, now time.Time, last efgsapi.BatchDownloadParams) efgsapi.BatchDownloadParams {
-	logger := logging.FromContext(ctx).Named("efgs.nextBatchParams")
-
-	today := now.Format("2006-01-02")
-	batchTagPrefix := now.Format("20060102")
+// processPendingBatch Reads and verifies the batch and enqueues its keys for import. Returns count of all keys and of
+// keys imported as CZ ones.
+func processPendingBatch(ctx context.Context, config *downloadConfig, now time.Time, response *pendingBatch) (int, int, error) {
+	recorded, err := isDownloadedBatch(ctx, config, response.Date, response.RequestedTag, response.BatchTag)
+	if err != nil || recorded {
+		_ = response.Body.Close()
+		return 0, 0, err
+	}
 
-	var nextBatchTag string
+	batch, err := readBatch(ctx, response)
+	if err != nil {
+		return 0, 0, err
+	}
 
-	if last.Date == today && last.BatchTag != "" {
-		parts := strings.Split(last.BatchTag, "-")
-		nextID, err := strconv.Atoi(parts[1])
-		if err != nil {
-			msg := fmt.Sprintf("Unexpected format of EFGS batch tag: '%v'", last.BatchTag)
-			logger.Error(msg)
-			panic(msg)
-		}
-		nextBatchTag = fmt.Sprintf("%v-%v", batchTagPrefix, nextID+1)
-	} else {
-		nextBatchTag = batchTagPrefix + "-2" // '2' because '1' is what one gets without explicit tag
+	if batch, err = verifyDownloadedBatch(ctx, config, response.Date, batch); err != nil {
+		return 0, 0, err
 	}
 
-	return efgsapi.BatchDownloadParams{
-		Date:     today,
-		BatchTag: nextBatchTag,
+	czKeys, err := importDownloadedBatch(ctx, config, now, response.Date, response.RequestedTag, batch)
+	if err != nil {
+		return 0, 0, err
 	}
+
+	return len(batch.Keys), czKeys, nil
 }
 
-func enqueueForImport(ctx context.Context, config *downloadConfig, keys []efgsapi.DiagnosisKey) (int, error) {
+// importedTestTypes Test types of imported keys, in order of their imports; revocations go last.
+var importedTestTypes = []string{efgsapi.TestTypeConfirmed, efgsapi.TestTypeLikely, efgsapi.TestTypeNegative}
+
+func enqueueForImport(ctx context.Context, config *downloadConfig, enqueuedAt time.Time, batch efgsapi.BatchDownloadParams, keys []efgsapi.DiagnosisKey) (int, error) {
 	logger := logging.FromContext(ctx).Named("efgs.enqueueForImport")
 
 	now := time.Now().Add(30 - time.Minute)
 
 	logger.Debugf("About to sort downloaded keys")
 
-	sortedKeys := make(map[string][]keyserverapi.ExposureKey)
+	// keys by country and test type; the Key server doesn't take report type of the key, it's given by the certificate
+	sortedKeys := make(map[string]map[string][]keyserverapi.ExposureKey)
 
 	skippedKeys := 0
+	unsupportedKeys := 0
 	importedAsCZ := 0
 
-	for _, key := range keys {
+	for i := range keys {
+		key := &keys[i]
+
 		// filter out keys that are too old
 		if !isRecent(key.RollingStartIntervalNumber, key.RollingPeriod, now, config.MaxIntervalAge) {
 			skippedKeys++
 			continue
 		}
 
+		testType, supported := efgsapi.TestTypeOf(key.ReportType)
+		if !supported {
+			unsupportedKeys++
+			continue
+		}
+
 		var dest string
 
 		// Import keys that relates to us as our own keys (#171)
@@ -306,45 +391,105 @@ func enqueueForImport(ctx context.Context, config *downloadConfig, keys []efgsap
 		}
 
 		mapKey := strings.ToUpper(dest)
-		sortedKeys[mapKey] = append(sortedKeys[mapKey], key.ToExposureKey())
+		if sortedKeys[mapKey] == nil {
+			sortedKeys[mapKey] = make(map[string][]keyserverapi.ExposureKey)
+		}
+		sortedKeys[mapKey][testType] = append(sortedKeys[mapKey][testType], key.ToExposureKey())
 	}
 
-	logger.Debugf("Sorted keys into %v groups (countries), %v keys skipped", len(sortedKeys), skippedKeys)
+	logger.Debugf("Sorted keys into %v groups (countries), %v keys skipped, %v keys of unsupported report type skipped", len(sortedKeys), skippedKeys, unsupportedKeys)
 
 	var errors []string
-	batchesCount := 0
+	var imports []*efgsapi.BatchImportRecord
+	var importParams []efgsapi.BatchImportParams
 
-	for country, countryKeys := range sortedKeys {
+	for country, keysByTestType := range sortedKeys {
 		haid, exists := config.HaidMappings[strings.ToLower(country)]
 		if !exists {
-			errors = append(errors, fmt.Sprintf("Keys from %v were provided but HAID mapping doesn't exist!", country))
+			countryKeysCount := 0
+			for _, testTypeKeys := range keysByTestType {
+				countryKeysCount += len(testTypeKeys)
+			}
+
+			msg := fmt.Sprintf("Keys from %v were provided but HAID mapping doesn't exist!", country)
+			errors = append(errors, msg)
+			imports = append(imports, &efgsapi.BatchImportRecord{
+				Date:       batch.Date,
+				BatchTag:   batch.BatchTag,
+				Country:    country,
+				KeysCount:  countryKeysCount,
+				Status:     efgsapi.ImportStatusFailed,
+				Error:      msg,
+				EnqueuedAt: enqueuedAt,
+				UpdatedAt:  enqueuedAt,
+			})
 			continue
 		}
 
-		batches := splitKeys(countryKeys, config.MaxKeysOnPublish, config.MaxSameStartIntervalKeys)
+		// parts are numbered across test types, in fixed order, so replayed batch gets the same import IDs
+		part := 0
 
-		logger.Infof("Enqueuing %v keys from %v for import in %v batches with HAID %v", len(countryKeys), country, len(batches), haid)
+		for _, testType := range importedTestTypes {
+			countryKeys := keysByTestType[testType]
+			if len(countryKeys) == 0 {
+				continue
+			}
 
-		for _, batch := range batches {
-			batchParams := efgsapi.BatchImportParams{
-				HAID: haid,
-				Keys: batch,
+			batches := splitKeys(countryKeys, config.MaxKeysOnPublish, config.MaxSameStartIntervalKeys)
+
+			logger.Infof("Enqueuing %v %v keys from %v for import in %v batches with HAID %v", len(countryKeys), testType, country, len(batches), haid)
+
+			for _, keysPart := range batches {
+				importParams = append(importParams, efgsapi.BatchImportParams{
+					ID:       efgsapi.ImportID(batch.Date, batch.BatchTag, country, part),
+					HAID:     haid,
+					Keys:     keysPart,
+					Date:     batch.Date,
+					BatchTag: batch.BatchTag,
+					Country:  country,
+					Part:     part,
+					TestType: testType,
+				})
+				imports = append(imports, &efgsapi.BatchImportRecord{
+					Date:       batch.Date,
+					BatchTag:   batch.BatchTag,
+					Country:    country,
+					Part:       part,
+					KeysCount:  len(keysPart),
+					TestType:   testType,
+					Status:     efgsapi.ImportStatusEnqueued,
+					EnqueuedAt: enqueuedAt,
+					UpdatedAt:  enqueuedAt,
+				})
+				part++
 			}
+		}
+	}
 
-			logger.Debugf("Enqueuing batch of %v keys from %v for import", len(batch), country)
+	// the imports must be recorded before they're enqueued, so the result of the import can't be overwritten
+	if err := config.Ledger.SaveBatchImports(imports); err != nil {
+		logger.Errorf("Could not save imports of batch '%v' to download ledger: %v", batch.BatchTag, err)
+		return 0, err
+	}
 
-			if err := config.PubSubClient.Publish(efgsconstants.TopicNameImportKeys, batchParams); err != nil {
-				msg := fmt.Sprintf("Error while enqueuing keys from %v: %+v", country, err)
-				logger.Warn(msg)
-				errors = append(errors, msg)
-				continue
-			}
+	batchesCount := 0
 
-			batchesCount++
+	for _, batchParams := range importParams {
+		logger.Debugf("Enqueuing batch of %v keys from %v for import", len(batchParams.Keys), batchParams.Country)
 
-			if efgsutils.EfgsExtendedLogging {
-				logger.Debugf("Enqueued batch: %+v", batchParams)
-			}
+		if err := config.PubSubClient.Publish(efgsconstants.TopicNameImportKeys, batchParams); err != nil {
+			msg := fmt.Sprintf("Error while enqueuing keys from %v: %+v", batchParams.Country, err)
+			logger.Warn(msg)
+			errors = append(errors, msg)
+
+			recordEnqueueFailure(ctx, config.Ledger, enqueuedAt, &batchParams, err)
+			continue
+		}
+
+		batchesCount++
+
+		if efgsutils.EfgsExtendedLogging {
+			logger.Debugf("Enqueued batch: %+v", batchParams)
 		}
 	}
 
@@ -357,12 +502,34 @@ func enqueueForImport(ctx context.Context, config *downloadConfig, keys []efgsap
 	return importedAsCZ, nil
 }
 
-func downloadKeys(ctx context.Context, config *downloadConfig, date string, batchTag string) ([]efgsapi.DiagnosisKey, error) {
-	logger := logging.FromContext(ctx).Named("efgs.downloadBatchByTag")
+func downloadKeys(ctx context.Context, config *downloadConfig, date string, batchTag string) (*efgsapi.DownloadedBatch, error) {
+	response, err := requestBatch(ctx, config, date, batchTag)
+	if err != nil || response == nil {
+		return nil, err
+	}
+
+	return readBatch(ctx, response)
+}
+
+// pendingBatch Response to batch download whose headers were received but whose body wasn't read yet. The body must
+// be closed, usually by readBatch.
+type pendingBatch struct {
+	Date         string
+	RequestedTag string
+	BatchTag     string
+	NextBatchTag string
+	ContentType  string
+	Body         io.ReadCloser
+}
+
+// requestBatch Requests the batch from EFGS, returning as soon as the response headers (with the tag of the next batch)
+// are received. Returns nil when the batch doesn't exist.
+func requestBatch(ctx context.Context, config *downloadConfig, date string, batchTag string) (*pendingBatch, error) {
+	logger := logging.FromContext(ctx).Named("efgs.requestBatch")
 
 	logger.Infof("About to download batch with tag '%v' for date %v!", batchTag, date)
 
-	url := config.URL
+	url := *config.URL
 	url.Path = "diagnosiskeys/download/" + date
 
 	req, err := http.NewRequest("GET", url.String(), nil)
@@ -371,7 +538,14 @@ func downloadKeys(ctx context.Context, config *downloadConfig, date string, batc
 		return nil, err
 	}
 
-	req.Header.Set("Accept", "application/json; version=1.0")
+	req = req.WithContext(ctx)
+
+	if config.DownloadProtobuf {
+		req.Header.Set("Accept", contentTypeProtobuf)
+	} else {
+		req.Header.Set("Accept", contentTypeJSON)
+	}
+
 	if batchTag != "" {
 		req.Header.Set("batchTag", batchTag)
 	}
@@ -402,40 +576,76 @@ func downloadKeys(ctx context.Context, config *downloadConfig, date string, batc
 		return nil, err
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	if resp.StatusCode != 200 {
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := resp.Body.Close(); err != nil {
+			return nil, err
+		}
+
+		if resp.StatusCode == 404 {
+			logger.Debugf("EFGS batch with tag '%v' doesn't exist", batchTag)
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("HTTP %v: %v", resp.StatusCode, string(body))
 	}
 
-	if err := resp.Body.Close(); err != nil {
-		return nil, err
+	response := &pendingBatch{
+		Date:         date,
+		RequestedTag: batchTag,
+		BatchTag:     resp.Header.Get("batchTag"),
+		NextBatchTag: resp.Header.Get("nextBatchTag"),
+		ContentType:  resp.Header.Get("Content-Type"),
+		Body:         resp.Body,
 	}
 
-	if resp.StatusCode == 404 {
-		logger.Debugf("EFGS batch with tag '%v' doesn't exist", batchTag)
-		return nil, nil
+	if response.BatchTag == "" {
+		response.BatchTag = batchTag
 	}
 
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("HTTP %v: %v", resp.StatusCode, string(body))
+	if response.NextBatchTag == "null" {
+		response.NextBatchTag = ""
 	}
 
-	var batchResponse efgsapi.DownloadBatchResponse
+	return response, nil
+}
+
+// readBatch Decodes keys from the body of the response as they're received, closing the body.
+func readBatch(ctx context.Context, response *pendingBatch) (*efgsapi.DownloadedBatch, error) {
+	logger := logging.FromContext(ctx).Named("efgs.readBatch")
 
-	if err = json.Unmarshal(body, &batchResponse); err != nil {
-		logger.Debugf("Download response parsing error: %v, body: %v", err, string(body))
+	keys, err := decodeKeys(response.ContentType, response.Body)
+	if err != nil {
+		_ = response.Body.Close()
+		logger.Debugf("Download response parsing error: %v, content type: %v", err, response.ContentType)
 		return nil, err
 	}
 
-	if batchResponse.Keys == nil {
-		logger.Debugf("No keys returned from EFGS for date %v and batchTag '%v', it's probably our own batch", date, batchTag)
-		batchResponse.Keys = []efgsapi.DiagnosisKey{}
+	if err := response.Body.Close(); err != nil {
+		return nil, err
+	}
+
+	if keys == nil {
+		logger.Debugf("No keys returned from EFGS for date %v and batchTag '%v', it's probably our own batch", response.Date, response.BatchTag)
+		keys = []efgsapi.DiagnosisKey{}
 	}
 
-	return batchResponse.Keys, nil
+	batch := &efgsapi.DownloadedBatch{
+		BatchTag:     response.BatchTag,
+		NextBatchTag: response.NextBatchTag,
+		Keys:         keys,
+	}
+
+	logger.Debugf("Downloaded batch '%v' with %v keys, next batch is '%v'", batch.BatchTag, len(batch.Keys), batch.NextBatchTag)
+
+	return batch, nil
 }
 
-func loadBatchParams(config *downloadConfig) (*efgsapi.BatchDownloadParams, error) {
+func loadDownloadCursor(config *downloadConfig) (*downloadCursor, error) {
 	val, err := config.RedisClient.Get(efgsconstants.RedisKeyNextBatch)
 	if err != nil {
 		if err == redisclient.Nil {
@@ -447,12 +657,12 @@ func loadBatchParams(config *downloadConfig) (*efgsapi.BatchDownloadParams, erro
 
 	// Something found!
 
-	var savedBatchParams efgsapi.BatchDownloadParams
-	if err := json.Unmarshal([]byte(val), &savedBatchParams); err != nil {
-		return nil, fmt.Errorf("Could not unmarshall saved batch params: %+v", err)
+	var cursor downloadCursor
+	if err := json.Unmarshal([]byte(val), &cursor); err != nil {
+		return nil, fmt.Errorf("Could not unmarshall saved download cursor: %+v", err)
 	}
 
-	return &savedBatchParams, nil
+	return &cursor, nil
 }
 
 func postponeRest(ctx context.Context, config *downloadConfig, nextBatch efgsapi.BatchDownloadParams) error {
@@ -468,51 +678,18 @@ func postponeRest(ctx context.Context, config *downloadConfig, nextBatch efgsapi
 	return nil
 }
 
-func updateDownloadedCounters(ctx context.Context, config *downloadConfig, now time.Time, czKeys int, totalKeys int) error {
+func updateDownloadedCounters(ctx context.Context, config *downloadConfig, now time.Time, date string, batchTag string, czKeys int, totalKeys int) error {
 	logger := logging.FromContext(ctx).Named("efgs.download-batch.updateDownloadedCounters")
 
-	var date = now.Format("20060102")
+	// every batch is counted once, even when it's processed again by a retry or continuation of the download
+	eventID := fmt.Sprintf("download-%v-%v", date, batchTag)
+	delta := structs.EfgsCounter{KeysDownloaded: totalKeys, KeysImportedCZ: czKeys}
 
-	// update daily counter
-	if err := updateDownloadedCounter(ctx, config.RealtimeDBClient, constants.DbEfgsCountersPrefix+date, increaseCounter(czKeys, totalKeys)); err != nil {
-		logger.Warnf("Cannot increase EFGS counter due to unknown error: %+v", err.Error())
-		return err
-	}
-
-	// update total counter
-	if err := updateDownloadedCounter(ctx, config.RealtimeDBClient, constants.DbEfgsCountersPrefix+"total", increaseCounter(czKeys, totalKeys)); err != nil {
+	// update daily and total counter
+	if err := config.CountersClient.Increment(ctx, constants.CounterEfgs, eventID, now, delta); err != nil {
 		logger.Warnf("Cannot increase EFGS counter due to unknown error: %+v", err.Error())
 		return err
 	}
 
 	return nil
 }
-
-func updateDownloadedCounter(ctx context.Context, client *realtimedb.Client, dbKey string, modifyFn func(structs.EfgsCounter) structs.EfgsCounter) error {
-	logger := logging.FromContext(ctx).Named("efgs.download-batch.updateDownloadedCounter")
-
-	return client.RunTransaction(ctx, dbKey, func(tn db.TransactionNode) (interface{}, error) {
-		var state structs.EfgsCounter
-
-		if err := tn.Unmarshal(&state); err != nil {
-			return nil, err
-		}
-
-		logger.Debugf("Found counter state, dbKey %v: %+v", dbKey, state)
-
-		state = modifyFn(state)
-
-		logger.Debugf("Saving updated counter state, dbKey %v: %+v", dbKey, state)
-
-		return state, nil
-	})
-}
-
-func increaseCounter(czKeys int, totalKeys int) func(structs.EfgsCounter) structs.EfgsCounter {
-	return func(state structs.EfgsCounter) structs.EfgsCounter {
-		state.KeysDownloaded += totalKeys
-		state.KeysImportedCZ += czKeys
-
-		return state
-	}
-}
@@ -0,0 +1,173 @@
+package efgs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	efgsapi "github.com/covid19cz/erouska-backend/internal/functions/efgs/api"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	contentTypeJSON     = "application/json; version=1.0"
+	contentTypeProtobuf = "application/protobuf; version=1.0"
+)
+
+// maxEncodedKeySize Limit of size of single encoded key; a proper key has less than 100 bytes.
+const maxEncodedKeySize = 64 * 1024
+
+// decodeKeys Decodes keys of downloaded batch, according to its content type. The body is decoded key by key, so it's
+// never held in memory as a whole.
+func decodeKeys(contentType string, body io.Reader) ([]efgsapi.DiagnosisKey, error) {
+	if strings.HasPrefix(contentType, "application/protobuf") {
+		return decodeProtobufKeys(body)
+	}
+
+	return decodeJSONKeys(body)
+}
+
+// decodeJSONKeys Decodes keys from the `keys` array of JSON object; other fields are skipped.
+func decodeJSONKeys(body io.Reader) ([]efgsapi.DiagnosisKey, error) {
+	decoder := json.NewDecoder(body)
+
+	if err := expectDelim(decoder, '{'); err != nil {
+		return nil, err
+	}
+
+	var keys []efgsapi.DiagnosisKey
+
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		if token != "keys" {
+			var skipped json.RawMessage
+			if err = decoder.Decode(&skipped); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		token, err = decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		if token == nil {
+			continue // "keys": null
+		}
+
+		if delim, ok := token.(json.Delim); !ok || delim != '[' {
+			return nil, fmt.Errorf("Invalid batch: keys are not an array but %v", token)
+		}
+
+		for decoder.More() {
+			keys = append(keys, efgsapi.DiagnosisKey{})
+			if err = decoder.Decode(&keys[len(keys)-1]); err != nil {
+				return nil, fmt.Errorf("Invalid key %v: %v", len(keys)-1, err)
+			}
+		}
+
+		if err = expectDelim(decoder, ']'); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := expectDelim(decoder, '}'); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func expectDelim(decoder *json.Decoder, expected json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+
+	if delim, ok := token.(json.Delim); !ok || delim != expected {
+		return fmt.Errorf("Invalid batch: expected '%v', got %v", expected, token)
+	}
+
+	return nil
+}
+
+// decodeProtobufKeys Decodes keys from serialized DiagnosisKeyBatch. The keys are read from the wire format one by one,
+// unknown fields are skipped.
+func decodeProtobufKeys(body io.Reader) ([]efgsapi.DiagnosisKey, error) {
+	reader := bufio.NewReader(body)
+
+	var keys []efgsapi.DiagnosisKey
+	var buffer []byte
+
+	for {
+		tag, err := binary.ReadUvarint(reader)
+		if err == io.EOF {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		number, wireType := protowire.DecodeTag(tag)
+
+		var size uint64
+
+		switch wireType {
+		case protowire.VarintType:
+			_, err = binary.ReadUvarint(reader)
+		case protowire.Fixed32Type:
+			size = 4
+		case protowire.Fixed64Type:
+			size = 8
+		case protowire.BytesType:
+			size, err = binary.ReadUvarint(reader)
+		default:
+			return nil, fmt.Errorf("Invalid batch: unsupported wire type %v of field %v", wireType, number)
+		}
+
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+
+		if number != 1 || wireType != protowire.BytesType {
+			if _, err = io.CopyN(ioutil.Discard, reader, int64(size)); err != nil {
+				return nil, unexpectedEOF(err)
+			}
+			continue
+		}
+
+		if size > maxEncodedKeySize {
+			return nil, fmt.Errorf("Invalid batch: key %v has %v bytes", len(keys), size)
+		}
+
+		if uint64(cap(buffer)) < size {
+			buffer = make([]byte, size)
+		}
+		buffer = buffer[:size]
+
+		if _, err = io.ReadFull(reader, buffer); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+
+		keys = append(keys, efgsapi.DiagnosisKey{})
+		if err = proto.Unmarshal(buffer, &keys[len(keys)-1]); err != nil {
+			return nil, fmt.Errorf("Invalid key %v: %v", len(keys)-1, err)
+		}
+	}
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
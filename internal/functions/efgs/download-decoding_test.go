@@ -0,0 +1,79 @@
+package efgs
+
+import (
+	"bytes"
+	"encoding/json"
+	efgsapi "github.com/covid19cz/erouska-backend/internal/functions/efgs/api"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeKeys(t *testing.T) {
+	keys := newSimulatorKeys("DE", 0, 50, time.Now())
+
+	jsonBody, err := json.Marshal(map[string]interface{}{"batchTag": "20201210-1", "keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	protobufBody, err := proto.Marshal(&efgsapi.DiagnosisKeyBatch{Keys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// unknown fields of the batch are skipped
+	protobufBody = protowire.AppendTag(protobufBody, 2, protowire.BytesType)
+	protobufBody = protowire.AppendBytes(protobufBody, []byte("unknown"))
+	protobufBody = protowire.AppendTag(protobufBody, 3, protowire.VarintType)
+	protobufBody = protowire.AppendVarint(protobufBody, 42)
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		wantKeys    int
+		wantErr     bool
+	}{
+		{name: "JSON", contentType: contentTypeJSON, body: jsonBody, wantKeys: 50},
+		{name: "protobuf", contentType: contentTypeProtobuf, body: protobufBody, wantKeys: 50},
+		{name: "JSON string report type", contentType: contentTypeJSON, body: []byte(`{"keys":[{"keyData":"AQI=","origin":"DE","reportType":"CONFIRMED_TEST"}]}`), wantKeys: 1},
+		{name: "JSON null keys", contentType: contentTypeJSON, body: []byte(`{"keys":null}`), wantKeys: 0},
+		{name: "JSON empty", contentType: contentTypeJSON, body: []byte(`{}`), wantKeys: 0},
+		{name: "protobuf empty", contentType: contentTypeProtobuf, body: []byte{}, wantKeys: 0},
+		{name: "JSON truncated", contentType: contentTypeJSON, body: jsonBody[:len(jsonBody)/2], wantErr: true},
+		{name: "JSON keys not array", contentType: contentTypeJSON, body: []byte(`{"keys":{}}`), wantErr: true},
+		{name: "protobuf truncated", contentType: contentTypeProtobuf, body: protobufBody[:len(protobufBody)/2], wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decoded, err := decodeKeys(tt.contentType, bytes.NewReader(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("decodeKeys() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			if len(decoded) != tt.wantKeys {
+				t.Fatalf("decodeKeys() = %v keys, want %v", len(decoded), tt.wantKeys)
+			}
+
+			if tt.wantKeys != len(keys) {
+				return
+			}
+
+			for i := range decoded {
+				key := &decoded[i]
+				if !bytes.Equal(key.KeyData, keys[i].KeyData) || key.RollingStartIntervalNumber != keys[i].RollingStartIntervalNumber ||
+					key.Origin != keys[i].Origin || key.ReportType != keys[i].ReportType || strings.Join(key.VisitedCountries, ",") != "DE,AT" {
+					t.Fatalf("decodeKeys() key %v = %v, want %v", i, key, keys[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package efgstest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	b64 "encoding/base64"
+	"encoding/binary"
+	"encoding/pem"
+	efgsapi "github.com/covid19cz/erouska-backend/internal/functions/efgs/api"
+	efgsutils "github.com/covid19cz/erouska-backend/internal/functions/efgs/utils"
+	"go.mozilla.org/pkcs7"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+//KeyPair Self-signed certificate with its private key, usable as NBTLS or NBBS pair of a national backend.
+type KeyPair struct {
+	Certificate *x509.Certificate
+	PrivateKey  *ecdsa.PrivateKey
+	// PEM Certificate and PKCS#8 private key in the form loaded from Secrets Manager.
+	PEM *efgsutils.X509KeyPair
+}
+
+//NewKeyPair Creates self-signed certificate valid for one year for given country.
+func NewKeyPair(commonName string, country string) (*KeyPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(now.UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName, Country: []string{country}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(1, 0, 0),
+	}
+
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	rawKey, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &KeyPair{
+		Certificate: cert,
+		PrivateKey:  key,
+		PEM: &efgsutils.X509KeyPair{
+			Cert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: raw}),
+			Key:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: rawKey}),
+		},
+	}, nil
+}
+
+//Sign Sorts the keys like uploading national backend does and makes detached PKCS#7 signature of them, base64 encoded.
+func (p *KeyPair) Sign(keys []*efgsapi.DiagnosisKey) (string, error) {
+	SortKeys(keys)
+
+	signedData, err := pkcs7.NewSignedData(BatchBytes(keys))
+	if err != nil {
+		return "", err
+	}
+
+	if err = signedData.AddSigner(p.Certificate, p.PrivateKey, pkcs7.SignerInfoConfig{}); err != nil {
+		return "", err
+	}
+
+	signedData.Detach()
+
+	signature, err := signedData.Finish()
+	if err != nil {
+		return "", err
+	}
+
+	return b64.StdEncoding.EncodeToString(signature), nil
+}
+
+//SortKeys Sorts the keys by their signed bytes representation, as required by EFGS.
+func SortKeys(keys []*efgsapi.DiagnosisKey) {
+	sort.SliceStable(keys, func(i, j int) bool {
+		return b64.StdEncoding.EncodeToString(keyBytes(keys[i])) < b64.StdEncoding.EncodeToString(keyBytes(keys[j]))
+	})
+}
+
+//BatchBytes Gets bytes of the keys which are signed by the uploader, in the format specified by EFGS. It's implemented
+//independently of the code under test on purpose.
+func BatchBytes(keys []*efgsapi.DiagnosisKey) []byte {
+	var raw []byte
+	for _, key := range keys {
+		raw = append(raw, keyBytes(key)...)
+	}
+	return raw
+}
+
+func keyBytes(key *efgsapi.DiagnosisKey) []byte {
+	countries := make([]string, len(key.VisitedCountries))
+	copy(countries, key.VisitedCountries)
+	sort.SliceStable(countries, func(i, j int) bool {
+		return b64.StdEncoding.EncodeToString([]byte(countries[i])) < b64.StdEncoding.EncodeToString([]byte(countries[j]))
+	})
+
+	fields := []string{
+		b64.StdEncoding.EncodeToString(key.KeyData),
+		encodeInt(int32(key.RollingStartIntervalNumber)),
+		encodeInt(int32(key.RollingPeriod)),
+		encodeInt(key.TransmissionRiskLevel),
+		b64.StdEncoding.EncodeToString([]byte(strings.Join(countries, ","))),
+		b64.StdEncoding.EncodeToString([]byte(key.Origin)),
+		encodeInt(int32(key.ReportType)),
+		encodeInt(key.DaysSinceOnsetOfSymptoms),
+	}
+
+	return []byte(strings.Join(fields, ".") + ".")
+}
+
+func encodeInt(num int32) string {
+	raw := make([]byte, 4)
+	binary.BigEndian.PutUint32(raw, uint32(num))
+	return b64.StdEncoding.EncodeToString(raw)
+}
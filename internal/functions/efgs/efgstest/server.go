@@ -0,0 +1,460 @@
+//Package efgstest provides in-process EFGS gateway simulator for tests.
+package efgstest
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	b64 "encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	efgsapi "github.com/covid19cz/erouska-backend/internal/functions/efgs/api"
+	efgsutils "github.com/covid19cz/erouska-backend/internal/functions/efgs/utils"
+	"google.golang.org/protobuf/proto"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	urlutils "net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Upload Keys uploaded by national backend of given country.
+type Upload struct {
+	Country    string
+	BatchTag   string
+	Keys       []*efgsapi.DiagnosisKey
+	UploadedAt time.Time
+
+	signature   string
+	signingCert *x509.Certificate
+}
+
+type downloadBatch struct {
+	tag     string
+	uploads []*Upload
+}
+
+//Server In-process EFGS gateway simulator. It behaves like EFGS run locally (EnvLocal): the client is identified by
+//X-SSL-Client-SHA256 and X-SSL-Client-DN headers instead of mTLS.
+type Server struct {
+	*httptest.Server
+
+	//Now Time used for dating uploaded batches.
+	Now func() time.Time
+	//FailKey Simulates EFGS failing to store the key; such keys are reported in 500 list of HTTP 207 response.
+	FailKey func(key *efgsapi.DiagnosisKey) bool
+
+	mu         sync.Mutex
+	batches    map[string][]*downloadBatch // by date
+	uploads    []*Upload
+	uploadTags map[string]bool
+	storedKeys map[string]bool // by payloadHash
+	signers    map[string]*KeyPair
+	callbacks  map[string]string
+	throttled  int
+	retryAfter time.Duration
+}
+
+//NewServer Starts new simulator. The caller should call Close when finished.
+func NewServer() *Server {
+	s := &Server{
+		Now:        time.Now,
+		batches:    make(map[string][]*downloadBatch),
+		uploadTags: make(map[string]bool),
+		storedKeys: make(map[string]bool),
+		signers:    make(map[string]*KeyPair),
+		callbacks:  make(map[string]string),
+	}
+
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+
+	return s
+}
+
+//BaseURL Gets URL of the simulator, to be used in place of EFGS URL.
+func (s *Server) BaseURL() *urlutils.URL {
+	url, _ := urlutils.Parse(s.URL)
+	return url
+}
+
+//SigningCertificate Gets certificate the simulator uses for signing batches of given country added by AddBatch.
+func (s *Server) SigningCertificate(country string) *x509.Certificate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.signer(country).Certificate
+}
+
+func (s *Server) signer(country string) *KeyPair {
+	country = strings.ToUpper(country)
+
+	if s.signers[country] == nil {
+		pair, err := NewKeyPair("NBBS "+country, country)
+		if err != nil {
+			panic(fmt.Sprintf("Could not create signing certificate: %v", err))
+		}
+		s.signers[country] = pair
+	}
+
+	return s.signers[country]
+}
+
+//AddBatch Makes the uploads available for download as one batch, as if they were uploaded by other countries. Uploads
+//are signed by the simulator's certificate of their country, see SigningCertificate. Returns tag of the batch.
+func (s *Server) AddBatch(date string, uploads ...Upload) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var stored []*Upload
+
+	for i := range uploads {
+		upload := uploads[i]
+		signer := s.signer(upload.Country)
+
+		signature, err := signer.Sign(upload.Keys)
+		if err != nil {
+			panic(fmt.Sprintf("Could not sign batch: %v", err))
+		}
+
+		upload.Country = strings.ToUpper(upload.Country)
+		upload.UploadedAt = s.Now()
+		upload.signature = signature
+		upload.signingCert = signer.Certificate
+		stored = append(stored, &upload)
+	}
+
+	return s.addBatch(date, stored...)
+}
+
+func (s *Server) addBatch(date string, uploads ...*Upload) string {
+	// like in EFGS, the tags are not sequential
+	hash := sha1.Sum([]byte(fmt.Sprintf("%v-%v", date, len(s.batches[date]))))
+	tag := fmt.Sprintf("%v-%x", strings.ReplaceAll(date, "-", ""), hash[:4])
+	s.batches[date] = append(s.batches[date], &downloadBatch{tag: tag, uploads: uploads})
+	return tag
+}
+
+//Uploads Gets batches accepted by the upload endpoint.
+func (s *Server) Uploads() []Upload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	uploads := make([]Upload, len(s.uploads))
+	for i, upload := range s.uploads {
+		uploads[i] = *upload
+	}
+
+	return uploads
+}
+
+//Callbacks Gets registered callbacks, URL by callback ID.
+func (s *Server) Callbacks() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	callbacks := make(map[string]string)
+	for id, url := range s.callbacks {
+		callbacks[id] = url
+	}
+
+	return callbacks
+}
+
+//Throttle Makes the simulator respond HTTP 429 to the next n requests, with Retry-After header set to now + retryAfter.
+func (s *Server) Throttle(n int, retryAfter time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.throttled = n
+	s.retryAfter = retryAfter
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.throttled > 0 {
+		s.throttled--
+		w.Header().Set("Retry-After", s.Now().Add(s.retryAfter).UTC().Format(http.TimeFormat))
+		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+		return
+	}
+
+	country, ok := clientCountry(r)
+	if !ok {
+		http.Error(w, "Missing or invalid client certificate headers", http.StatusForbidden)
+		return
+	}
+
+	path := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/diagnosiskeys/upload":
+		s.handleUpload(w, r, country)
+	case r.Method == http.MethodGet && len(path) == 3 && path[1] == "download":
+		s.handleDownload(w, r, country, path[2])
+	case r.Method == http.MethodGet && len(path) == 5 && path[1] == "audit" && path[2] == "download":
+		s.handleAudit(w, path[3], path[4])
+	case len(path) == 3 && path[1] == "callback":
+		s.handleCallback(w, r, path[2])
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// clientCountry Gets country of the client from the subject of its certificate, as sent by EFGS proxy.
+func clientCountry(r *http.Request) (string, bool) {
+	if r.Header.Get("X-SSL-Client-SHA256") == "" {
+		return "", false
+	}
+
+	for _, part := range strings.Split(r.Header.Get("X-SSL-Client-DN"), ",") {
+		if strings.HasPrefix(part, "C=") {
+			return strings.ToUpper(strings.TrimPrefix(part, "C=")), true
+		}
+	}
+
+	return "", false
+}
+
+func (s *Server) handleUpload(w http.ResponseWriter, r *http.Request, country string) {
+	batchTag := r.Header.Get("batchTag")
+	if batchTag == "" || r.Header.Get("batchSignature") == "" {
+		http.Error(w, "Missing batchTag or batchSignature header", http.StatusBadRequest)
+		return
+	}
+
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/protobuf") {
+		http.Error(w, "Unsupported content type", http.StatusNotAcceptable)
+		return
+	}
+
+	if s.uploadTags[batchTag] {
+		http.Error(w, "Batch tag already exists", http.StatusConflict)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var batch efgsapi.DiagnosisKeyBatch
+	if err = proto.Unmarshal(body, &batch); err != nil || len(batch.Keys) == 0 {
+		http.Error(w, fmt.Sprintf("Invalid batch: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	signingCert, err := verifySignature(r.Header.Get("batchSignature"), batch.Keys, country)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for i, key := range batch.Keys {
+		if err = validateKey(key, country); err != nil {
+			http.Error(w, fmt.Sprintf("Key %v is invalid: %v", i, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	result := efgsapi.UploadBatchResponse{Error: []int{}, Duplicate: []int{}, Success: []int{}}
+	var stored []*efgsapi.DiagnosisKey
+
+	for i, key := range batch.Keys {
+		hash := payloadHash(key)
+
+		switch {
+		case s.storedKeys[hash]:
+			result.Duplicate = append(result.Duplicate, i)
+		case s.FailKey != nil && s.FailKey(key):
+			result.Error = append(result.Error, i)
+		default:
+			s.storedKeys[hash] = true
+			result.Success = append(result.Success, i)
+			stored = append(stored, key)
+		}
+	}
+
+	s.uploadTags[batchTag] = true
+
+	if len(stored) > 0 {
+		upload := &Upload{
+			Country:     country,
+			BatchTag:    batchTag,
+			Keys:        stored,
+			UploadedAt:  s.Now(),
+			signature:   r.Header.Get("batchSignature"),
+			signingCert: signingCert,
+		}
+		s.uploads = append(s.uploads, upload)
+		s.addBatch(s.Now().Format("2006-01-02"), upload)
+	}
+
+	if len(stored) == len(batch.Keys) {
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusMultiStatus)
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// payloadHash Identifies stored key. Like EFGS, duplicates are found by hash of the whole key, so a key revised by the
+// uploader (e.g. with other report type) is stored again.
+func payloadHash(key *efgsapi.DiagnosisKey) string {
+	payload, _ := proto.MarshalOptions{Deterministic: true}.Marshal(key)
+	hash := sha256.Sum256(payload)
+	return b64.StdEncoding.EncodeToString(hash[:])
+}
+
+func verifySignature(signature string, keys []*efgsapi.DiagnosisKey, country string) (*x509.Certificate, error) {
+	raw, err := b64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode batch signature: %v", err)
+	}
+
+	p7, err := efgsutils.ParsePKCS7(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse batch signature: %v", err)
+	}
+
+	p7.Content = BatchBytes(keys)
+
+	if err = p7.Verify(); err != nil {
+		return nil, fmt.Errorf("Invalid batch signature: %v", err)
+	}
+
+	signer := p7.GetOnlySigner()
+	if signer == nil {
+		return nil, fmt.Errorf("Batch signature must have exactly one signer")
+	}
+
+	if len(signer.Subject.Country) != 0 && !strings.EqualFold(signer.Subject.Country[0], country) {
+		return nil, fmt.Errorf("Batch is signed by certificate of %v", signer.Subject.Country[0])
+	}
+
+	return signer, nil
+}
+
+func validateKey(key *efgsapi.DiagnosisKey, country string) error {
+	switch {
+	case len(key.KeyData) != 16:
+		return fmt.Errorf("keyData must have 16 bytes")
+	case key.RollingPeriod < 1 || key.RollingPeriod > 144:
+		return fmt.Errorf("rollingPeriod must be between 1 and 144")
+	case (key.TransmissionRiskLevel < 0 || key.TransmissionRiskLevel > 8) && key.TransmissionRiskLevel != 0x7FFFFFFF:
+		return fmt.Errorf("transmissionRiskLevel must be between 0 and 8")
+	case key.DaysSinceOnsetOfSymptoms < -14 || key.DaysSinceOnsetOfSymptoms > 4014:
+		return fmt.Errorf("days_since_onset_of_symptoms is out of range")
+	case !strings.EqualFold(key.Origin, country):
+		return fmt.Errorf("origin %v doesn't match the uploader %v", key.Origin, country)
+	}
+
+	return nil
+}
+
+func (s *Server) findBatch(date string, batchTag string) (int, *downloadBatch) {
+	for i, batch := range s.batches[date] {
+		if batchTag == "" || batch.tag == batchTag {
+			return i, batch
+		}
+	}
+
+	return -1, nil
+}
+
+func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request, country string, date string) {
+	accept := r.Header.Get("Accept")
+	if !strings.HasPrefix(accept, "application/json") && !strings.HasPrefix(accept, "application/protobuf") {
+		http.Error(w, "Unsupported accept header", http.StatusNotAcceptable)
+		return
+	}
+
+	i, batch := s.findBatch(date, r.Header.Get("batchTag"))
+	if batch == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	nextBatchTag := "null"
+	if i+1 < len(s.batches[date]) {
+		nextBatchTag = s.batches[date][i+1].tag
+	}
+
+	// EFGS doesn't send keys back to their uploader
+	var keys []*efgsapi.DiagnosisKey
+	for _, upload := range batch.uploads {
+		if upload.Country != country {
+			keys = append(keys, upload.Keys...)
+		}
+	}
+
+	w.Header().Set("batchTag", batch.tag)
+	w.Header().Set("nextBatchTag", nextBatchTag)
+
+	if strings.HasPrefix(accept, "application/protobuf") {
+		raw, err := proto.Marshal(&efgsapi.DiagnosisKeyBatch{Keys: keys})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/protobuf; version=1.0")
+		_, _ = w.Write(raw)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; version=1.0")
+	_ = json.NewEncoder(w).Encode(struct {
+		Keys []*efgsapi.DiagnosisKey `json:"keys"`
+	}{keys})
+}
+
+func (s *Server) handleAudit(w http.ResponseWriter, date string, batchTag string) {
+	_, batch := s.findBatch(date, batchTag)
+	if batch == nil || batchTag == "" {
+		http.Error(w, "Batch not found", http.StatusNotFound)
+		return
+	}
+
+	entries := []efgsapi.AuditEntry{}
+
+	for _, upload := range batch.uploads {
+		entries = append(entries, efgsapi.AuditEntry{
+			Country:                   upload.Country,
+			UploadedTime:              upload.UploadedAt,
+			UploaderSigningThumbprint: efgsutils.CertificateThumbprint(upload.signingCert),
+			SigningCertificate:        string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upload.signingCert.Raw})),
+			Amount:                    len(upload.Keys),
+			BatchSignature:            upload.signature,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(entries)
+}
+
+func (s *Server) handleCallback(w http.ResponseWriter, r *http.Request, id string) {
+	switch r.Method {
+	case http.MethodPut:
+		url := r.URL.Query().Get("url")
+		if url == "" {
+			http.Error(w, "Missing url", http.StatusBadRequest)
+			return
+		}
+		s.callbacks[id] = url
+	case http.MethodDelete:
+		if _, exists := s.callbacks[id]; !exists {
+			http.NotFound(w, r)
+			return
+		}
+		delete(s.callbacks, id)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
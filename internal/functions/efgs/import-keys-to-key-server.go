@@ -21,14 +21,16 @@ var seededRand = rand.New(rand.NewSource(time.Now().UnixNano()))
 
 const defaultDSOS = -1
 
+// acceptedTestTypes Test types accepted when verifying codes; the Verification server refuses codes of test types
+// which aren't accepted.
+var acceptedTestTypes = []string{efgsapi.TestTypeConfirmed, efgsapi.TestTypeLikely, efgsapi.TestTypeNegative}
+
 //ImportKeysToKeyServer Imports keys to Key server
 func ImportKeysToKeyServer(ctx context.Context, m pubsub.Message) error {
 	logger := logging.FromContext(ctx).Named("efgs.ImportKeysToKeyServer")
 
 	var payload efgsapi.BatchImportParams
 
-	// TODO consider requeueing the batch again in case of failure
-
 	if decodeErr := pubsub.DecodeJSONEvent(m, &payload); decodeErr != nil {
 		err := fmt.Errorf("Error while parsing event payload: %v", decodeErr)
 		logger.Error(err)
@@ -42,10 +44,12 @@ func ImportKeysToKeyServer(ctx context.Context, m pubsub.Message) error {
 		return err
 	}
 
-	return importKeysToKeyServer(ctx, config, time.Now(), payload.HAID, payload.Keys)
+	outcome, err := importKeysToKeyServer(ctx, config, time.Now(), payload.HAID, payload.TestType, payload.Keys)
+
+	return handleImportResult(ctx, config, time.Now(), &payload, outcome, err)
 }
 
-func importKeysToKeyServer(ctx context.Context, config *publishConfig, now time.Time, haid string, keys []efgsapi.ExpKey) error {
+func importKeysToKeyServer(ctx context.Context, config *publishConfig, now time.Time, haid string, testType string, keys []efgsapi.ExpKey) (*importOutcome, error) {
 	logger := logging.FromContext(ctx).Named("efgs.importKeysToKeyServer")
 
 	// Filter out too old keys. That was once done before, but there may be some more invalid due to
@@ -70,29 +74,88 @@ func importKeysToKeyServer(ctx context.Context, config *publishConfig, now time.
 		panic(msg)
 	}
 
-	logger.Debugf("Going to import batch of %v keys with HAID %v", keysCount, haid)
+	if testType == "" {
+		testType = efgsapi.TestTypeConfirmed // enqueued before the test type was recorded
+	}
+
+	if testType == efgsapi.TestTypeNegative {
+		return revokeImportedKeys(ctx, config, haid, filteredKeys)
+	}
+
+	logger.Debugf("Going to import batch of %v %v keys with HAID %v", keysCount, testType, haid)
+
+	resp, err := signAndPublishKeys(ctx, config, haid, testType, filteredKeys, "")
+
+	outcome := &importOutcome{}
+	if resp != nil {
+		outcome.Inserted = resp.InsertedExposures
+		outcome.Rejected = keysCount - resp.InsertedExposures
+		outcome.ErrorCode = resp.Code
+		outcome.RevisionToken = resp.RevisionToken
+	}
 
-	resp, err := signAndPublishKeys(ctx, config, haid, filteredKeys)
 	if err != nil {
 		logger.Errorf("Error when publishing keys: %v", err)
-		return err
+		return outcome, err
 	}
 
 	logger.Infof("Batch of %v keys with HAID %v uploaded (%v sent)", resp.InsertedExposures, haid, keysCount)
 
-	return nil
+	return outcome, nil
 }
 
-func signAndPublishKeys(ctx context.Context, config *publishConfig, haid string, keys efgsapi.ExpKeyBatch) (*keyserverapi.PublishResponse, error) {
-	logger := logging.FromContext(ctx).Named("efgs.signAndPublishKeys")
+// revokeImportedKeys Revises previously imported keys to negative test type, by revision tokens of their imports. Keys
+// which were never imported are skipped, there's nothing to revoke.
+func revokeImportedKeys(ctx context.Context, config *publishConfig, haid string, keys []efgsapi.ExpKey) (*importOutcome, error) {
+	logger := logging.FromContext(ctx).Named("efgs.revokeImportedKeys")
 
-	vc, err := requestNewVC(ctx, config)
+	keysData := make([]string, len(keys))
+	for i, key := range keys {
+		keysData[i] = key.Key
+	}
+
+	revisionTokens, err := config.Ledger.GetRevisionTokens(keysData)
 	if err != nil {
-		logger.Debugf("Error when getting VC: %v", err)
-		return nil, err
+		return nil, fmt.Errorf("Could not get revision tokens: %v", err)
+	}
+
+	// keys grouped by revision token of the import they were imported by
+	byToken := make(map[string][]efgsapi.ExpKey)
+	revocable := 0
+	for _, key := range keys {
+		if token, found := revisionTokens[key.Key]; found {
+			byToken[token] = append(byToken[token], key)
+			revocable++
+		}
+	}
+
+	logger.Debugf("Going to revoke %v of %v keys with HAID %v, imported by %v imports", revocable, len(keys), haid, len(byToken))
+
+	outcome := &importOutcome{Rejected: len(keys)}
+
+	for revisionToken, revokedKeys := range byToken {
+		resp, err := signAndPublishKeys(ctx, config, haid, efgsapi.TestTypeNegative, revokedKeys, revisionToken)
+		if resp != nil {
+			outcome.Inserted += resp.InsertedExposures
+			outcome.Rejected -= resp.InsertedExposures
+			outcome.ErrorCode = resp.Code
+		}
+
+		if err != nil {
+			logger.Errorf("Error when revoking keys: %v", err)
+			return outcome, err
+		}
 	}
 
-	token, err := verifyCode(ctx, config, vc)
+	logger.Infof("%v of %v keys with HAID %v revoked", outcome.Inserted, len(keys), haid)
+
+	return outcome, nil
+}
+
+func signAndPublishKeys(ctx context.Context, config *publishConfig, haid string, testType string, keys efgsapi.ExpKeyBatch, revisionToken string) (*keyserverapi.PublishResponse, error) {
+	logger := logging.FromContext(ctx).Named("efgs.signAndPublishKeys")
+
+	token, err := config.TokenPool.take(ctx, config, testType, time.Now())
 	if err != nil {
 		logger.Debugf("Error when getting token: %v", err)
 		return nil, err
@@ -107,21 +170,21 @@ func signAndPublishKeys(ctx context.Context, config *publishConfig, haid string,
 		return nil, err
 	}
 
-	resp, err := publishKeys(ctx, config, haid, keys, certificate, hmacKey)
+	resp, err := publishKeys(ctx, config, haid, keys, certificate, hmacKey, revisionToken)
 
 	if err != nil {
 		logger.Debugf("Error when publishing keys to Key server: %v", err)
-		return nil, err
+		return resp, err
 	}
 
 	return resp, nil
 }
 
-func requestNewVC(ctx context.Context, config *publishConfig) (string, error) {
+func requestNewVC(ctx context.Context, config *publishConfig, testType string) (string, error) {
 	logger := logging.FromContext(ctx).Named("efgs.requestNewVC")
 
 	body, err := json.Marshal(&efgsapi.IssueCodeRequest{
-		TestType:    "confirmed",
+		TestType:    testType,
 		SymptomDate: time.Now().AddDate(0, 0, defaultDSOS).Format("2006-01-02"),
 	})
 
@@ -182,6 +245,7 @@ func verifyCode(ctx context.Context, config *publishConfig, code string) (string
 
 	body, err := json.Marshal(&efgsapi.VerifyRequest{
 		VerificationCode: code,
+		AcceptTestTypes:  acceptedTestTypes,
 	})
 
 	if err != nil {
@@ -302,7 +366,7 @@ func getCertificate(ctx context.Context, config *publishConfig, keys efgsapi.Exp
 	return r.Certificate, nil
 }
 
-func publishKeys(ctx context.Context, config *publishConfig, haid string, keys efgsapi.ExpKeyBatch, certificate string, secret []byte) (*keyserverapi.PublishResponse, error) {
+func publishKeys(ctx context.Context, config *publishConfig, haid string, keys efgsapi.ExpKeyBatch, certificate string, secret []byte, revisionToken string) (*keyserverapi.PublishResponse, error) {
 	logger := logging.FromContext(ctx).Named("efgs.publishKeys")
 
 	keysCount := len(keys)
@@ -315,7 +379,7 @@ func publishKeys(ctx context.Context, config *publishConfig, haid string, keys e
 		HMACKey:              base64.StdEncoding.EncodeToString(secret),
 		SymptomOnsetInterval: 0,
 		Traveler:             false,
-		RevisionToken:        "",
+		RevisionToken:        revisionToken,
 		Padding:              "",
 	}
 
@@ -364,7 +428,7 @@ func publishKeys(ctx context.Context, config *publishConfig, haid string, keys e
 	}
 
 	if r.Code != "" || r.ErrorMessage != "" {
-		return nil, fmt.Errorf("%v: %+v", r.Code, r.ErrorMessage)
+		return &r, fmt.Errorf("%v: %+v", r.Code, r.ErrorMessage)
 	}
 
 	if r.InsertedExposures != keysCount {
@@ -0,0 +1,177 @@
+package efgs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	efgsapi "github.com/covid19cz/erouska-backend/internal/functions/efgs/api"
+	efgsconstants "github.com/covid19cz/erouska-backend/internal/functions/efgs/constants"
+	"github.com/covid19cz/erouska-backend/internal/logging"
+	"net/http"
+	"time"
+)
+
+// importOutcome Result of import of keys to the Key server.
+type importOutcome struct {
+	Inserted  int
+	Rejected  int
+	ErrorCode string
+	// RevisionToken Token for revision of the imported keys.
+	RevisionToken string
+}
+
+// handleImportResult Records result of the import in the download ledger. Failed import is scheduled for retry with
+// exponential backoff or, after too many attempts, moved to the dead-letter topic. Returns error only when the failure
+// couldn't be handled that way.
+func handleImportResult(ctx context.Context, config *publishConfig, now time.Time, params *efgsapi.BatchImportParams, outcome *importOutcome, importErr error) error {
+	logger := logging.FromContext(ctx).Named("efgs.handleImportResult")
+
+	if params.BatchTag == "" {
+		return importErr // enqueued before the ledger existed
+	}
+
+	record := &efgsapi.BatchImportRecord{
+		Date:      params.Date,
+		BatchTag:  params.BatchTag,
+		Country:   params.Country,
+		Part:      params.Part,
+		KeysCount: len(params.Keys),
+		Status:    efgsapi.ImportStatusImported,
+		Attempts:  params.Attempt + 1,
+		UpdatedAt: now,
+	}
+
+	if outcome != nil {
+		record.Inserted = outcome.Inserted
+		record.Rejected = outcome.Rejected
+		record.ErrorCode = outcome.ErrorCode
+		record.RevisionToken = outcome.RevisionToken
+	}
+
+	if importErr == nil {
+		if err := config.Ledger.UpdateBatchImport(record); err != nil {
+			logger.Warnf("Could not update import %v in download ledger: %v", params.ID, err)
+		}
+		if record.RevisionToken != "" && params.TestType != efgsapi.TestTypeNegative {
+			recordImportedKeys(ctx, config.Ledger, now, params)
+		}
+		return nil
+	}
+
+	record.Error = importErr.Error()
+
+	retry := *params
+	retry.Attempt = record.Attempts
+
+	if record.Attempts >= config.MaxImportAttempts {
+		if err := config.PubSubClient.Publish(efgsconstants.TopicNameImportKeysDeadLetter, retry); err != nil {
+			return fmt.Errorf("Could not move import %v to dead-letter topic: %v (import error: %v)", params.ID, err, importErr)
+		}
+
+		// logged as error so it's picked up by the alerting
+		logger.Errorf("Import %v has failed %v times, moved it to dead-letter topic: %v", params.ID, record.Attempts, importErr)
+
+		record.Status = efgsapi.ImportStatusDeadLettered
+		if err := config.Ledger.UpdateBatchImport(record); err != nil {
+			logger.Warnf("Could not update import %v in download ledger: %v", params.ID, err)
+		}
+		return nil
+	}
+
+	payload, err := json.Marshal(retry)
+	if err != nil {
+		return err
+	}
+
+	record.Status = efgsapi.ImportStatusRetrying
+	record.NextAttemptAt = now.Add(importRetryBackoff(config.ImportRetryBackoff, record.Attempts))
+	record.Payload = string(payload)
+
+	if err = config.Ledger.UpdateBatchImport(record); err != nil {
+		return fmt.Errorf("Could not schedule retry of import %v: %v (import error: %v)", params.ID, err, importErr)
+	}
+
+	logger.Warnf("Import %v has failed (attempt %v), going to retry at %v: %v", params.ID, record.Attempts, record.NextAttemptAt, importErr)
+
+	return nil
+}
+
+// recordImportedKeys Links the imported keys to their import, so they can be revoked by its revision token. Failure
+// only means the keys can't be revoked, so it's not an error of the import.
+func recordImportedKeys(ctx context.Context, ledger downloadLedger, now time.Time, params *efgsapi.BatchImportParams) {
+	logger := logging.FromContext(ctx).Named("efgs.recordImportedKeys")
+
+	keys := make([]*efgsapi.ImportedKeyRecord, len(params.Keys))
+	for i, key := range params.Keys {
+		keys[i] = &efgsapi.ImportedKeyRecord{
+			KeyData:    key.Key,
+			Date:       params.Date,
+			BatchTag:   params.BatchTag,
+			Country:    params.Country,
+			Part:       params.Part,
+			ImportedAt: now,
+		}
+	}
+
+	if err := ledger.SaveImportedKeys(keys); err != nil {
+		logger.Warnf("Could not save keys of import %v, they can't be revoked: %v", params.ID, err)
+	}
+}
+
+// importRetryBackoff Delay before next attempt; it's doubled with every failed attempt.
+func importRetryBackoff(backoff time.Duration, attempts int) time.Duration {
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+	}
+	return backoff
+}
+
+//RequeueImports Enqueues again imports of downloaded keys which have failed and are due to be retried.
+func RequeueImports(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.FromContext(ctx).Named("efgs.RequeueImports")
+
+	count, err := requeueImports(ctx, loadRequeueImportsConfig(), time.Now())
+	if err != nil {
+		logger.Errorf("Could not requeue imports: %+v", err)
+		http.Error(w, fmt.Sprintf("Error: %v", err), 500)
+		return
+	}
+
+	http.Error(w, fmt.Sprintf("ok, %v imports requeued", count), 200)
+}
+
+func requeueImports(ctx context.Context, config *requeueImportsConfig, now time.Time) (int, error) {
+	logger := logging.FromContext(ctx).Named("efgs.requeueImports")
+
+	records, err := config.Ledger.GetDueImportRetries(now)
+	if err != nil {
+		return 0, err
+	}
+
+	requeued := 0
+
+	for _, record := range records {
+		var params efgsapi.BatchImportParams
+		if err := json.Unmarshal([]byte(record.Payload), &params); err != nil {
+			return requeued, fmt.Errorf("Invalid payload of import of batch '%v' for %v: %v", record.BatchTag, record.Country, err)
+		}
+
+		if err := config.PubSubClient.Publish(efgsconstants.TopicNameImportKeys, params); err != nil {
+			return requeued, err
+		}
+
+		record.Status = efgsapi.ImportStatusEnqueued
+		record.Payload = ""
+		record.UpdatedAt = now
+
+		if err := config.Ledger.UpdateBatchImport(record); err != nil {
+			return requeued, err
+		}
+
+		logger.Infof("Requeued import %v (attempt %v)", params.ID, params.Attempt+1)
+		requeued++
+	}
+
+	return requeued, nil
+}
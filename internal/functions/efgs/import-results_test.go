@@ -0,0 +1,217 @@
+package efgs
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	efgsapi "github.com/covid19cz/erouska-backend/internal/functions/efgs/api"
+	efgsconstants "github.com/covid19cz/erouska-backend/internal/functions/efgs/constants"
+	"github.com/covid19cz/erouska-backend/internal/utils"
+	keyserverapi "github.com/google/exposure-notifications-server/pkg/api/v1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHandleImportResult(t *testing.T) {
+	now := time.Date(2020, 12, 10, 12, 0, 0, 0, time.UTC)
+
+	ledger := newMemoryLedger()
+	publisher := &recordingPublisher{}
+	config := &publishConfig{Ledger: ledger, PubSubClient: publisher, MaxImportAttempts: 3, ImportRetryBackoff: time.Minute}
+	requeueConfig := &requeueImportsConfig{Ledger: ledger, PubSubClient: publisher}
+
+	params := efgsapi.BatchImportParams{
+		ID:       efgsapi.ImportID("2020-12-10", "tag-1", "DE", 0),
+		HAID:     "haid-de",
+		Keys:     make(efgsapi.ExpKeyBatch, 10),
+		Date:     "2020-12-10",
+		BatchTag: "tag-1",
+		Country:  "DE",
+	}
+
+	_ = ledger.SaveBatchImports([]*efgsapi.BatchImportRecord{{Date: params.Date, BatchTag: params.BatchTag, Country: params.Country, KeysCount: 10, Status: efgsapi.ImportStatusEnqueued}})
+
+	record := func() *efgsapi.BatchImportRecord {
+		return ledger.imports[importID(&efgsapi.BatchImportRecord{Date: params.Date, BatchTag: params.BatchTag, Country: params.Country})]
+	}
+
+	ctx := context.Background()
+	importErr := errors.New("HTTP 503: unavailable")
+
+	// failed attempts are retried with exponential backoff
+
+	for attempt, backoff := range []time.Duration{time.Minute, 2 * time.Minute} {
+		if err := handleImportResult(ctx, config, now, &params, &importOutcome{ErrorCode: "unavailable"}, importErr); err != nil {
+			t.Fatalf("handleImportResult() error = %v", err)
+		}
+
+		if r := record(); r.Status != efgsapi.ImportStatusRetrying || r.Attempts != attempt+1 || !r.NextAttemptAt.Equal(now.Add(backoff)) || r.ErrorCode != "unavailable" {
+			t.Fatalf("Import record after attempt %v = %+v", attempt+1, r)
+		}
+
+		if count, _ := requeueImports(ctx, requeueConfig, now.Add(backoff-time.Second)); count != 0 {
+			t.Fatalf("requeueImports() = %v before the retry is due", count)
+		}
+
+		now = now.Add(backoff)
+
+		if count, err := requeueImports(ctx, requeueConfig, now); count != 1 || err != nil {
+			t.Fatalf("requeueImports() = %v, error %v; want 1", count, err)
+		}
+
+		requeued := publisher.messages[len(publisher.messages)-1].(efgsapi.BatchImportParams)
+		if publisher.topics[len(publisher.topics)-1] != efgsconstants.TopicNameImportKeys || requeued.Attempt != attempt+1 || len(requeued.Keys) != 10 {
+			t.Fatalf("Requeued import = %+v", requeued)
+		}
+
+		if r := record(); r.Status != efgsapi.ImportStatusEnqueued || r.Payload != "" {
+			t.Fatalf("Import record after requeue = %+v", r)
+		}
+
+		params = requeued
+	}
+
+	// the last attempt moves the keys to dead-letter topic
+
+	if err := handleImportResult(ctx, config, now, &params, &importOutcome{}, importErr); err != nil {
+		t.Fatalf("handleImportResult() error = %v", err)
+	}
+
+	if r := record(); r.Status != efgsapi.ImportStatusDeadLettered || r.Attempts != 3 || r.Error != importErr.Error() {
+		t.Fatalf("Import record after last attempt = %+v", r)
+	}
+
+	if publisher.topics[len(publisher.topics)-1] != efgsconstants.TopicNameImportKeysDeadLetter {
+		t.Fatalf("Keys were published to %v, want dead-letter topic", publisher.topics[len(publisher.topics)-1])
+	}
+
+	// successful import records the result
+
+	params.Attempt = 0
+
+	if err := handleImportResult(ctx, config, now, &params, &importOutcome{Inserted: 9, Rejected: 1}, nil); err != nil {
+		t.Fatalf("handleImportResult() error = %v", err)
+	}
+
+	if r := record(); r.Status != efgsapi.ImportStatusImported || r.Inserted != 9 || r.Rejected != 1 || r.Error != "" {
+		t.Fatalf("Import record after success = %+v", r)
+	}
+}
+
+func TestHandleImportResultWithoutLedger(t *testing.T) {
+	importErr := errors.New("failed")
+
+	// imports enqueued before the ledger existed fail as before
+	err := handleImportResult(context.Background(), &publishConfig{}, time.Now(), &efgsapi.BatchImportParams{HAID: "haid-de"}, nil, importErr)
+	if err != importErr {
+		t.Fatalf("handleImportResult() error = %v, want %v", err, importErr)
+	}
+}
+
+// fakeKeyServer Accepts all published keys, recording the requests.
+type fakeKeyServer struct {
+	mutex    sync.Mutex
+	requests []keyserverapi.Publish
+}
+
+func (s *fakeKeyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var request keyserverapi.Publish
+	_ = json.NewDecoder(r.Body).Decode(&request)
+
+	s.mutex.Lock()
+	s.requests = append(s.requests, request)
+	token := fmt.Sprintf("revision-token-%v", len(s.requests))
+	s.mutex.Unlock()
+
+	_ = json.NewEncoder(w).Encode(keyserverapi.PublishResponse{InsertedExposures: len(request.Keys), RevisionToken: token})
+}
+
+func TestRevokeImportedKeys(t *testing.T) {
+	keyServer := &fakeKeyServer{}
+	verificationServer := &fakeVerificationServer{calls: make(map[string]int)}
+
+	mux := http.NewServeMux()
+	mux.Handle("/v1/publish", keyServer)
+	mux.Handle("/api/", verificationServer)
+
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ledger := newMemoryLedger()
+	config := newTokenPoolTestConfig(server, 2, false)
+	config.KeyServer = &utils.KeyServerConfig{URL: server.URL}
+	config.Ledger = ledger
+	config.MaxKeysOnPublish = 30
+	config.MaxIntervalAge = 15
+
+	ctx := context.Background()
+	now := time.Now()
+
+	newKey := func(id byte) efgsapi.ExpKey {
+		return efgsapi.ExpKey{
+			Key:            base64.StdEncoding.EncodeToString([]byte{id, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}),
+			IntervalNumber: int32(now.Add(-24*time.Hour).Unix()/600) / 144 * 144,
+			IntervalCount:  144,
+		}
+	}
+
+	params := efgsapi.BatchImportParams{
+		ID:       efgsapi.ImportID("2020-12-10", "tag-1", "DE", 0),
+		HAID:     "haid-de",
+		Keys:     efgsapi.ExpKeyBatch{newKey(1), newKey(2)},
+		Date:     "2020-12-10",
+		BatchTag: "tag-1",
+		Country:  "DE",
+		TestType: efgsapi.TestTypeConfirmed,
+	}
+
+	_ = ledger.SaveBatchImports([]*efgsapi.BatchImportRecord{{Date: params.Date, BatchTag: params.BatchTag, Country: params.Country, KeysCount: 2, TestType: params.TestType, Status: efgsapi.ImportStatusEnqueued}})
+
+	// the import is linked to its keys by the revision token
+
+	outcome, err := importKeysToKeyServer(ctx, config, now, params.HAID, params.TestType, params.Keys)
+	if err != nil || outcome.Inserted != 2 || outcome.RevisionToken != "revision-token-1" {
+		t.Fatalf("importKeysToKeyServer() = %+v, error %v", outcome, err)
+	}
+
+	if err = handleImportResult(ctx, config, now, &params, outcome, nil); err != nil {
+		t.Fatalf("handleImportResult() error = %v", err)
+	}
+
+	if tokens, _ := ledger.GetRevisionTokens([]string{newKey(1).Key, newKey(3).Key}); len(tokens) != 1 || tokens[newKey(1).Key] != "revision-token-1" {
+		t.Fatalf("GetRevisionTokens() = %v, want token of the import for the imported key", tokens)
+	}
+
+	// revoked keys are revised by the token of their import, keys never imported are skipped
+
+	outcome, err = importKeysToKeyServer(ctx, config, now, params.HAID, efgsapi.TestTypeNegative, efgsapi.ExpKeyBatch{newKey(1), newKey(3)})
+	if err != nil || outcome.Inserted != 1 || outcome.Rejected != 1 {
+		t.Fatalf("importKeysToKeyServer() = %+v, error %v; want 1 key revoked", outcome, err)
+	}
+
+	if len(keyServer.requests) != 2 {
+		t.Fatalf("Key server got %v requests, want 2", len(keyServer.requests))
+	}
+
+	revision := keyServer.requests[1]
+	if revision.RevisionToken != "revision-token-1" || len(revision.Keys) != 1 || revision.Keys[0].Key != newKey(1).Key {
+		t.Fatalf("Revision request = %+v", revision)
+	}
+
+	if !strings.HasPrefix(revision.VerificationPayload, "certificate-for-"+efgsapi.TestTypeNegative) {
+		t.Fatalf("Revision was published with certificate %v, want one of negative test type", revision.VerificationPayload)
+	}
+
+	// nothing is published when none of the keys was imported
+
+	outcome, err = importKeysToKeyServer(ctx, config, now, params.HAID, efgsapi.TestTypeNegative, efgsapi.ExpKeyBatch{newKey(4)})
+	if err != nil || outcome.Inserted != 0 || len(keyServer.requests) != 2 {
+		t.Fatalf("importKeysToKeyServer() = %+v, error %v; want nothing revoked", outcome, err)
+	}
+}
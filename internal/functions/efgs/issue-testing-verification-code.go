@@ -1,6 +1,7 @@
 package efgs
 
 import (
+	efgsapi "github.com/covid19cz/erouska-backend/internal/functions/efgs/api"
 	"github.com/covid19cz/erouska-backend/internal/logging"
 	"github.com/covid19cz/erouska-backend/internal/secrets"
 	"golang.org/x/net/context"
@@ -51,7 +52,7 @@ func issueTestingVerificationCode(ctx context.Context, r *http.Request, config *
 
 	// authenticated, go ahead
 
-	vc, err := requestNewVC(ctx, config)
+	vc, err := requestNewVC(ctx, config, efgsapi.TestTypeConfirmed)
 	if err != nil {
 		logger.Warnf("Could not load publish config: %v", err)
 		return 500, "Could not get VC"
@@ -9,6 +9,7 @@ import (
 	efgsapi "github.com/covid19cz/erouska-backend/internal/functions/efgs/api"
 	efgsutils "github.com/covid19cz/erouska-backend/internal/functions/efgs/utils"
 	"github.com/covid19cz/erouska-backend/internal/logging"
+	"github.com/covid19cz/erouska-backend/pkg/api/v1"
 	keyserverapi "github.com/google/exposure-notifications-server/pkg/api/v1"
 	"go.mozilla.org/pkcs7"
 	"sort"
@@ -16,8 +17,8 @@ import (
 	"unsafe"
 )
 
-//ToDiagnosisKey Converts ExposureKey to DiagnosisKey
-func ToDiagnosisKey(symptomsSince time.Time, key *keyserverapi.ExposureKey, origin string, visitedCountries []string) *efgsapi.DiagnosisKey {
+//ToDiagnosisKey Converts ExposureKey published by the device to DiagnosisKey, with report type mapped from the device one.
+func ToDiagnosisKey(symptomsSince time.Time, key *keyserverapi.ExposureKey, origin string, visitedCountries []string, reportType v1.ReportType) *efgsapi.DiagnosisKey {
 	bytes, err := b64.StdEncoding.DecodeString(key.Key)
 	if err != nil {
 		panic(err) // this would be very, very bad!
@@ -32,7 +33,7 @@ func ToDiagnosisKey(symptomsSince time.Time, key *keyserverapi.ExposureKey, orig
 		TransmissionRiskLevel:      int32(key.TransmissionRisk),
 		VisitedCountries:           visitedCountries,
 		Origin:                     origin,
-		ReportType:                 efgsapi.ReportType_CONFIRMED_TEST,
+		ReportType:                 efgsapi.ReportTypeFromDevice(reportType),
 		DaysSinceOnsetOfSymptoms:   dsos,
 	}
 }
@@ -108,15 +109,9 @@ func makeBatch(keys []*efgsapi.DiagnosisKey) efgsapi.DiagnosisKeyBatch {
 	}
 }
 
-func signBatch(ctx context.Context, efgsEnv efgsutils.Environment, diagnosisKey *efgsapi.DiagnosisKeyBatch) (string, error) {
+func signBatch(ctx context.Context, nbbsPair *efgsutils.X509KeyPair, diagnosisKey *efgsapi.DiagnosisKeyBatch) (string, error) {
 	logger := logging.FromContext(ctx).Named("efgs.signBatch")
 
-	nbbsPair, err := efgsutils.LoadX509KeyPair(ctx, efgsEnv, efgsutils.NBBS)
-	if err != nil {
-		logger.Debugf("Error loading authentication certificate: %v", err)
-		return "", err
-	}
-
 	certBlock, _ := pem.Decode(nbbsPair.Cert)
 	keyBlock, _ := pem.Decode(nbbsPair.Key)
 
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	efgsapi "github.com/covid19cz/erouska-backend/internal/functions/efgs/api"
+	"github.com/covid19cz/erouska-backend/pkg/api/v1"
 	keyserverapi "github.com/google/exposure-notifications-server/pkg/api/v1"
 	"github.com/leanovate/gopter"
 	"github.com/leanovate/gopter/gen"
@@ -19,6 +20,7 @@ func TestToDiagnosisKey(t *testing.T) {
 	type args struct {
 		symptomsDate time.Time
 		key          *keyserverapi.ExposureKey
+		reportType   v1.ReportType
 	}
 
 	tests := []struct {
@@ -66,11 +68,47 @@ func TestToDiagnosisKey(t *testing.T) {
 			},
 			want: newDiagKey("10.12.2020", 5),
 		},
+		{
+			name: "confirmed-test",
+			args: args{
+				symptomsDate: parsed("10.12.2020"),
+				key:          newExpKey("10.12.2020"),
+				reportType:   v1.ConfirmedTest,
+			},
+			want: newDiagKey("10.12.2020", 0),
+		},
+		{
+			name: "self-report",
+			args: args{
+				symptomsDate: parsed("10.12.2020"),
+				key:          newExpKey("10.12.2020"),
+				reportType:   v1.SelfReport,
+			},
+			want: withReportType(newDiagKey("10.12.2020", 0), efgsapi.ReportType_SELF_REPORT),
+		},
+		{
+			name: "clinical-diagnosis",
+			args: args{
+				symptomsDate: parsed("10.12.2020"),
+				key:          newExpKey("10.12.2020"),
+				reportType:   v1.ConfirmedClinicalDiagnosis,
+			},
+			want: withReportType(newDiagKey("10.12.2020", 0), efgsapi.ReportType_CONFIRMED_CLINICAL_DIAGNOSIS),
+		},
+		{
+			name: "revoked",
+			args: args{
+				symptomsDate: parsed("10.12.2020"),
+				key:          newExpKey("10.12.2020"),
+				reportType:   v1.Revoked,
+			},
+			want: withReportType(newDiagKey("10.12.2020", 0), efgsapi.ReportType_REVOKED),
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := ToDiagnosisKey(tt.args.symptomsDate, tt.args.key, "CZ", []string{"DE"}); !reflect.DeepEqual(got, tt.want) {
+			if got := ToDiagnosisKey(tt.args.symptomsDate, tt.args.key, "CZ", []string{"DE"}, tt.args.reportType); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("ToDiagnosisKey() = %v, want %v", got, tt.want)
 			}
 		})
@@ -401,6 +439,11 @@ func newDiagKey(start string, dsos int32) *efgsapi.DiagnosisKey {
 	}
 }
 
+func withReportType(key *efgsapi.DiagnosisKey, reportType efgsapi.ReportType) *efgsapi.DiagnosisKey {
+	key.ReportType = reportType
+	return key
+}
+
 func parsed(start string) time.Time {
 	t, err := time.Parse("2.1.2006", start)
 	if err != nil {
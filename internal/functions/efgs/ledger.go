@@ -0,0 +1,163 @@
+package efgs
+
+import (
+	"context"
+	"fmt"
+	efgsapi "github.com/covid19cz/erouska-backend/internal/functions/efgs/api"
+	"github.com/covid19cz/erouska-backend/internal/logging"
+	"sort"
+	"time"
+)
+
+// importStuckAfter Pending (enqueued or retrying) import not updated within this time is considered lost.
+const importStuckAfter = 2 * time.Hour
+
+// downloadLedger Persistent record of downloaded batches and imports of their keys.
+type downloadLedger interface {
+	SaveDownloadedBatch(batch *efgsapi.DownloadedBatchRecord) error
+	GetDownloadedBatch(date string, batchTag string) (*efgsapi.DownloadedBatchRecord, error)
+	SaveBatchImports(imports []*efgsapi.BatchImportRecord) error
+	UpdateBatchImport(record *efgsapi.BatchImportRecord) error
+	GetDownloadedBatches(dateFrom string, dateTo string) ([]*efgsapi.DownloadedBatchRecord, error)
+	GetDueImportRetries(now time.Time) ([]*efgsapi.BatchImportRecord, error)
+	SaveImportedKeys(keys []*efgsapi.ImportedKeyRecord) error
+	GetRevisionTokens(keys []string) (map[string]string, error)
+}
+
+//BatchGap Batch which is missing in the download ledger or whose keys were not imported.
+type BatchGap struct {
+	Date     string `json:"date"`
+	BatchTag string `json:"batchTag"`
+	Reason   string `json:"reason"`
+}
+
+// importDownloadedBatch Records the downloaded batch in the ledger and enqueues its keys for import. Returns count of
+// keys imported as CZ ones.
+func importDownloadedBatch(ctx context.Context, config *downloadConfig, now time.Time, date string, requestedTag string, batch *efgsapi.DownloadedBatch) (int, error) {
+	logger := logging.FromContext(ctx).Named("efgs.importDownloadedBatch")
+
+	record := &efgsapi.DownloadedBatchRecord{
+		Date:         date,
+		BatchTag:     batch.BatchTag,
+		NextBatchTag: batch.NextBatchTag,
+		First:        requestedTag == "",
+		KeysCount:    len(batch.Keys),
+		Quarantined:  batch.Quarantined,
+		DownloadedAt: now,
+	}
+
+	if err := config.Ledger.SaveDownloadedBatch(record); err != nil {
+		logger.Errorf("Could not save batch '%v' to download ledger: %v", batch.BatchTag, err)
+		return 0, err
+	}
+
+	if len(batch.Keys) == 0 {
+		return 0, nil
+	}
+
+	logger.Infof("Going to enqueue %v keys from batch '%v'", len(batch.Keys), batch.BatchTag)
+
+	return enqueueForImport(ctx, config, now, efgsapi.BatchDownloadParams{Date: date, BatchTag: batch.BatchTag}, batch.Keys)
+}
+
+// isDownloadedBatch Checks whether the batch is already in the download ledger, so it's not imported twice: a batch
+// announced by EFGS callback is reached by polling too and the announcement may be redelivered. Only replay imports
+// recorded batches again. When the recorded batch was requested as the first one of the day, it's marked so.
+func isDownloadedBatch(ctx context.Context, config *downloadConfig, date string, requestedTag string, batchTag string) (bool, error) {
+	logger := logging.FromContext(ctx).Named("efgs.isDownloadedBatch")
+
+	record, err := config.Ledger.GetDownloadedBatch(date, batchTag)
+	if err != nil {
+		logger.Errorf("Could not get batch '%v' from download ledger: %v", batchTag, err)
+		return false, err
+	}
+
+	if record == nil {
+		return false, nil
+	}
+
+	logger.Infof("Batch '%v' from %v was already downloaded at %v, skipping", batchTag, date, record.DownloadedAt)
+
+	if requestedTag == "" && !record.First {
+		record.First = true
+		if err := config.Ledger.SaveDownloadedBatch(record); err != nil {
+			logger.Errorf("Could not save batch '%v' to download ledger: %v", batchTag, err)
+			return true, err
+		}
+	}
+
+	return true, nil
+}
+
+// recordEnqueueFailure Marks the import as failed in the ledger, when its keys couldn't be enqueued.
+func recordEnqueueFailure(ctx context.Context, ledger downloadLedger, now time.Time, params *efgsapi.BatchImportParams, enqueueErr error) {
+	logger := logging.FromContext(ctx).Named("efgs.recordEnqueueFailure")
+
+	record := &efgsapi.BatchImportRecord{
+		Date:      params.Date,
+		BatchTag:  params.BatchTag,
+		Country:   params.Country,
+		Part:      params.Part,
+		KeysCount: len(params.Keys),
+		Status:    efgsapi.ImportStatusFailed,
+		Error:     enqueueErr.Error(),
+		UpdatedAt: now,
+	}
+
+	if err := ledger.UpdateBatchImport(record); err != nil {
+		logger.Warnf("Could not update import of batch '%v' in download ledger: %v", params.BatchTag, err)
+	}
+}
+
+// findGaps Finds batches which are missing in the ledger or weren't imported. The batches must be from the dates
+// given, which are all checked for presence of the first batch of the day.
+func findGaps(dates []string, batches []*efgsapi.DownloadedBatchRecord, now time.Time) []BatchGap {
+	recorded := make(map[string]bool)
+	hasFirst := make(map[string]bool)
+
+	for _, batch := range batches {
+		recorded[batch.Date+"/"+batch.BatchTag] = true
+		if batch.First {
+			hasFirst[batch.Date] = true
+		}
+	}
+
+	var gaps []BatchGap
+
+	for _, date := range dates {
+		if !hasFirst[date] {
+			gaps = append(gaps, BatchGap{Date: date, Reason: "First batch of the day was not downloaded"})
+		}
+	}
+
+	for _, batch := range batches {
+		if batch.NextBatchTag != "" && !recorded[batch.Date+"/"+batch.NextBatchTag] {
+			gaps = append(gaps, BatchGap{
+				Date:     batch.Date,
+				BatchTag: batch.NextBatchTag,
+				Reason:   fmt.Sprintf("Batch following '%v' was not downloaded", batch.BatchTag),
+			})
+		}
+
+		for _, record := range batch.Imports {
+			failed := record.Status == efgsapi.ImportStatusFailed || record.Status == efgsapi.ImportStatusDeadLettered
+			pending := record.Status == efgsapi.ImportStatusEnqueued || record.Status == efgsapi.ImportStatusRetrying
+			stuck := pending && now.Sub(record.UpdatedAt) > importStuckAfter
+
+			if failed || stuck {
+				gaps = append(gaps, BatchGap{
+					Date:     batch.Date,
+					BatchTag: batch.BatchTag,
+					Reason:   fmt.Sprintf("Import of part %v for %v is %v", record.Part, record.Country, record.Status),
+				})
+				break
+			}
+		}
+	}
+
+	sort.SliceStable(gaps, func(i, j int) bool {
+		return gaps[i].Date < gaps[j].Date
+	})
+
+	return gaps
+}
@@ -0,0 +1,340 @@
+package efgs
+
+import (
+	"context"
+	"fmt"
+	efgsapi "github.com/covid19cz/erouska-backend/internal/functions/efgs/api"
+	"github.com/covid19cz/erouska-backend/internal/functions/efgs/efgstest"
+	urlutils "net/url"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryLedger Download ledger kept in memory, replacing records the same way as the database does.
+type memoryLedger struct {
+	mutex   sync.Mutex
+	batches map[string]*efgsapi.DownloadedBatchRecord
+	imports map[string]*efgsapi.BatchImportRecord
+	keys    map[string]*efgsapi.ImportedKeyRecord
+	order   []string
+}
+
+func newMemoryLedger() *memoryLedger {
+	return &memoryLedger{
+		batches: make(map[string]*efgsapi.DownloadedBatchRecord),
+		imports: make(map[string]*efgsapi.BatchImportRecord),
+		keys:    make(map[string]*efgsapi.ImportedKeyRecord),
+	}
+}
+
+func importID(record *efgsapi.BatchImportRecord) string {
+	return fmt.Sprintf("%v/%v/%v/%v", record.Date, record.BatchTag, record.Country, record.Part)
+}
+
+func (l *memoryLedger) SaveDownloadedBatch(batch *efgsapi.DownloadedBatchRecord) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	id := batch.Date + "/" + batch.BatchTag
+	record := *batch
+
+	if existing, found := l.batches[id]; found {
+		record.First = record.First || existing.First
+	} else {
+		l.order = append(l.order, id)
+	}
+
+	l.batches[id] = &record
+	return nil
+}
+
+func (l *memoryLedger) SaveBatchImports(imports []*efgsapi.BatchImportRecord) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, record := range imports {
+		copied := *record
+		l.imports[importID(record)] = &copied
+	}
+	return nil
+}
+
+func (l *memoryLedger) UpdateBatchImport(record *efgsapi.BatchImportRecord) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if existing, found := l.imports[importID(record)]; found {
+		existing.Status = record.Status
+		existing.Error = record.Error
+		existing.Inserted = record.Inserted
+		existing.Rejected = record.Rejected
+		existing.ErrorCode = record.ErrorCode
+		existing.Attempts = record.Attempts
+		existing.NextAttemptAt = record.NextAttemptAt
+		existing.RevisionToken = record.RevisionToken
+		existing.Payload = record.Payload
+		existing.UpdatedAt = record.UpdatedAt
+	}
+	return nil
+}
+
+func (l *memoryLedger) GetDueImportRetries(now time.Time) ([]*efgsapi.BatchImportRecord, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var imports []*efgsapi.BatchImportRecord
+	for _, record := range l.imports {
+		if record.Status == efgsapi.ImportStatusRetrying && !record.NextAttemptAt.After(now) {
+			copied := *record
+			imports = append(imports, &copied)
+		}
+	}
+	return imports, nil
+}
+
+func (l *memoryLedger) SaveImportedKeys(keys []*efgsapi.ImportedKeyRecord) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for _, key := range keys {
+		copied := *key
+		l.keys[key.KeyData] = &copied
+	}
+	return nil
+}
+
+func (l *memoryLedger) GetRevisionTokens(keys []string) (map[string]string, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	tokens := make(map[string]string)
+	for _, keyData := range keys {
+		key, found := l.keys[keyData]
+		if !found {
+			continue
+		}
+
+		record, found := l.imports[fmt.Sprintf("%v/%v/%v/%v", key.Date, key.BatchTag, key.Country, key.Part)]
+		if found && record.RevisionToken != "" {
+			tokens[keyData] = record.RevisionToken
+		}
+	}
+	return tokens, nil
+}
+
+func (l *memoryLedger) GetDownloadedBatch(date string, batchTag string) (*efgsapi.DownloadedBatchRecord, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	batch, found := l.batches[date+"/"+batchTag]
+	if !found {
+		return nil, nil
+	}
+
+	copied := *batch
+	return &copied, nil
+}
+
+func (l *memoryLedger) GetDownloadedBatches(dateFrom string, dateTo string) ([]*efgsapi.DownloadedBatchRecord, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var batches []*efgsapi.DownloadedBatchRecord
+
+	for _, id := range l.order {
+		batch := *l.batches[id]
+		if batch.Date < dateFrom || batch.Date > dateTo {
+			continue
+		}
+
+		for _, record := range l.imports {
+			if record.Date == batch.Date && record.BatchTag == batch.BatchTag {
+				copied := *record
+				batch.Imports = append(batch.Imports, &copied)
+			}
+		}
+
+		sort.Slice(batch.Imports, func(i, j int) bool { return importID(batch.Imports[i]) < importID(batch.Imports[j]) })
+
+		batches = append(batches, &batch)
+	}
+
+	return batches, nil
+}
+
+func TestFindGaps(t *testing.T) {
+	now := time.Date(2020, 12, 11, 12, 0, 0, 0, time.UTC)
+
+	imported := func(country string) *efgsapi.BatchImportRecord {
+		return &efgsapi.BatchImportRecord{Country: country, Status: efgsapi.ImportStatusImported, UpdatedAt: now.Add(-5 * time.Hour)}
+	}
+
+	tests := []struct {
+		name    string
+		batches []*efgsapi.DownloadedBatchRecord
+		want    []BatchGap
+	}{
+		{
+			name: "complete chain",
+			batches: []*efgsapi.DownloadedBatchRecord{
+				{Date: "2020-12-10", BatchTag: "a", NextBatchTag: "b", First: true, Imports: []*efgsapi.BatchImportRecord{imported("DE")}},
+				{Date: "2020-12-10", BatchTag: "b"},
+			},
+		},
+		{
+			name: "missing first batch",
+			batches: []*efgsapi.DownloadedBatchRecord{
+				{Date: "2020-12-10", BatchTag: "b"},
+			},
+			want: []BatchGap{{Date: "2020-12-10", Reason: "First batch of the day was not downloaded"}},
+		},
+		{
+			name: "missing batch in the chain",
+			batches: []*efgsapi.DownloadedBatchRecord{
+				{Date: "2020-12-10", BatchTag: "a", NextBatchTag: "b", First: true},
+				{Date: "2020-12-10", BatchTag: "c"},
+			},
+			want: []BatchGap{{Date: "2020-12-10", BatchTag: "b", Reason: "Batch following 'a' was not downloaded"}},
+		},
+		{
+			name: "failed and stuck imports",
+			batches: []*efgsapi.DownloadedBatchRecord{
+				{Date: "2020-12-10", BatchTag: "a", NextBatchTag: "b", First: true, Imports: []*efgsapi.BatchImportRecord{
+					imported("AT"),
+					{Country: "DE", Part: 1, Status: efgsapi.ImportStatusFailed},
+				}},
+				{Date: "2020-12-10", BatchTag: "b", NextBatchTag: "c", Imports: []*efgsapi.BatchImportRecord{
+					{Country: "DE", Status: efgsapi.ImportStatusEnqueued, UpdatedAt: now.Add(-3 * time.Hour)},
+				}},
+				{Date: "2020-12-10", BatchTag: "c", Imports: []*efgsapi.BatchImportRecord{
+					{Country: "DE", Status: efgsapi.ImportStatusEnqueued, UpdatedAt: now.Add(-time.Minute)},
+				}},
+			},
+			want: []BatchGap{
+				{Date: "2020-12-10", BatchTag: "a", Reason: "Import of part 1 for DE is failed"},
+				{Date: "2020-12-10", BatchTag: "b", Reason: "Import of part 0 for DE is enqueued"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := findGaps([]string{"2020-12-10"}, tt.batches, now); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("findGaps() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayBatches(t *testing.T) {
+	sim := efgstest.NewServer()
+	defer sim.Close()
+
+	now := time.Now()
+	today := now.Format("2006-01-02")
+
+	first := sim.AddBatch(today, efgstest.Upload{Country: "DE", Keys: newSimulatorKeys("DE", 0, 2, now)})
+	second := sim.AddBatch(today, efgstest.Upload{Country: "AT", Keys: newSimulatorKeys("AT", 0, 1, now)})
+	third := sim.AddBatch(today, efgstest.Upload{Country: "DE", Keys: newSimulatorKeys("DE", 2, 1, now)})
+
+	publisher := &recordingPublisher{}
+	config := newSimulatorDownloadConfig(t, sim, publisher)
+	ledger := config.Ledger.(*memoryLedger)
+
+	ctx := context.Background()
+
+	// the second batch was missed, e.g. because the download cursor was lost
+	for _, tag := range []string{"", third} {
+		batch, err := downloadVerifiedKeys(ctx, config, today, tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = importDownloadedBatch(ctx, config, now, today, tag, batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	gaps, err := detectGaps(ctx, config, now, today, today)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantGaps := []BatchGap{{Date: today, BatchTag: second, Reason: "Batch following '" + first + "' was not downloaded"}}
+	if !reflect.DeepEqual(gaps, wantGaps) {
+		t.Fatalf("detectGaps() = %+v, want %+v", gaps, wantGaps)
+	}
+
+	replayed, err := replayBatches(ctx, config, now, &replayRequest{DateFrom: today, DateTo: today, OnlyGaps: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []efgsapi.BatchDownloadParams{{Date: today, BatchTag: second}}; !reflect.DeepEqual(replayed, want) {
+		t.Fatalf("replayBatches() = %+v, want %+v", replayed, want)
+	}
+
+	if imported := importedKeys(publisher); !reflect.DeepEqual(imported, map[string]int{"haid-de": 3, "haid-at": 1}) {
+		t.Fatalf("Enqueued %v keys for import", imported)
+	}
+
+	// import of the first batch fails for good, replay of whole day enqueues everything again
+
+	publishConfig := &publishConfig{Ledger: ledger, PubSubClient: &recordingPublisher{}, MaxImportAttempts: 1}
+
+	for _, msg := range publisher.messages {
+		params := msg.(efgsapi.BatchImportParams)
+		var importErr error
+		if params.BatchTag == first {
+			importErr = context.DeadlineExceeded
+		}
+		if err = handleImportResult(ctx, publishConfig, now, &params, &importOutcome{}, importErr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if gaps, _ = detectGaps(ctx, config, now, today, today); len(gaps) != 1 || gaps[0].BatchTag != first {
+		t.Fatalf("detectGaps() = %+v, want failed import of %v", gaps, first)
+	}
+
+	replayed, err = replayBatches(ctx, config, now, &replayRequest{DateFrom: today, DateTo: today})
+	if err != nil || len(replayed) != 3 {
+		t.Fatalf("replayBatches() = %+v, error %v; want all 3 batches", replayed, err)
+	}
+
+	if imported := importedKeys(publisher); !reflect.DeepEqual(imported, map[string]int{"haid-de": 6, "haid-at": 2}) {
+		t.Fatalf("Enqueued %v keys for import", imported)
+	}
+
+	if gaps, _ = detectGaps(ctx, config, now, today, today); len(gaps) != 0 {
+		t.Fatalf("detectGaps() = %+v after replay, want none", gaps)
+	}
+}
+
+func TestParseReplayRequest(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    *replayRequest
+		wantErr bool
+	}{
+		{query: "date=2020-12-10", want: &replayRequest{DateFrom: "2020-12-10", DateTo: "2020-12-10"}},
+		{query: "from=2020-12-01&to=2020-12-10&onlyGaps=true", want: &replayRequest{DateFrom: "2020-12-01", DateTo: "2020-12-10", OnlyGaps: true}},
+		{query: "date=2020-12-10&batchTag=abc", want: &replayRequest{DateFrom: "2020-12-10", DateTo: "2020-12-10", BatchTag: "abc"}},
+		{query: "", wantErr: true},
+		{query: "from=2020-12-10&to=2020-12-01", wantErr: true},
+		{query: "from=2020-11-01&to=2020-12-10", wantErr: true},
+		{query: "from=2020-12-01&to=2020-12-10&batchTag=abc", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			query, _ := urlutils.ParseQuery(tt.query)
+			got, err := parseReplayRequest(query)
+			if (err != nil) != tt.wantErr || !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parseReplayRequest() = %+v, error %v; want %+v", got, err, tt.want)
+			}
+		})
+	}
+}
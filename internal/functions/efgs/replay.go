@@ -0,0 +1,221 @@
+package efgs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	efgsapi "github.com/covid19cz/erouska-backend/internal/functions/efgs/api"
+	"github.com/covid19cz/erouska-backend/internal/logging"
+	"net/http"
+	urlutils "net/url"
+	"time"
+)
+
+// maxReplayDays EFGS keeps batches for 14 days, there's nothing to download behind that.
+const maxReplayDays = 14
+
+type replayRequest struct {
+	DateFrom string
+	DateTo   string
+	// BatchTag Replay only this batch (from DateFrom).
+	BatchTag string
+	// OnlyGaps Replay only batches found by gap detection.
+	OnlyGaps bool
+}
+
+//ReplayBatches Detects gaps in the download ledger (GET) or re-downloads and re-imports batches from EFGS (POST).
+//Query parameters: `date` or `from` and `to` (inclusive), optionally `batchTag` for replaying a single batch, or
+//`onlyGaps=true` for replaying only the detected gaps.
+func ReplayBatches(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.FromContext(ctx).Named("efgs.ReplayBatches")
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, "Only GET and POST are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	request, err := parseReplayRequest(r.URL.Query())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	config, err := loadDownloadConfig(ctx)
+	if err != nil {
+		logger.Errorf("Could not load config: %+v", err)
+		http.Error(w, fmt.Sprintf("Error: %v", err), 500)
+		return
+	}
+
+	now := time.Now()
+
+	var response interface{}
+
+	if r.Method == http.MethodGet {
+		gaps, err := detectGaps(ctx, config, now, request.DateFrom, request.DateTo)
+		if err != nil {
+			logger.Errorf("Could not detect gaps: %+v", err)
+			http.Error(w, fmt.Sprintf("Error: %v", err), 500)
+			return
+		}
+
+		for _, gap := range gaps {
+			// logged as error so it's picked up by the alerting
+			logger.Errorf("EFGS download gap: %+v", gap)
+		}
+
+		response = map[string]interface{}{"gaps": gaps}
+	} else {
+		replayed, err := replayBatches(ctx, config, now, request)
+		if err != nil {
+			logger.Errorf("Could not replay batches: %+v", err)
+			http.Error(w, fmt.Sprintf("Error: %v (replayed %v batches)", err, len(replayed)), 500)
+			return
+		}
+
+		response = map[string]interface{}{"replayed": replayed}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(response); err != nil {
+		logger.Warnf("Could not write response: %v", err)
+	}
+}
+
+func parseReplayRequest(query urlutils.Values) (*replayRequest, error) {
+	request := &replayRequest{
+		DateFrom: query.Get("from"),
+		DateTo:   query.Get("to"),
+		BatchTag: query.Get("batchTag"),
+		OnlyGaps: query.Get("onlyGaps") == "true",
+	}
+
+	if date := query.Get("date"); date != "" {
+		request.DateFrom = date
+		request.DateTo = date
+	}
+
+	if request.DateTo == "" {
+		request.DateTo = request.DateFrom
+	}
+
+	from, err := time.Parse("2006-01-02", request.DateFrom)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid date '%v'", request.DateFrom)
+	}
+
+	to, err := time.Parse("2006-01-02", request.DateTo)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid date '%v'", request.DateTo)
+	}
+
+	if to.Before(from) || to.Sub(from) >= maxReplayDays*24*time.Hour {
+		return nil, fmt.Errorf("Invalid date range %v - %v, at most %v days are allowed", request.DateFrom, request.DateTo, maxReplayDays)
+	}
+
+	if request.BatchTag != "" && (request.DateTo != request.DateFrom || request.OnlyGaps) {
+		return nil, fmt.Errorf("Single batch can be replayed only for single date")
+	}
+
+	return request, nil
+}
+
+func detectGaps(ctx context.Context, config *downloadConfig, now time.Time, dateFrom string, dateTo string) ([]BatchGap, error) {
+	logger := logging.FromContext(ctx).Named("efgs.detectGaps")
+
+	batches, err := config.Ledger.GetDownloadedBatches(dateFrom, dateTo)
+	if err != nil {
+		return nil, err
+	}
+
+	gaps := findGaps(datesBetween(dateFrom, dateTo), batches, now)
+
+	logger.Infof("Found %v gaps in %v downloaded batches from %v - %v", len(gaps), len(batches), dateFrom, dateTo)
+
+	return gaps, nil
+}
+
+// replayBatches Re-downloads the batches and enqueues their keys for import again. Whole days are replayed by following
+// the chain of batches; gaps are replayed by following the chain until an already recorded batch is reached.
+func replayBatches(ctx context.Context, config *downloadConfig, now time.Time, request *replayRequest) ([]efgsapi.BatchDownloadParams, error) {
+	logger := logging.FromContext(ctx).Named("efgs.replayBatches")
+
+	var queue []efgsapi.BatchDownloadParams
+	recorded := make(map[string]bool)
+
+	switch {
+	case request.BatchTag != "":
+		queue = append(queue, efgsapi.BatchDownloadParams{Date: request.DateFrom, BatchTag: request.BatchTag})
+	case request.OnlyGaps:
+		batches, err := config.Ledger.GetDownloadedBatches(request.DateFrom, request.DateTo)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, batch := range batches {
+			recorded[batch.Date+"/"+batch.BatchTag] = true
+		}
+
+		for _, gap := range findGaps(datesBetween(request.DateFrom, request.DateTo), batches, now) {
+			logger.Infof("Going to replay gap: %+v", gap)
+			queue = append(queue, efgsapi.BatchDownloadParams{Date: gap.Date, BatchTag: gap.BatchTag})
+		}
+	default:
+		for _, date := range datesBetween(request.DateFrom, request.DateTo) {
+			queue = append(queue, efgsapi.BatchDownloadParams{Date: date})
+		}
+	}
+
+	var replayed []efgsapi.BatchDownloadParams
+	done := make(map[string]bool)
+
+	for len(queue) > 0 {
+		params := queue[0]
+		queue = queue[1:]
+
+		if params.BatchTag != "" && done[params.Date+"/"+params.BatchTag] {
+			continue
+		}
+
+		batch, err := downloadVerifiedKeys(ctx, config, params.Date, params.BatchTag)
+		if err != nil {
+			return replayed, err
+		}
+
+		if batch == nil {
+			logger.Warnf("Batch '%v' from %v doesn't exist in EFGS", params.BatchTag, params.Date)
+			continue
+		}
+
+		if _, err = importDownloadedBatch(ctx, config, now, params.Date, params.BatchTag, batch); err != nil {
+			return replayed, err
+		}
+
+		done[params.Date+"/"+batch.BatchTag] = true
+		replayed = append(replayed, efgsapi.BatchDownloadParams{Date: params.Date, BatchTag: batch.BatchTag})
+
+		logger.Infof("Replayed batch '%v' from %v with %v keys", batch.BatchTag, params.Date, len(batch.Keys))
+
+		if request.BatchTag != "" || batch.NextBatchTag == "" || recorded[params.Date+"/"+batch.NextBatchTag] {
+			continue
+		}
+
+		queue = append(queue, efgsapi.BatchDownloadParams{Date: params.Date, BatchTag: batch.NextBatchTag})
+	}
+
+	return replayed, nil
+}
+
+// datesBetween Lists dates from - to (inclusive), the dates must be valid.
+func datesBetween(from string, to string) []string {
+	start, _ := time.Parse("2006-01-02", from)
+	end, _ := time.Parse("2006-01-02", to)
+
+	var dates []string
+	for date := start; !date.After(end); date = date.AddDate(0, 0, 1) {
+		dates = append(dates, date.Format("2006-01-02"))
+	}
+
+	return dates
+}
@@ -0,0 +1,560 @@
+package efgs
+
+import (
+	"context"
+	"fmt"
+	"github.com/covid19cz/erouska-backend/internal/constants"
+	"github.com/covid19cz/erouska-backend/internal/counters"
+	"github.com/covid19cz/erouska-backend/internal/firebase/structs"
+	efgsapi "github.com/covid19cz/erouska-backend/internal/functions/efgs/api"
+	efgsconstants "github.com/covid19cz/erouska-backend/internal/functions/efgs/constants"
+	"github.com/covid19cz/erouska-backend/internal/functions/efgs/efgstest"
+	efgsutils "github.com/covid19cz/erouska-backend/internal/functions/efgs/utils"
+	"github.com/covid19cz/erouska-backend/internal/store"
+	redisclient "github.com/go-redis/redis/v8"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newSimulatorKeys(origin string, from int, count int, now time.Time) []*efgsapi.DiagnosisKey {
+	today := uint32(now.Unix()/600) / 144 * 144
+
+	keys := make([]*efgsapi.DiagnosisKey, count)
+	for i := range keys {
+		keys[i] = &efgsapi.DiagnosisKey{
+			KeyData:                    []byte(fmt.Sprintf("%v-simkey-%06d", origin, from+i)),
+			RollingStartIntervalNumber: today - uint32(i*144),
+			RollingPeriod:              144,
+			TransmissionRiskLevel:      2,
+			VisitedCountries:           []string{"DE", "AT"},
+			Origin:                     origin,
+			ReportType:                 efgsapi.ReportType_CONFIRMED_TEST,
+		}
+	}
+	return keys
+}
+
+func newSimulatorKeyPair(t *testing.T, commonName string) *efgsutils.X509KeyPair {
+	pair, err := efgstest.NewKeyPair(commonName, czCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pair.PEM
+}
+
+func newSimulatorDownloadConfig(t *testing.T, sim *efgstest.Server, publisher *recordingPublisher) *downloadConfig {
+	storeClient := store.NewMemoryClient()
+
+	return &downloadConfig{
+		Env:            efgsutils.EnvLocal,
+		Client:         sim.Client(),
+		URL:            sim.BaseURL(),
+		NBTLSPair:      newSimulatorKeyPair(t, "NBTLS CZ"),
+		HaidMappings:   map[string]string{"de": "haid-de", "at": "haid-at"},
+		PubSubClient:   publisher,
+		RedisClient:    fakeRedis{},
+		CountersClient: counters.Client{Store: storeClient},
+		StoreClient:    storeClient,
+		Ledger:         newMemoryLedger(),
+		TrustList: trustedThumbprints{
+			"DE": {efgsutils.CertificateThumbprint(sim.SigningCertificate("DE"))},
+			"AT": {efgsutils.CertificateThumbprint(sim.SigningCertificate("AT"))},
+		},
+		VerifyBatchSignatures:    true,
+		MaxKeysOnPublish:         30,
+		MaxIntervalAge:           15,
+		MaxSameStartIntervalKeys: 15,
+		DownloadConcurrency:      3,
+		DownloadProtobuf:         true,
+	}
+}
+
+// importedKeys Counts keys enqueued for import, by HAID.
+func importedKeys(publisher *recordingPublisher) map[string]int {
+	imported := make(map[string]int)
+	for _, msg := range publisher.messages {
+		params := msg.(efgsapi.BatchImportParams)
+		imported[params.HAID] += len(params.Keys)
+	}
+	return imported
+}
+
+type fakeRedis map[string]string
+
+func (r fakeRedis) Get(key string) (string, error) {
+	val, found := r[key]
+	if !found {
+		return "", redisclient.Nil
+	}
+	return val, nil
+}
+
+func (r fakeRedis) Set(key string, value interface{}, ttl time.Duration) error {
+	r[key] = fmt.Sprintf("%v", value)
+	return nil
+}
+
+func TestUploadBatchToSimulator(t *testing.T) {
+	sim := efgstest.NewServer()
+	defer sim.Close()
+
+	url := sim.BaseURL()
+	url.Path = "diagnosiskeys/upload"
+
+	config := &uploadConfig{
+		URL:       url,
+		Env:       efgsutils.EnvLocal,
+		NBTLSPair: newSimulatorKeyPair(t, "NBTLS CZ"),
+		NBBSPair:  newSimulatorKeyPair(t, "NBBS CZ"),
+		Client:    sim.Client(),
+	}
+
+	ctx := context.Background()
+	now := time.Now()
+
+	upload := func(batchTag string, keys []*efgsapi.DiagnosisKey) (*efgsapi.UploadBatchResponse, error) {
+		sortDiagnosisKey(keys)
+		batch := makeBatch(keys)
+		config.BatchTag = batchTag
+		return uploadBatch(ctx, &batch, config)
+	}
+
+	keys := newSimulatorKeys(czCode, 0, 3, now)
+
+	resp, err := upload("20201210-a", keys)
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("uploadBatch() = %+v, error %v; want 201", resp, err)
+	}
+
+	if uploads := sim.Uploads(); len(uploads) != 1 || len(uploads[0].Keys) != 3 {
+		t.Fatalf("Simulator has %+v uploads, want one with 3 keys", uploads)
+	}
+
+	// one key was already uploaded, one fails to be stored
+	moreKeys := append(newSimulatorKeys(czCode, 3, 2, now), keys[0])
+	failing := string(moreKeys[1].KeyData)
+	sim.FailKey = func(key *efgsapi.DiagnosisKey) bool { return string(key.KeyData) == failing }
+
+	resp, err = upload("20201210-b", moreKeys)
+	if err != nil || resp.StatusCode != http.StatusMultiStatus {
+		t.Fatalf("uploadBatch() = %+v, error %v; want 207", resp, err)
+	}
+
+	if len(resp.Success) != 1 || len(resp.Duplicate) != 1 || len(resp.Error) != 1 {
+		t.Fatalf("uploadBatch() = %+v, want one created, one duplicate and one failed key", resp)
+	}
+
+	if string(moreKeys[resp.Error[0]].KeyData) != failing {
+		t.Fatalf("uploadBatch() reported key %v as failed, want %v", resp.Error[0], failing)
+	}
+
+	// revised key differs from the uploaded one, so it's stored again; the revision itself only once
+	revised := func() []*efgsapi.DiagnosisKey {
+		key := keys[1]
+		return []*efgsapi.DiagnosisKey{{
+			KeyData:                    key.KeyData,
+			RollingStartIntervalNumber: key.RollingStartIntervalNumber,
+			RollingPeriod:              key.RollingPeriod,
+			TransmissionRiskLevel:      key.TransmissionRiskLevel,
+			VisitedCountries:           key.VisitedCountries,
+			Origin:                     key.Origin,
+			ReportType:                 efgsapi.ReportType_REVOKED,
+			DaysSinceOnsetOfSymptoms:   key.DaysSinceOnsetOfSymptoms,
+		}}
+	}
+
+	resp, err = upload("20201210-r1", revised())
+	if err != nil || resp.StatusCode != http.StatusCreated {
+		t.Fatalf("uploadBatch() of revised key = %+v, error %v; want 201", resp, err)
+	}
+
+	resp, err = upload("20201210-r2", revised())
+	if err != nil || resp.StatusCode != http.StatusMultiStatus || len(resp.Duplicate) != 1 {
+		t.Fatalf("uploadBatch() of revised key again = %+v, error %v; want duplicate", resp, err)
+	}
+
+	if _, err = upload("20201210-b", newSimulatorKeys(czCode, 10, 1, now)); err == nil {
+		t.Fatalf("uploadBatch() with existing batch tag succeeded")
+	}
+
+	resp, err = upload("20201210-c", newSimulatorKeys("DE", 0, 1, now))
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("uploadBatch() of foreign keys = %+v, error %v; want 400", resp, err)
+	}
+}
+
+func TestDownloadFromSimulator(t *testing.T) {
+	sim := efgstest.NewServer()
+	defer sim.Close()
+
+	now := time.Now()
+	today := now.Format("2006-01-02")
+
+	sim.AddBatch(today, efgstest.Upload{Country: "DE", Keys: newSimulatorKeys("DE", 0, 3, now)}, efgstest.Upload{Country: "AT", Keys: newSimulatorKeys("AT", 0, 2, now)})
+	sim.AddBatch(today, efgstest.Upload{Country: czCode, Keys: newSimulatorKeys(czCode, 0, 2, now)})
+	sim.AddBatch(today, efgstest.Upload{Country: "DE", Keys: newSimulatorKeys("DE", 3, 1, now)})
+
+	publisher := &recordingPublisher{}
+	config := newSimulatorDownloadConfig(t, sim, publisher)
+
+	ctx := context.Background()
+
+	if err := downloadAllRecursively(ctx, config, now, efgsapi.BatchDownloadParams{Date: today}); err != nil {
+		t.Fatalf("downloadAllRecursively() error = %v", err)
+	}
+
+	if imported := importedKeys(publisher); imported["haid-de"] != 4 || imported["haid-at"] != 2 || len(imported) != 2 {
+		t.Fatalf("Enqueued %v keys for import, want 4 from DE and 2 from AT", imported)
+	}
+}
+
+func TestDownloadKeysOfReportTypes(t *testing.T) {
+	sim := efgstest.NewServer()
+	defer sim.Close()
+
+	now := time.Now()
+	today := now.Format("2006-01-02")
+
+	withReportType := func(keys []*efgsapi.DiagnosisKey, reportType efgsapi.ReportType) []*efgsapi.DiagnosisKey {
+		for _, key := range keys {
+			key.ReportType = reportType
+		}
+		return keys
+	}
+
+	var keys []*efgsapi.DiagnosisKey
+	keys = append(keys, withReportType(newSimulatorKeys("DE", 0, 1, now), efgsapi.ReportType_REVOKED)...)
+	keys = append(keys, withReportType(newSimulatorKeys("DE", 1, 2, now), efgsapi.ReportType_CONFIRMED_CLINICAL_DIAGNOSIS)...)
+	keys = append(keys, withReportType(newSimulatorKeys("DE", 3, 1, now), efgsapi.ReportType_SELF_REPORT)...)
+	keys = append(keys, newSimulatorKeys("DE", 4, 3, now)...)
+
+	sim.AddBatch(today, efgstest.Upload{Country: "DE", Keys: keys})
+
+	publisher := &recordingPublisher{}
+	config := newSimulatorDownloadConfig(t, sim, publisher)
+
+	if err := downloadAllRecursively(context.Background(), config, now, efgsapi.BatchDownloadParams{Date: today}); err != nil {
+		t.Fatalf("downloadAllRecursively() error = %v", err)
+	}
+
+	// self-reported keys can't be imported; parts of the other test types are numbered in fixed order
+	want := []struct {
+		testType string
+		keys     int
+	}{
+		{testType: efgsapi.TestTypeConfirmed, keys: 3},
+		{testType: efgsapi.TestTypeLikely, keys: 2},
+		{testType: efgsapi.TestTypeNegative, keys: 1},
+	}
+
+	if len(publisher.messages) != len(want) {
+		t.Fatalf("Enqueued %v imports, want %v", len(publisher.messages), len(want))
+	}
+
+	for part, w := range want {
+		params := publisher.messages[part].(efgsapi.BatchImportParams)
+		if params.Part != part || params.TestType != w.testType || len(params.Keys) != w.keys {
+			t.Fatalf("Import %v = part %v of %v keys of %v test type, want %v keys of %v test type", part, params.Part, len(params.Keys), params.TestType, w.keys, w.testType)
+		}
+	}
+
+	batches, _ := config.Ledger.GetDownloadedBatches(today, today)
+	if len(batches) != 1 || len(batches[0].Imports) != 3 || batches[0].Imports[2].TestType != efgsapi.TestTypeNegative {
+		t.Fatalf("Download ledger = %+v, want 3 imports with test types", batches)
+	}
+}
+
+func TestDownloadAllBatchesConcurrently(t *testing.T) {
+	sim := efgstest.NewServer()
+	defer sim.Close()
+
+	now := time.Now()
+	today := now.Format("2006-01-02")
+
+	for i := 0; i < 20; i++ {
+		sim.AddBatch(today, efgstest.Upload{Country: "DE", Keys: newSimulatorKeys("DE", i*2, 2, now)}, efgstest.Upload{Country: "AT", Keys: newSimulatorKeys("AT", i, 1, now)})
+	}
+
+	publisher := &recordingPublisher{}
+	config := newSimulatorDownloadConfig(t, sim, publisher)
+
+	ctx := context.Background()
+
+	if err := downloadAllRecursively(ctx, config, now, efgsapi.BatchDownloadParams{Date: today}); err != nil {
+		t.Fatalf("downloadAllRecursively() error = %v", err)
+	}
+
+	if imported := importedKeys(publisher); imported["haid-de"] != 40 || imported["haid-at"] != 20 {
+		t.Fatalf("Enqueued %v keys for import, want 40 from DE and 20 from AT", imported)
+	}
+
+	batches, _ := config.Ledger.GetDownloadedBatches(today, today)
+	if len(batches) != 20 {
+		t.Fatalf("Download ledger has %v batches, want 20", len(batches))
+	}
+
+	if gaps := findGaps([]string{today}, batches, now); len(gaps) != 0 {
+		t.Fatalf("findGaps() = %+v, want no gaps", gaps)
+	}
+
+	// failure of one batch stops the download
+	sim.AddBatch(today, efgstest.Upload{Country: "PL", Keys: newSimulatorKeys("PL", 0, 1, now)})
+	for i := 0; i < 10; i++ {
+		sim.AddBatch(today, efgstest.Upload{Country: "DE", Keys: newSimulatorKeys("DE", 100+i, 1, now)})
+	}
+
+	// PL isn't trusted, the batch would be quarantined instead
+	config.VerifyBatchSignatures = false
+
+	if err := downloadAllRecursively(ctx, config, now, efgsapi.BatchDownloadParams{Date: today}); err == nil {
+		t.Fatalf("downloadAllRecursively() with batch without HAID mapping succeeded")
+	}
+}
+
+func TestDownloadCountersCountEveryBatchOnce(t *testing.T) {
+	sim := efgstest.NewServer()
+	defer sim.Close()
+
+	now := time.Now()
+	today := now.Format("2006-01-02")
+
+	sim.AddBatch(today, efgstest.Upload{Country: "DE", Keys: newSimulatorKeys("DE", 0, 2, now)})
+	sim.AddBatch(today, efgstest.Upload{Country: "AT", Keys: newSimulatorKeys("AT", 0, 1, now)})
+
+	config := newSimulatorDownloadConfig(t, sim, &recordingPublisher{})
+
+	ctx := context.Background()
+
+	checkCounter := func(wantKeys int) {
+		t.Helper()
+
+		var counter structs.EfgsCounter
+		if err := config.CountersClient.Get(ctx, constants.CounterEfgs, counters.KeyTotal, &counter); err != nil {
+			t.Fatal(err)
+		}
+
+		if counter.KeysDownloaded != wantKeys {
+			t.Fatalf("Downloaded keys counter = %v, want %v", counter.KeysDownloaded, wantKeys)
+		}
+	}
+
+	download := func(wantKeys int) {
+		t.Helper()
+
+		// always from the first batch, like a retry of the whole download
+		if err := downloadAllRecursively(ctx, config, now, efgsapi.BatchDownloadParams{Date: today}); err != nil {
+			t.Fatalf("downloadAllRecursively() error = %v", err)
+		}
+
+		checkCounter(wantKeys)
+	}
+
+	download(3)
+	download(3)
+
+	// new batches are counted even when the download starts with the counted ones
+	sim.AddBatch(today, efgstest.Upload{Country: "DE", Keys: newSimulatorKeys("DE", 2, 4, now)})
+	download(7)
+
+	// batches reached by polling are counted as well, once
+	sim.AddBatch(today, efgstest.Upload{Country: "AT", Keys: newSimulatorKeys("AT", 1, 2, now)})
+	for i := 0; i < 5; i++ {
+		if err := downloadNextBatch(ctx, config, now); err != nil {
+			t.Fatalf("downloadNextBatch() error = %v", err)
+		}
+	}
+	checkCounter(9)
+}
+
+func TestDownloadNextBatchFollowsChain(t *testing.T) {
+	sim := efgstest.NewServer()
+	defer sim.Close()
+
+	now := time.Now()
+	today := now.Format("2006-01-02")
+
+	first := sim.AddBatch(today, efgstest.Upload{Country: "DE", Keys: newSimulatorKeys("DE", 0, 2, now)})
+	second := sim.AddBatch(today, efgstest.Upload{Country: "AT", Keys: newSimulatorKeys("AT", 0, 1, now)})
+
+	publisher := &recordingPublisher{}
+	config := newSimulatorDownloadConfig(t, sim, publisher)
+	redis := config.RedisClient.(fakeRedis)
+
+	// cursor from yesterday is discarded
+	redis[efgsconstants.RedisKeyNextBatch] = `{"date":"2020-12-09","batchTag":"20201209-5"}`
+
+	ctx := context.Background()
+
+	run := func(wantCursor downloadCursor, wantImported map[string]int) {
+		t.Helper()
+
+		if err := downloadNextBatch(ctx, config, now); err != nil {
+			t.Fatalf("downloadNextBatch() error = %v", err)
+		}
+
+		cursor, _ := loadDownloadCursor(config)
+		if cursor == nil || *cursor != wantCursor {
+			t.Fatalf("Download cursor = %+v, want %+v", cursor, wantCursor)
+		}
+
+		if imported := importedKeys(publisher); !reflect.DeepEqual(imported, wantImported) {
+			t.Fatalf("Enqueued %v keys for import, want %v", imported, wantImported)
+		}
+	}
+
+	run(downloadCursor{Date: today, NextBatchTag: second}, map[string]int{"haid-de": 2})
+	run(downloadCursor{Date: today, LastBatchTag: second}, map[string]int{"haid-de": 2, "haid-at": 1})
+
+	// end of the chain, nothing new
+	run(downloadCursor{Date: today, LastBatchTag: second}, map[string]int{"haid-de": 2, "haid-at": 1})
+
+	third := sim.AddBatch(today, efgstest.Upload{Country: "DE", Keys: newSimulatorKeys("DE", 2, 1, now)})
+
+	run(downloadCursor{Date: today, LastBatchTag: third}, map[string]int{"haid-de": 3, "haid-at": 1})
+
+	if first == second || second == third {
+		t.Fatalf("Simulator batch tags %v, %v, %v are not unique", first, second, third)
+	}
+}
+
+func TestAnnouncedBatchIsImportedOnce(t *testing.T) {
+	sim := efgstest.NewServer()
+	defer sim.Close()
+
+	now := time.Now()
+	today := now.Format("2006-01-02")
+
+	first := sim.AddBatch(today, efgstest.Upload{Country: "DE", Keys: newSimulatorKeys("DE", 0, 2, now)})
+	sim.AddBatch(today, efgstest.Upload{Country: "AT", Keys: newSimulatorKeys("AT", 0, 1, now)})
+
+	publisher := &recordingPublisher{}
+	config := newSimulatorDownloadConfig(t, sim, publisher)
+
+	ctx := context.Background()
+
+	check := func(wantImported map[string]int, wantDownloaded int) {
+		t.Helper()
+
+		if imported := importedKeys(publisher); !reflect.DeepEqual(imported, wantImported) {
+			t.Fatalf("Enqueued %v keys for import, want %v", imported, wantImported)
+		}
+
+		var counter structs.EfgsCounter
+		if err := config.CountersClient.Get(ctx, constants.CounterEfgs, counters.KeyTotal, &counter); err != nil {
+			t.Fatal(err)
+		}
+
+		if counter.KeysDownloaded != wantDownloaded {
+			t.Fatalf("Downloaded keys counter = %v, want %v", counter.KeysDownloaded, wantDownloaded)
+		}
+	}
+
+	// the announcement is redelivered
+	for i := 0; i < 2; i++ {
+		if err := downloadAnnouncedBatch(ctx, config, now, efgsapi.BatchDownloadParams{Date: today, BatchTag: first}); err != nil {
+			t.Fatalf("downloadAnnouncedBatch() error = %v", err)
+		}
+	}
+
+	check(map[string]int{"haid-de": 2}, 2)
+
+	// polling reaches the announced batch, then the next one
+	for i := 0; i < 2; i++ {
+		if err := downloadNextBatch(ctx, config, now); err != nil {
+			t.Fatalf("downloadNextBatch() error = %v", err)
+		}
+	}
+
+	check(map[string]int{"haid-de": 2, "haid-at": 1}, 3)
+
+	// download of the whole day
+	if err := downloadAllRecursively(ctx, config, now, efgsapi.BatchDownloadParams{Date: today}); err != nil {
+		t.Fatalf("downloadAllRecursively() error = %v", err)
+	}
+
+	check(map[string]int{"haid-de": 2, "haid-at": 1}, 3)
+
+	// polling has found the announced batch to be the first one of the day
+	gaps, err := detectGaps(ctx, config, now, today, today)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(gaps) != 0 {
+		t.Fatalf("detectGaps() = %+v, want none", gaps)
+	}
+}
+
+func TestManageCallbackInSimulator(t *testing.T) {
+	sim := efgstest.NewServer()
+	defer sim.Close()
+
+	config := &callbackRegistrationConfig{
+		Env:         efgsutils.EnvLocal,
+		Client:      sim.Client(),
+		URL:         sim.BaseURL(),
+		NBTLSPair:   newSimulatorKeyPair(t, "NBTLS CZ"),
+		CallbackID:  "erouska",
+		CallbackURL: "https://example.com/EfgsBatchCallback",
+	}
+
+	ctx := context.Background()
+
+	if err := manageCallback(ctx, config, http.MethodPut); err != nil {
+		t.Fatalf("manageCallback(PUT) error = %v", err)
+	}
+
+	if url := sim.Callbacks()["erouska"]; url != config.CallbackURL {
+		t.Fatalf("Registered callback URL = '%v', want '%v'", url, config.CallbackURL)
+	}
+
+	if err := manageCallback(ctx, config, http.MethodDelete); err != nil {
+		t.Fatalf("manageCallback(DELETE) error = %v", err)
+	}
+
+	if len(sim.Callbacks()) != 0 {
+		t.Fatalf("Callbacks %v are still registered", sim.Callbacks())
+	}
+}
+
+func TestSimulatorThrottling(t *testing.T) {
+	sim := efgstest.NewServer()
+	defer sim.Close()
+
+	nbtlsPair := newSimulatorKeyPair(t, "NBTLS CZ")
+	ctx := context.Background()
+
+	fingerprint, _ := efgsutils.GetCertificateFingerprint(ctx, nbtlsPair)
+	subject, _ := efgsutils.GetCertificateSubject(ctx, nbtlsPair)
+
+	get := func() *http.Response {
+		req, _ := http.NewRequest("GET", sim.URL+"/diagnosiskeys/download/2020-12-10", nil)
+		req.Header.Set("Accept", "application/json; version=1.0")
+		req.Header.Set("X-SSL-Client-SHA256", fingerprint)
+		req.Header.Set("X-SSL-Client-DN", subject)
+
+		resp, err := sim.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	sim.Throttle(1, time.Minute)
+
+	resp := get()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("Status = %v, want 429", resp.StatusCode)
+	}
+
+	if retryAfter, err := time.Parse(time.RFC1123, resp.Header.Get("Retry-After")); err != nil || retryAfter.Before(time.Now()) {
+		t.Fatalf("Retry-After = '%v' (%v), want time in the future", resp.Header.Get("Retry-After"), err)
+	}
+
+	if resp = get(); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Status = %v, want 404 of missing batch once throttling is over", resp.StatusCode)
+	}
+}
@@ -0,0 +1,136 @@
+package efgs
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"github.com/covid19cz/erouska-backend/internal/constants"
+	efgsutils "github.com/covid19cz/erouska-backend/internal/functions/efgs/utils"
+	"github.com/covid19cz/erouska-backend/internal/logging"
+	"github.com/covid19cz/erouska-backend/internal/store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"net/http"
+	urlutils "net/url"
+	"time"
+)
+
+type trustListConfig struct {
+	Env         efgsutils.Environment
+	Client      *http.Client
+	URL         *urlutils.URL
+	NBTLSPair   *efgsutils.X509KeyPair
+	StoreClient store.Storer
+	TrustAnchor *x509.Certificate
+	Path        string        `env:"EFGS_TRUST_LIST_PATH,default=trustList"`
+	MaxAge      time.Duration `env:"EFGS_TRUST_LIST_MAX_AGE,default=6h"`
+}
+
+// cachedTrustList Trust list as downloaded from EFGS. It's validated again whenever loaded, the cache itself isn't trusted.
+type cachedTrustList struct {
+	Entries   string    `firestore:"entries" json:"entries"`
+	FetchedAt time.Time `firestore:"fetchedAt" json:"fetchedAt"`
+}
+
+// loadTrustList Gets the trust list from cache, downloading it from EFGS when the cache is older than MaxAge. When EFGS
+// is unavailable, the cached list is used regardless its age.
+func loadTrustList(ctx context.Context, config *trustListConfig, now time.Time) (*efgsutils.TrustList, error) {
+	logger := logging.FromContext(ctx).Named("efgs.loadTrustList")
+
+	var cached cachedTrustList
+	err := config.StoreClient.Get(ctx, constants.CollectionEfgsTrustList, string(config.Env), &cached)
+	if err != nil && status.Code(err) != codes.NotFound {
+		return nil, fmt.Errorf("Error while querying Firestore: %v", err)
+	}
+
+	cacheExists := err == nil
+
+	if !cacheExists || now.Sub(cached.FetchedAt) > config.MaxAge {
+		entries, err := downloadTrustList(ctx, config)
+
+		switch {
+		case err == nil:
+			cached = cachedTrustList{Entries: entries, FetchedAt: now}
+			if err = config.StoreClient.Set(ctx, constants.CollectionEfgsTrustList, string(config.Env), cached); err != nil {
+				logger.Warnf("Could not cache trust list: %v", err)
+			}
+		case cacheExists:
+			logger.Warnf("Could not download trust list, using cached one from %v: %v", cached.FetchedAt, err)
+		default:
+			return nil, fmt.Errorf("Could not download trust list: %v", err)
+		}
+	}
+
+	var entries []efgsutils.TrustListEntry
+	if err = json.Unmarshal([]byte(cached.Entries), &entries); err != nil {
+		return nil, fmt.Errorf("Could not parse trust list: %v", err)
+	}
+
+	trustList, errors := efgsutils.NewTrustList(entries, config.TrustAnchor, now)
+	for _, err := range errors {
+		logger.Warnf("Skipping invalid certificate: %v", err)
+	}
+
+	logger.Debugf("Loaded trust list with %v of %v certificates", len(entries)-len(errors), len(entries))
+
+	return trustList, nil
+}
+
+func downloadTrustList(ctx context.Context, config *trustListConfig) (string, error) {
+	logger := logging.FromContext(ctx).Named("efgs.downloadTrustList")
+
+	url := *config.URL
+	url.Path = config.Path
+
+	req, err := http.NewRequest("GET", url.String(), nil)
+	if err != nil {
+		logger.Error("Error creating trust list request")
+		return "", err
+	}
+
+	req.Header.Set("Accept", "application/json; version=1.0")
+
+	if config.Env == efgsutils.EnvLocal {
+		logger.Debugf("Setting up LOCAL EFGS headers")
+
+		fingerprint, err := efgsutils.GetCertificateFingerprint(ctx, config.NBTLSPair)
+		if err != nil {
+			return "", err
+		}
+		subject, err := efgsutils.GetCertificateSubject(ctx, config.NBTLSPair)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("X-SSL-Client-SHA256", fingerprint)
+		req.Header.Set("X-SSL-Client-DN", subject)
+	}
+
+	resp, err := config.Client.Do(req)
+	if err != nil {
+		logger.Errorf("Error while downloading trust list: %v", err)
+		return "", err
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if err := resp.Body.Close(); err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("HTTP %v: %v", resp.StatusCode, string(body))
+	}
+
+	var entries []efgsutils.TrustListEntry
+	if err = json.Unmarshal(body, &entries); err != nil {
+		logger.Debugf("Trust list parsing error: %v, body: %v", err, string(body))
+		return "", err
+	}
+
+	return string(body), nil
+}
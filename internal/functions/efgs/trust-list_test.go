@@ -0,0 +1,63 @@
+package efgs
+
+import (
+	"context"
+	efgsutils "github.com/covid19cz/erouska-backend/internal/functions/efgs/utils"
+	"github.com/covid19cz/erouska-backend/internal/store"
+	"net/http"
+	"net/http/httptest"
+	urlutils "net/url"
+	"testing"
+	"time"
+)
+
+func TestLoadTrustListCaching(t *testing.T) {
+	anchor := newSigningCert(t, "EU")
+
+	var requests int
+	available := true
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if !available {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("[]"))
+	}))
+	defer server.Close()
+
+	url, _ := urlutils.Parse(server.URL)
+
+	config := &trustListConfig{
+		Env:         efgsutils.EnvAcc,
+		Client:      server.Client(),
+		URL:         url,
+		StoreClient: store.NewMemoryClient(),
+		TrustAnchor: anchor.cert,
+		Path:        "trustList",
+		MaxAge:      time.Hour,
+	}
+
+	ctx := context.Background()
+	now := time.Date(2020, 12, 10, 12, 0, 0, 0, time.UTC)
+
+	available = false
+	if _, err := loadTrustList(ctx, config, now); err == nil {
+		t.Fatalf("loadTrustList() succeeded without EFGS and cache")
+	}
+
+	available = true
+	if _, err := loadTrustList(ctx, config, now); err != nil || requests != 2 {
+		t.Fatalf("loadTrustList() error = %v, requests = %v; want download", err, requests)
+	}
+
+	if _, err := loadTrustList(ctx, config, now.Add(30*time.Minute)); err != nil || requests != 2 {
+		t.Fatalf("loadTrustList() error = %v, requests = %v; want cached list", err, requests)
+	}
+
+	available = false
+	if _, err := loadTrustList(ctx, config, now.Add(2*time.Hour)); err != nil || requests != 3 {
+		t.Fatalf("loadTrustList() error = %v, requests = %v; want stale cached list", err, requests)
+	}
+}
@@ -7,14 +7,13 @@ import (
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
-	"firebase.google.com/go/db"
 	"fmt"
 	"github.com/covid19cz/erouska-backend/internal/constants"
+	"github.com/covid19cz/erouska-backend/internal/counters"
 	"github.com/covid19cz/erouska-backend/internal/firebase/structs"
 	efgsapi "github.com/covid19cz/erouska-backend/internal/functions/efgs/api"
 	efgsutils "github.com/covid19cz/erouska-backend/internal/functions/efgs/utils"
 	"github.com/covid19cz/erouska-backend/internal/logging"
-	"github.com/covid19cz/erouska-backend/internal/realtimedb"
 	"github.com/covid19cz/erouska-backend/internal/utils"
 	"google.golang.org/protobuf/proto"
 	"io/ioutil"
@@ -94,7 +93,7 @@ func uploadAndRemoveBatch(ctx context.Context, uploadConfig *uploadConfig, now t
 
 			logger.Debugf("Batch %s successfully uploaded", uploadConfig.BatchTag)
 
-			if err = updateUploadedCounters(ctx, uploadConfig.RealtimeDBClient, batchKeysCount); err != nil {
+			if err = updateUploadedCounters(ctx, uploadConfig.CountersClient, uploadConfig.BatchTag, batchKeysCount); err != nil {
 				logger.Warnf("Could not update EFGS upload counters: %v", err)
 			}
 		} else { // nothing was saved to EFGS
@@ -133,7 +132,7 @@ func uploadBatch(ctx context.Context, batch *efgsapi.DiagnosisKeyBatch, config *
 		return nil, err
 	}
 
-	signedBatch, err := signBatch(ctx, config.Env, batch)
+	signedBatch, err := signBatch(ctx, config.NBBSPair, batch)
 	if err != nil {
 		logger.Debug("Batch signing error")
 		return nil, err
@@ -299,42 +298,14 @@ func calculateBatchTag(date time.Time, batch *efgsapi.DiagnosisKeyBatch) string
 	return date.Format("20060102") + "-" + hex.EncodeToString(hash.Sum(nil))[:7]
 }
 
-func updateUploadedCounters(ctx context.Context, client *realtimedb.Client, keysCount int) error {
+func updateUploadedCounters(ctx context.Context, client counters.Counters, batchTag string, keysCount int) error {
 	logger := logging.FromContext(ctx).Named("efgs.upload-batch.updateUploadedCounters")
 
-	var date = utils.GetTimeNow().Format("20060102")
-
-	// update daily counter
-	if err := updateUploadedCounter(ctx, client, constants.DbEfgsCountersPrefix+date, keysCount); err != nil {
-		logger.Warnf("Cannot increase EFGS counter due to unknown error: %+v", err.Error())
-		return err
-	}
-
-	// update total counter
-	if err := updateUploadedCounter(ctx, client, constants.DbEfgsCountersPrefix+"total", keysCount); err != nil {
+	// update daily and total counter
+	if err := client.Increment(ctx, constants.CounterEfgs, "upload-"+batchTag, *utils.GetTimeNow(), structs.EfgsCounter{KeysUploaded: keysCount}); err != nil {
 		logger.Warnf("Cannot increase EFGS counter due to unknown error: %+v", err.Error())
 		return err
 	}
 
 	return nil
 }
-
-func updateUploadedCounter(ctx context.Context, client *realtimedb.Client, dbKey string, keysCount int) error {
-	logger := logging.FromContext(ctx).Named("efgs.upload-batch.updateUploadedCounter")
-
-	return client.RunTransaction(ctx, dbKey, func(tn db.TransactionNode) (interface{}, error) {
-		var state structs.EfgsCounter
-
-		if err := tn.Unmarshal(&state); err != nil {
-			return nil, err
-		}
-
-		logger.Debugf("Found counter state, dbKey %v: %+v", dbKey, state)
-
-		state.KeysUploaded += keysCount
-
-		logger.Debugf("Saving updated counter state, dbKey %v: %+v", dbKey, state)
-
-		return state, nil
-	})
-}
@@ -0,0 +1,194 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	b64 "encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"github.com/covid19cz/erouska-backend/internal/secrets"
+	"go.mozilla.org/pkcs7"
+	"strings"
+	"sync"
+	"time"
+)
+
+//TrustListCertType Type of certificate in EFGS trust list.
+type TrustListCertType string
+
+const (
+	//TrustListAuthentication Certificate used by national backend for mTLS.
+	TrustListAuthentication TrustListCertType = "AUTHENTICATION"
+	//TrustListSigning Certificate used by national backend for signing batches.
+	TrustListSigning TrustListCertType = "SIGNING"
+)
+
+//TrustListEntry Certificate as listed by EFGS. RawData is base64 encoded DER certificate, Signature is base64 encoded
+//detached PKCS#7 signature of the DER certificate made by EFGS trust anchor.
+type TrustListEntry struct {
+	Country         string            `json:"country"`
+	CertificateType TrustListCertType `json:"certificateType"`
+	Thumbprint      string            `json:"thumbprint"`
+	RawData         string            `json:"rawData"`
+	Signature       string            `json:"signature"`
+}
+
+//TrustedCertificate Certificate from trust list which passed the validation.
+type TrustedCertificate struct {
+	Country     string
+	Type        TrustListCertType
+	Thumbprint  string
+	Certificate *x509.Certificate
+}
+
+//CertificateTrust Decides which certificates may sign batches of given country.
+type CertificateTrust interface {
+	IsTrusted(country string, cert *x509.Certificate) bool
+}
+
+//TrustList Validated certificates of national backends, indexed by country. A country may have more valid certificates
+//of the same type at once, e.g. while rotating them.
+type TrustList struct {
+	certificates map[string][]TrustedCertificate
+}
+
+//NewTrustList Validates the entries against the trust anchor and builds the trust list from those which passed.
+//Entries failing the validation are skipped and reported by returned errors.
+func NewTrustList(entries []TrustListEntry, anchor *x509.Certificate, now time.Time) (*TrustList, []error) {
+	list := &TrustList{certificates: make(map[string][]TrustedCertificate)}
+
+	var errors []error
+
+	for i, entry := range entries {
+		trusted, err := validateTrustListEntry(entry, anchor, now)
+		if err != nil {
+			errors = append(errors, fmt.Errorf("Trust list entry %v (%v %v): %v", i, entry.Country, entry.CertificateType, err))
+			continue
+		}
+
+		list.certificates[trusted.Country] = append(list.certificates[trusted.Country], *trusted)
+	}
+
+	return list, errors
+}
+
+func validateTrustListEntry(entry TrustListEntry, anchor *x509.Certificate, now time.Time) (*TrustedCertificate, error) {
+	raw, err := b64.StdEncoding.DecodeString(entry.RawData)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode certificate: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse certificate: %v", err)
+	}
+
+	thumbprint := CertificateThumbprint(cert)
+	if !strings.EqualFold(thumbprint, entry.Thumbprint) {
+		return nil, fmt.Errorf("Thumbprint %v doesn't match the certificate %v", entry.Thumbprint, thumbprint)
+	}
+
+	signature, err := b64.StdEncoding.DecodeString(entry.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("Could not decode signature: %v", err)
+	}
+
+	p7, err := ParsePKCS7(signature)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse signature: %v", err)
+	}
+
+	p7.Content = raw
+
+	if err = p7.Verify(); err != nil {
+		return nil, fmt.Errorf("Invalid signature: %v", err)
+	}
+
+	if signer := p7.GetOnlySigner(); signer == nil || !bytes.Equal(signer.Raw, anchor.Raw) {
+		return nil, fmt.Errorf("Not signed by the trust anchor")
+	}
+
+	if now.Before(cert.NotBefore) || now.After(cert.NotAfter) {
+		return nil, fmt.Errorf("Certificate is valid only from %v to %v", cert.NotBefore, cert.NotAfter)
+	}
+
+	country := strings.ToUpper(entry.Country)
+
+	if len(cert.Subject.Country) != 0 && !strings.EqualFold(cert.Subject.Country[0], country) {
+		return nil, fmt.Errorf("Certificate is issued for %v", cert.Subject.Country[0])
+	}
+
+	return &TrustedCertificate{
+		Country:     country,
+		Type:        entry.CertificateType,
+		Thumbprint:  thumbprint,
+		Certificate: cert,
+	}, nil
+}
+
+//Lookup Finds certificate of given country by its thumbprint.
+func (l *TrustList) Lookup(country string, thumbprint string) (*TrustedCertificate, bool) {
+	for _, trusted := range l.certificates[strings.ToUpper(country)] {
+		if strings.EqualFold(trusted.Thumbprint, thumbprint) {
+			return &trusted, true
+		}
+	}
+
+	return nil, false
+}
+
+//Certificates Gets all certificates of given type for the country.
+func (l *TrustList) Certificates(country string, certType TrustListCertType) []TrustedCertificate {
+	var certificates []TrustedCertificate
+
+	for _, trusted := range l.certificates[strings.ToUpper(country)] {
+		if trusted.Type == certType {
+			certificates = append(certificates, trusted)
+		}
+	}
+
+	return certificates
+}
+
+//IsTrusted Checks whether the certificate is listed as signing certificate of given country.
+func (l *TrustList) IsTrusted(country string, cert *x509.Certificate) bool {
+	trusted, found := l.Lookup(country, CertificateThumbprint(cert))
+	return found && trusted.Type == TrustListSigning
+}
+
+//CertificateThumbprint Gets hex-encoded SHA-256 thumbprint of the certificate, as used by EFGS.
+func CertificateThumbprint(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(hash[:])
+}
+
+// pkcs7Mutex The pkcs7 library modifies a package variable while parsing, so signatures can't be parsed concurrently.
+var pkcs7Mutex sync.Mutex
+
+//ParsePKCS7 Parses PKCS#7 signed data; safe for concurrent use, unlike pkcs7.Parse.
+func ParsePKCS7(data []byte) (*pkcs7.PKCS7, error) {
+	pkcs7Mutex.Lock()
+	defer pkcs7Mutex.Unlock()
+
+	return pkcs7.Parse(data)
+}
+
+//LoadTrustAnchor Loads certificate of EFGS trust anchor from Secrets Manager.
+func LoadTrustAnchor(ctx context.Context, env Environment) (*x509.Certificate, error) {
+	secretsClient := secrets.Client{}
+
+	certBytes, err := secretsClient.Get(fmt.Sprintf("efgs-%v-trust-anchor", env))
+	if err != nil {
+		return nil, err
+	}
+
+	certBlock, _ := pem.Decode(certBytes)
+	if certBlock == nil {
+		return nil, fmt.Errorf("Trust anchor is not a PEM certificate")
+	}
+
+	return x509.ParseCertificate(certBlock.Bytes)
+}
@@ -0,0 +1,133 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	b64 "encoding/base64"
+	"go.mozilla.org/pkcs7"
+	"math/big"
+	"testing"
+	"time"
+)
+
+var testNow = time.Now()
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, country string, notAfter time.Time) testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "NB " + country, Country: []string{country}},
+		NotBefore:    testNow.AddDate(-1, 0, 0),
+		NotAfter:     notAfter,
+	}
+
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testCert{cert: cert, key: key}
+}
+
+// entry Lists the certificate in trust list, signed by given anchor.
+func (c testCert) entry(t *testing.T, anchor testCert, country string, certType TrustListCertType) TrustListEntry {
+	signedData, err := pkcs7.NewSignedData(c.cert.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = signedData.AddSigner(anchor.cert, anchor.key, pkcs7.SignerInfoConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	signedData.Detach()
+	signature, err := signedData.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return TrustListEntry{
+		Country:         country,
+		CertificateType: certType,
+		Thumbprint:      CertificateThumbprint(c.cert),
+		RawData:         b64.StdEncoding.EncodeToString(c.cert.Raw),
+		Signature:       b64.StdEncoding.EncodeToString(signature),
+	}
+}
+
+func TestNewTrustList(t *testing.T) {
+	validUntil := testNow.AddDate(1, 0, 0)
+
+	anchor := newTestCert(t, "EU", validUntil)
+	fakeAnchor := newTestCert(t, "EU", validUntil)
+
+	deOld := newTestCert(t, "DE", testNow.AddDate(0, 0, 5))
+	deNew := newTestCert(t, "DE", validUntil)
+	deExpired := newTestCert(t, "DE", testNow.AddDate(0, 0, -1))
+	deForged := newTestCert(t, "DE", validUntil)
+	at := newTestCert(t, "AT", validUntil)
+
+	mismatched := deNew.entry(t, anchor, "DE", TrustListSigning)
+	mismatched.Thumbprint = CertificateThumbprint(at.cert)
+
+	entries := []TrustListEntry{
+		deOld.entry(t, anchor, "DE", TrustListSigning),
+		deNew.entry(t, anchor, "de", TrustListSigning),
+		at.entry(t, anchor, "AT", TrustListAuthentication),
+		deExpired.entry(t, anchor, "DE", TrustListSigning),
+		deForged.entry(t, fakeAnchor, "DE", TrustListSigning),
+		at.entry(t, anchor, "DE", TrustListSigning),
+		mismatched,
+	}
+
+	list, errors := NewTrustList(entries, anchor.cert, testNow)
+
+	if len(errors) != 4 {
+		t.Fatalf("NewTrustList() errors = %v, want 4 invalid entries", errors)
+	}
+
+	tests := []struct {
+		name    string
+		country string
+		cert    *x509.Certificate
+		want    bool
+	}{
+		{"rotated out certificate is still valid", "DE", deOld.cert, true},
+		{"rotated in certificate", "DE", deNew.cert, true},
+		{"expired certificate", "DE", deExpired.cert, false},
+		{"certificate not signed by anchor", "DE", deForged.cert, false},
+		{"certificate of other country", "DE", at.cert, false},
+		{"authentication certificate", "AT", at.cert, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := list.IsTrusted(tt.country, tt.cert); got != tt.want {
+				t.Fatalf("IsTrusted() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got := list.Certificates("DE", TrustListSigning); len(got) != 2 {
+		t.Fatalf("Certificates() = %v, want 2 DE signing certificates", got)
+	}
+
+	if _, found := list.Lookup("at", CertificateThumbprint(at.cert)); !found {
+		t.Fatalf("Lookup() didn't find AT certificate")
+	}
+}
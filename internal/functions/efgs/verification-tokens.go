@@ -0,0 +1,327 @@
+package efgs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	efgsapi "github.com/covid19cz/erouska-backend/internal/functions/efgs/api"
+	efgsutils "github.com/covid19cz/erouska-backend/internal/functions/efgs/utils"
+	"github.com/covid19cz/erouska-backend/internal/logging"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// maxBatchIssueCodes Limit of codes in one request to batch-issue API of the Verification server.
+const maxBatchIssueCodes = 10
+
+// sharedTokenPool Pool shared by all imports handled by the same function instance.
+var sharedTokenPool = &verificationTokenPool{}
+
+type verificationToken struct {
+	token    string
+	issuedAt time.Time
+}
+
+// verificationTokenPool Verification tokens issued in advance, by test type. Every certificate needs its own token, but
+// the tokens can be obtained concurrently and in bulk instead of one VC -> token chain per imported batch.
+type verificationTokenPool struct {
+	mutex   sync.Mutex
+	tokens  map[string][]verificationToken
+	refills map[string]*tokenRefill
+}
+
+// tokenRefill Refill of the pool in progress; done is closed when it's finished.
+type tokenRefill struct {
+	done chan struct{}
+	err  error
+}
+
+// take Gets a token of the test type from the pool; the pool is refilled when it's empty. Tokens older than the
+// configured max age are dropped, as they may have expired in the Verification server. The pool isn't locked while
+// it's refilled, only one refill of the test type runs at a time and other callers wait for it.
+func (p *verificationTokenPool) take(ctx context.Context, config *publishConfig, testType string, now time.Time) (string, error) {
+	logger := logging.FromContext(ctx).Named("efgs.verificationTokenPool.take")
+
+	for {
+		p.mutex.Lock()
+
+		if token, ok := p.pop(config, testType, now); ok {
+			p.mutex.Unlock()
+			return token, nil
+		}
+
+		if refill, ok := p.refills[testType]; ok {
+			p.mutex.Unlock()
+
+			select {
+			case <-refill.done:
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+
+			if refill.err != nil {
+				return "", refill.err
+			}
+
+			// someone else may have taken the tokens already, try again
+			continue
+		}
+
+		refill := &tokenRefill{done: make(chan struct{})}
+		p.refills[testType] = refill
+		p.mutex.Unlock()
+
+		size := config.VerificationPoolSize
+		if size < 1 {
+			size = 1
+		}
+
+		logger.Debugf("Verification token pool of %v tokens is empty, going to issue %v tokens", testType, size)
+
+		tokens, err := issueVerificationTokens(ctx, config, testType, size)
+
+		p.mutex.Lock()
+		delete(p.refills, testType)
+		if err == nil {
+			for _, token := range tokens[1:] {
+				p.tokens[testType] = append(p.tokens[testType], verificationToken{token: token, issuedAt: now})
+			}
+		}
+		refill.err = err
+		close(refill.done)
+		p.mutex.Unlock()
+
+		if err != nil {
+			return "", err
+		}
+
+		return tokens[0], nil
+	}
+}
+
+// pop Removes a token of the test type from the pool, dropping the old ones. The pool must be locked.
+func (p *verificationTokenPool) pop(config *publishConfig, testType string, now time.Time) (string, bool) {
+	if p.tokens == nil {
+		p.tokens = make(map[string][]verificationToken)
+		p.refills = make(map[string]*tokenRefill)
+	}
+
+	for len(p.tokens[testType]) > 0 {
+		token := p.tokens[testType][0]
+		p.tokens[testType] = p.tokens[testType][1:]
+
+		if now.Sub(token.issuedAt) < config.VerificationTokenMaxAge {
+			return token.token, true
+		}
+	}
+
+	return "", false
+}
+
+// issueVerificationTokens Issues codes and exchanges them for tokens, concurrently but within configured limits. Some
+// tokens may be missing in the result when the Verification server fails; error is returned only when there's none.
+func issueVerificationTokens(ctx context.Context, config *publishConfig, testType string, count int) ([]string, error) {
+	logger := logging.FromContext(ctx).Named("efgs.issueVerificationTokens")
+
+	codes, err := issueVerificationCodes(ctx, config, testType, count)
+	if len(codes) == 0 {
+		return nil, fmt.Errorf("Could not issue any verification code: %v", err)
+	}
+
+	if err != nil {
+		logger.Warnf("Issued only %v of %v verification codes: %v", len(codes), count, err)
+	}
+
+	tokens := make([]string, len(codes))
+	errs := make([]error, len(codes))
+
+	runConcurrently(len(codes), config.VerificationConcurrency, func(i int) {
+		tokens[i], errs[i] = verifyCode(ctx, config, codes[i])
+	})
+
+	var verified []string
+	for i, token := range tokens {
+		if errs[i] != nil {
+			err = errs[i]
+			continue
+		}
+		verified = append(verified, token)
+	}
+
+	if len(verified) == 0 {
+		return nil, fmt.Errorf("Could not verify any verification code: %v", err)
+	}
+
+	if len(verified) < len(codes) {
+		logger.Warnf("Verified only %v of %v verification codes: %v", len(verified), len(codes), err)
+	}
+
+	return verified, nil
+}
+
+// issueVerificationCodes Issues codes by the admin API, using batch-issue API when enabled. The requests are rate
+// limited, so the import doesn't exceed the admin API quota.
+func issueVerificationCodes(ctx context.Context, config *publishConfig, testType string, count int) ([]string, error) {
+	requestSize := 1
+	if config.VerificationBatchIssue {
+		requestSize = maxBatchIssueCodes
+	}
+
+	requestsCount := (count + requestSize - 1) / requestSize
+
+	results := make([][]string, requestsCount)
+	errs := make([]error, requestsCount)
+
+	limiter := newRateLimiter(config.VerificationRateLimit)
+	defer limiter.stop()
+
+	runConcurrently(requestsCount, config.VerificationConcurrency, func(i int) {
+		limiter.wait()
+
+		if !config.VerificationBatchIssue {
+			var code string
+			code, errs[i] = requestNewVC(ctx, config, testType)
+			if errs[i] == nil {
+				results[i] = []string{code}
+			}
+			return
+		}
+
+		size := requestSize
+		if rest := count - i*requestSize; rest < size {
+			size = rest
+		}
+		results[i], errs[i] = requestNewVCs(ctx, config, testType, size)
+	})
+
+	var codes []string
+	var err error
+
+	for i, result := range results {
+		if errs[i] != nil {
+			err = errs[i]
+		}
+		codes = append(codes, result...)
+	}
+
+	return codes, err
+}
+
+func requestNewVCs(ctx context.Context, config *publishConfig, testType string, count int) ([]string, error) {
+	logger := logging.FromContext(ctx).Named("efgs.requestNewVCs")
+
+	request := efgsapi.BatchIssueCodeRequest{}
+	for i := 0; i < count; i++ {
+		request.Codes = append(request.Codes, &efgsapi.IssueCodeRequest{
+			TestType:    testType,
+			SymptomDate: time.Now().AddDate(0, 0, defaultDSOS).Format("2006-01-02"),
+		})
+	}
+
+	body, err := json.Marshal(&request)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", config.VerificationServer.GetAdminURL("api/batch-issue"), bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Add("content-type", "application/json")
+	req.Header.Add("accept", "application/json")
+	req.Header.Add("x-api-key", config.VerificationServer.AdminKey)
+
+	logger.Debugf("Requesting %v new VCs of %v test type", count, testType)
+
+	response, err := config.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err = ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := response.Body.Close(); err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != 200 && response.StatusCode != 400 {
+		return nil, fmt.Errorf("HTTP %v: %v", response.StatusCode, string(body))
+	}
+
+	var r efgsapi.BatchIssueCodeResponse
+	if err = json.Unmarshal(body, &r); err != nil {
+		return nil, err
+	}
+	if efgsutils.EfgsExtendedLogging {
+		logger.Debugf("Response: %+v", r)
+	}
+
+	if r.ErrorCode != "" || r.Error != "" {
+		return nil, fmt.Errorf("%v: %+v", r.ErrorCode, r.Error)
+	}
+
+	var codes []string
+	for _, code := range r.Codes {
+		if code.ErrorCode != "" || code.Error != "" {
+			err = fmt.Errorf("%v: %+v", code.ErrorCode, code.Error)
+			continue
+		}
+		codes = append(codes, code.VerificationCode)
+	}
+
+	return codes, err
+}
+
+// runConcurrently Calls the function for 0 <= i < count, in at most `limit` goroutines at once.
+func runConcurrently(count int, limit int, f func(i int)) {
+	if limit <= 0 {
+		limit = 1
+	}
+
+	semaphore := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		semaphore <- struct{}{}
+
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			f(i)
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+// rateLimiter Spreads calls evenly so there's at most `perSecond` of them per second. Zero means no limit.
+type rateLimiter struct {
+	ticker *time.Ticker
+}
+
+func newRateLimiter(perSecond int) *rateLimiter {
+	if perSecond <= 0 {
+		return &rateLimiter{}
+	}
+	return &rateLimiter{ticker: time.NewTicker(time.Second / time.Duration(perSecond))}
+}
+
+func (l *rateLimiter) wait() {
+	if l.ticker != nil {
+		<-l.ticker.C
+	}
+}
+
+func (l *rateLimiter) stop() {
+	if l.ticker != nil {
+		l.ticker.Stop()
+	}
+}
@@ -0,0 +1,247 @@
+package efgs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	efgsapi "github.com/covid19cz/erouska-backend/internal/functions/efgs/api"
+	"github.com/covid19cz/erouska-backend/internal/utils"
+	"github.com/stretchr/stew/slice"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeVerificationServer Issues codes and exchanges them for tokens, counting the calls. Tokens carry test type of
+// their codes.
+type fakeVerificationServer struct {
+	mutex       sync.Mutex
+	calls       map[string]int
+	inFlight    int
+	maxInFlight int
+	issued      int
+	testTypes   map[string]string
+	failCode    string
+}
+
+func (s *fakeVerificationServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	s.calls[r.URL.Path]++
+	s.inFlight++
+	if s.inFlight > s.maxInFlight {
+		s.maxInFlight = s.inFlight
+	}
+	s.mutex.Unlock()
+
+	defer func() {
+		s.mutex.Lock()
+		s.inFlight--
+		s.mutex.Unlock()
+	}()
+
+	time.Sleep(5 * time.Millisecond)
+
+	newCode := func(request *efgsapi.IssueCodeRequest) *efgsapi.IssueCodeResponse {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.issued++
+		code := fmt.Sprintf("code-%v", s.issued)
+		if s.testTypes == nil {
+			s.testTypes = make(map[string]string)
+		}
+		s.testTypes[code] = request.TestType
+		return &efgsapi.IssueCodeResponse{VerificationCode: code}
+	}
+
+	var response interface{}
+
+	switch r.URL.Path {
+	case "/api/issue":
+		var request efgsapi.IssueCodeRequest
+		_ = json.NewDecoder(r.Body).Decode(&request)
+
+		response = newCode(&request)
+	case "/api/batch-issue":
+		var request efgsapi.BatchIssueCodeRequest
+		_ = json.NewDecoder(r.Body).Decode(&request)
+
+		batch := efgsapi.BatchIssueCodeResponse{}
+		for _, code := range request.Codes {
+			batch.Codes = append(batch.Codes, newCode(code))
+		}
+		response = batch
+	case "/api/verify":
+		var request efgsapi.VerifyRequest
+		_ = json.NewDecoder(r.Body).Decode(&request)
+
+		s.mutex.Lock()
+		testType := s.testTypes[request.VerificationCode]
+		s.mutex.Unlock()
+
+		switch {
+		case request.VerificationCode == s.failCode:
+			response = efgsapi.VerifyResponse{ErrorCode: "code_invalid", Error: "invalid code"}
+		case !slice.ContainsString(request.AcceptTestTypes, testType):
+			response = efgsapi.VerifyResponse{ErrorCode: "unsupported_test_type", Error: "test type not accepted"}
+		default:
+			response = efgsapi.VerifyResponse{VerificationToken: testType + "-token-for-" + request.VerificationCode}
+		}
+	case "/api/certificate":
+		var request efgsapi.CertificateRequest
+		_ = json.NewDecoder(r.Body).Decode(&request)
+
+		response = efgsapi.CertificateResponse{Certificate: "certificate-for-" + request.VerificationToken}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+func newTokenPoolTestConfig(server *httptest.Server, poolSize int, batchIssue bool) *publishConfig {
+	return &publishConfig{
+		VerificationServer:      &utils.VerificationServerConfig{AdminURL: server.URL, DeviceURL: server.URL},
+		Client:                  server.Client(),
+		TokenPool:               &verificationTokenPool{},
+		VerificationPoolSize:    poolSize,
+		VerificationConcurrency: 2,
+		VerificationTokenMaxAge: 30 * time.Minute,
+		VerificationBatchIssue:  batchIssue,
+	}
+}
+
+func TestVerificationTokenPool(t *testing.T) {
+	fake := &fakeVerificationServer{calls: make(map[string]int)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	config := newTokenPoolTestConfig(server, 5, false)
+
+	ctx := context.Background()
+	now := time.Now()
+
+	tokens := make(map[string]bool)
+
+	take := func(testType string, now time.Time) {
+		t.Helper()
+
+		token, err := config.TokenPool.take(ctx, config, testType, now)
+		if err != nil {
+			t.Fatalf("take() error = %v", err)
+		}
+		if tokens[token] {
+			t.Fatalf("take() returned token %v twice", token)
+		}
+		if !strings.HasPrefix(token, testType+"-") {
+			t.Fatalf("take() returned token %v, want token of %v test type", token, testType)
+		}
+		tokens[token] = true
+	}
+
+	for i := 0; i < 5; i++ {
+		take(efgsapi.TestTypeConfirmed, now)
+	}
+
+	if fake.calls["/api/issue"] != 5 || fake.calls["/api/verify"] != 5 {
+		t.Fatalf("Verification server calls = %v, want 5 issues and 5 verifications for 5 tokens", fake.calls)
+	}
+
+	if fake.maxInFlight > config.VerificationConcurrency {
+		t.Fatalf("%v concurrent requests, want at most %v", fake.maxInFlight, config.VerificationConcurrency)
+	}
+
+	// pool is refilled when empty
+	take(efgsapi.TestTypeConfirmed, now)
+
+	if fake.calls["/api/issue"] != 10 {
+		t.Fatalf("Verification server calls = %v, want the pool refilled", fake.calls)
+	}
+
+	// old tokens are dropped
+	take(efgsapi.TestTypeConfirmed, now.Add(config.VerificationTokenMaxAge))
+
+	if fake.calls["/api/issue"] != 15 {
+		t.Fatalf("Verification server calls = %v, want old tokens dropped", fake.calls)
+	}
+
+	// tokens of other test types have their own pools
+	take(efgsapi.TestTypeNegative, now)
+	take(efgsapi.TestTypeConfirmed, now)
+
+	if fake.calls["/api/issue"] != 20 {
+		t.Fatalf("Verification server calls = %v, want the pool of negative tokens filled", fake.calls)
+	}
+}
+
+func TestVerificationTokenPoolBatchIssue(t *testing.T) {
+	fake := &fakeVerificationServer{calls: make(map[string]int), failCode: "code-3"}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	config := newTokenPoolTestConfig(server, 12, true)
+
+	tokens, err := issueVerificationTokens(context.Background(), config, efgsapi.TestTypeLikely, config.VerificationPoolSize)
+	if err != nil {
+		t.Fatalf("issueVerificationTokens() error = %v", err)
+	}
+
+	if fake.calls["/api/batch-issue"] != 2 || fake.calls["/api/issue"] != 0 || fake.issued != 12 {
+		t.Fatalf("Verification server calls = %v (%v codes issued), want 2 batch issues of 12 codes", fake.calls, fake.issued)
+	}
+
+	// failed verification of one code doesn't fail the others
+	if len(tokens) != 11 {
+		t.Fatalf("issueVerificationTokens() = %v tokens, want 11", len(tokens))
+	}
+}
+
+func TestVerificationTokenPoolConcurrentTakes(t *testing.T) {
+	fake := &fakeVerificationServer{calls: make(map[string]int)}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+
+	config := newTokenPoolTestConfig(server, 5, false)
+
+	ctx := context.Background()
+	now := time.Now()
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	tokens := make(map[string]bool)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			token, err := config.TokenPool.take(ctx, config, efgsapi.TestTypeConfirmed, now)
+			if err != nil {
+				t.Errorf("take() error = %v", err)
+				return
+			}
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if tokens[token] {
+				t.Errorf("take() returned token %v twice", token)
+			}
+			tokens[token] = true
+		}()
+	}
+
+	// other test type isn't blocked by the refill in progress
+	if _, err := config.TokenPool.take(ctx, config, efgsapi.TestTypeNegative, now); err != nil {
+		t.Fatalf("take() error = %v", err)
+	}
+
+	wg.Wait()
+
+	// concurrent callers share refills instead of each issuing its own pool
+	if len(tokens) != 10 || fake.calls["/api/issue"] != 15 {
+		t.Fatalf("%v tokens taken, Verification server calls = %v, want 2 refills of confirmed and 1 of negative tokens", len(tokens), fake.calls)
+	}
+}
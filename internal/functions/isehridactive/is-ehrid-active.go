@@ -35,7 +35,7 @@ func IsEhridActive(w http.ResponseWriter, r *http.Request) {
 
 	logger.Debugf("Handling isEhridActive request: %v %+v", ehrid, request)
 
-	_, err = storeClient.Doc(constants.CollectionRegistrations, ehrid).Get(ctx)
+	err = storeClient.Get(ctx, constants.CollectionRegistrations, ehrid, nil)
 
 	var active bool
 
@@ -28,7 +28,7 @@ func DownloadMetrics(w http.ResponseWriter, r *http.Request) {
 	downloadMetrics(ctx, w, r, client, date)
 }
 
-func downloadMetrics(ctx context.Context, w http.ResponseWriter, r *http.Request, client store.Client, date time.Time) {
+func downloadMetrics(ctx context.Context, w http.ResponseWriter, r *http.Request, client store.Storer, date time.Time) {
 	logger := logging.FromContext(ctx).Named("metricsapi.downloadMetrics")
 
 	var req v1.DownloadMetricsRequest
@@ -64,7 +64,7 @@ func downloadMetrics(ctx context.Context, w http.ResponseWriter, r *http.Request
 	downloadSingle(ctx, w, r, client, date, fallbackToYesterday)
 }
 
-func downloadSingle(ctx context.Context, w http.ResponseWriter, r *http.Request, client store.Client, date time.Time, fallbackToYesterday bool) {
+func downloadSingle(ctx context.Context, w http.ResponseWriter, r *http.Request, client store.Storer, date time.Time, fallbackToYesterday bool) {
 	logger := logging.FromContext(ctx).Named("metricsapi.downloadSingle")
 
 	data, err := loadData(ctx, client, date)
@@ -88,7 +88,7 @@ func downloadSingle(ctx context.Context, w http.ResponseWriter, r *http.Request,
 	httputils.SendResponse(w, r, data)
 }
 
-func downloadAll(ctx context.Context, w http.ResponseWriter, r *http.Request, client store.Client, today time.Time) {
+func downloadAll(ctx context.Context, w http.ResponseWriter, r *http.Request, client store.Storer, today time.Time) {
 	logger := logging.FromContext(ctx).Named("metricsapi.downloadAll")
 
 	var allData []structs.MetricsData
@@ -114,12 +114,14 @@ func downloadAll(ctx context.Context, w http.ResponseWriter, r *http.Request, cl
 	httputils.SendResponse(w, r, allData)
 }
 
-func loadData(ctx context.Context, client store.Client, date time.Time) (*structs.MetricsData, error) {
+func loadData(ctx context.Context, client store.Storer, date time.Time) (*structs.MetricsData, error) {
 	logger := logging.FromContext(ctx).Named("fetchMetrics")
 
 	logger.Infof("Getting metrics data for %v", date.Format("02.01.2006"))
 
-	rec, err := client.Doc(constants.CollectionMetrics, date.Format("20060102")).Get(ctx)
+	var data structs.MetricsData
+
+	err := client.Get(ctx, constants.CollectionMetrics, date.Format("20060102"), &data)
 	if status.Code(err) == codes.NotFound {
 		logger.Warnf("Data for %v not found", date.Format("02.01.2006"))
 		return nil, nil
@@ -129,11 +131,5 @@ func loadData(ctx context.Context, client store.Client, date time.Time) (*struct
 		return nil, err
 	}
 
-	var data structs.MetricsData
-	if err := rec.DataTo(&data); err != nil {
-		logger.Debugf("Error while parsing data: %v", err)
-		return nil, err
-	}
-
 	return &data, nil
 }
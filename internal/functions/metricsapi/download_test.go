@@ -0,0 +1,86 @@
+package metricsapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/covid19cz/erouska-backend/internal/constants"
+	"github.com/covid19cz/erouska-backend/internal/firebase/structs"
+	"github.com/covid19cz/erouska-backend/internal/store"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDownloadMetrics(t *testing.T) {
+
+	ctx := context.Background()
+
+	storeClient := store.NewMemoryClient()
+
+	for _, date := range []string{"20201031", "20201101"} {
+		if err := storeClient.Set(ctx, constants.CollectionMetrics, date, structs.MetricsData{Date: date}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	today := time.Date(2020, 11, 2, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantDates  []string
+	}{
+		{name: "today falls back to yesterday", query: "", wantStatus: http.StatusOK, wantDates: []string{"20201101"}},
+		{name: "explicit date", query: "?date=2020-10-31", wantStatus: http.StatusOK, wantDates: []string{"20201031"}},
+		{name: "explicit date without data", query: "?date=2020-11-02", wantStatus: http.StatusNotFound},
+		{name: "all", query: "?date=all", wantStatus: http.StatusOK, wantDates: []string{"20201101", "20201031"}},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/"+tt.query, nil)
+		w := httptest.NewRecorder()
+
+		downloadMetrics(ctx, w, r, storeClient, today)
+
+		if w.Code != tt.wantStatus {
+			t.Fatalf("%v: status %v, want %v", tt.name, w.Code, tt.wantStatus)
+		}
+		if tt.wantStatus != http.StatusOK {
+			continue
+		}
+
+		var response struct {
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("%v: %v", tt.name, err)
+		}
+
+		var dates []string
+		if tt.query == "?date=all" {
+			var all []structs.MetricsData
+			if err := json.Unmarshal(response.Data, &all); err != nil {
+				t.Fatalf("%v: %v", tt.name, err)
+			}
+			for _, data := range all {
+				dates = append(dates, data.Date)
+			}
+		} else {
+			var data structs.MetricsData
+			if err := json.Unmarshal(response.Data, &data); err != nil {
+				t.Fatalf("%v: %v", tt.name, err)
+			}
+			dates = append(dates, data.Date)
+		}
+
+		diff := cmp.Diff(tt.wantDates, dates)
+		if diff != "" {
+			t.Fatalf("%v: downloaded metrics mismatch (-want +got):\n%v", tt.name, diff)
+		}
+	}
+}
@@ -4,14 +4,12 @@ import (
 	"context"
 	"fmt"
 	"github.com/covid19cz/erouska-backend/internal/constants"
+	"github.com/covid19cz/erouska-backend/internal/counters"
 	"github.com/covid19cz/erouska-backend/internal/firebase/structs"
 	"github.com/covid19cz/erouska-backend/internal/logging"
 	"github.com/covid19cz/erouska-backend/internal/monitoring"
-	"github.com/covid19cz/erouska-backend/internal/realtimedb"
 	"github.com/covid19cz/erouska-backend/internal/store"
 	httputils "github.com/covid19cz/erouska-backend/internal/utils/http"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
 	"net/http"
 	"os"
 	"time"
@@ -20,7 +18,7 @@ import (
 type config struct {
 	projectID        string
 	now              time.Time
-	realtimedbClient realtimedb.RealtimeDB
+	countersClient   counters.Counters
 	firestoreClient  store.Storer
 	monitoringClient monitoring.Reader
 }
@@ -40,7 +38,7 @@ func PrepareNewVersion(w http.ResponseWriter, r *http.Request) {
 	config := config{
 		projectID:        projectID,
 		now:              time.Now(),
-		realtimedbClient: realtimedb.Client{},
+		countersClient:   counters.Client{Store: store.Client{}},
 		firestoreClient:  store.Client{},
 		monitoringClient: monitoring.Client{},
 	}
@@ -58,13 +56,8 @@ func prepareNewVersion(ctx context.Context, config *config) error {
 	logger := logging.FromContext(ctx).Named("prepareNewVersion")
 
 	yesterday := config.now.UTC().Add(-24 * time.Hour)
-	doc, err := config.firestoreClient.Doc(constants.CollectionMetrics, yesterday.Format("20060102")).Get(ctx)
-	if err != nil {
-		logger.Debugf("Could not fetch yesterdays data for yestPublishers: %v", err)
-		return err
-	}
 	var yestData structs.MetricsData
-	if err = doc.DataTo(&yestData); err != nil {
+	if err := config.firestoreClient.Get(ctx, constants.CollectionMetrics, yesterday.Format("20060102"), &yestData); err != nil {
 		logger.Debugf("Could not fetch yesterdays data for yestPublishers: %v", err)
 		return err
 	}
@@ -114,8 +107,7 @@ func prepareNewVersion(ctx context.Context, config *config) error {
 
 	logger.Debugf("Collected data: %+v", data)
 
-	_, err = config.firestoreClient.Doc(constants.CollectionMetrics, today).Set(ctx, &data)
-	if err != nil {
+	if err := config.firestoreClient.Set(ctx, constants.CollectionMetrics, today, &data); err != nil {
 		return fmt.Errorf("Error while saving data: %v", err)
 	}
 
@@ -128,26 +120,11 @@ func getNotificationsCount(ctx context.Context, config *config, key string) (int
 
 	logger.Debugf("Getting notification counter with key %v", key)
 
-	doc := config.firestoreClient.Doc(constants.CollectionNotificationCounters, key)
-
 	var data structs.NotificationCounter
 
-	rec, err := doc.Get(ctx)
-	if err != nil {
-		if status.Code(err) != codes.NotFound {
-			return 0, fmt.Errorf("Error while querying Firestore: %v", err)
-		}
-
-		logger.Warnf("Notifications counter for '%v' was not found, using default value", key)
-
-		data = structs.NotificationCounter{
-			NotificationsCount: 0,
-		}
-	} else {
-		err = rec.DataTo(&data)
-		if err != nil {
-			return 0, fmt.Errorf("Error while querying Firestore: %v", err)
-		}
+	if err := config.countersClient.Get(ctx, constants.CounterNotifications, key, &data); err != nil {
+		logger.Debugf("Error while querying DB: %v", err)
+		return 0, err
 	}
 
 	return int32(data.NotificationsCount), nil
@@ -160,7 +137,7 @@ func getActivationsCount(ctx context.Context, config *config, key string) (int32
 
 	var data structs.UserCounter
 
-	if err := config.realtimedbClient.NewRef(constants.DbUserCountersPrefix+key).Get(ctx, &data); err != nil {
+	if err := config.countersClient.Get(ctx, constants.CounterUsers, key, &data); err != nil {
 		logger.Debugf("Error while querying DB: %v", err)
 		return 0, err
 	}
@@ -175,7 +152,7 @@ func getPublishersCount(ctx context.Context, config *config, key string) (int32,
 
 	var data structs.PublisherCounter
 
-	if err := config.realtimedbClient.NewRef(constants.DbPublisherCountersPrefix+key).Get(ctx, &data); err != nil {
+	if err := config.countersClient.Get(ctx, constants.CounterPublishers, key, &data); err != nil {
 		logger.Debugf("Error while querying DB: %v", err)
 		return 0, err
 	}
@@ -190,12 +167,9 @@ func getEfgsCounter(ctx context.Context, config *config, key string) (*structs.E
 
 	var data structs.EfgsCounter
 
-	if err := config.realtimedbClient.NewRef(constants.DbEfgsCountersPrefix+key).Get(ctx, &data); err != nil {
-		if status.Code(err) != codes.NotFound {
-			return nil, fmt.Errorf("Error while querying Firestore: %v", err)
-		}
-
-		logger.Debug("EFGS counter for '%v' was not found, using default value", key)
+	if err := config.countersClient.Get(ctx, constants.CounterEfgs, key, &data); err != nil {
+		logger.Debugf("Error while querying DB: %v", err)
+		return nil, err
 	}
 
 	return &data, nil
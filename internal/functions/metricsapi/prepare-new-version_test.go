@@ -0,0 +1,126 @@
+package metricsapi
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/covid19cz/erouska-backend/internal/constants"
+	"github.com/covid19cz/erouska-backend/internal/counters"
+	"github.com/covid19cz/erouska-backend/internal/firebase/structs"
+	"github.com/covid19cz/erouska-backend/internal/store"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPrepareNewVersion(t *testing.T) {
+
+	ctx := context.Background()
+
+	storeClient := store.NewMemoryClient()
+	countersClient := counters.Client{Store: storeClient}
+
+	now := time.Date(2020, 11, 2, 1, 0, 0, 0, time.UTC)
+	yesterday := now.Add(-24 * time.Hour)
+	dayBefore := yesterday.Add(-24 * time.Hour)
+
+	yestData := structs.MetricsData{
+		Date:                        "20201101",
+		ActivationsTotal:            100,
+		KeyPublishersTotal:          20,
+		NotificationsTotal:          30,
+		EfgsKeysUploadedTotal:       40,
+		EfgsKeysDownloadedTotal:     50,
+		EfgsPublishersTotal:         60,
+		EfgsImportedCzTotal:         70,
+		ActivationsYesterday:        1,
+		EfgsKeysDownloadedYesterday: 2,
+	}
+
+	if err := storeClient.Set(ctx, constants.CollectionMetrics, "20201101", yestData); err != nil {
+		t.Fatal(err)
+	}
+
+	increments := []struct {
+		name    string
+		eventID string
+		at      time.Time
+		delta   interface{}
+	}{
+		{constants.CounterUsers, "eABCDEF123", yesterday, structs.UserCounter{UsersCount: 1}},
+		{constants.CounterUsers, "eGHIJKL456", yesterday, structs.UserCounter{UsersCount: 1}},
+		{constants.CounterUsers, "eMNOPQR789", dayBefore, structs.UserCounter{UsersCount: 1}},
+		{constants.CounterPublishers, "publish-1", yesterday, structs.PublisherCounter{PublishersCount: 1, KeysCount: 14}},
+		{constants.CounterNotifications, "eABCDEF123_20201101", yesterday, structs.NotificationCounter{NotificationsCount: 1}},
+		{constants.CounterEfgs, "upload-1", yesterday, structs.EfgsCounter{KeysUploaded: 14, Publishers: 1}},
+		{constants.CounterEfgs, "download-1", yesterday, structs.EfgsCounter{KeysDownloaded: 300, KeysImportedCZ: 5}},
+	}
+
+	for _, increment := range increments {
+		if err := countersClient.Increment(ctx, increment.name, increment.eventID, increment.at, increment.delta); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config := config{
+		projectID:       "test",
+		now:             now,
+		countersClient:  countersClient,
+		firestoreClient: storeClient,
+	}
+
+	if err := prepareNewVersion(ctx, &config); err != nil {
+		t.Fatalf("prepareNewVersion no error expected: %v", err)
+	}
+
+	var saved structs.MetricsData
+	if err := storeClient.Get(ctx, constants.CollectionMetrics, "20201102", &saved); err != nil {
+		t.Fatalf("metrics not saved: %v", err)
+	}
+
+	want := structs.MetricsData{
+		Modified:                    now.Unix(),
+		Date:                        "20201102",
+		ActivationsYesterday:        2,
+		ActivationsTotal:            102,
+		KeyPublishersYesterday:      1,
+		KeyPublishersTotal:          21,
+		NotificationsYesterday:      1,
+		NotificationsTotal:          31,
+		EfgsKeysUploadedYesterday:   14,
+		EfgsKeysUploadedTotal:       54,
+		EfgsKeysDownloadedYesterday: 300,
+		EfgsKeysDownloadedTotal:     350,
+		EfgsPublishersYesterday:     1,
+		EfgsPublishersTotal:         61,
+		EfgsImportedCzYesterday:     5,
+		EfgsImportedCzTotal:         75,
+	}
+
+	diff := cmp.Diff(want, saved)
+	if diff != "" {
+		t.Fatalf("saved metrics mismatch (-want +got):\n%v", diff)
+	}
+}
+
+func TestPrepareNewVersionWithoutYesterday(t *testing.T) {
+
+	ctx := context.Background()
+
+	storeClient := store.NewMemoryClient()
+
+	config := config{
+		projectID:       "test",
+		now:             time.Date(2020, 11, 2, 1, 0, 0, 0, time.UTC),
+		countersClient:  counters.Client{Store: storeClient},
+		firestoreClient: storeClient,
+	}
+
+	if err := prepareNewVersion(ctx, &config); err == nil {
+		t.Fatalf("prepareNewVersion without yesterdays data error expected")
+	}
+
+	if err := storeClient.Get(ctx, constants.CollectionMetrics, "20201102", nil); err == nil {
+		t.Fatalf("metrics saved without yesterdays data")
+	}
+}
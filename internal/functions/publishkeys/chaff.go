@@ -0,0 +1,106 @@
+package publishkeys
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/covid19cz/erouska-backend/internal/logging"
+	"github.com/covid19cz/erouska-backend/pkg/api/v1"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// chaffHeader Header of decoy requests sent by devices, so real uploads can't be told from network traffic. The same
+// header is used by the Key server and the Verification server.
+const chaffHeader = "X-Chaff"
+
+// Latency of chaff responses before any real request was handled.
+const defaultChaffLatency = 1500 * time.Millisecond
+
+// fakeRevisionTokenSize Size of the random revision token in chaff response; its real size doesn't matter, as the
+// response is padded.
+const fakeRevisionTokenSize = 256
+
+// publishLatencies Latencies of recent real requests, shared by all requests handled by the same function instance.
+var publishLatencies = newLatencyTracker(100)
+
+func isChaffRequest(headers http.Header) bool {
+	return headers.Get(chaffHeader) != ""
+}
+
+// handleChaffRequest Answers decoy request like a real one, neither Key server nor EFGS DB is touched. Its body is
+// drained but never parsed, decoys don't need to contain valid keys. The response is sent after the time real requests
+// take.
+func handleChaffRequest(ctx context.Context, w http.ResponseWriter, body io.Reader, receivedAt time.Time) {
+	logger := logging.FromContext(ctx).Named("publish-keys.handleChaffRequest")
+
+	logger.Debug("Handling chaff request")
+
+	if _, err := io.Copy(ioutil.Discard, body); err != nil {
+		logger.Debugf("Could not read body of chaff request: %v", err)
+	}
+
+	response := &v1.PublishKeysResponseDevice{}
+
+	token := make([]byte, fakeRevisionTokenSize)
+	if _, err := rand.Read(token); err != nil {
+		logger.Warnf("Could not generate revision token: %v", err)
+	}
+	response.RevisionToken = base64.StdEncoding.EncodeToString(token)
+
+	if err := padResponse(response); err != nil {
+		logger.Warnf("Could not pad response: %v", err)
+	}
+
+	select {
+	case <-time.After(publishLatencies.average() - time.Since(receivedAt)):
+	case <-ctx.Done():
+		return
+	}
+
+	sendResponseToClient(ctx, w, response)
+}
+
+// latencyTracker Keeps latencies of the last N requests.
+type latencyTracker struct {
+	mutex     sync.Mutex
+	latencies []time.Duration
+	next      int
+	size      int
+}
+
+func newLatencyTracker(size int) *latencyTracker {
+	return &latencyTracker{size: size}
+}
+
+func (t *latencyTracker) record(latency time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(t.latencies) < t.size {
+		t.latencies = append(t.latencies, latency)
+		return
+	}
+
+	t.latencies[t.next] = latency
+	t.next = (t.next + 1) % t.size
+}
+
+func (t *latencyTracker) average() time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(t.latencies) == 0 {
+		return defaultChaffLatency
+	}
+
+	var sum time.Duration
+	for _, latency := range t.latencies {
+		sum += latency
+	}
+
+	return sum / time.Duration(len(t.latencies))
+}
@@ -0,0 +1,60 @@
+package publishkeys
+
+import (
+	"encoding/json"
+	"github.com/covid19cz/erouska-backend/pkg/api/v1"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPublishKeysChaff(t *testing.T) {
+	tracker := newLatencyTracker(3)
+	for _, latency := range []time.Duration{10 * time.Millisecond, 50 * time.Millisecond, 60 * time.Millisecond} {
+		tracker.record(latency)
+	}
+
+	original := publishLatencies
+	publishLatencies = tracker
+	defer func() { publishLatencies = original }()
+
+	// decoy body isn't even parsed
+	request := httptest.NewRequest("POST", "/", strings.NewReader("random bytes, not JSON"))
+	request.Header.Set(chaffHeader, "1")
+	recorder := httptest.NewRecorder()
+
+	start := time.Now()
+
+	// no config is loaded and no Key server called, that would fail here
+	PublishKeys(recorder, request)
+
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("Chaff response was sent after %v, want average latency of real requests", elapsed)
+	}
+
+	if recorder.Body.Len() != 1024 {
+		t.Fatalf("Chaff response has %v bytes, want padded to 1024", recorder.Body.Len())
+	}
+
+	var response v1.PublishKeysResponseDevice
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || response.InsertedExposures != 0 || response.RevisionToken == "" || response.Code != "" {
+		t.Fatalf("Chaff response = %+v, error %v", response, err)
+	}
+}
+
+func TestLatencyTracker(t *testing.T) {
+	tracker := newLatencyTracker(2)
+
+	if got := tracker.average(); got != defaultChaffLatency {
+		t.Fatalf("average() = %v, want default %v", got, defaultChaffLatency)
+	}
+
+	tracker.record(time.Second)
+	tracker.record(3 * time.Second)
+	tracker.record(5 * time.Second) // replaces the oldest one
+
+	if got := tracker.average(); got != 4*time.Second {
+		t.Fatalf("average() = %v, want 4s", got)
+	}
+}
@@ -0,0 +1,74 @@
+package publishkeys
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/covid19cz/erouska-backend/internal/logging"
+	"github.com/covid19cz/erouska-backend/internal/utils/errors"
+	"github.com/covid19cz/erouska-backend/pkg/api/v1"
+	"net/http"
+)
+
+// keyServerError Classifies failed response of the Key server. Its body isn't JSON when the failure comes from
+// something in front of the Key server (e.g. load balancer).
+func keyServerError(status int, body []byte) errors.ErouskaError {
+	var response v1.PublishKeysResponseServer
+	if err := json.Unmarshal(body, &response); err != nil || response.ErrorMessage == "" {
+		response.ErrorMessage = fmt.Sprintf("HTTP %v: %v", status, http.StatusText(status))
+	}
+
+	msg := fmt.Sprintf("Key server has refused the keys: %v", response.ErrorMessage)
+
+	switch {
+	case response.Code == v1.ErrorCertificateInvalid:
+		return &errors.InvalidVerificationCertificateError{Msg: msg}
+	case status >= 500:
+		return &errors.UpstreamUnavailableError{Msg: fmt.Sprintf("Key server has failed: %v", response.ErrorMessage)}
+	default:
+		return &errors.UpstreamRejectedError{ErrorCode: response.Code, Msg: msg}
+	}
+}
+
+// deviceErrorCode Code of the error in response for device.
+func deviceErrorCode(err errors.ErouskaError) string {
+	switch e := err.(type) {
+	case *errors.UpstreamRejectedError:
+		if e.ErrorCode != "" {
+			return e.ErrorCode
+		}
+		return v1.ErrorBadRequest
+	case *errors.InvalidVerificationCertificateError:
+		return v1.ErrorCertificateInvalid
+	case *errors.UpstreamUnavailableError:
+		return v1.ErrorUpstreamUnavailable
+	case *errors.MalformedRequestError:
+		return v1.ErrorBadRequest
+	default:
+		return v1.ErrorInternal
+	}
+}
+
+// sendErrorToClient Answers the device with the error, in the same (padded) format the Key server does. Like other
+// functions (see httputils.SendErrorResponse), the response has status 200 and the device tells the error by its code.
+func sendErrorToClient(ctx context.Context, w http.ResponseWriter, err errors.ErouskaError) {
+	logger := logging.FromContext(ctx).Named("publish-keys.sendErrorToClient")
+
+	response := &v1.PublishKeysResponseDevice{ErrorMessage: err.Error(), Code: deviceErrorCode(err)}
+	if err := padResponse(response); err != nil {
+		logger.Warnf("Could not pad response for device: %v", err)
+	}
+
+	blob, e := json.Marshal(response)
+	if e != nil {
+		logger.Warnf("Could not serialize response for device: %v", e)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if _, e = w.Write(blob); e != nil {
+		logger.Warnf("Could not send response to device: %v", e)
+	}
+}
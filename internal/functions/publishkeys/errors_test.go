@@ -0,0 +1,126 @@
+package publishkeys
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/covid19cz/erouska-backend/internal/certificate"
+	"github.com/covid19cz/erouska-backend/internal/store"
+	"github.com/covid19cz/erouska-backend/internal/utils"
+	"github.com/covid19cz/erouska-backend/internal/utils/errors"
+	"github.com/covid19cz/erouska-backend/pkg/api/v1"
+	keyserverapi "github.com/google/exposure-notifications-server/pkg/api/v1"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPublishKeysErrors(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		unreached bool
+		verifyErr errors.ErouskaError
+		wantCode  string
+	}{
+		{
+			name:      "invalid certificate refused by us",
+			verifyErr: &errors.InvalidVerificationCertificateError{Msg: "Invalid verification certificate: expired"},
+			wantCode:  v1.ErrorCertificateInvalid,
+		},
+		{
+			name:      "public keys of Verification server unavailable",
+			verifyErr: &errors.UpstreamUnavailableError{Msg: "Could not verify certificate: HTTP 503"},
+			wantCode:  v1.ErrorUpstreamUnavailable,
+		},
+		{
+			name:      "Key server unreachable",
+			unreached: true,
+			wantCode:  v1.ErrorUpstreamUnavailable,
+		},
+		{
+			name:     "Key server failure",
+			status:   http.StatusInternalServerError,
+			body:     `{"error":"db down","code":"internal_error"}`,
+			wantCode: v1.ErrorUpstreamUnavailable,
+		},
+		{
+			name:     "load balancer failure",
+			status:   http.StatusBadGateway,
+			body:     "<html>Bad gateway</html>",
+			wantCode: v1.ErrorUpstreamUnavailable,
+		},
+		{
+			name:     "invalid certificate",
+			status:   http.StatusUnauthorized,
+			body:     `{"error":"token expired","code":"health_authority_verification_certificate_invalid"}`,
+			wantCode: v1.ErrorCertificateInvalid,
+		},
+		{
+			name:     "rejected revision",
+			status:   http.StatusBadRequest,
+			body:     `{"error":"bad token","code":"invalid_revision_token"}`,
+			wantCode: keyserverapi.ErrorInvalidRevisionToken,
+		},
+		{
+			name:     "rejected without code",
+			status:   http.StatusNotFound,
+			body:     `{"error":"unknown app"}`,
+			wantCode: v1.ErrorBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer keyServer.Close()
+
+			if tt.unreached {
+				keyServer.Close()
+			}
+
+			publisher := &recordingPublisher{}
+			config := &config{
+				keyServerConfig:     &utils.KeyServerConfig{URL: keyServer.URL},
+				client:              &http.Client{},
+				storeClient:         store.NewMemoryClient(),
+				pubSubClient:        publisher,
+				certificateVerifier: staticVerifier{claims: &certificate.Claims{}, err: tt.verifyErr},
+				correlationID:       "correlation-1",
+			}
+
+			request := v1.PublishKeysRequestDevice{
+				Publish: keyserverapi.Publish{Keys: []keyserverapi.ExposureKey{{Key: "z2Cx9hdz2SlxZ8GEgqTYpA=="}}},
+			}
+
+			recorder := httptest.NewRecorder()
+			publishKeys(ctx, config, recorder, request, http.Header{})
+
+			if recorder.Code != http.StatusOK {
+				t.Errorf("Status = %v, want %v", recorder.Code, http.StatusOK)
+			}
+
+			var response v1.PublishKeysResponseDevice
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+				t.Fatalf("Could not deserialize response %q: %v", recorder.Body.String(), err)
+			}
+
+			if response.Code != tt.wantCode || response.ErrorMessage == "" || response.InsertedExposures != 0 {
+				t.Errorf("Response = %+v, want code %v", response, tt.wantCode)
+			}
+
+			if len(recorder.Body.Bytes()) != responsePaddingBuckets[0] {
+				t.Errorf("Response size = %v, want it padded to %v", len(recorder.Body.Bytes()), responsePaddingBuckets[0])
+			}
+
+			if len(publisher.topics) != 0 {
+				t.Errorf("Published aftermath of failed request to %v", publisher.topics)
+			}
+		})
+	}
+}
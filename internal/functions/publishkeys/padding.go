@@ -0,0 +1,85 @@
+package publishkeys
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/covid19cz/erouska-backend/pkg/api/v1"
+)
+
+// Sizes (of serialized JSON) the requests and responses are padded to, so their size doesn't tell what they contain.
+// Bigger ones are padded to a multiple of the last bucket.
+var (
+	requestPaddingBuckets  = []int{4 * 1024, 8 * 1024, 16 * 1024, 32 * 1024}
+	responsePaddingBuckets = []int{1024, 2 * 1024, 4 * 1024}
+)
+
+// maxPaddedRequestSize The Key server refuses requests bigger than 64 kB.
+const maxPaddedRequestSize = 64 * 1024
+
+// padRequest Replaces padding of the request for Key server by random data, so its size is in one of the buckets.
+func padRequest(request *v1.PublishKeysRequestServer) error {
+	request.Padding = ""
+
+	size, err := serializedSize(request)
+	if err != nil {
+		return err
+	}
+
+	bucket := paddingBucket(size, requestPaddingBuckets)
+	if bucket > maxPaddedRequestSize {
+		bucket = maxPaddedRequestSize
+	}
+
+	request.Padding, err = randomPadding(bucket - size)
+	return err
+}
+
+// padResponse Replaces padding of the response for device by random data, so its size is in one of the buckets.
+func padResponse(response *v1.PublishKeysResponseDevice) error {
+	// the padding is omitted when empty, so the size is measured with one character of it
+	response.Padding = "x"
+
+	size, err := serializedSize(response)
+	if err != nil {
+		return err
+	}
+
+	response.Padding, err = randomPadding(paddingBucket(size, responsePaddingBuckets) - size + 1)
+	return err
+}
+
+func serializedSize(payload interface{}) (int, error) {
+	blob, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	return len(blob), nil
+}
+
+// paddingBucket Gets the smallest bucket the size fits in.
+func paddingBucket(size int, buckets []int) int {
+	for _, bucket := range buckets {
+		if size <= bucket {
+			return bucket
+		}
+	}
+
+	last := buckets[len(buckets)-1]
+	return (size + last - 1) / last * last
+}
+
+// randomPadding Generates random base64 characters; they're never escaped in JSON, so the serialized size grows by
+// exactly the length.
+func randomPadding(length int) (string, error) {
+	if length <= 0 {
+		return "", nil
+	}
+
+	bytes := make([]byte, length*3/4+1)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+
+	return base64.RawStdEncoding.EncodeToString(bytes)[:length], nil
+}
@@ -0,0 +1,73 @@
+package publishkeys
+
+import (
+	"encoding/json"
+	"github.com/covid19cz/erouska-backend/pkg/api/v1"
+	keyserverapi "github.com/google/exposure-notifications-server/pkg/api/v1"
+	"strings"
+	"testing"
+)
+
+func TestPadRequest(t *testing.T) {
+	newRequest := func(keysCount int, padding string) *v1.PublishKeysRequestServer {
+		request := &v1.PublishKeysRequestServer{
+			HealthAuthorityID:   "cz.covid19cz.erouska",
+			VerificationPayload: strings.Repeat("a", 600),
+			Padding:             padding,
+		}
+		for i := 0; i < keysCount; i++ {
+			request.Keys = append(request.Keys, keyserverapi.ExposureKey{Key: "z2Cx9hdz2SlxZ8GEgqTYpA==", IntervalNumber: 2662992, IntervalCount: 144})
+		}
+		return request
+	}
+
+	tests := []struct {
+		name    string
+		request *v1.PublishKeysRequestServer
+		want    int
+	}{
+		{name: "small", request: newRequest(1, ""), want: 4 * 1024},
+		{name: "padding of device replaced", request: newRequest(1, strings.Repeat("p", 5000)), want: 4 * 1024},
+		{name: "more keys", request: newRequest(50, ""), want: 8 * 1024},
+		{name: "over buckets", request: newRequest(400, ""), want: 64 * 1024},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := padRequest(tt.request); err != nil {
+				t.Fatalf("padRequest() error = %v", err)
+			}
+
+			blob, _ := json.Marshal(tt.request)
+			if len(blob) != tt.want {
+				t.Fatalf("padRequest() size = %v, want %v", len(blob), tt.want)
+			}
+		})
+	}
+}
+
+func TestPadResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		response *v1.PublishKeysResponseDevice
+		want     int
+	}{
+		{name: "success", response: &v1.PublishKeysResponseDevice{InsertedExposures: 14, RevisionToken: strings.Repeat("r", 300)}, want: 1024},
+		{name: "error", response: &v1.PublishKeysResponseDevice{Code: "unknown_health_authority_id", ErrorMessage: "unknown health authority"}, want: 1024},
+		{name: "long revision token", response: &v1.PublishKeysResponseDevice{InsertedExposures: 14, RevisionToken: strings.Repeat("r", 1500)}, want: 2 * 1024},
+		{name: "exactly bucket", response: &v1.PublishKeysResponseDevice{RevisionToken: strings.Repeat("r", 1024-len(`{"revisionToken":"","padding":"x"}`))}, want: 1024},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := padResponse(tt.response); err != nil {
+				t.Fatalf("padResponse() error = %v", err)
+			}
+
+			blob, _ := json.Marshal(tt.response)
+			if len(blob) != tt.want {
+				t.Fatalf("padResponse() size = %v, want %v", len(blob), tt.want)
+			}
+		})
+	}
+}
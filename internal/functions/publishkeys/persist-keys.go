@@ -0,0 +1,44 @@
+package publishkeys
+
+import (
+	"context"
+	"fmt"
+	"github.com/covid19cz/erouska-backend/internal/logging"
+	"github.com/covid19cz/erouska-backend/internal/pubsub"
+	"github.com/covid19cz/erouska-backend/pkg/api/v1"
+)
+
+//PersistKeysPayload Keys published by device, to be saved for upload to EFGS.
+type PersistKeysPayload struct {
+	CorrelationID string `json:"correlationId" validate:"required"`
+	// Request Accepted by the Key server already, so it's not validated again.
+	Request v1.PublishKeysRequestDevice `json:"request" validate:"-"`
+}
+
+//PersistKeysForEfgs Saves keys published by device to EFGS database. New keys come with the aftermath event, this only
+//handles events enqueued before it.
+func PersistKeysForEfgs(ctx context.Context, m pubsub.Message) error {
+	logger := logging.FromContext(ctx).Named("publish-keys.PersistKeysForEfgs")
+
+	var payload PersistKeysPayload
+
+	if err := pubsub.DecodeJSONEvent(m, &payload); err != nil {
+		return fmt.Errorf("Error while parsing event payload: %v", err)
+	}
+
+	logger.Debugf("Handling keys persistence with correlation ID '%v'", payload.CorrelationID)
+
+	config, err := loadConfig(ctx, payload.CorrelationID)
+	if err != nil {
+		return fmt.Errorf("Could not load config: %v", err)
+	}
+
+	if err = persistKeysForEfgs(ctx, config, payload.Request, nil); err != nil {
+		logger.Errorf("Error while processing keys persistence: %v", err)
+		return err
+	}
+
+	logger.Info("Saved uploaded keys to EFGS database")
+
+	return nil
+}
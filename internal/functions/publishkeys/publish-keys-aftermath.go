@@ -0,0 +1,66 @@
+package publishkeys
+
+import (
+	"context"
+	"fmt"
+	"github.com/covid19cz/erouska-backend/internal/certificate"
+	"github.com/covid19cz/erouska-backend/internal/constants"
+	"github.com/covid19cz/erouska-backend/internal/logging"
+	"github.com/covid19cz/erouska-backend/internal/pubsub"
+	"github.com/covid19cz/erouska-backend/pkg/api/v1"
+)
+
+//AftermathPayload Keys successfully published by device, for the work done after the device got its response.
+type AftermathPayload struct {
+	CorrelationID     string `json:"correlationId" validate:"required"`
+	InsertedExposures int    `json:"insertedExposures"`
+	// Request Request of the device, present only when its user has consented to federation - the keys are then saved
+	// for upload to EFGS. It was validated and accepted by the Key server already, so it's not validated again.
+	Request *v1.PublishKeysRequestDevice `json:"request,omitempty" validate:"-"`
+	// Claims Verified claims of the certificate, present with the request.
+	Claims *certificate.Claims `json:"claims,omitempty" validate:"-"`
+}
+
+//AfterMath Updates counters and saves keys for upload to EFGS. Any failure fails the whole event, so it's retried;
+//both steps can be repeated safely.
+func AfterMath(ctx context.Context, m pubsub.Message) error {
+	var payload AftermathPayload
+
+	if err := pubsub.DecodeJSONEvent(m, &payload); err != nil {
+		return fmt.Errorf("Error while parsing event payload: %v", err)
+	}
+
+	config, err := loadConfig(ctx, payload.CorrelationID)
+	if err != nil {
+		return fmt.Errorf("Could not load config: %v", err)
+	}
+
+	return pubsub.NewLedger(config.storeClient).ProcessOnce(ctx, constants.TopicPublishKeys, m, func(ctx context.Context, m pubsub.Message) error {
+		return afterMath(ctx, config, &payload)
+	})
+}
+
+func afterMath(ctx context.Context, config *config, payload *AftermathPayload) error {
+	logger := logging.FromContext(ctx).Named("publish-keys.afterMath")
+
+	logger.Debugf("Doing publish keys aftermath for correlation ID '%v'", payload.CorrelationID)
+
+	efgsConsent := payload.Request != nil
+
+	if err := updateCounters(ctx, config.countersClient, payload.CorrelationID, payload.InsertedExposures+1, efgsConsent); err != nil {
+		return fmt.Errorf("Could not update publishers and keys counter: %v", err)
+	}
+
+	if !efgsConsent {
+		logger.Info("Federation is disabled for this request")
+		return nil
+	}
+
+	if err := persistKeysForEfgs(ctx, config, *payload.Request, payload.Claims); err != nil {
+		return fmt.Errorf("Error while processing keys persistence: %v", err)
+	}
+
+	logger.Info("Saved uploaded keys to EFGS database")
+
+	return nil
+}
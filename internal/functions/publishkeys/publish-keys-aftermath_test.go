@@ -0,0 +1,217 @@
+package publishkeys
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/covid19cz/erouska-backend/internal/certificate"
+	"github.com/covid19cz/erouska-backend/internal/constants"
+	"github.com/covid19cz/erouska-backend/internal/counters"
+	"github.com/covid19cz/erouska-backend/internal/firebase/structs"
+	efgsapi "github.com/covid19cz/erouska-backend/internal/functions/efgs/api"
+	"github.com/covid19cz/erouska-backend/internal/outbox"
+	"github.com/covid19cz/erouska-backend/internal/store"
+	"github.com/covid19cz/erouska-backend/internal/utils"
+	"github.com/covid19cz/erouska-backend/internal/utils/errors"
+	"github.com/covid19cz/erouska-backend/pkg/api/v1"
+	keyserverapi "github.com/google/exposure-notifications-server/pkg/api/v1"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// recordingPublisher Records published messages, serialized the same way as PubSub does.
+type recordingPublisher struct {
+	topics   []string
+	messages []string
+}
+
+func (p *recordingPublisher) Publish(topic string, msg interface{}) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	p.topics = append(p.topics, topic)
+	p.messages = append(p.messages, string(payload))
+	return nil
+}
+
+// recordingDatabase Records keys saved to EFGS database, by the method they were saved by.
+type recordingDatabase struct {
+	persisted []*efgsapi.DiagnosisKey
+	revised   []*efgsapi.DiagnosisKey
+}
+
+func (d *recordingDatabase) PersistDiagnosisKeys(keys []*efgsapi.DiagnosisKey, policyVersion string) error {
+	d.persisted = append(d.persisted, keys...)
+	return nil
+}
+
+func (d *recordingDatabase) ReviseDiagnosisKeys(keys []*efgsapi.DiagnosisKey, policyVersion string) error {
+	d.revised = append(d.revised, keys...)
+	return nil
+}
+
+// staticVerifier Verifies every certificate with the same result.
+type staticVerifier struct {
+	claims *certificate.Claims
+	err    errors.ErouskaError
+}
+
+func (v staticVerifier) Verify(ctx context.Context, token string) (*certificate.Claims, errors.ErouskaError) {
+	return v.claims, v.err
+}
+
+func TestPublishKeysEnqueuesAftermath(t *testing.T) {
+	keyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(keyserverapi.PublishResponse{InsertedExposures: 2, RevisionToken: "revision-token"})
+	}))
+	defer keyServer.Close()
+
+	ctx := context.Background()
+
+	claims := &certificate.Claims{}
+	claims.ReportType = keyserverapi.ReportTypeConfirmed
+	claims.SymptomOnsetInterval = 2662992
+
+	tests := []struct {
+		name        string
+		consent     bool
+		wantRequest bool
+	}{
+		{name: "with consent to federation", consent: true, wantRequest: true},
+		{name: "without consent to federation", consent: false, wantRequest: false},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storeClient := store.NewMemoryClient()
+			publisher := &recordingPublisher{}
+
+			config := &config{
+				keyServerConfig:     &utils.KeyServerConfig{URL: keyServer.URL},
+				client:              keyServer.Client(),
+				storeClient:         storeClient,
+				pubSubClient:        publisher,
+				certificateVerifier: staticVerifier{claims: claims},
+				correlationID:       fmt.Sprintf("correlation-%v", i),
+			}
+
+			request := v1.PublishKeysRequestDevice{
+				Publish:             keyserverapi.Publish{Keys: []keyserverapi.ExposureKey{{Key: "z2Cx9hdz2SlxZ8GEgqTYpA=="}, {Key: "a2Cx9hdz2SlxZ8GEgqTYpA=="}}},
+				ConsentToFederation: tt.consent,
+			}
+
+			recorder := httptest.NewRecorder()
+			publishKeys(ctx, config, recorder, request, http.Header{})
+
+			var response v1.PublishKeysResponseDevice
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil || response.InsertedExposures != 2 {
+				t.Fatalf("Response = %+v, error %v", response, err)
+			}
+
+			// the event is saved to outbox before the response and published after it
+			var entry outbox.Entry
+			if err := storeClient.Get(ctx, constants.CollectionOutbox, aftermathOutboxID(config.correlationID), &entry); err != nil || entry.Status != outbox.StatusPublished {
+				t.Fatalf("Outbox entry = %+v, error %v; want published one", entry, err)
+			}
+
+			if len(publisher.topics) != 1 || publisher.topics[0] != constants.TopicPublishKeys {
+				t.Fatalf("Published to %v, want %v", publisher.topics, constants.TopicPublishKeys)
+			}
+
+			var payload AftermathPayload
+			if err := json.Unmarshal([]byte(publisher.messages[0]), &payload); err != nil {
+				t.Fatal(err)
+			}
+
+			if payload.CorrelationID != config.correlationID || payload.InsertedExposures != 2 || (payload.Request != nil) != tt.wantRequest {
+				t.Fatalf("Aftermath payload = %+v", payload)
+			}
+
+			// the claims are needed for EFGS only
+			if tt.wantRequest && (payload.Claims == nil || payload.Claims.SymptomOnsetInterval != claims.SymptomOnsetInterval) {
+				t.Fatalf("Aftermath claims = %+v, want %+v", payload.Claims, claims)
+			}
+			if !tt.wantRequest && payload.Claims != nil {
+				t.Fatalf("Aftermath claims = %+v, want none", payload.Claims)
+			}
+		})
+	}
+}
+
+func TestAfterMathWithoutConsent(t *testing.T) {
+	ctx := context.Background()
+	countersClient := counters.Client{Store: store.NewMemoryClient()}
+	config := &config{countersClient: countersClient}
+
+	payload := &AftermathPayload{CorrelationID: "correlation-1", InsertedExposures: 9}
+
+	// redelivered event is counted once
+	for i := 0; i < 2; i++ {
+		if err := afterMath(ctx, config, payload); err != nil {
+			t.Fatalf("afterMath() error = %v", err)
+		}
+	}
+
+	var publishers structs.PublisherCounter
+	if err := countersClient.Get(ctx, constants.CounterPublishers, counters.KeyTotal, &publishers); err != nil || publishers.PublishersCount != 1 || publishers.KeysCount != 10 {
+		t.Fatalf("Publishers counter = %+v, error %v", publishers, err)
+	}
+
+	var efgs structs.EfgsCounter
+	if err := countersClient.Get(ctx, constants.CounterEfgs, counters.KeyTotal, &efgs); err != nil || efgs.Publishers != 0 {
+		t.Fatalf("EFGS counter = %+v, error %v; want nothing counted without consent", efgs, err)
+	}
+}
+
+func TestPersistKeysForEfgsRevision(t *testing.T) {
+	ctx := context.Background()
+
+	request := v1.PublishKeysRequestDevice{
+		Publish: keyserverapi.Publish{
+			Keys:          []keyserverapi.ExposureKey{{Key: "z2Cx9hdz2SlxZ8GEgqTYpA==", IntervalNumber: 2662992, IntervalCount: 144, TransmissionRisk: 5}},
+			RevisionToken: "revision-token",
+		},
+		ConsentToFederation: true,
+	}
+
+	tests := []struct {
+		name          string
+		revisionToken string
+		reportType    string
+		wantRevised   bool
+		wantType      efgsapi.ReportType
+	}{
+		{name: "first publish", reportType: keyserverapi.ReportTypeConfirmed, wantType: efgsapi.ReportType_CONFIRMED_TEST},
+		{name: "revision", revisionToken: "revision-token", reportType: keyserverapi.ReportTypeConfirmed, wantRevised: true, wantType: efgsapi.ReportType_CONFIRMED_TEST},
+		{name: "revocation", revisionToken: "revision-token", reportType: keyserverapi.ReportTypeNegative, wantRevised: true, wantType: efgsapi.ReportType_REVOKED},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database := &recordingDatabase{}
+			config := &config{storeClient: store.NewMemoryClient(), efgsdatabase: database}
+
+			request.RevisionToken = tt.revisionToken
+			claims := &certificate.Claims{VerificationClaims: keyserverapi.VerificationClaims{ReportType: tt.reportType}}
+
+			if err := persistKeysForEfgs(ctx, config, request, claims); err != nil {
+				t.Fatalf("persistKeysForEfgs() error = %v", err)
+			}
+
+			saved, other := database.persisted, database.revised
+			if tt.wantRevised {
+				saved, other = database.revised, database.persisted
+			}
+
+			if len(saved) != 1 || len(other) != 0 {
+				t.Fatalf("Persisted %v and revised %v keys, want the key revised = %v", len(database.persisted), len(database.revised), tt.wantRevised)
+			}
+
+			if saved[0].ReportType != tt.wantType {
+				t.Fatalf("Saved key with report type %v, want %v", saved[0].ReportType, tt.wantType)
+			}
+		})
+	}
+}
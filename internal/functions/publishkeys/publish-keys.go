@@ -5,52 +5,84 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
-	"firebase.google.com/go/db"
 	"fmt"
+	"github.com/covid19cz/erouska-backend/internal/certificate"
 	"github.com/covid19cz/erouska-backend/internal/constants"
+	"github.com/covid19cz/erouska-backend/internal/counters"
 	"github.com/covid19cz/erouska-backend/internal/firebase/structs"
 	"github.com/covid19cz/erouska-backend/internal/functions/efgs"
 	efgsapi "github.com/covid19cz/erouska-backend/internal/functions/efgs/api"
 	efgsdatabase "github.com/covid19cz/erouska-backend/internal/functions/efgs/database"
 	efgsutils "github.com/covid19cz/erouska-backend/internal/functions/efgs/utils"
 	"github.com/covid19cz/erouska-backend/internal/logging"
-	"github.com/covid19cz/erouska-backend/internal/realtimedb"
+	"github.com/covid19cz/erouska-backend/internal/outbox"
+	"github.com/covid19cz/erouska-backend/internal/pubsub"
 	"github.com/covid19cz/erouska-backend/internal/secrets"
+	"github.com/covid19cz/erouska-backend/internal/store"
 	"github.com/covid19cz/erouska-backend/internal/utils"
+	"github.com/covid19cz/erouska-backend/internal/utils/errors"
 	"github.com/covid19cz/erouska-backend/pkg/api/v1"
-	"github.com/dgrijalva/jwt-go"
 	"github.com/lithammer/shortuuid/v3"
+	rpccode "google.golang.org/genproto/googleapis/rpc/code"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"sync"
 	"time"
 )
 
-const (
-	countryOfOrigin              = "CZ"
-	defaultTransmissionRiskLevel = 2  // see docs for ExposureKey - "CONFIRMED will lead to TR 2"
-	defaultSymptomDate           = -1 // == yesterday - this is a good default/fallback value because it's taken as serious by the EN API
-)
+const countryOfOrigin = "CZ"
 
 type config struct {
 	keyServerConfig         *utils.KeyServerConfig
 	client                  *http.Client
-	realtimeDBClient        *realtimedb.Client
-	efgsdatabase            *efgsdatabase.Connection
+	countersClient          counters.Counters
+	storeClient             store.Storer
+	pubSubClient            pubsub.EventPublisher
+	efgsdatabase            keysDatabase
+	certificateVerifier     certificateVerifier
 	defaultVisitedCountries []string
+	uploadPolicyFile        string
 	correlationID           string
+	// receivedAt When the request was received; zero when not handling request of the device.
+	receivedAt time.Time
+}
+
+// keysDatabase EFGS database the published keys are saved to, see efgsdatabase.Connection.
+type keysDatabase interface {
+	PersistDiagnosisKeys(keys []*efgsapi.DiagnosisKey, policyVersion string) error
+	ReviseDiagnosisKeys(keys []*efgsapi.DiagnosisKey, policyVersion string) error
+}
+
+// certificateVerifier Verifies certificate of the published keys; see certificate.Verifier.
+type certificateVerifier interface {
+	Verify(ctx context.Context, token string) (*certificate.Claims, errors.ErouskaError)
 }
 
+// The verifier is shared by requests handled by the same function instance, so the public keys are cached across them.
+var (
+	sharedVerifier      *certificate.Verifier
+	sharedVerifierMutex sync.Mutex
+)
+
 //PublishKeys Handler
 func PublishKeys(w http.ResponseWriter, r *http.Request) {
 	var ctx = r.Context()
 	logger := logging.FromContext(ctx).Named("publish-keys.PublishKeys")
 
+	receivedAt := time.Now()
+
+	if isChaffRequest(r.Header) {
+		handleChaffRequest(ctx, w, r.Body, receivedAt)
+		return
+	}
+
 	var request v1.PublishKeysRequestDevice
 
 	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		logger.Errorf("Could not read request body: %v", err)
-		http.Error(w, "Could not read body", http.StatusInternalServerError)
+		sendErrorToClient(ctx, w, &errors.MalformedRequestError{Status: rpccode.Code_INVALID_ARGUMENT, Msg: "Could not read body"})
 		return
 	}
 
@@ -60,7 +92,7 @@ func PublishKeys(w http.ResponseWriter, r *http.Request) {
 
 	if err := json.Unmarshal(body, &request); err != nil {
 		logger.Errorf("Could not deserialize request from device: %v", err)
-		http.Error(w, "Could not deserialize", http.StatusBadRequest)
+		sendErrorToClient(ctx, w, &errors.MalformedRequestError{Status: rpccode.Code_INVALID_ARGUMENT, Msg: "Could not deserialize"})
 		return
 	}
 
@@ -68,10 +100,31 @@ func PublishKeys(w http.ResponseWriter, r *http.Request) {
 		logger.Debugf("Handling PublishKeys request: %+v", request)
 	}
 
+	limits, err := utils.LoadKeyServerLimits(ctx)
+	if err != nil {
+		logger.Errorf("Could not load Key server limits: %v", err)
+		sendErrorToClient(ctx, w, &errors.UnknownError{Msg: "Could not load config"})
+		return
+	}
+
+	if msg, valid := validateRequest(ctx, &request, limits); !valid {
+		logger.Warnf("Refusing invalid request: %v", msg)
+		sendErrorToClient(ctx, w, &errors.MalformedRequestError{Status: rpccode.Code_INVALID_ARGUMENT, Msg: msg})
+		return
+	}
+
 	config, err := loadConfig(ctx, shortuuid.New())
 	if err != nil {
 		logger.Errorf("Could not load config: %v", err)
-		http.Error(w, "Could not load config", http.StatusInternalServerError)
+		sendErrorToClient(ctx, w, &errors.UnknownError{Msg: "Could not load config"})
+		return
+	}
+
+	config.receivedAt = receivedAt
+
+	if config.certificateVerifier, err = loadCertificateVerifier(ctx); err != nil {
+		logger.Errorf("Could not load certificate verifier: %v", err)
+		sendErrorToClient(ctx, w, &errors.UnknownError{Msg: "Could not load config"})
 		return
 	}
 
@@ -83,11 +136,27 @@ func publishKeys(ctx context.Context, config *config, w http.ResponseWriter, req
 
 	logger.Debugf("Handling request with correlation ID '%v'", config.correlationID)
 
+	claims, certificateErr := config.certificateVerifier.Verify(ctx, requestPayload.VerificationPayload)
+	if certificateErr != nil {
+		sendErrorToClient(ctx, w, certificateErr)
+		recordLatency(config)
+
+		logger.Warnf("Refusing keys with unverified certificate: %v", certificateErr)
+		return
+	}
+
 	var serverRequest = toServerRequest(&requestPayload)
 
-	serverResponse, err := passToKeyServer(ctx, config, serverRequest, requestHeaders)
-	if err != nil {
-		logger.Errorf("Could not obtain response from Key server: %v", err)
+	if err := padRequest(serverRequest); err != nil {
+		logger.Warnf("Could not pad request for Key server: %v", err)
+	}
+
+	serverResponse, keyServerErr := passToKeyServer(ctx, config, serverRequest, requestHeaders)
+	if keyServerErr != nil {
+		sendErrorToClient(ctx, w, keyServerErr)
+		recordLatency(config)
+
+		logger.Errorf("Could not publish keys to Key server: %v", keyServerErr)
 		return
 	}
 
@@ -95,85 +164,136 @@ func publishKeys(ctx context.Context, config *config, w http.ResponseWriter, req
 		logger.Debugf("Received response from Key server: %+v", serverResponse)
 	}
 
-	// send response to client ASAP
-	sendResponseToClient(ctx, w, toDeviceResponse(serverResponse))
-
-	if serverResponse.Code == "" && serverResponse.ErrorMessage == "" {
-		logger.Infof("Successfully uploaded %v keys to Key server (%v keys sent)", serverResponse.InsertedExposures, len(serverRequest.Keys))
-
-		efgsConsent := requestPayload.ConsentToFederation
+	success := serverResponse.Code == "" && serverResponse.ErrorMessage == ""
 
-		if err := updateCounters(ctx, config.realtimeDBClient, serverResponse.InsertedExposures+1, efgsConsent); err != nil {
-			logger.Errorf("Could not update publishers and keys counter: %+v", err)
-			// don't fail, this is not so important
-		}
+	// save the aftermath event before responding, so it can't get lost
+	outboxID := ""
+	if success {
+		payload := toAftermathPayload(config.correlationID, &requestPayload, claims, serverResponse)
 
-		if efgsConsent {
-			logger.Debug("Going to save uploaded keys to EFGS database")
+		if err := addToOutbox(ctx, config, payload); err != nil {
+			logger.Errorf("Could not save aftermath event to outbox, will publish it directly: %v", err)
 
-			if err = persistKeysForEfgs(ctx, config, requestPayload); err != nil {
-				logger.Errorf("Error while processing keys persistence: %v", err)
-				// don't fail, this is not so important
-			} else {
-				logger.Info("Saved uploaded keys to EFGS database")
+			if err = config.pubSubClient.Publish(constants.TopicPublishKeys, payload); err != nil {
+				logger.Errorf("Could not publish aftermath event, counters and EFGS keys are lost: %v", err)
 			}
 		} else {
-			logger.Info("Federation is disabled for this request")
+			outboxID = aftermathOutboxID(config.correlationID)
 		}
-	} else {
+	}
+
+	deviceResponse := toDeviceResponse(serverResponse)
+	if err := padResponse(deviceResponse); err != nil {
+		logger.Warnf("Could not pad response for device: %v", err)
+	}
+
+	// send response to client ASAP
+	sendResponseToClient(ctx, w, deviceResponse)
+
+	recordLatency(config)
+
+	if !success {
 		// error has occurred! don't fail, just pass the error to client
 		logger.Errorf("Key server has refused the keys; code %v, message '%v'", serverResponse.Code, serverResponse.ErrorMessage)
+		return
+	}
+
+	logger.Infof("Successfully uploaded %v keys to Key server (%v keys sent)", serverResponse.InsertedExposures, len(serverRequest.Keys))
+
+	if outboxID != "" {
+		relay := outbox.Relay{Store: config.storeClient, Publisher: config.pubSubClient}
+		if err := relay.Publish(ctx, outboxID); err != nil {
+			// it will be published by the outbox relay later
+			logger.Warnf("Could not publish aftermath event: %v", err)
+		}
 	}
 }
 
-func persistKeysForEfgs(ctx context.Context, config *config, request v1.PublishKeysRequestDevice) error {
+// recordLatency Records how long it took to answer the request, so chaff requests are answered after the same time.
+func recordLatency(config *config) {
+	if !config.receivedAt.IsZero() {
+		publishLatencies.record(time.Since(config.receivedAt))
+	}
+}
+
+// toAftermathPayload Builds the aftermath event; the keys and claims are included only when user has consented to
+// federation.
+func toAftermathPayload(correlationID string, request *v1.PublishKeysRequestDevice, claims *certificate.Claims, response *v1.PublishKeysResponseServer) *AftermathPayload {
+	payload := &AftermathPayload{CorrelationID: correlationID, InsertedExposures: response.InsertedExposures}
+	if request.ConsentToFederation {
+		payload.Request = request
+		payload.Claims = claims
+	}
+	return payload
+}
+
+func addToOutbox(ctx context.Context, config *config, payload *AftermathPayload) error {
+	return config.storeClient.RunTransaction(ctx, func(ctx context.Context, tx store.Transaction) error {
+		return outbox.Add(tx, aftermathOutboxID(config.correlationID), constants.TopicPublishKeys, payload)
+	})
+}
+
+func aftermathOutboxID(correlationID string) string {
+	return constants.TopicPublishKeys + "_" + correlationID
+}
+
+// persistKeysForEfgs Saves the keys for upload to EFGS. Report type and symptom onset are taken from the verified claims
+// of the certificate; they're nil for requests published before the certificates were verified.
+func persistKeysForEfgs(ctx context.Context, config *config, request v1.PublishKeysRequestDevice, claims *certificate.Claims) error {
 	logger := logging.FromContext(ctx).Named("publish-keys.persistKeysForEfgs")
 
 	logger.Debugf("Handling keys upload")
 
-	visitedCountries := request.VisitedCountries
-	if len(visitedCountries) == 0 {
-		visitedCountries = config.defaultVisitedCountries
+	policy, err := loadUploadPolicy(ctx, config)
+	if err != nil {
+		return err
 	}
 
-	// non-travelling users, willing to share their keys
-	if !request.Traveler {
-		visitedCountries = []string{}
-	}
+	logger.Debugf("Using upload policy '%v'", policy.Version)
+
+	visitedCountries := policy.visitedCountries(&request)
 
 	logger.Debugf("Using visitedCountries: %+v", visitedCountries)
 
 	// Days of start of symptoms
-	// Try to read it from VC and if not present, use the default value.
-	dos := extractDoS(request)
+	dos := policy.symptomOnset(&request, claims, time.Now())
 
 	logger.Debugf("Extracted DoS %v", dos.Format("2006-01-02"))
 
+	reportType := request.ReportType
+	if claims != nil {
+		reportType = claims.DeviceReportType()
+	}
+
 	var keys []*efgsapi.DiagnosisKey
 	for _, k := range request.Keys {
-		diagnosisKey := efgs.ToDiagnosisKey(dos, &k, countryOfOrigin, visitedCountries)
-		if diagnosisKey.TransmissionRiskLevel == 0 {
-			diagnosisKey.TransmissionRiskLevel = defaultTransmissionRiskLevel
-		}
+		diagnosisKey := efgs.ToDiagnosisKey(dos, &k, countryOfOrigin, visitedCountries, reportType)
+		diagnosisKey.TransmissionRiskLevel = policy.transmissionRiskLevel(reportType, k.TransmissionRisk)
 		keys = append(keys, diagnosisKey)
 	}
 
-	return config.efgsdatabase.PersistDiagnosisKeys(keys)
+	// the revision was accepted by the Key server, so the keys were published before
+	if request.RevisionToken != "" {
+		logger.Debugf("Revising %v keys to report type %v", len(keys), reportType)
+		return config.efgsdatabase.ReviseDiagnosisKeys(keys, policy.Version)
+	}
+
+	return config.efgsdatabase.PersistDiagnosisKeys(keys, policy.Version)
 }
 
-func passToKeyServer(ctx context.Context, config *config, requestPayload *v1.PublishKeysRequestServer, requestHeaders http.Header) (*v1.PublishKeysResponseServer, error) {
+func passToKeyServer(ctx context.Context, config *config, requestPayload *v1.PublishKeysRequestServer, requestHeaders http.Header) (*v1.PublishKeysResponseServer, errors.ErouskaError) {
 	logger := logging.FromContext(ctx).Named("publish-keys.passToKeyServer")
 
 	blob, err := json.Marshal(requestPayload)
 	if err != nil {
 		logger.Debugf("Could not serialize request for Key server: %v", err)
-		return nil, err
+		return nil, &errors.UnknownError{Msg: fmt.Sprintf("Could not serialize request for Key server: %v", err)}
 	}
 
 	req, err := http.NewRequest("POST", config.keyServerConfig.GetURL("v1/publish"), bytes.NewBuffer(blob))
 	if err != nil {
 		logger.Debugf("Could not create request for Key server: %v", err)
-		return nil, err
+		return nil, &errors.UnknownError{Msg: fmt.Sprintf("Could not create request for Key server: %v", err)}
 	}
 
 	req.Header = requestHeaders.Clone()
@@ -186,27 +306,27 @@ func passToKeyServer(ctx context.Context, config *config, requestPayload *v1.Pub
 	response, err := config.client.Do(req)
 	if err != nil {
 		logger.Debugf("Could not obtain response from Key server: %v", err)
-		return nil, err
+		return nil, &errors.UpstreamUnavailableError{Msg: fmt.Sprintf("Could not reach Key server: %v", err)}
 	}
 
 	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
-		return nil, err
+		return nil, &errors.UpstreamUnavailableError{Msg: fmt.Sprintf("Could not read response of Key server: %v", err)}
 	}
 
 	if err := response.Body.Close(); err != nil {
-		return nil, err
+		logger.Warnf("Could not close response of Key server: %v", err)
 	}
 
-	if response.StatusCode != 200 {
-		return nil, fmt.Errorf("HTTP %v: %v", response.StatusCode, string(body))
+	if response.StatusCode != http.StatusOK {
+		return nil, keyServerError(response.StatusCode, body)
 	}
 
 	var serverResponse v1.PublishKeysResponseServer
 
 	if err = json.Unmarshal(body, &serverResponse); err != nil {
 		logger.Debugf("Could not deserialize response from Key server: %v", err)
-		return nil, err
+		return nil, &errors.UpstreamUnavailableError{Msg: fmt.Sprintf("Invalid response of Key server: %v", err)}
 	}
 
 	return &serverResponse, nil
@@ -230,8 +350,11 @@ func loadConfig(ctx context.Context, correlationID string) (*config, error) {
 	config := config{
 		keyServerConfig:  keyServerConfig,
 		client:           &http.Client{},
-		realtimeDBClient: &realtimedb.Client{},
+		countersClient:   counters.Client{Store: store.Client{}},
+		storeClient:      store.Client{},
+		pubSubClient:     pubsub.Client{},
 		efgsdatabase:     &efgsdatabase.Database,
+		uploadPolicyFile: os.Getenv("EFGS_UPLOAD_POLICY_FILE"),
 		correlationID:    correlationID,
 	}
 
@@ -246,6 +369,22 @@ func loadConfig(ctx context.Context, correlationID string) (*config, error) {
 	return &config, nil
 }
 
+// loadCertificateVerifier Gets the shared verifier, it's created on first use.
+func loadCertificateVerifier(ctx context.Context) (*certificate.Verifier, error) {
+	sharedVerifierMutex.Lock()
+	defer sharedVerifierMutex.Unlock()
+
+	if sharedVerifier == nil {
+		certificateConfig, err := utils.LoadVerificationCertificateConfig(ctx)
+		if err != nil {
+			return nil, err
+		}
+		sharedVerifier = certificate.NewVerifier(certificateConfig)
+	}
+
+	return sharedVerifier, nil
+}
+
 func sendResponseToClient(ctx context.Context, w http.ResponseWriter, response *v1.PublishKeysResponseDevice) {
 	logger := logging.FromContext(ctx).Named("publish-keys.sendResponseToClient")
 
@@ -266,64 +405,21 @@ func sendResponseToClient(ctx context.Context, w http.ResponseWriter, response *
 	}
 }
 
-func extractDoS(request v1.PublishKeysRequestDevice) time.Time {
-	defaultDoS := func() time.Time {
-		return time.Now().Add(defaultSymptomDate * 24 * time.Hour).Truncate(24 * time.Hour)
-	}
-
-	// We parse the token but we don't care about signature validation.
-	token, _ := jwt.Parse(request.VerificationPayload, func(token *jwt.Token) (interface{}, error) {
-		return []byte("hello-world"), nil
-	})
-
-	// Here we certainly got validation error but we don't care, the validation was already done by Key server.
-	// If we got the token too, it's just enough.
-
-	if token == nil {
-		return defaultDoS()
-	}
-
-	if token.Claims == nil {
-		return defaultDoS()
-	}
-
-	claims := token.Claims.(jwt.MapClaims)
-	value, ok := claims["symptomOnsetInterval"]
-	if !ok {
-		return defaultDoS()
-	}
-
-	soi := int64(value.(float64))
-
-	return time.Unix(soi*600, 0).Truncate(24 * time.Hour)
-}
-
-func updateCounters(ctx context.Context, client *realtimedb.Client, keysCount int, efgsEnabled bool) error {
+func updateCounters(ctx context.Context, client counters.Counters, correlationID string, keysCount int, efgsEnabled bool) error {
 	logger := logging.FromContext(ctx).Named("publish-keys.updateCounters")
 
-	var date = utils.GetTimeNow().Format("20060102")
+	var now = *utils.GetTimeNow()
 
-	// update keys daily counter
-	if err := updateKeysCounter(ctx, client, constants.DbPublisherCountersPrefix+date, keysCount); err != nil {
-		logger.Debugf("Cannot increase publishers counter due to unknown error: %+v", err.Error())
-		return err
-	}
-
-	// update keys total counter
-	if err := updateKeysCounter(ctx, client, constants.DbPublisherCountersPrefix+"total", keysCount); err != nil {
+	// update keys daily and total counter
+	publisherDelta := structs.PublisherCounter{PublishersCount: 1, KeysCount: keysCount}
+	if err := client.Increment(ctx, constants.CounterPublishers, correlationID, now, publisherDelta); err != nil {
 		logger.Debugf("Cannot increase publishers counter due to unknown error: %+v", err.Error())
 		return err
 	}
 
 	if efgsEnabled {
-		// update publishers daily counter
-		if err := updatePublishersCounter(ctx, client, constants.DbEfgsCountersPrefix+date); err != nil {
-			logger.Debugf("Cannot increase EFGS publishers counter due to unknown error: %+v", err.Error())
-			return err
-		}
-
-		// update publishers total counter
-		if err := updatePublishersCounter(ctx, client, constants.DbEfgsCountersPrefix+"total"); err != nil {
+		// update publishers daily and total counter
+		if err := client.Increment(ctx, constants.CounterEfgs, correlationID, now, structs.EfgsCounter{Publishers: 1}); err != nil {
 			logger.Debugf("Cannot increase EFGS publishers counter due to unknown error: %+v", err.Error())
 			return err
 		}
@@ -332,47 +428,6 @@ func updateCounters(ctx context.Context, client *realtimedb.Client, keysCount in
 	return nil
 }
 
-func updateKeysCounter(ctx context.Context, client *realtimedb.Client, dbKey string, keysCount int) error {
-	logger := logging.FromContext(ctx).Named("publish-keys.updateKeysCounter")
-
-	return client.RunTransaction(ctx, dbKey, func(tn db.TransactionNode) (interface{}, error) {
-		var state structs.PublisherCounter
-
-		if err := tn.Unmarshal(&state); err != nil {
-			return nil, err
-		}
-
-		logger.Debugf("Found counter state, dbKey %v: %+v", dbKey, state)
-
-		state.PublishersCount++
-		state.KeysCount += keysCount
-
-		logger.Debugf("Saving updated counter state, dbKey %v: %+v", dbKey, state)
-
-		return state, nil
-	})
-}
-
-func updatePublishersCounter(ctx context.Context, client *realtimedb.Client, dbKey string) error {
-	logger := logging.FromContext(ctx).Named("publish-keys.updatePublishersCounter")
-
-	return client.RunTransaction(ctx, dbKey, func(tn db.TransactionNode) (interface{}, error) {
-		var state structs.EfgsCounter
-
-		if err := tn.Unmarshal(&state); err != nil {
-			return nil, err
-		}
-
-		logger.Debugf("Found counter state, dbKey %v: %+v", dbKey, state)
-
-		state.Publishers++
-
-		logger.Debugf("Saving updated counter state, dbKey %v: %+v", dbKey, state)
-
-		return state, nil
-	})
-}
-
 func toServerRequest(request *v1.PublishKeysRequestDevice) *v1.PublishKeysRequestServer {
 	return &v1.PublishKeysRequestServer{
 		Keys:                 request.Keys,
@@ -0,0 +1,201 @@
+package publishkeys
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/covid19cz/erouska-backend/internal/certificate"
+	"github.com/covid19cz/erouska-backend/internal/constants"
+	"github.com/covid19cz/erouska-backend/pkg/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// Sources of date of symptom onset.
+const (
+	// symptomOnsetFromToken Claim of the verification certificate, issued by the Verification server.
+	symptomOnsetFromToken = "verificationToken"
+	// symptomOnsetFromTestDate Date of the test, claimed by the verification certificate.
+	symptomOnsetFromTestDate = "testDate"
+	// symptomOnsetFromRequest SymptomOnsetInterval sent by the device.
+	symptomOnsetFromRequest = "request"
+)
+
+// uploadPolicyDocID ID of the policy document in Firestore.
+const uploadPolicyDocID = "current"
+
+//UploadPolicy Rules for preparing keys published by devices for upload to EFGS. Its version is recorded on every key
+//persisted for EFGS, so it's known which rules the key was prepared by.
+type UploadPolicy struct {
+	Version string `firestore:"version" json:"version"`
+	// DefaultVisitedCountries Countries used for travellers who haven't sent any.
+	DefaultVisitedCountries []string `firestore:"defaultVisitedCountries" json:"defaultVisitedCountries"`
+	// KeepNonTravelerCountries Keep countries sent by users who are not travellers; they're dropped otherwise.
+	KeepNonTravelerCountries bool `firestore:"keepNonTravelerCountries" json:"keepNonTravelerCountries"`
+	// AllowedCountries When not empty, only these countries are kept in visited countries.
+	AllowedCountries []string `firestore:"allowedCountries" json:"allowedCountries"`
+	// DeniedCountries These countries are always removed from visited countries.
+	DeniedCountries []string `firestore:"deniedCountries" json:"deniedCountries"`
+	// TransmissionRiskLevels TRL by report type sent by the device. Keys of other report types keep TRL sent by the
+	// device or get the default one.
+	TransmissionRiskLevels       map[string]int32 `firestore:"transmissionRiskLevels" json:"transmissionRiskLevels"`
+	DefaultTransmissionRiskLevel int32            `firestore:"defaultTransmissionRiskLevel" json:"defaultTransmissionRiskLevel"`
+	// SymptomOnsetSources Where the date of symptom onset is taken from, in this order.
+	SymptomOnsetSources []string `firestore:"symptomOnsetSources" json:"symptomOnsetSources"`
+	// DefaultSymptomOnsetDaysAgo Used when none of the sources provides the date.
+	DefaultSymptomOnsetDaysAgo int `firestore:"defaultSymptomOnsetDaysAgo" json:"defaultSymptomOnsetDaysAgo"`
+}
+
+// defaultUploadPolicy Policy used when no other is configured; it keeps the rules used before the policy existed.
+func defaultUploadPolicy(defaultVisitedCountries []string) *UploadPolicy {
+	return &UploadPolicy{
+		Version:                      "default",
+		DefaultVisitedCountries:      defaultVisitedCountries,
+		DefaultTransmissionRiskLevel: 2, // see docs for ExposureKey - "CONFIRMED will lead to TR 2"
+		SymptomOnsetSources:          []string{symptomOnsetFromToken},
+		DefaultSymptomOnsetDaysAgo:   1, // == yesterday - this is a good default/fallback value because it's taken as serious by the EN API
+	}
+}
+
+// loadUploadPolicy Loads the policy from the configured file or, when there's none, from Firestore. When there's no
+// policy in Firestore either, the default one is used.
+func loadUploadPolicy(ctx context.Context, config *config) (*UploadPolicy, error) {
+	var policy UploadPolicy
+
+	switch {
+	case config.uploadPolicyFile != "":
+		bytes, err := ioutil.ReadFile(config.uploadPolicyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read upload policy: %v", err)
+		}
+
+		if err = json.Unmarshal(bytes, &policy); err != nil {
+			return nil, fmt.Errorf("Could not parse upload policy: %v", err)
+		}
+	default:
+		err := config.storeClient.Get(ctx, constants.CollectionEfgsUploadPolicy, uploadPolicyDocID, &policy)
+		if status.Code(err) == codes.NotFound {
+			return defaultUploadPolicy(config.defaultVisitedCountries), nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Could not load upload policy: %v", err)
+		}
+	}
+
+	if err := policy.validate(); err != nil {
+		return nil, fmt.Errorf("Invalid upload policy '%v': %v", policy.Version, err)
+	}
+
+	return &policy, nil
+}
+
+func (p *UploadPolicy) validate() error {
+	if p.Version == "" {
+		return fmt.Errorf("version is missing")
+	}
+
+	for reportType, trl := range p.TransmissionRiskLevels {
+		if trl < 0 || trl > 8 {
+			return fmt.Errorf("TRL %v of %v is out of range 0-8", trl, reportType)
+		}
+	}
+
+	if p.DefaultTransmissionRiskLevel < 0 || p.DefaultTransmissionRiskLevel > 8 {
+		return fmt.Errorf("default TRL %v is out of range 0-8", p.DefaultTransmissionRiskLevel)
+	}
+
+	for _, source := range p.SymptomOnsetSources {
+		if source != symptomOnsetFromToken && source != symptomOnsetFromTestDate && source != symptomOnsetFromRequest {
+			return fmt.Errorf("unknown symptom onset source '%v'", source)
+		}
+	}
+
+	return nil
+}
+
+// visitedCountries Gets countries the keys are to be shared with.
+func (p *UploadPolicy) visitedCountries(request *v1.PublishKeysRequestDevice) []string {
+	requested := request.VisitedCountries
+	if len(requested) == 0 {
+		requested = p.DefaultVisitedCountries
+	}
+
+	// non-travelling users, willing to share their keys
+	if !request.Traveler && !p.KeepNonTravelerCountries {
+		return []string{}
+	}
+
+	countries := []string{}
+	seen := make(map[string]bool)
+
+	for _, country := range requested {
+		country = strings.ToUpper(strings.TrimSpace(country))
+
+		if country == "" || seen[country] || containsCountry(p.DeniedCountries, country) {
+			continue
+		}
+
+		if len(p.AllowedCountries) > 0 && !containsCountry(p.AllowedCountries, country) {
+			continue
+		}
+
+		seen[country] = true
+		countries = append(countries, country)
+	}
+
+	return countries
+}
+
+// transmissionRiskLevel Gets TRL of the key, by report type of the request.
+func (p *UploadPolicy) transmissionRiskLevel(reportType v1.ReportType, keyTRL int) int32 {
+	if trl, found := p.TransmissionRiskLevels[string(reportType)]; found {
+		return trl
+	}
+
+	if keyTRL != 0 {
+		return int32(keyTRL)
+	}
+
+	return p.DefaultTransmissionRiskLevel
+}
+
+// symptomOnset Gets the day of symptom onset, from the first source which provides it. Claims are nil for requests
+// published before the certificates were verified.
+func (p *UploadPolicy) symptomOnset(request *v1.PublishKeysRequestDevice, claims *certificate.Claims, now time.Time) time.Time {
+	for _, source := range p.SymptomOnsetSources {
+		switch source {
+		case symptomOnsetFromToken:
+			if claims == nil {
+				continue
+			}
+			if onset, found := claims.SymptomOnset(); found {
+				return onset
+			}
+		case symptomOnsetFromTestDate:
+			if claims == nil {
+				continue
+			}
+			if testDate, found := claims.TestDate(); found {
+				return testDate
+			}
+		case symptomOnsetFromRequest:
+			if request.SymptomOnsetInterval > 0 {
+				return time.Unix(int64(request.SymptomOnsetInterval)*600, 0).Truncate(24 * time.Hour)
+			}
+		}
+	}
+
+	return now.AddDate(0, 0, -p.DefaultSymptomOnsetDaysAgo).Truncate(24 * time.Hour)
+}
+
+func containsCountry(countries []string, country string) bool {
+	for _, c := range countries {
+		if strings.EqualFold(c, country) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,178 @@
+package publishkeys
+
+import (
+	"context"
+	"github.com/covid19cz/erouska-backend/internal/certificate"
+	"github.com/covid19cz/erouska-backend/internal/constants"
+	"github.com/covid19cz/erouska-backend/internal/store"
+	"github.com/covid19cz/erouska-backend/pkg/api/v1"
+	keyserverapi "github.com/google/exposure-notifications-server/pkg/api/v1"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUploadPolicyVisitedCountries(t *testing.T) {
+	policy := &UploadPolicy{
+		Version:                 "test",
+		DefaultVisitedCountries: []string{"DE", "AT", "PL"},
+		DeniedCountries:         []string{"cz"},
+	}
+
+	tests := []struct {
+		name     string
+		policy   func(p UploadPolicy) UploadPolicy
+		traveler bool
+		visited  []string
+		want     []string
+	}{
+		{name: "traveler", traveler: true, visited: []string{"sk", "DE", "SK"}, want: []string{"SK", "DE"}},
+		{name: "traveler without countries", traveler: true, want: []string{"DE", "AT", "PL"}},
+		{name: "non-traveler", visited: []string{"SK"}, want: []string{}},
+		{name: "denied country", traveler: true, visited: []string{"CZ", "SK"}, want: []string{"SK"}},
+		{
+			name:    "non-traveler countries kept",
+			policy:  func(p UploadPolicy) UploadPolicy { p.KeepNonTravelerCountries = true; return p },
+			visited: []string{"SK"},
+			want:    []string{"SK"},
+		},
+		{
+			name:     "allowed countries",
+			policy:   func(p UploadPolicy) UploadPolicy { p.AllowedCountries = []string{"DE", "SK"}; return p },
+			traveler: true,
+			visited:  []string{"SK", "HU", "DE"},
+			want:     []string{"SK", "DE"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := *policy
+			if tt.policy != nil {
+				p = tt.policy(p)
+			}
+
+			request := &v1.PublishKeysRequestDevice{VisitedCountries: tt.visited}
+			request.Traveler = tt.traveler
+
+			if got := p.visitedCountries(request); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("visitedCountries() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUploadPolicyTransmissionRiskLevel(t *testing.T) {
+	policy := &UploadPolicy{
+		Version:                      "test",
+		TransmissionRiskLevels:       map[string]int32{v1.SelfReport: 4, v1.ConfirmedTest: 2},
+		DefaultTransmissionRiskLevel: 3,
+	}
+
+	tests := []struct {
+		reportType v1.ReportType
+		keyTRL     int
+		want       int32
+	}{
+		{reportType: v1.SelfReport, keyTRL: 6, want: 4},
+		{reportType: v1.ConfirmedTest, want: 2},
+		{reportType: v1.ConfirmedClinicalDiagnosis, keyTRL: 6, want: 6},
+		{reportType: "", want: 3},
+	}
+
+	for _, tt := range tests {
+		if got := policy.transmissionRiskLevel(tt.reportType, tt.keyTRL); got != tt.want {
+			t.Errorf("transmissionRiskLevel(%v, %v) = %v, want %v", tt.reportType, tt.keyTRL, got, tt.want)
+		}
+	}
+}
+
+func TestUploadPolicySymptomOnset(t *testing.T) {
+	now := time.Date(2020, 12, 10, 15, 0, 0, 0, time.UTC)
+	tokenDay := time.Date(2020, 12, 5, 0, 0, 0, 0, time.UTC)
+	testDay := time.Date(2020, 12, 6, 0, 0, 0, 0, time.UTC)
+	requestDay := time.Date(2020, 12, 7, 0, 0, 0, 0, time.UTC)
+	defaultDay := time.Date(2020, 12, 8, 0, 0, 0, 0, time.UTC)
+
+	claims := &certificate.Claims{TestDateInterval: uint32(testDay.Unix()/600 + 50)}
+	claims.SymptomOnsetInterval = uint32(tokenDay.Unix() / 600)
+
+	request := &v1.PublishKeysRequestDevice{Publish: keyserverapi.Publish{
+		SymptomOnsetInterval: int32(requestDay.Unix() / 600),
+	}}
+
+	tests := []struct {
+		name    string
+		sources []string
+		request *v1.PublishKeysRequestDevice
+		claims  *certificate.Claims
+		want    time.Time
+	}{
+		{name: "token first", sources: []string{symptomOnsetFromToken, symptomOnsetFromRequest}, request: request, claims: claims, want: tokenDay},
+		{name: "test date first", sources: []string{symptomOnsetFromTestDate, symptomOnsetFromToken}, request: request, claims: claims, want: testDay},
+		{name: "request first", sources: []string{symptomOnsetFromRequest, symptomOnsetFromToken}, request: request, claims: claims, want: requestDay},
+		{name: "no claims", sources: []string{symptomOnsetFromToken, symptomOnsetFromTestDate, symptomOnsetFromRequest}, request: request, want: requestDay},
+		{name: "no claimed dates", sources: []string{symptomOnsetFromToken, symptomOnsetFromTestDate}, request: request, claims: &certificate.Claims{}, want: defaultDay},
+		{name: "no source", sources: nil, request: request, claims: claims, want: defaultDay},
+		{name: "nothing provided", sources: []string{symptomOnsetFromToken, symptomOnsetFromRequest}, request: &v1.PublishKeysRequestDevice{}, want: defaultDay},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy := &UploadPolicy{Version: "test", SymptomOnsetSources: tt.sources, DefaultSymptomOnsetDaysAgo: 2}
+
+			if got := policy.symptomOnset(tt.request, tt.claims, now); !got.Equal(tt.want) {
+				t.Fatalf("symptomOnset() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadUploadPolicy(t *testing.T) {
+	ctx := context.Background()
+	storeClient := store.NewMemoryClient()
+	config := &config{storeClient: storeClient, defaultVisitedCountries: []string{"DE"}}
+
+	policy, err := loadUploadPolicy(ctx, config)
+	if err != nil || !reflect.DeepEqual(policy, defaultUploadPolicy([]string{"DE"})) {
+		t.Fatalf("loadUploadPolicy() = %+v, error %v; want the default policy", policy, err)
+	}
+
+	stored := &UploadPolicy{Version: "2020-12-10", DeniedCountries: []string{"CZ"}, DefaultTransmissionRiskLevel: 2}
+	if err = storeClient.Set(ctx, constants.CollectionEfgsUploadPolicy, uploadPolicyDocID, stored); err != nil {
+		t.Fatal(err)
+	}
+
+	policy, err = loadUploadPolicy(ctx, config)
+	if err != nil || !reflect.DeepEqual(policy, stored) {
+		t.Fatalf("loadUploadPolicy() = %+v, error %v; want %+v", policy, err, stored)
+	}
+
+	file, err := ioutil.TempFile("", "upload-policy-*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+
+	if _, err = file.WriteString(`{"version": "file-1", "symptomOnsetSources": ["request"]}`); err != nil {
+		t.Fatal(err)
+	}
+	_ = file.Close()
+
+	config.uploadPolicyFile = file.Name()
+
+	policy, err = loadUploadPolicy(ctx, config)
+	if err != nil || policy.Version != "file-1" || !reflect.DeepEqual(policy.SymptomOnsetSources, []string{symptomOnsetFromRequest}) {
+		t.Fatalf("loadUploadPolicy() = %+v, error %v; want policy from the file", policy, err)
+	}
+
+	if err = ioutil.WriteFile(file.Name(), []byte(`{"version": "file-2", "symptomOnsetSources": ["guess"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if policy, err = loadUploadPolicy(ctx, config); err == nil {
+		t.Fatalf("loadUploadPolicy() = %+v, want error for unknown symptom onset source", policy)
+	}
+}
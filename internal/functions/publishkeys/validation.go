@@ -0,0 +1,114 @@
+package publishkeys
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"github.com/covid19cz/erouska-backend/internal/utils"
+	"github.com/covid19cz/erouska-backend/pkg/api/v1"
+	keyserverapi "github.com/google/exposure-notifications-server/pkg/api/v1"
+	"gopkg.in/go-playground/validator.v9"
+	"strconv"
+	"strings"
+)
+
+// defaultMaxKeysOnPublish Limit of keys used when validating without the limits, the Key server's default.
+const defaultMaxKeysOnPublish = 30
+
+// limitsKey Key of the Key server limits in context of the validation.
+type limitsKey struct{}
+
+// minHMACKeyLength Devices generate 16 bytes long HMAC keys at least.
+const minHMACKeyLength = 16
+
+// validationDescriptions Descriptions of failed validations, for the error messages.
+var validationDescriptions = map[string]string{
+	"required":          "is required",
+	"country":           "must be ISO 3166-1 alpha-2 country code",
+	"keys_count":        "must contain 1 to %v keys",
+	"key_data":          fmt.Sprintf("must be base64 of %v bytes", keyserverapi.KeyLength),
+	"interval_number":   fmt.Sprintf("must be aligned to start of a day (multiple of %v)", keyserverapi.MaxIntervalCount),
+	"interval_count":    fmt.Sprintf("must be between %v and %v", keyserverapi.MinIntervalCount, keyserverapi.MaxIntervalCount),
+	"transmission_risk": fmt.Sprintf("must be between %v and %v", keyserverapi.MinTransmissionRisk, keyserverapi.MaxTransmissionRisk),
+	"hmac_key":          fmt.Sprintf("must be base64 of %v bytes at least", minHMACKeyLength),
+}
+
+func init() {
+	// the Key server's structs can't be tagged, so they're validated as whole
+	utils.Validate.RegisterStructValidationCtx(validatePublish, keyserverapi.Publish{})
+}
+
+// validateRequest Validates request of the device, the same way the Key server with the limits would do. Returns
+// message listing the invalid fields.
+func validateRequest(ctx context.Context, request *v1.PublishKeysRequestDevice, limits *utils.KeyServerLimits) (string, bool) {
+	err := utils.Validate.StructCtx(context.WithValue(ctx, limitsKey{}, limits), request)
+	if err == nil {
+		return "", true
+	}
+
+	fieldErrors, ok := err.(validator.ValidationErrors)
+	if !ok {
+		return err.Error(), false
+	}
+
+	messages := make([]string, len(fieldErrors))
+	for i, fieldError := range fieldErrors {
+		description, ok := validationDescriptions[fieldError.Tag()]
+		if !ok {
+			description = fmt.Sprintf("has failed on '%v'", fieldError.Tag())
+		}
+		if fieldError.Param() != "" {
+			description = fmt.Sprintf(description, fieldError.Param())
+		}
+		messages[i] = fmt.Sprintf("%v %v", fieldError.Field(), description)
+	}
+
+	return "Invalid request: " + strings.Join(messages, "; "), false
+}
+
+func validatePublish(ctx context.Context, sl validator.StructLevel) {
+	publish := sl.Current().Interface().(keyserverapi.Publish)
+
+	limits, ok := ctx.Value(limitsKey{}).(*utils.KeyServerLimits)
+	if !ok || limits == nil {
+		limits = &utils.KeyServerLimits{MaxKeysOnPublish: defaultMaxKeysOnPublish}
+	}
+
+	if count := len(publish.Keys); count == 0 || count > limits.MaxKeysOnPublish {
+		sl.ReportError(publish.Keys, "Keys", "Keys", "keys_count", strconv.Itoa(limits.MaxKeysOnPublish))
+	}
+
+	for i, key := range publish.Keys {
+		field := fmt.Sprintf("Keys[%v]", i)
+
+		if !isBase64OfLength(key.Key, keyserverapi.KeyLength, keyserverapi.KeyLength) {
+			sl.ReportError(key.Key, field+".Key", "Key", "key_data", "")
+		}
+		if key.IntervalNumber%keyserverapi.MaxIntervalCount != 0 {
+			sl.ReportError(key.IntervalNumber, field+".IntervalNumber", "IntervalNumber", "interval_number", "")
+		}
+		if key.IntervalCount < keyserverapi.MinIntervalCount || key.IntervalCount > keyserverapi.MaxIntervalCount {
+			sl.ReportError(key.IntervalCount, field+".IntervalCount", "IntervalCount", "interval_count", "")
+		}
+		if key.TransmissionRisk < keyserverapi.MinTransmissionRisk || key.TransmissionRisk > keyserverapi.MaxTransmissionRisk {
+			sl.ReportError(key.TransmissionRisk, field+".TransmissionRisk", "TransmissionRisk", "transmission_risk", "")
+		}
+	}
+
+	if publish.VerificationPayload == "" {
+		sl.ReportError(publish.VerificationPayload, "VerificationPayload", "VerificationPayload", "required", "")
+	}
+
+	if !isBase64OfLength(publish.HMACKey, minHMACKeyLength, -1) {
+		sl.ReportError(publish.HMACKey, "HMACKey", "HMACKey", "hmac_key", "")
+	}
+}
+
+// isBase64OfLength Whether the value is base64 of minLength to maxLength bytes; negative maxLength means no limit.
+func isBase64OfLength(value string, minLength int, maxLength int) bool {
+	bytes, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return false
+	}
+	return len(bytes) >= minLength && (maxLength < 0 || len(bytes) <= maxLength)
+}
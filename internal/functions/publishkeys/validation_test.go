@@ -0,0 +1,141 @@
+package publishkeys
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/covid19cz/erouska-backend/internal/utils"
+	"github.com/covid19cz/erouska-backend/pkg/api/v1"
+	keyserverapi "github.com/google/exposure-notifications-server/pkg/api/v1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func validRequest() *v1.PublishKeysRequestDevice {
+	return &v1.PublishKeysRequestDevice{
+		Publish: keyserverapi.Publish{
+			Keys: []keyserverapi.ExposureKey{
+				{Key: "z2Cx9hdz2SlxZ8GEgqTYpA==", IntervalNumber: 2662992, IntervalCount: 144, TransmissionRisk: 5},
+				{Key: "a2Cx9hdz2SlxZ8GEgqTYpA==", IntervalNumber: 2663136, IntervalCount: 62},
+			},
+			HealthAuthorityID:   "cz.covid19cz.erouska",
+			VerificationPayload: "eyJhbGciOiJFUzI1NiJ9.e30.c2ln",
+			HMACKey:             "4qcdDfDWNZ9zAmrB6p6pf/tz9GhNSZwrH+rS0rwYQEs=",
+		},
+		VisitedCountries: []string{"DE", "AT"},
+	}
+}
+
+func TestValidateRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(r *v1.PublishKeysRequestDevice)
+		want   []string // invalid fields
+	}{
+		{name: "valid", modify: func(r *v1.PublishKeysRequestDevice) {}},
+		{name: "no visited countries", modify: func(r *v1.PublishKeysRequestDevice) { r.VisitedCountries = nil }},
+		{
+			name:   "not base64 key",
+			modify: func(r *v1.PublishKeysRequestDevice) { r.Keys[1].Key = "not base64!" },
+			want:   []string{"Keys[1].Key must be base64"},
+		},
+		{
+			name:   "short key",
+			modify: func(r *v1.PublishKeysRequestDevice) { r.Keys[0].Key = "z2Cx9hdz2SlxZ8GE" },
+			want:   []string{"Keys[0].Key must be base64"},
+		},
+		{
+			name: "unaligned interval and invalid count",
+			modify: func(r *v1.PublishKeysRequestDevice) {
+				r.Keys[0].IntervalNumber = 2662993
+				r.Keys[1].IntervalCount = 145
+			},
+			want: []string{"Keys[0].IntervalNumber must be aligned", "Keys[1].IntervalCount must be between"},
+		},
+		{
+			name:   "zero interval count",
+			modify: func(r *v1.PublishKeysRequestDevice) { r.Keys[0].IntervalCount = 0 },
+			want:   []string{"Keys[0].IntervalCount must be between"},
+		},
+		{
+			name:   "transmission risk",
+			modify: func(r *v1.PublishKeysRequestDevice) { r.Keys[0].TransmissionRisk = 9 },
+			want:   []string{"Keys[0].TransmissionRisk must be between"},
+		},
+		{
+			name:   "no keys",
+			modify: func(r *v1.PublishKeysRequestDevice) { r.Keys = nil },
+			want:   []string{"Keys must contain"},
+		},
+		{
+			name: "too many keys",
+			modify: func(r *v1.PublishKeysRequestDevice) {
+				for len(r.Keys) <= 5 {
+					r.Keys = append(r.Keys, r.Keys[0])
+				}
+			},
+			want: []string{"Keys must contain 1 to 5 keys"},
+		},
+		{
+			name:   "invalid country",
+			modify: func(r *v1.PublishKeysRequestDevice) { r.VisitedCountries = []string{"DE", "XX", "xx"} },
+			want:   []string{"VisitedCountries[1] must be ISO", "VisitedCountries[2] must be ISO"},
+		},
+		{name: "lower case country", modify: func(r *v1.PublishKeysRequestDevice) { r.VisitedCountries = []string{"de", "At"} }},
+		{
+			name:   "short HMAC key",
+			modify: func(r *v1.PublishKeysRequestDevice) { r.HMACKey = "c2hvcnQ=" },
+			want:   []string{"HMACKey must be base64"},
+		},
+		{
+			name: "missing HMAC key and verification payload",
+			modify: func(r *v1.PublishKeysRequestDevice) {
+				r.HMACKey = ""
+				r.VerificationPayload = ""
+			},
+			want: []string{"HMACKey must be base64", "VerificationPayload is required"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := validRequest()
+			tt.modify(request)
+
+			msg, valid := validateRequest(context.Background(), request, &utils.KeyServerLimits{MaxKeysOnPublish: 5})
+			if valid != (len(tt.want) == 0) {
+				t.Fatalf("validateRequest() = %v, %q", valid, msg)
+			}
+
+			for _, want := range tt.want {
+				if !strings.Contains(msg, want) {
+					t.Errorf("Message %q doesn't contain %q", msg, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPublishKeysRefusesInvalidRequest(t *testing.T) {
+	request := validRequest()
+	request.Keys[0].Key = "not base64!"
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	PublishKeys(recorder, httptest.NewRequest("POST", "/", bytes.NewReader(body)))
+
+	var response v1.PublishKeysResponseDevice
+	if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	if recorder.Code != http.StatusOK || response.Code != v1.ErrorBadRequest || !strings.Contains(response.ErrorMessage, "Keys[0].Key") {
+		t.Fatalf("Response = %v %+v, want refused key", recorder.Code, response)
+	}
+}
@@ -2,18 +2,27 @@ package registerehrid
 
 import (
 	"context"
-	"firebase.google.com/go/db"
 	"fmt"
 	"github.com/covid19cz/erouska-backend/internal/constants"
+	"github.com/covid19cz/erouska-backend/internal/counters"
 	"github.com/covid19cz/erouska-backend/internal/firebase/structs"
 	"github.com/covid19cz/erouska-backend/internal/logging"
 	"github.com/covid19cz/erouska-backend/internal/pubsub"
-	"github.com/covid19cz/erouska-backend/internal/realtimedb"
+	"github.com/covid19cz/erouska-backend/internal/store"
 	"github.com/covid19cz/erouska-backend/internal/utils"
 )
 
 // AfterMath handler
 func AfterMath(ctx context.Context, m pubsub.Message) error {
+	storeClient := store.Client{}
+	client := counters.Client{Store: storeClient}
+
+	return pubsub.NewLedger(storeClient).ProcessOnce(ctx, constants.TopicRegisterUser, m, func(ctx context.Context, m pubsub.Message) error {
+		return afterMath(ctx, client, m)
+	})
+}
+
+func afterMath(ctx context.Context, client counters.Counters, m pubsub.Message) error {
 	logger := logging.FromContext(ctx)
 
 	var payload AftermathPayload
@@ -25,19 +34,8 @@ func AfterMath(ctx context.Context, m pubsub.Message) error {
 
 	logger.Debugf("Doing user registration aftermath for eHrid '%s'!", payload.Ehrid)
 
-	client := realtimedb.Client{}
-
-	var date = utils.GetTimeNow().Format("20060102")
-
-	// update daily counter
-	err := updateCounter(ctx, client, constants.DbUserCountersPrefix+date)
-	if err != nil {
-		logger.Warnf("Cannot handle register user aftermath due to unknown error: %+v", err.Error())
-		return err
-	}
-
-	// update total counter
-	err = updateCounter(ctx, client, constants.DbUserCountersPrefix+"total")
+	// update daily and total counter
+	err := updateCounter(ctx, client, payload.Ehrid)
 	if err != nil {
 		logger.Warnf("Cannot handle register user aftermath due to unknown error: %+v", err.Error())
 		return err
@@ -50,22 +48,11 @@ func AfterMath(ctx context.Context, m pubsub.Message) error {
 	return nil
 }
 
-func updateCounter(ctx context.Context, client realtimedb.Client, key string) error {
+func updateCounter(ctx context.Context, client counters.Counters, ehrid string) error {
 	logger := logging.FromContext(ctx)
 
-	return client.RunTransaction(ctx, key, func(tn db.TransactionNode) (interface{}, error) {
-		var state structs.UserCounter
-
-		if err := tn.Unmarshal(&state); err != nil {
-			return nil, err
-		}
+	logger.Debugf("Increasing users counter for eHrid %v", ehrid)
 
-		logger.Debugf("Found counter state, key %v: %+v", key, state)
-
-		state.UsersCount++
-
-		logger.Debugf("Saving updated counter state, key %v: %+v", key, state)
-
-		return state, nil
-	})
+	// every eHrid is activated exactly once, so it's a good event ID
+	return client.Increment(ctx, constants.CounterUsers, ehrid, *utils.GetTimeNow(), structs.UserCounter{UsersCount: 1})
 }
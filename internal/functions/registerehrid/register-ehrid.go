@@ -1,7 +1,6 @@
 package registerehrid
 
 import (
-	"cloud.google.com/go/firestore"
 	"context"
 	"fmt"
 	"net/http"
@@ -11,6 +10,7 @@ import (
 	"github.com/covid19cz/erouska-backend/internal/constants"
 	"github.com/covid19cz/erouska-backend/internal/firebase/structs"
 	"github.com/covid19cz/erouska-backend/internal/logging"
+	"github.com/covid19cz/erouska-backend/internal/outbox"
 	"github.com/covid19cz/erouska-backend/internal/pubsub"
 	"github.com/covid19cz/erouska-backend/internal/store"
 	"github.com/covid19cz/erouska-backend/internal/utils"
@@ -73,17 +73,21 @@ func RegisterEhrid(w http.ResponseWriter, r *http.Request) {
 
 	httputils.SendResponse(w, r, response)
 
-	aftermathPayload := AftermathPayload{Ehrid: ehrid}
+	// the event was saved together with the registration, relay will publish it if this fails
+	relay := outbox.Relay{Store: storeClient, Publisher: pubSubClient}
 
-	topicName := constants.TopicRegisterUser
-	logger.Debugf("Publishing event to %v: %+v", topicName, aftermathPayload)
-	err = pubSubClient.Publish(topicName, aftermathPayload)
+	logger.Debugf("Publishing event to %v for eHrid %v", constants.TopicRegisterUser, ehrid)
+	err = relay.Publish(ctx, aftermathOutboxID(ehrid))
 	if err != nil {
-		logger.Warnf("Could not send %v notification due to unknown error: %+v", topicName, err.Error())
+		logger.Warnf("Could not send %v notification due to unknown error: %+v", constants.TopicRegisterUser, err.Error())
 	}
 }
 
-func register(ctx context.Context, store store.Storer, generateEhrid func() string, registration structs.Registration) (string, error) {
+func aftermathOutboxID(ehrid string) string {
+	return constants.TopicRegisterUser + "_" + ehrid
+}
+
+func register(ctx context.Context, storeClient store.Storer, generateEhrid func() string, registration structs.Registration) (string, error) {
 	logger := logging.FromContext(ctx)
 
 	var ehrid string
@@ -91,12 +95,11 @@ func register(ctx context.Context, store store.Storer, generateEhrid func() stri
 	err := retry.Do(
 		func() error {
 			ehrid = generateEhrid()
-			var doc = store.Doc(constants.CollectionRegistrations, ehrid)
 
 			logger.Debugf("Trying eHrid: %v", ehrid)
 
-			return store.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
-				_, err := tx.Get(doc)
+			return storeClient.RunTransaction(ctx, func(ctx context.Context, tx store.Transaction) error {
+				err := tx.Get(constants.CollectionRegistrations, ehrid, nil)
 
 				if err == nil {
 					// doc found, need retry
@@ -110,7 +113,11 @@ func register(ctx context.Context, store store.Storer, generateEhrid func() stri
 
 				logger.Infof("Generated new eHrid %v, saving registration %+v", ehrid, registration)
 
-				return tx.Set(doc, registration)
+				if err := tx.Set(constants.CollectionRegistrations, ehrid, registration); err != nil {
+					return err
+				}
+
+				return outbox.Add(tx, aftermathOutboxID(ehrid), constants.TopicRegisterUser, AftermathPayload{Ehrid: ehrid})
 			})
 		},
 		retry.RetryIf(func(err error) bool {
@@ -4,7 +4,9 @@ import (
 	"context"
 	"testing"
 
+	"github.com/covid19cz/erouska-backend/internal/constants"
 	"github.com/covid19cz/erouska-backend/internal/firebase/structs"
+	"github.com/covid19cz/erouska-backend/internal/outbox"
 	"github.com/covid19cz/erouska-backend/internal/store"
 
 	"github.com/google/go-cmp/cmp"
@@ -14,9 +16,7 @@ func TestRegister(t *testing.T) {
 
 	ctx := context.Background()
 
-	store := store.MockClient{}
-
-	mockGenEhrid := func() string { return "eABCDEF123" }
+	store := store.NewMemoryClient()
 
 	tables := []struct {
 		x structs.Registration
@@ -30,7 +30,7 @@ func TestRegister(t *testing.T) {
 				Model:           "iPhone 8",
 				Locale:          "cs_CZ",
 			},
-			mockGenEhrid,
+			func() string { return "eABCDEF123" },
 		},
 		{
 			structs.Registration{
@@ -40,7 +40,7 @@ func TestRegister(t *testing.T) {
 				Model:           "Yololo",
 				Locale:          "en_US",
 			},
-			mockGenEhrid,
+			func() string { return "eGHIJKL456" },
 		},
 	}
 
@@ -54,5 +54,63 @@ func TestRegister(t *testing.T) {
 		if err != nil {
 			t.Fatalf("register no error expected")
 		}
+
+		var saved structs.Registration
+		if err := store.Get(ctx, constants.CollectionRegistrations, ehrid, &saved); err != nil {
+			t.Fatalf("registration not saved: %v", err)
+		}
+
+		diff = cmp.Diff(saved, table.x)
+		if diff != "" {
+			t.Fatalf("saved registration mismatch (-want +got):\n%v", diff)
+		}
+
+		var entry outbox.Entry
+		if err := store.Get(ctx, constants.CollectionOutbox, aftermathOutboxID(ehrid), &entry); err != nil {
+			t.Fatalf("aftermath event not saved to outbox: %v", err)
+		}
+
+		diff = cmp.Diff(entry.Payload, `{"ehrid":"`+ehrid+`"}`)
+		if diff != "" {
+			t.Fatalf("aftermath event mismatch (-want +got):\n%v", diff)
+		}
+	}
+}
+
+func TestRegisterRetriesOnCollision(t *testing.T) {
+
+	ctx := context.Background()
+
+	store := store.NewMemoryClient()
+
+	if err := store.Set(ctx, constants.CollectionRegistrations, "eABCDEF123", structs.Registration{Platform: "ios"}); err != nil {
+		t.Fatal(err)
+	}
+
+	generated := []string{"eABCDEF123", "eGHIJKL456"}
+	genEhrid := func() string {
+		ehrid := generated[0]
+		generated = generated[1:]
+		return ehrid
+	}
+
+	ehrid, err := register(ctx, store, genEhrid, structs.Registration{Platform: "android"})
+	if err != nil {
+		t.Fatalf("register no error expected: %v", err)
+	}
+
+	diff := cmp.Diff(ehrid, "eGHIJKL456")
+	if diff != "" {
+		t.Fatalf("register mismatch (-want +got):\n%v", diff)
+	}
+
+	var original structs.Registration
+	if err := store.Get(ctx, constants.CollectionRegistrations, "eABCDEF123", &original); err != nil {
+		t.Fatal(err)
+	}
+
+	diff = cmp.Diff(original.Platform, "ios")
+	if diff != "" {
+		t.Fatalf("original registration overwritten (-want +got):\n%v", diff)
 	}
 }
@@ -1,10 +1,10 @@
 package registernotification
 
 import (
-	"cloud.google.com/go/firestore"
 	"context"
 	"fmt"
 	"github.com/covid19cz/erouska-backend/internal/constants"
+	"github.com/covid19cz/erouska-backend/internal/counters"
 	"github.com/covid19cz/erouska-backend/internal/firebase/structs"
 	"github.com/covid19cz/erouska-backend/internal/logging"
 	"github.com/covid19cz/erouska-backend/internal/pubsub"
@@ -12,10 +12,23 @@ import (
 	"github.com/covid19cz/erouska-backend/internal/utils"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"time"
 )
 
 //AfterMath Handler
 func AfterMath(ctx context.Context, m pubsub.Message) error {
+	return afterMathOnce(ctx, store.Client{}, m)
+}
+
+func afterMathOnce(ctx context.Context, client store.Storer, m pubsub.Message) error {
+	countersClient := counters.Client{Store: client}
+
+	return pubsub.NewLedger(client).ProcessOnce(ctx, constants.TopicRegisterNotification, m, func(ctx context.Context, m pubsub.Message) error {
+		return afterMath(ctx, client, countersClient, m)
+	})
+}
+
+func afterMath(ctx context.Context, client store.Storer, countersClient counters.Counters, m pubsub.Message) error {
 	logger := logging.FromContext(ctx)
 
 	var payload AftermathPayload
@@ -27,16 +40,14 @@ func AfterMath(ctx context.Context, m pubsub.Message) error {
 
 	logger.Debugf("Doing notification registration aftermath for eHrid '%s'!", payload.Ehrid)
 
-	client := store.Client{}
-
-	var date = utils.GetTimeNow().Format("20060102")
-
-	doc := client.Doc(constants.CollectionDailyNotificationAttemptsEhrid, payload.Ehrid)
+	var now = *utils.GetTimeNow()
+	var date = now.Format("20060102")
 
 	var finalDailyCount int
 
-	err := client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
-		rec, err := tx.Get(doc)
+	err := client.RunTransaction(ctx, func(ctx context.Context, tx store.Transaction) error {
+		var states map[string]int
+		err := tx.Get(constants.CollectionDailyNotificationAttemptsEhrid, payload.Ehrid, &states)
 
 		if err != nil {
 			if status.Code(err) != codes.NotFound {
@@ -46,16 +57,10 @@ func AfterMath(ctx context.Context, m pubsub.Message) error {
 
 			logger.Debugf("Saving default daily state")
 			finalDailyCount = 1
-			return tx.Set(doc, map[string]int{date: 1})
+			return tx.Set(constants.CollectionDailyNotificationAttemptsEhrid, payload.Ehrid, map[string]int{date: 1})
 		}
 		// record for eHrid found, let's update it
 
-		var states map[string]int
-		err = rec.DataTo(&states)
-		if err != nil {
-			return fmt.Errorf("Error while querying Firestore: %v", err)
-		}
-
 		logger.Debugf("Found daily states: %+v", states)
 
 		// Step 1. Increase daily state
@@ -69,7 +74,7 @@ func AfterMath(ctx context.Context, m pubsub.Message) error {
 
 		logger.Debugf("Saving updated daily states for eHRID %v: %+v", payload.Ehrid, states)
 
-		return tx.Set(doc, states)
+		return tx.Set(constants.CollectionDailyNotificationAttemptsEhrid, payload.Ehrid, states)
 	})
 
 	if err != nil {
@@ -79,30 +84,11 @@ func AfterMath(ctx context.Context, m pubsub.Message) error {
 
 	logger.Debugf("Daily count for %v: %v", payload.Ehrid, finalDailyCount)
 
-	// Step 2. Check if daily state is not too high
-
-	var thresholdsOK = finalDailyCount == 1
-
-	logger.Debugf("Thresholds ok: %v", thresholdsOK)
-
-	// Step 3. Possibly increase notificationsCount
-
-	if thresholdsOK {
-		// update daily counter
-		err = updateCounter(ctx, client, date)
-
-		if err != nil {
-			logger.Warnf("Cannot handle register notification aftermath due to unknown error: %+v", err.Error())
-			return err
-		}
+	// Step 2. Increase notificationsCount, once per eHrid and day
 
-		// update total counter
-		err = updateCounter(ctx, client, "total")
-
-		if err != nil {
-			logger.Warnf("Cannot handle register notification aftermath due to unknown error: %+v", err.Error())
-			return err
-		}
+	if err = updateCounter(ctx, countersClient, payload.Ehrid, now); err != nil {
+		logger.Warnf("Cannot handle register notification aftermath due to unknown error: %+v", err.Error())
+		return err
 	}
 
 	logger.Debugf("Register notification aftermath done")
@@ -112,35 +98,13 @@ func AfterMath(ctx context.Context, m pubsub.Message) error {
 	return nil
 }
 
-func updateCounter(ctx context.Context, client store.Client, key string) error {
+func updateCounter(ctx context.Context, client counters.Counters, ehrid string, now time.Time) error {
 	logger := logging.FromContext(ctx)
 
-	doc := client.Doc(constants.CollectionNotificationCounters, key)
+	logger.Debugf("Increasing notifications counter for eHrid %v", ehrid)
 
-	return client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
-		rec, err := tx.Get(doc)
+	// only the first notification of the eHrid in the day is counted, even when the event is redelivered or retried
+	eventID := ehrid + "_" + now.Format("20060102")
 
-		if err != nil {
-			if status.Code(err) != codes.NotFound {
-				return fmt.Errorf("Error while querying Firestore: %v", err)
-			}
-			// not found:
-
-			logger.Debugf("Saving default global daily state, key %v", key)
-			return tx.Set(doc, structs.NotificationCounter{NotificationsCount: 1})
-		}
-
-		var data structs.NotificationCounter
-		err = rec.DataTo(&data)
-		if err != nil {
-			return fmt.Errorf("Error while querying Firestore: %v", err)
-		}
-		logger.Debugf("Found global daily states, key %v: %+v", key, data)
-
-		data.NotificationsCount++
-
-		logger.Debugf("Saving updated global daily state, key %v: %+v", key, data)
-
-		return tx.Set(doc, data)
-	})
+	return client.Increment(ctx, constants.CounterNotifications, eventID, now, structs.NotificationCounter{NotificationsCount: 1})
 }
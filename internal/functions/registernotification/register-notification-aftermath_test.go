@@ -0,0 +1,62 @@
+package registernotification
+
+import (
+	"context"
+	"testing"
+
+	"github.com/covid19cz/erouska-backend/internal/constants"
+	"github.com/covid19cz/erouska-backend/internal/counters"
+	"github.com/covid19cz/erouska-backend/internal/firebase/structs"
+	"github.com/covid19cz/erouska-backend/internal/pubsub"
+	"github.com/covid19cz/erouska-backend/internal/store"
+)
+
+func TestAfterMathRedelivery(t *testing.T) {
+	ctx := context.Background()
+
+	storeClient := store.NewMemoryClient()
+	countersClient := counters.Client{Store: storeClient}
+
+	message := func(id string, ehrid string) pubsub.Message {
+		return pubsub.Message{ID: id, Data: []byte(`{"ehrid":"` + ehrid + `"}`)}
+	}
+
+	deliveries := []pubsub.Message{
+		message("message-1", "eABCDEF123"),
+		message("message-1", "eABCDEF123"), // redelivery
+		message("message-2", "eABCDEF123"), // the same eHrid again
+		message("message-3", "eGHIJKL456"),
+		message("message-3", "eGHIJKL456"), // redelivery
+	}
+
+	for _, m := range deliveries {
+		if err := afterMathOnce(ctx, storeClient, m); err != nil {
+			t.Fatalf("afterMathOnce(%v) error: %v", m.ID, err)
+		}
+	}
+
+	// processing skipped by the ledger is still counted once
+	if err := afterMath(ctx, storeClient, countersClient, message("message-3", "eGHIJKL456")); err != nil {
+		t.Fatalf("afterMath() error: %v", err)
+	}
+
+	var total structs.NotificationCounter
+	if err := countersClient.Get(ctx, constants.CounterNotifications, counters.KeyTotal, &total); err != nil {
+		t.Fatal(err)
+	}
+
+	if total.NotificationsCount != 2 {
+		t.Errorf("Total notifications count = %v, want 2", total.NotificationsCount)
+	}
+
+	var attempts map[string]int
+	if err := storeClient.Get(ctx, constants.CollectionDailyNotificationAttemptsEhrid, "eABCDEF123", &attempts); err != nil {
+		t.Fatal(err)
+	}
+
+	for date, count := range attempts {
+		if count != 2 {
+			t.Errorf("Attempts of eABCDEF123 on %v = %v, want 2", date, count)
+		}
+	}
+}
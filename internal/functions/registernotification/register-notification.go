@@ -1,12 +1,10 @@
 package registernotification
 
 import (
-	"cloud.google.com/go/firestore"
 	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/dgrijalva/jwt-go"
-	"google.golang.org/api/iterator"
 	"net/http"
 	"regexp"
 	"strings"
@@ -37,6 +35,7 @@ func RegisterNotification(w http.ResponseWriter, r *http.Request) {
 	logger := logging.FromContext(ctx).Named("RegisterNotification")
 	authClient := auth.Client{}
 	pubSubClient := pubsub.Client{}
+	storeClient := store.Client{}
 
 	var request v1.RegisterNotificationRequest
 
@@ -65,9 +64,9 @@ func RegisterNotification(w http.ResponseWriter, r *http.Request) {
 
 	if !isEhrid {
 		logger.Infof("Provided ID is not eHrid: %v", uid)
-		err = handleForFUID(ctx, uid)
+		err = handleForFUID(ctx, storeClient, uid)
 	} else {
-		err = handleForEhrid(ctx, uid)
+		err = handleForEhrid(ctx, storeClient, uid)
 	}
 
 	if err != nil {
@@ -90,14 +89,12 @@ func RegisterNotification(w http.ResponseWriter, r *http.Request) {
 	httputils.SendEmptyResponse(w, r)
 }
 
-func handleForEhrid(ctx context.Context, ehrid string) error {
+func handleForEhrid(ctx context.Context, storeClient store.Storer, ehrid string) error {
 	logger := logging.FromContext(ctx).Named("register-notification.handleForEhrid")
-	storeClient := store.Client{}
 
-	doc := storeClient.Doc(constants.CollectionRegistrations, ehrid)
-
-	return storeClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
-		rec, err := tx.Get(doc)
+	return storeClient.RunTransaction(ctx, func(ctx context.Context, tx store.Transaction) error {
+		var registration structs.Registration
+		err := tx.Get(constants.CollectionRegistrations, ehrid, &registration)
 
 		if err != nil {
 			if status.Code(err) != codes.NotFound {
@@ -107,12 +104,6 @@ func handleForEhrid(ctx context.Context, ehrid string) error {
 
 			return &errors.NotFoundError{Msg: fmt.Sprintf("Could not find registration for %v: %v", ehrid, err)}
 		}
-
-		var registration structs.Registration
-		err = rec.DataTo(&registration)
-		if err != nil {
-			return fmt.Errorf("Error while querying Firestore: %v", err)
-		}
 		logger.Debugf("Found registration: %+v", registration)
 
 		registration.LastNotificationStatus = "sent"
@@ -120,31 +111,23 @@ func handleForEhrid(ctx context.Context, ehrid string) error {
 
 		logger.Debugf("Saving updated notification state: %+v", registration)
 
-		return tx.Set(doc, registration)
+		return tx.Set(constants.CollectionRegistrations, ehrid, registration)
 	})
 }
 
-func handleForFUID(ctx context.Context, fuid string) error {
+func handleForFUID(ctx context.Context, storeClient store.Storer, fuid string) error {
 	logger := logging.FromContext(ctx).Named("register-notification.handleForFUID")
-	storeClient := store.Client{}
 
 	logger.Debugf("Looking for FUID %v in collection %v", fuid, constants.CollectionRegistrationsV1)
 
-	it := storeClient.Find(constants.CollectionRegistrationsV1, "fuid", fuid).Snapshots(ctx)
-
-	resp, err := it.Next()
-	if err == iterator.Done {
-		return fmt.Errorf("Could not find record for FUID %v", fuid)
-	}
+	if _, err := storeClient.Find(ctx, constants.CollectionRegistrationsV1, "fuid", fuid); err != nil {
+		if status.Code(err) == codes.NotFound {
+			return fmt.Errorf("Could not find record for FUID %v", fuid)
+		}
 
-	if err != nil {
 		return err
 	}
 
-	if resp.Size == 0 {
-		return fmt.Errorf("Could not find record for FUID %v", fuid)
-	}
-
 	logger.Debugf("Record for FUID %+v found", fuid)
 
 	return nil
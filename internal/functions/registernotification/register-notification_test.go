@@ -0,0 +1,71 @@
+package registernotification
+
+import (
+	"context"
+	"testing"
+
+	"github.com/covid19cz/erouska-backend/internal/constants"
+	"github.com/covid19cz/erouska-backend/internal/firebase/structs"
+	"github.com/covid19cz/erouska-backend/internal/store"
+	"github.com/covid19cz/erouska-backend/internal/utils/errors"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHandleForEhrid(t *testing.T) {
+
+	ctx := context.Background()
+
+	store := store.NewMemoryClient()
+
+	registration := structs.Registration{Platform: "ios", PushRegistrationToken: "token", CreatedAt: 1596000000}
+
+	if err := store.Set(ctx, constants.CollectionRegistrations, "eABCDEF123", registration); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := handleForEhrid(ctx, store, "eABCDEF123"); err != nil {
+		t.Fatalf("handleForEhrid no error expected: %v", err)
+	}
+
+	var saved structs.Registration
+	if err := store.Get(ctx, constants.CollectionRegistrations, "eABCDEF123", &saved); err != nil {
+		t.Fatal(err)
+	}
+
+	if saved.LastNotificationUpdatedAt == 0 {
+		t.Fatalf("notification time not saved")
+	}
+
+	registration.LastNotificationStatus = "sent"
+	registration.LastNotificationUpdatedAt = saved.LastNotificationUpdatedAt
+
+	diff := cmp.Diff(registration, saved)
+	if diff != "" {
+		t.Fatalf("saved registration mismatch (-want +got):\n%v", diff)
+	}
+
+	err := handleForEhrid(ctx, store, "eGHIJKL456")
+	if _, ok := err.(*errors.NotFoundError); !ok {
+		t.Fatalf("handleForEhrid of unknown eHrid: %v, NotFoundError expected", err)
+	}
+}
+
+func TestHandleForFUID(t *testing.T) {
+
+	ctx := context.Background()
+
+	store := store.NewMemoryClient()
+
+	if err := store.Set(ctx, constants.CollectionRegistrationsV1, "doc-1", structs.RegistrationV1{FUID: "fuid-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := handleForFUID(ctx, store, "fuid-1"); err != nil {
+		t.Fatalf("handleForFUID no error expected: %v", err)
+	}
+
+	if err := handleForFUID(ctx, store, "fuid-2"); err == nil {
+		t.Fatalf("handleForFUID of unknown FUID error expected")
+	}
+}
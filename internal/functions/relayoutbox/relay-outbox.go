@@ -0,0 +1,30 @@
+package relayoutbox
+
+import (
+	"fmt"
+	"github.com/covid19cz/erouska-backend/internal/logging"
+	"github.com/covid19cz/erouska-backend/internal/outbox"
+	"github.com/covid19cz/erouska-backend/internal/pubsub"
+	"github.com/covid19cz/erouska-backend/internal/store"
+	"net/http"
+)
+
+//RelayOutbox Publishes events which are still pending in the outbox.
+func RelayOutbox(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	logger := logging.FromContext(ctx).Named("relay-outbox.RelayOutbox")
+
+	relay := outbox.Relay{Store: store.Client{}, Publisher: pubsub.Client{}}
+
+	published, err := relay.Flush(ctx, outbox.DefaultBatchSize)
+	if err != nil {
+		msg := fmt.Sprintf("Could not relay outbox: %v", err)
+		logger.Error(msg)
+		http.Error(w, msg, 500)
+		return
+	}
+
+	logger.Infof("Published %v outbox entries", published)
+
+	http.Error(w, "ok", 200)
+}
@@ -0,0 +1,70 @@
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/covid19cz/erouska-backend/internal/logging"
+)
+
+const shutdownTimeout = 10 * time.Second
+
+//Server HTTP server which can be gracefully stopped by closing its context.
+type Server struct {
+	listener net.Listener
+}
+
+//New Creates new server listening on given port. Empty port means a random one.
+func New(port string) (*Server, error) {
+	addr := ":" + port
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create listener on %v: %v", addr, err)
+	}
+
+	return &Server{listener: listener}, nil
+}
+
+//Addr Address the server is listening on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+//ServeHTTPHandler Serves given handler and blocks until the context is closed. Requests being processed at that moment
+//are given some time to finish before the server is stopped.
+func (s *Server) ServeHTTPHandler(ctx context.Context, handler http.Handler) error {
+	logger := logging.FromContext(ctx).Named("httpserver.ServeHTTPHandler")
+
+	srv := &http.Server{Handler: handler}
+
+	errCh := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+
+		logger.Debugf("Context closed, shutting down the server")
+
+		shutdownCtx, done := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer done()
+
+		errCh <- srv.Shutdown(shutdownCtx)
+	}()
+
+	logger.Infof("Listening on %v", s.Addr())
+
+	if err := srv.Serve(s.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("Could not serve: %v", err)
+	}
+
+	if err := <-errCh; err != nil {
+		return fmt.Errorf("Could not shut down the server: %v", err)
+	}
+
+	logger.Debugf("Server stopped")
+
+	return nil
+}
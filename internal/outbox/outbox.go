@@ -0,0 +1,149 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/covid19cz/erouska-backend/internal/constants"
+	"github.com/covid19cz/erouska-backend/internal/logging"
+	"github.com/covid19cz/erouska-backend/internal/pubsub"
+	"github.com/covid19cz/erouska-backend/internal/store"
+)
+
+const (
+	//StatusPending Entry waiting to be published.
+	StatusPending = "pending"
+	//StatusPublished Entry already published.
+	StatusPublished = "published"
+)
+
+//DefaultBatchSize Max. number of entries published by one relay run.
+const DefaultBatchSize = 100
+
+//PublishedTTL How long is a published entry kept in the outbox.
+const PublishedTTL = 7 * 24 * time.Hour
+
+//Entry Event stored in the outbox.
+type Entry struct {
+	Topic     string    `firestore:"topic" json:"topic"`
+	Payload   string    `firestore:"payload" json:"payload"`
+	Status    string    `firestore:"status" json:"status"`
+	CreatedAt time.Time `firestore:"createdAt" json:"createdAt"`
+	Attempts  int       `firestore:"attempts" json:"attempts"`
+	LastError string    `firestore:"lastError" json:"lastError"`
+	// ExpireAt Time after which a published entry may be deleted, e.g. by Firestore TTL policy.
+	ExpireAt *time.Time `firestore:"expireAt,omitempty" json:"expireAt,omitempty"`
+}
+
+//Add Stores the event to the outbox within the transaction, so it's published if and only if the transaction
+//succeeds. The id must be unique for the event.
+func Add(tx store.Transaction, id string, topic string, msg interface{}) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	entry := Entry{
+		Topic:     topic,
+		Payload:   string(payload),
+		Status:    StatusPending,
+		CreatedAt: time.Now(),
+	}
+
+	return tx.Set(constants.CollectionOutbox, id, entry)
+}
+
+//Relay Publishes pending events from the outbox to PubSub. An entry is retried until it's acknowledged by PubSub,
+//so every event is delivered at least once.
+type Relay struct {
+	Store     store.Storer
+	Publisher pubsub.EventPublisher
+}
+
+//Publish Tries to publish the entry right away. When it fails, the entry is left for the next relay run.
+func (r Relay) Publish(ctx context.Context, id string) error {
+	logger := logging.FromContext(ctx).Named("outbox.Relay.Publish")
+
+	var entry Entry
+	if err := r.Store.Get(ctx, constants.CollectionOutbox, id, &entry); err != nil {
+		return fmt.Errorf("Error while querying Firestore: %v", err)
+	}
+
+	if entry.Status != StatusPending {
+		logger.Debugf("Outbox entry %v was already published", id)
+		return nil
+	}
+
+	logger.Debugf("Publishing outbox entry %v to %v", id, entry.Topic)
+
+	publishErr := r.Publisher.Publish(entry.Topic, json.RawMessage(entry.Payload))
+
+	err := r.Store.RunTransaction(ctx, func(ctx context.Context, tx store.Transaction) error {
+		var current Entry
+		if err := tx.Get(constants.CollectionOutbox, id, &current); err != nil {
+			return err
+		}
+
+		if current.Status != StatusPending {
+			return nil // published by someone else meanwhile
+		}
+
+		current.Attempts++
+
+		if publishErr != nil {
+			current.LastError = publishErr.Error()
+		} else {
+			expireAt := time.Now().Add(PublishedTTL)
+			current.Status = StatusPublished
+			current.LastError = ""
+			current.ExpireAt = &expireAt
+		}
+
+		return tx.Set(constants.CollectionOutbox, id, current)
+	})
+
+	if publishErr != nil {
+		return fmt.Errorf("Could not publish outbox entry %v: %v", id, publishErr)
+	}
+
+	if err != nil {
+		// the event is out; it'll be published once more by the next relay run
+		logger.Warnf("Could not mark outbox entry %v as published: %v", id, err)
+	}
+
+	return nil
+}
+
+//Flush Publishes up to batchSize pending entries. Returns number of published entries.
+func (r Relay) Flush(ctx context.Context, batchSize int) (int, error) {
+	logger := logging.FromContext(ctx).Named("outbox.Relay.Flush")
+
+	ids, err := r.Store.FindAll(ctx, constants.CollectionOutbox, "status", StatusPending, batchSize)
+	if err != nil {
+		return 0, fmt.Errorf("Error while querying Firestore: %v", err)
+	}
+
+	logger.Debugf("Found %v pending outbox entries", len(ids))
+
+	var published int
+	var errors []string
+
+	for _, id := range ids {
+		if err := r.Publish(ctx, id); err != nil {
+			logger.Warnf("%v", err)
+			errors = append(errors, err.Error())
+			continue
+		}
+
+		published++
+	}
+
+	if len(errors) != 0 {
+		return published, fmt.Errorf("Following errors have happened, only %v of %v entries has been published:\n%v", published, len(ids), strings.Join(errors, "\n"))
+	}
+
+	return published, nil
+}
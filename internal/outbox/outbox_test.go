@@ -0,0 +1,118 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/covid19cz/erouska-backend/internal/constants"
+	"github.com/covid19cz/erouska-backend/internal/store"
+	"github.com/stretchr/testify/assert"
+)
+
+type testPayload struct {
+	Value string `json:"value"`
+}
+
+type testPublisher struct {
+	failures  int
+	published []string
+}
+
+func (p *testPublisher) Publish(topic string, msg interface{}) error {
+	if p.failures > 0 {
+		p.failures--
+		return fmt.Errorf("failing on purpose")
+	}
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	p.published = append(p.published, topic+":"+string(payload))
+	return nil
+}
+
+func addEntry(t *testing.T, storeClient store.Storer, id string, value string) {
+	err := storeClient.RunTransaction(context.Background(), func(ctx context.Context, tx store.Transaction) error {
+		return Add(tx, id, "topic", testPayload{Value: value})
+	})
+	assert.Nil(t, err)
+}
+
+func TestRelayRetriesUntilPublished(t *testing.T) {
+	ctx := context.Background()
+
+	storeClient := store.NewMemoryClient()
+	publisher := &testPublisher{failures: 1}
+	relay := Relay{Store: storeClient, Publisher: publisher}
+
+	addEntry(t, storeClient, "entry-1", "ahoj")
+
+	assert.NotNil(t, relay.Publish(ctx, "entry-1"))
+	assert.Empty(t, publisher.published)
+
+	var entry Entry
+	assert.Nil(t, storeClient.Get(ctx, constants.CollectionOutbox, "entry-1", &entry))
+	assert.Equal(t, StatusPending, entry.Status)
+	assert.Equal(t, 1, entry.Attempts)
+	assert.Equal(t, "failing on purpose", entry.LastError)
+
+	published, err := relay.Flush(ctx, DefaultBatchSize)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, published)
+	assert.Equal(t, []string{`topic:{"value":"ahoj"}`}, publisher.published)
+
+	assert.Nil(t, storeClient.Get(ctx, constants.CollectionOutbox, "entry-1", &entry))
+	assert.Equal(t, StatusPublished, entry.Status)
+	assert.Equal(t, 2, entry.Attempts)
+	assert.NotNil(t, entry.ExpireAt)
+
+	// nothing more to publish
+	published, err = relay.Flush(ctx, DefaultBatchSize)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, published)
+	assert.Nil(t, relay.Publish(ctx, "entry-1"))
+	assert.Len(t, publisher.published, 1)
+}
+
+func TestRelayFlushLimit(t *testing.T) {
+	ctx := context.Background()
+
+	storeClient := store.NewMemoryClient()
+	publisher := &testPublisher{}
+	relay := Relay{Store: storeClient, Publisher: publisher}
+
+	for i := 0; i < 5; i++ {
+		addEntry(t, storeClient, fmt.Sprintf("entry-%d", i), fmt.Sprintf("value-%d", i))
+	}
+
+	published, err := relay.Flush(ctx, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, published)
+
+	published, err = relay.Flush(ctx, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, published)
+	assert.Len(t, publisher.published, 5)
+}
+
+func TestAddIsTransactional(t *testing.T) {
+	ctx := context.Background()
+
+	storeClient := store.NewMemoryClient()
+
+	err := storeClient.RunTransaction(ctx, func(ctx context.Context, tx store.Transaction) error {
+		if err := Add(tx, "entry-1", "topic", testPayload{Value: "ahoj"}); err != nil {
+			return err
+		}
+		return fmt.Errorf("failing on purpose")
+	})
+	assert.NotNil(t, err)
+
+	ids, err := storeClient.FindAll(ctx, constants.CollectionOutbox, "status", StatusPending, DefaultBatchSize)
+	assert.Nil(t, err)
+	assert.Empty(t, ids)
+}
@@ -0,0 +1,139 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/covid19cz/erouska-backend/internal/constants"
+	"github.com/covid19cz/erouska-backend/internal/logging"
+	"github.com/covid19cz/erouska-backend/internal/store"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+//DefaultLedgerTTL How long is a processed message remembered. PubSub doesn't retain messages for longer than 7 days.
+const DefaultLedgerTTL = 7 * 24 * time.Hour
+
+//DefaultLedgerLease How long is a message claimed by the instance processing it. It's longer than the longest run of
+//a function (9 minutes), so the claim of a crashed instance expires before the message is redelivered for good.
+const DefaultLedgerLease = 10 * time.Minute
+
+//Ledger Remembers successfully processed messages, so redelivered messages can be acknowledged without processing.
+type Ledger struct {
+	Store store.Storer
+	TTL   time.Duration
+	Lease time.Duration
+	Now   func() time.Time
+}
+
+type processedMessage struct {
+	Subscription string `firestore:"subscription" json:"subscription"`
+	// ProcessedAt When the message was processed; zero while it's being processed.
+	ProcessedAt time.Time `firestore:"processedAt" json:"processedAt"`
+	// ClaimedUntil Until when the message is processed by an instance, other deliveries are refused meanwhile.
+	ClaimedUntil time.Time `firestore:"claimedUntil" json:"claimedUntil"`
+	// ExpireAt Time after which the record may be deleted, e.g. by Firestore TTL policy.
+	ExpireAt time.Time `firestore:"expireAt" json:"expireAt"`
+}
+
+// claimResult Outcome of an attempt to claim a message.
+type claimResult int
+
+const (
+	claimed claimResult = iota
+	alreadyProcessed
+	beingProcessed
+)
+
+//NewLedger Creates ledger with default TTL and lease backed by given storage.
+func NewLedger(storeClient store.Storer) Ledger {
+	return Ledger{Store: storeClient, TTL: DefaultLedgerTTL, Lease: DefaultLedgerLease, Now: time.Now}
+}
+
+//ProcessOnce Passes the message to the subscriber unless it was already processed by the subscription. The message
+//is claimed in a transaction first, so concurrent deliveries of the same message aren't processed twice; delivery
+//of a message being processed fails and is retried later. The message is recorded as processed only when the
+//subscriber succeeds, so failed messages are still retried.
+func (l Ledger) ProcessOnce(ctx context.Context, subscription string, m Message, subscriber Subscriber) error {
+	logger := logging.FromContext(ctx).Named("pubsub.Ledger.ProcessOnce")
+
+	messageID := MessageID(ctx, m)
+	if messageID == "" {
+		logger.Warnf("Message for %v has no ID, can't check whether it was already processed", subscription)
+		return subscriber(ctx, m)
+	}
+
+	docID := subscription + "_" + messageID
+	now := l.Now()
+
+	result, err := l.claim(ctx, subscription, docID, now)
+	if err != nil {
+		return err
+	}
+
+	switch result {
+	case alreadyProcessed:
+		logger.Infof("Message %v was already processed by %v, skipping", messageID, subscription)
+		return nil
+	case beingProcessed:
+		return fmt.Errorf("Message %v is being processed by %v in other instance", messageID, subscription)
+	}
+
+	if err := subscriber(ctx, m); err != nil {
+		// release the claim, so the retry doesn't wait for the lease
+		released := processedMessage{Subscription: subscription, ExpireAt: now.Add(l.TTL)}
+		if e := l.Store.Set(ctx, constants.CollectionProcessedMessages, docID, released); e != nil {
+			logger.Warnf("Could not release claim of message %v by %v: %v", messageID, subscription, e)
+		}
+		return err
+	}
+
+	processed := processedMessage{
+		Subscription: subscription,
+		ProcessedAt:  l.Now(),
+		ExpireAt:     now.Add(l.TTL),
+	}
+
+	if err := l.Store.Set(ctx, constants.CollectionProcessedMessages, docID, processed); err != nil {
+		// the message was processed; failing now would only cause the redelivery we try to prevent
+		logger.Errorf("Could not record message %v as processed by %v: %v", messageID, subscription, err)
+	}
+
+	return nil
+}
+
+// claim Claims the message for this instance, unless it was already processed or claimed by other instance.
+func (l Ledger) claim(ctx context.Context, subscription string, docID string, now time.Time) (claimResult, error) {
+	result := claimed
+
+	err := l.Store.RunTransaction(ctx, func(ctx context.Context, tx store.Transaction) error {
+		result = claimed
+
+		var record processedMessage
+		err := tx.Get(constants.CollectionProcessedMessages, docID, &record)
+
+		if err != nil && status.Code(err) != codes.NotFound {
+			return fmt.Errorf("Error while querying Firestore: %v", err)
+		}
+
+		if err == nil && now.Before(record.ExpireAt) {
+			if !record.ProcessedAt.IsZero() {
+				result = alreadyProcessed
+				return nil
+			}
+			if now.Before(record.ClaimedUntil) {
+				result = beingProcessed
+				return nil
+			}
+		}
+
+		return tx.Set(constants.CollectionProcessedMessages, docID, processedMessage{
+			Subscription: subscription,
+			ClaimedUntil: now.Add(l.Lease),
+			ExpireAt:     now.Add(l.TTL),
+		})
+	})
+
+	return result, err
+}
@@ -0,0 +1,115 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/covid19cz/erouska-backend/internal/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLedgerSkipsProcessedMessages(t *testing.T) {
+	ctx := context.Background()
+
+	now := time.Date(2020, 11, 20, 10, 0, 0, 0, time.UTC)
+	ledger := Ledger{Store: store.NewMemoryClient(), TTL: time.Hour, Lease: time.Minute, Now: func() time.Time { return now }}
+
+	var calls int
+	subscriber := func(ctx context.Context, m Message) error {
+		calls++
+		return nil
+	}
+
+	m := Message{Data: []byte(`{"value":"ahoj"}`), ID: "message-1"}
+
+	assert.Nil(t, ledger.ProcessOnce(ctx, "topic", m, subscriber))
+	assert.Nil(t, ledger.ProcessOnce(ctx, "topic", m, subscriber)) // redelivery
+	assert.Equal(t, 1, calls)
+
+	// other subscription processes the message on its own
+	assert.Nil(t, ledger.ProcessOnce(ctx, "other-topic", m, subscriber))
+	assert.Equal(t, 2, calls)
+
+	// after TTL, the message is forgotten
+	now = now.Add(2 * time.Hour)
+	assert.Nil(t, ledger.ProcessOnce(ctx, "topic", m, subscriber))
+	assert.Equal(t, 3, calls)
+}
+
+func TestLedgerRetriesFailedMessages(t *testing.T) {
+	ctx := context.Background()
+
+	ledger := NewLedger(store.NewMemoryClient())
+
+	var calls int
+	subscriber := func(ctx context.Context, m Message) error {
+		calls++
+		if calls == 1 {
+			return fmt.Errorf("failing on purpose")
+		}
+		return nil
+	}
+
+	m := Message{Data: []byte(`{"value":"ahoj"}`), ID: "message-1"}
+
+	assert.NotNil(t, ledger.ProcessOnce(ctx, "topic", m, subscriber))
+	assert.Nil(t, ledger.ProcessOnce(ctx, "topic", m, subscriber))
+	assert.Nil(t, ledger.ProcessOnce(ctx, "topic", m, subscriber))
+	assert.Equal(t, 2, calls)
+}
+
+func TestLedgerWithoutMessageID(t *testing.T) {
+	ctx := context.Background()
+
+	ledger := NewLedger(store.NewMemoryClient())
+
+	var calls int
+	subscriber := func(ctx context.Context, m Message) error {
+		calls++
+		return nil
+	}
+
+	m := Message{Data: []byte(`{"value":"ahoj"}`)}
+
+	assert.Nil(t, ledger.ProcessOnce(ctx, "topic", m, subscriber))
+	assert.Nil(t, ledger.ProcessOnce(ctx, "topic", m, subscriber))
+	assert.Equal(t, 2, calls)
+}
+
+func TestLedgerRefusesConcurrentDelivery(t *testing.T) {
+	ctx := context.Background()
+
+	now := time.Date(2020, 11, 20, 10, 0, 0, 0, time.UTC)
+	ledger := Ledger{Store: store.NewMemoryClient(), TTL: time.Hour, Lease: time.Minute, Now: func() time.Time { return now }}
+
+	m := Message{Data: []byte(`{"value":"ahoj"}`), ID: "message-1"}
+
+	var calls int
+	var redelivery error
+
+	subscriber := func(ctx context.Context, m Message) error {
+		calls++
+		// the same message delivered again while this one is being processed
+		redelivery = ledger.ProcessOnce(ctx, "topic", m, func(ctx context.Context, m Message) error {
+			calls++
+			return nil
+		})
+		return nil
+	}
+
+	assert.Nil(t, ledger.ProcessOnce(ctx, "topic", m, subscriber))
+	assert.NotNil(t, redelivery)
+	assert.Equal(t, 1, calls)
+
+	// claim of a crashed instance expires
+	crashed := Message{Data: []byte(`{"value":"ahoj"}`), ID: "message-2"}
+	_, err := ledger.claim(ctx, "topic", "topic_message-2", now)
+	assert.Nil(t, err)
+
+	assert.NotNil(t, ledger.ProcessOnce(ctx, "topic", crashed, func(ctx context.Context, m Message) error { return nil }))
+
+	now = now.Add(2 * time.Minute)
+	assert.Nil(t, ledger.ProcessOnce(ctx, "topic", crashed, func(ctx context.Context, m Message) error { return nil }))
+}
@@ -0,0 +1,164 @@
+package pubsub
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/covid19cz/erouska-backend/internal/logging"
+	"github.com/lithammer/shortuuid/v3"
+)
+
+const (
+	defaultMaxDeliveryAttempts = 5
+	defaultMinBackoff          = 100 * time.Millisecond
+	defaultMaxBackoff          = 10 * time.Second
+)
+
+var localClient *LocalClient
+
+//EnableLocalDelivery Makes the real client deliver all messages through given local client instead of Google PubSub.
+func EnableLocalDelivery(client *LocalClient) {
+	localClient = client
+}
+
+//Subscriber Function consuming messages of some topic, e.g. a Cloud Function with PubSub trigger.
+type Subscriber func(ctx context.Context, m Message) error
+
+//SubscriptionConfig Delivery settings of a local subscription. Zero values mean defaults.
+type SubscriptionConfig struct {
+	// MaxDeliveryAttempts Number of delivery attempts before the message is dead-lettered.
+	MaxDeliveryAttempts int
+	// MinBackoff Delay before the first redelivery. It's doubled with every other attempt.
+	MinBackoff time.Duration
+	// MaxBackoff Upper limit of delay between redeliveries.
+	MaxBackoff time.Duration
+	// DeadLetterTopic Topic where undeliverable messages are forwarded to. Optional.
+	DeadLetterTopic string
+}
+
+type localSubscription struct {
+	subscriber Subscriber
+	config     SubscriptionConfig
+}
+
+//LocalClient In-memory PubSub client which delivers messages to subscribers in the same process.
+type LocalClient struct {
+	mutex         sync.Mutex
+	subscriptions map[string][]localSubscription
+	deadLetters   map[string][]Message
+	inFlight      sync.WaitGroup
+}
+
+//NewLocalClient Creates new local client without any subscriptions.
+func NewLocalClient() *LocalClient {
+	return &LocalClient{
+		subscriptions: make(map[string][]localSubscription),
+		deadLetters:   make(map[string][]Message),
+	}
+}
+
+//Subscribe Registers subscriber to the topic.
+func (c *LocalClient) Subscribe(topic string, subscriber Subscriber, config SubscriptionConfig) {
+	if config.MaxDeliveryAttempts <= 0 {
+		config.MaxDeliveryAttempts = defaultMaxDeliveryAttempts
+	}
+	if config.MinBackoff <= 0 {
+		config.MinBackoff = defaultMinBackoff
+	}
+	if config.MaxBackoff <= 0 {
+		config.MaxBackoff = defaultMaxBackoff
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.subscriptions[topic] = append(c.subscriptions[topic], localSubscription{subscriber: subscriber, config: config})
+}
+
+//Publish Publish message to some topic. The delivery itself is asynchronous.
+func (c *LocalClient) Publish(topic string, msg interface{}) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	c.publishMessage(topic, Message{Data: payload, ID: shortuuid.New()})
+
+	return nil
+}
+
+//Wait Blocks until all published messages (including those published by subscribers meanwhile) are either
+//delivered or dead-lettered.
+func (c *LocalClient) Wait() {
+	c.inFlight.Wait()
+}
+
+//DeadLetters Gets messages of given topic which could not be delivered.
+func (c *LocalClient) DeadLetters(topic string) []Message {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return append([]Message(nil), c.deadLetters[topic]...)
+}
+
+func (c *LocalClient) publishMessage(topic string, m Message) {
+	logger := logging.FromContext(context.Background()).Named("pubsub.LocalClient")
+
+	c.mutex.Lock()
+	subscriptions := c.subscriptions[topic]
+	c.mutex.Unlock()
+
+	if len(subscriptions) == 0 {
+		logger.Debugf("No subscription for topic %v, dropping the message", topic)
+		return
+	}
+
+	for _, subscription := range subscriptions {
+		c.inFlight.Add(1)
+		go func(subscription localSubscription) {
+			defer c.inFlight.Done()
+			c.deliver(topic, subscription, m)
+		}(subscription)
+	}
+}
+
+func (c *LocalClient) deliver(topic string, subscription localSubscription, m Message) {
+	logger := logging.FromContext(context.Background()).Named("pubsub.LocalClient.deliver")
+
+	config := subscription.config
+	backoff := config.MinBackoff
+
+	for attempt := 1; ; attempt++ {
+		ctx := logging.WithLogger(context.Background(), logger.Named(topic))
+
+		err := subscription.subscriber(ctx, m)
+		if err == nil {
+			return
+		}
+
+		logger.Warnf("Delivery of message to %v has failed (attempt %v/%v): %v", topic, attempt, config.MaxDeliveryAttempts, err)
+
+		if attempt >= config.MaxDeliveryAttempts {
+			break
+		}
+
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > config.MaxBackoff {
+			backoff = config.MaxBackoff
+		}
+	}
+
+	logger.Errorf("Message to %v could not be delivered, dead-lettering it", topic)
+
+	c.mutex.Lock()
+	c.deadLetters[topic] = append(c.deadLetters[topic], m)
+	c.mutex.Unlock()
+
+	if config.DeadLetterTopic != "" {
+		c.publishMessage(config.DeadLetterTopic, m)
+	}
+}
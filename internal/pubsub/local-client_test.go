@@ -0,0 +1,90 @@
+package pubsub
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testPayload struct {
+	Value string `json:"value" validate:"required"`
+}
+
+func TestLocalClientChainedDelivery(t *testing.T) {
+	client := NewLocalClient()
+
+	var received atomic.Value
+
+	client.Subscribe("first", func(ctx context.Context, m Message) error {
+		var payload testPayload
+		if err := DecodeJSONEvent(m, &payload); err != nil {
+			return err
+		}
+
+		return client.Publish("second", testPayload{Value: payload.Value + "-forwarded"})
+	}, SubscriptionConfig{})
+
+	client.Subscribe("second", func(ctx context.Context, m Message) error {
+		var payload testPayload
+		if err := DecodeJSONEvent(m, &payload); err != nil {
+			return err
+		}
+
+		received.Store(payload.Value)
+		return nil
+	}, SubscriptionConfig{})
+
+	assert.Nil(t, client.Publish("first", testPayload{Value: "ahoj"}))
+	client.Wait()
+
+	assert.Equal(t, "ahoj-forwarded", received.Load())
+	assert.Empty(t, client.DeadLetters("first"))
+	assert.Empty(t, client.DeadLetters("second"))
+}
+
+func TestLocalClientRetries(t *testing.T) {
+	client := NewLocalClient()
+
+	var attempts int32
+
+	client.Subscribe("topic", func(ctx context.Context, m Message) error {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			return fmt.Errorf("failing on purpose")
+		}
+		return nil
+	}, SubscriptionConfig{MaxDeliveryAttempts: 3, MinBackoff: time.Millisecond})
+
+	assert.Nil(t, client.Publish("topic", testPayload{Value: "ahoj"}))
+	client.Wait()
+
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+	assert.Empty(t, client.DeadLetters("topic"))
+}
+
+func TestLocalClientDeadLettering(t *testing.T) {
+	client := NewLocalClient()
+
+	var attempts int32
+	var deadLettered int32
+
+	client.Subscribe("topic", func(ctx context.Context, m Message) error {
+		atomic.AddInt32(&attempts, 1)
+		return fmt.Errorf("failing on purpose")
+	}, SubscriptionConfig{MaxDeliveryAttempts: 2, MinBackoff: time.Millisecond, DeadLetterTopic: "topic-dead"})
+
+	client.Subscribe("topic-dead", func(ctx context.Context, m Message) error {
+		atomic.AddInt32(&deadLettered, 1)
+		return nil
+	}, SubscriptionConfig{})
+
+	assert.Nil(t, client.Publish("topic", testPayload{Value: "ahoj"}))
+	client.Wait()
+
+	assert.Equal(t, int32(2), atomic.LoadInt32(&attempts))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&deadLettered))
+	assert.Len(t, client.DeadLetters("topic"), 1)
+}
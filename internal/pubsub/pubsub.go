@@ -14,6 +14,7 @@ import (
 	"os"
 	"strings"
 
+	"cloud.google.com/go/functions/metadata"
 	"cloud.google.com/go/pubsub"
 )
 
@@ -23,6 +24,8 @@ var PubSubClient *pubsub.Client
 // Message is the payload of a Pub/Sub event.
 type Message struct {
 	Data []byte `json:"data"`
+	// ID Identifier of the message, the same for all its redeliveries. Use MessageID to read it.
+	ID string `json:"messageId"`
 }
 
 func init() {
@@ -53,8 +56,12 @@ type EventPublisher interface {
 //Client Real PubSub client.
 type Client struct{}
 
-//Publish Publish message to some topic.
+//Publish Publish message to some topic. When local delivery is enabled, the message is delivered in-process.
 func (c Client) Publish(topic string, msg interface{}) error {
+	if localClient != nil {
+		return localClient.Publish(topic, msg)
+	}
+
 	var t = PubSubClient.Topic(topic)
 	payload, err := json.Marshal(msg)
 	if err != nil {
@@ -77,6 +84,21 @@ func (c MockClient) Publish(topic string, msg interface{}) error {
 	return nil
 }
 
+//MessageID Gets identifier of the message. Cloud Functions don't pass it in the message itself but in the event
+//metadata, so it's taken from the context when missing in the message.
+func MessageID(ctx context.Context, m Message) string {
+	if m.ID != "" {
+		return m.ID
+	}
+
+	meta, err := metadata.FromContext(ctx)
+	if err != nil {
+		return ""
+	}
+
+	return meta.EventID
+}
+
 //DecodeJSONEvent Decodes and validates PubSub message into given interface.
 func DecodeJSONEvent(m Message, dst interface{}) errors.ErouskaError {
 	dec := json.NewDecoder(bytes.NewBuffer(m.Data))
@@ -0,0 +1,259 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// MemoryClient is a fully working in-memory storage, e.g. for unit tests or local runs. Documents are kept serialized
+// to JSON so the stored data can't be modified from outside. Fields are queried by the names Firestore would store
+// them under, i.e. by `firestore` tags, not by `json` ones.
+type MemoryClient struct {
+	mutex       sync.Mutex
+	collections map[string]map[string]memoryDocument
+}
+
+// memoryDocument Stored document: the whole data for reading and its fields by their Firestore names for querying.
+type memoryDocument struct {
+	data   []byte
+	fields map[string][]byte
+}
+
+// NewMemoryClient creates an empty in-memory storage.
+func NewMemoryClient() *MemoryClient {
+	return &MemoryClient{collections: make(map[string]map[string]memoryDocument)}
+}
+
+// Get loads the document with the given identifier into dst. The dst may be nil when only existence of the document matters.
+func (m *MemoryClient) Get(ctx context.Context, collectionName string, id string, dst interface{}) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.get(collectionName, id, dst)
+}
+
+// Set creates or overwrites the document with the given identifier.
+func (m *MemoryClient) Set(ctx context.Context, collectionName string, id string, data interface{}) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.set(collectionName, id, data)
+}
+
+// Find returns identifier of the first (by identifier) document whose field has given value.
+func (m *MemoryClient) Find(ctx context.Context, collectionName string, field string, value interface{}) (string, error) {
+	ids, err := m.FindAll(ctx, collectionName, field, value, 1)
+	if err != nil {
+		return "", err
+	}
+
+	if len(ids) == 0 {
+		return "", status.Error(codes.NotFound, fmt.Sprintf("Could not find document in %v with %v == %v", collectionName, field, value))
+	}
+
+	return ids[0], nil
+}
+
+// FindAll returns identifiers of at most limit documents (ordered by identifier) whose field has given value.
+func (m *MemoryClient) FindAll(ctx context.Context, collectionName string, field string, value interface{}, limit int) ([]string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	wanted, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	collection := m.collections[collectionName]
+
+	var ids []string
+	for id := range collection {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var found []string
+	for _, id := range ids {
+		if len(found) >= limit {
+			break
+		}
+
+		if actual, ok := collection[id].fields[field]; ok && bytes.Equal(actual, wanted) {
+			found = append(found, id)
+		}
+	}
+
+	return found, nil
+}
+
+// RunTransaction runs f in a transaction. Transactions are serialized and writes are applied only when f succeeds.
+func (m *MemoryClient) RunTransaction(ctx context.Context, f func(context.Context, Transaction) error) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	tx := &memoryTransaction{client: m}
+
+	if err := f(ctx, tx); err != nil {
+		return err
+	}
+
+	for _, write := range tx.writes {
+		m.collection(write.collectionName)[write.id] = write.document
+	}
+
+	return nil
+}
+
+func (m *MemoryClient) get(collectionName string, id string, dst interface{}) error {
+	document, ok := m.collections[collectionName][id]
+	if !ok {
+		return status.Error(codes.NotFound, fmt.Sprintf("Document %v/%v not found", collectionName, id))
+	}
+
+	if dst == nil {
+		return nil
+	}
+
+	return json.Unmarshal(document.data, dst)
+}
+
+func (m *MemoryClient) set(collectionName string, id string, data interface{}) error {
+	document, err := newMemoryDocument(data)
+	if err != nil {
+		return err
+	}
+
+	m.collection(collectionName)[id] = document
+	return nil
+}
+
+func (m *MemoryClient) collection(collectionName string) map[string]memoryDocument {
+	collection, ok := m.collections[collectionName]
+	if !ok {
+		collection = make(map[string]memoryDocument)
+		m.collections[collectionName] = collection
+	}
+
+	return collection
+}
+
+type memoryWrite struct {
+	collectionName string
+	id             string
+	document       memoryDocument
+}
+
+type memoryTransaction struct {
+	client *MemoryClient
+	writes []memoryWrite
+}
+
+func (t *memoryTransaction) Get(collectionName string, id string, dst interface{}) error {
+	if len(t.writes) > 0 {
+		return fmt.Errorf("read after write in transaction")
+	}
+
+	return t.client.get(collectionName, id, dst)
+}
+
+func (t *memoryTransaction) Set(collectionName string, id string, data interface{}) error {
+	document, err := newMemoryDocument(data)
+	if err != nil {
+		return err
+	}
+
+	t.writes = append(t.writes, memoryWrite{collectionName: collectionName, id: id, document: document})
+	return nil
+}
+
+func newMemoryDocument(data interface{}) (memoryDocument, error) {
+	serialized, err := json.Marshal(data)
+	if err != nil {
+		return memoryDocument{}, err
+	}
+
+	fields, err := firestoreFields(data)
+	if err != nil {
+		return memoryDocument{}, err
+	}
+
+	return memoryDocument{data: serialized, fields: fields}, nil
+}
+
+// firestoreFields Serializes top-level fields of the document under the names Firestore stores them under: struct
+// fields by their `firestore` tag (or Go name when there's none, skipping "-" and empty "omitempty" ones), map entries
+// by their keys.
+func firestoreFields(data interface{}) (map[string][]byte, error) {
+	value := reflect.ValueOf(data)
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return nil, nil
+		}
+		value = value.Elem()
+	}
+
+	fields := make(map[string][]byte)
+
+	switch value.Kind() {
+	case reflect.Map:
+		if value.Type().Key().Kind() != reflect.String {
+			return nil, nil
+		}
+
+		iter := value.MapRange()
+		for iter.Next() {
+			serialized, err := json.Marshal(iter.Value().Interface())
+			if err != nil {
+				return nil, err
+			}
+			fields[iter.Key().String()] = serialized
+		}
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			if field.PkgPath != "" {
+				continue // unexported
+			}
+
+			name := field.Name
+			tag := strings.Split(field.Tag.Get("firestore"), ",")
+			if tag[0] == "-" {
+				continue
+			}
+			if tag[0] != "" {
+				name = tag[0]
+			}
+			if len(tag) > 1 && tag[1] == "omitempty" && isEmptyValue(value.Field(i)) {
+				continue
+			}
+
+			serialized, err := json.Marshal(value.Field(i).Interface())
+			if err != nil {
+				return nil, err
+			}
+			fields[name] = serialized
+		}
+	}
+
+	return fields, nil
+}
+
+func isEmptyValue(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return value.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return value.IsNil()
+	default:
+		return value.IsZero()
+	}
+}
@@ -0,0 +1,172 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type testDocument struct {
+	Name     string `json:"name"`
+	Platform string `firestore:"platform" json:"os"`
+	Hidden   string `firestore:"-" json:"hidden"`
+	Optional string `firestore:"optional,omitempty" json:"optional"`
+}
+
+func TestMemoryClientGetSet(t *testing.T) {
+	ctx := context.Background()
+	client := NewMemoryClient()
+
+	if err := client.Get(ctx, "docs", "missing", nil); status.Code(err) != codes.NotFound {
+		t.Errorf("Get() of missing document error = %v, want NotFound", err)
+	}
+
+	document := testDocument{Name: "first", Platform: "ios"}
+	if err := client.Set(ctx, "docs", "1", &document); err != nil {
+		t.Fatal(err)
+	}
+
+	// stored data can't be modified from outside
+	document.Name = "modified"
+
+	var loaded testDocument
+	if err := client.Get(ctx, "docs", "1", &loaded); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(testDocument{Name: "first", Platform: "ios"}, loaded); diff != "" {
+		t.Errorf("Get() mismatch (-want +got):\n%v", diff)
+	}
+
+	if err := client.Get(ctx, "docs", "1", nil); err != nil {
+		t.Errorf("Get() of existing document without dst error = %v", err)
+	}
+
+	if err := client.Get(ctx, "other", "1", nil); status.Code(err) != codes.NotFound {
+		t.Errorf("Get() from other collection error = %v, want NotFound", err)
+	}
+}
+
+func TestMemoryClientFindAll(t *testing.T) {
+	ctx := context.Background()
+	client := NewMemoryClient()
+
+	documents := map[string]interface{}{
+		"3": testDocument{Name: "third", Platform: "ios", Hidden: "x"},
+		"1": testDocument{Name: "first", Platform: "ios", Hidden: "x", Optional: "set"},
+		"2": &testDocument{Name: "second", Platform: "android"},
+		"4": map[string]interface{}{"platform": "ios", "count": 4},
+		"5": "not an object",
+	}
+
+	for id, document := range documents {
+		if err := client.Set(ctx, "docs", id, document); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		field string
+		value interface{}
+		limit int
+		want  []string
+	}{
+		{name: "by firestore tag", field: "platform", value: "ios", limit: 10, want: []string{"1", "3", "4"}},
+		{name: "limited", field: "platform", value: "ios", limit: 2, want: []string{"1", "3"}},
+		{name: "by field name without firestore tag", field: "Name", value: "second", limit: 10, want: []string{"2"}},
+		{name: "not by json tag", field: "os", value: "ios", limit: 10, want: nil},
+		{name: "not by json tag without firestore tag", field: "name", value: "second", limit: 10, want: nil},
+		{name: "ignored field", field: "Hidden", value: "x", limit: 10, want: nil},
+		{name: "omitted empty field", field: "optional", value: "", limit: 10, want: nil},
+		{name: "set omitempty field", field: "optional", value: "set", limit: 10, want: []string{"1"}},
+		{name: "map entry", field: "count", value: 4, limit: 10, want: []string{"4"}},
+	}
+
+	for _, tt := range tests {
+		got, err := client.FindAll(ctx, "docs", tt.field, tt.value, tt.limit)
+		if err != nil {
+			t.Fatalf("%v: FindAll() error = %v", tt.name, err)
+		}
+
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("%v: FindAll() mismatch (-want +got):\n%v", tt.name, diff)
+		}
+	}
+
+	if id, err := client.Find(ctx, "docs", "platform", "android"); err != nil || id != "2" {
+		t.Errorf("Find() = %v, %v, want 2", id, err)
+	}
+
+	if _, err := client.Find(ctx, "docs", "platform", "windows"); status.Code(err) != codes.NotFound {
+		t.Errorf("Find() of missing value error = %v, want NotFound", err)
+	}
+}
+
+func TestMemoryClientRunTransaction(t *testing.T) {
+	ctx := context.Background()
+	client := NewMemoryClient()
+
+	if err := client.Set(ctx, "docs", "1", testDocument{Name: "first"}); err != nil {
+		t.Fatal(err)
+	}
+
+	rename := func(name string, fail error) func(context.Context, Transaction) error {
+		return func(ctx context.Context, tx Transaction) error {
+			var document testDocument
+			if err := tx.Get("docs", "1", &document); err != nil {
+				return err
+			}
+
+			document.Name = name
+			if err := tx.Set("docs", "1", document); err != nil {
+				return err
+			}
+			if err := tx.Set("docs", "2", document); err != nil {
+				return err
+			}
+
+			return fail
+		}
+	}
+
+	if err := client.RunTransaction(ctx, rename("failed", fmt.Errorf("failure"))); err == nil {
+		t.Fatalf("RunTransaction() of failing function succeeded")
+	}
+
+	var document testDocument
+	if err := client.Get(ctx, "docs", "1", &document); err != nil || document.Name != "first" {
+		t.Errorf("Document after failed transaction = %+v, %v, want the original", document, err)
+	}
+	if err := client.Get(ctx, "docs", "2", nil); status.Code(err) != codes.NotFound {
+		t.Errorf("Document written by failed transaction exists: %v", err)
+	}
+
+	if err := client.RunTransaction(ctx, rename("renamed", nil)); err != nil {
+		t.Fatalf("RunTransaction() error = %v", err)
+	}
+
+	for _, id := range []string{"1", "2"} {
+		if err := client.Get(ctx, "docs", id, &document); err != nil || document.Name != "renamed" {
+			t.Errorf("Document %v after transaction = %+v, %v, want renamed", id, document, err)
+		}
+	}
+
+	if ids, err := client.FindAll(ctx, "docs", "Name", "renamed", 10); err != nil || len(ids) != 2 {
+		t.Errorf("FindAll() after transaction = %v, %v, want both documents", ids, err)
+	}
+
+	err := client.RunTransaction(ctx, func(ctx context.Context, tx Transaction) error {
+		if err := tx.Set("docs", "3", testDocument{}); err != nil {
+			return err
+		}
+		return tx.Get("docs", "1", nil)
+	})
+	if err == nil {
+		t.Errorf("RunTransaction() allowed read after write")
+	}
+}
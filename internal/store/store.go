@@ -2,62 +2,120 @@ package store
 
 import (
 	"context"
+	"fmt"
 
 	"cloud.google.com/go/firestore"
 	"github.com/covid19cz/erouska-backend/internal/firebase"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-// Storer is a storage abstraction layer interface
+// Storer is a storage abstraction layer interface. Missing documents are reported by an error with codes.NotFound
+// status, the same way Firestore does it.
 type Storer interface {
-	Doc(string, string) *firestore.DocumentRef
-	RunTransaction(context.Context, func(context.Context, *firestore.Transaction) error, ...firestore.TransactionOption) error
-	Find(collectionName string, field string, value interface{}) firestore.Query
+	Get(ctx context.Context, collectionName string, id string, dst interface{}) error
+	Set(ctx context.Context, collectionName string, id string, data interface{}) error
+	Find(ctx context.Context, collectionName string, field string, value interface{}) (string, error)
+	FindAll(ctx context.Context, collectionName string, field string, value interface{}, limit int) ([]string, error)
+	RunTransaction(ctx context.Context, f func(context.Context, Transaction) error) error
 }
 
-// Client to interact with storage API
+// Transaction is an abstraction of storage transaction. All reads must precede all writes.
+type Transaction interface {
+	Get(collectionName string, id string, dst interface{}) error
+	Set(collectionName string, id string, data interface{}) error
+}
+
+// Client to interact with storage API (Firestore)
 type Client struct{}
 
-// Doc returns a DocumentRef that refers to the document in the collection with the given identifier.
-func (i Client) Doc(collectionName string, path string) *firestore.DocumentRef {
+// Get loads the document with the given identifier into dst. The dst may be nil when only existence of the document matters.
+func (i Client) Get(ctx context.Context, collectionName string, id string, dst interface{}) error {
 	client := firebase.FirestoreClient
-	return client.Collection(collectionName).Doc(path)
+
+	snap, err := client.Collection(collectionName).Doc(id).Get(ctx)
+	if err != nil {
+		return err
+	}
+
+	if dst == nil {
+		return nil
+	}
+
+	return snap.DataTo(dst)
 }
 
-// Find Creates query searching for record with given field value.
-func (i Client) Find(collectionName string, field string, value interface{}) firestore.Query {
+// Set creates or overwrites the document with the given identifier.
+func (i Client) Set(ctx context.Context, collectionName string, id string, data interface{}) error {
 	client := firebase.FirestoreClient
-	return client.Collection(collectionName).Where(field, "==", value).Limit(1)
+
+	_, err := client.Collection(collectionName).Doc(id).Set(ctx, data)
+	return err
 }
 
-// RunTransaction runs f in a transaction.
-func (i Client) RunTransaction(ctx context.Context, f func(context.Context, *firestore.Transaction) error, opts ...firestore.TransactionOption) (err error) {
+// Find returns identifier of the first document whose field has given value.
+func (i Client) Find(ctx context.Context, collectionName string, field string, value interface{}) (string, error) {
 	client := firebase.FirestoreClient
-	return client.RunTransaction(ctx, f, opts...)
-}
 
-// MockClient mocks storage client functionaly for unit tests
-type MockClient struct{}
+	it := client.Collection(collectionName).Where(field, "==", value).Limit(1).Documents(ctx)
+	defer it.Stop()
 
-// Doc returns a DocumentRef that refers to the document in the collection with the given identifier.
-func (i MockClient) Doc(_ string, path string) *firestore.DocumentRef {
+	snap, err := it.Next()
+	if err == iterator.Done {
+		return "", status.Error(codes.NotFound, fmt.Sprintf("Could not find document in %v with %v == %v", collectionName, field, value))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return snap.Ref.ID, nil
+}
 
-	ret := firestore.DocumentRef{
-		Parent: nil,
-		Path:   path,
-		//shortPath: "coll-1/doc-1",
-		ID: "abc",
+// FindAll returns identifiers of at most limit documents whose field has given value.
+func (i Client) FindAll(ctx context.Context, collectionName string, field string, value interface{}, limit int) ([]string, error) {
+	client := firebase.FirestoreClient
+
+	snaps, err := client.Collection(collectionName).Where(field, "==", value).Limit(limit).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
 	}
 
-	return &ret
+	var ids []string
+	for _, snap := range snaps {
+		ids = append(ids, snap.Ref.ID)
+	}
 
+	return ids, nil
 }
 
 // RunTransaction runs f in a transaction.
-func (i MockClient) RunTransaction(ctx context.Context, f func(context.Context, *firestore.Transaction) error, opts ...firestore.TransactionOption) (err error) {
-	return nil
+func (i Client) RunTransaction(ctx context.Context, f func(context.Context, Transaction) error) error {
+	client := firebase.FirestoreClient
+
+	return client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		return f(ctx, firestoreTransaction{client: client, inner: tx})
+	})
+}
+
+type firestoreTransaction struct {
+	client *firestore.Client
+	inner  *firestore.Transaction
+}
+
+func (t firestoreTransaction) Get(collectionName string, id string, dst interface{}) error {
+	snap, err := t.inner.Get(t.client.Collection(collectionName).Doc(id))
+	if err != nil {
+		return err
+	}
+
+	if dst == nil {
+		return nil
+	}
+
+	return snap.DataTo(dst)
 }
 
-// Find Creates query searching for record with given field value. NOOP.
-func (i MockClient) Find(collectionName string, field string, value interface{}) firestore.Query {
-	return firestore.Query{}
+func (t firestoreTransaction) Set(collectionName string, id string, data interface{}) error {
+	return t.inner.Set(t.client.Collection(collectionName).Doc(id), data)
 }
@@ -13,6 +13,11 @@ type KeyServerConfig struct {
 	URL string `env:"KEY_SERVER_URL, required"`
 }
 
+//KeyServerLimits Limits of requests accepted by the Key server, set by the same variables as in the Key server.
+type KeyServerLimits struct {
+	MaxKeysOnPublish int `env:"MAX_KEYS_ON_PUBLISH,default=30"`
+}
+
 //VerificationServerConfig Configuration of Verification server.
 type VerificationServerConfig struct {
 	AdminURL  string `env:"VERIFICATION_SERVER_ADMIN_URL, required"`
@@ -21,6 +26,14 @@ type VerificationServerConfig struct {
 	DeviceKey string
 }
 
+//VerificationCertificateConfig Configuration of verification of certificates issued by Verification server.
+type VerificationCertificateConfig struct {
+	// JwksURL URL of public keys of the Verification server, in JWKS format.
+	JwksURL  string `env:"VERIFICATION_CERTIFICATE_JWKS_URL, required"`
+	Issuer   string `env:"VERIFICATION_CERTIFICATE_ISSUER, required"`
+	Audience string `env:"VERIFICATION_CERTIFICATE_AUDIENCE, required"`
+}
+
 //LoadKeyServerConfig Load KeyServer config.
 func LoadKeyServerConfig(ctx context.Context) (*KeyServerConfig, error) {
 	logger := logging.FromContext(ctx)
@@ -34,6 +47,19 @@ func LoadKeyServerConfig(ctx context.Context) (*KeyServerConfig, error) {
 	return &keyServerConfig, nil
 }
 
+//LoadKeyServerLimits Load limits of the KeyServer.
+func LoadKeyServerLimits(ctx context.Context) (*KeyServerLimits, error) {
+	logger := logging.FromContext(ctx)
+
+	var keyServerLimits KeyServerLimits
+	if err := envconfig.Process(ctx, &keyServerLimits); err != nil {
+		logger.Debugf("Could not load KeyServerLimits: %v", err)
+		return nil, err
+	}
+
+	return &keyServerLimits, nil
+}
+
 //LoadVerificationServerConfig Load Verification server config.
 func LoadVerificationServerConfig(ctx context.Context) (*VerificationServerConfig, error) {
 	logger := logging.FromContext(ctx)
@@ -67,6 +93,19 @@ func LoadVerificationServerConfig(ctx context.Context) (*VerificationServerConfi
 	return &verificationServerConfig, nil
 }
 
+//LoadVerificationCertificateConfig Load config of verification of certificates.
+func LoadVerificationCertificateConfig(ctx context.Context) (*VerificationCertificateConfig, error) {
+	logger := logging.FromContext(ctx)
+
+	var certificateConfig VerificationCertificateConfig
+	if err := envconfig.Process(ctx, &certificateConfig); err != nil {
+		logger.Debugf("Could not load VerificationCertificateConfig: %v", err)
+		return nil, err
+	}
+
+	return &certificateConfig, nil
+}
+
 //GetURL Gets configured url with given path set. It does URL verification but it also ensures that a valid URL comes
 //out of it, no matter if the original one (passed to ENV) included some path or trailing slash etc.
 func (c *KeyServerConfig) GetURL(path string) string {
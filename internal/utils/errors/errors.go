@@ -73,3 +73,48 @@ func (mr *UnauthenticatedError) Error() string {
 func (mr *UnauthenticatedError) Code() rpccode.Code {
 	return rpccode.Code_UNAUTHENTICATED
 }
+
+//UpstreamUnavailableError Error for upstream service (e.g. the Key server) which couldn't be reached or has failed itself.
+type UpstreamUnavailableError struct {
+	Msg string
+}
+
+func (e *UpstreamUnavailableError) Error() string {
+	return e.Msg
+}
+
+//Code Code of the error.
+func (e *UpstreamUnavailableError) Code() rpccode.Code {
+	return rpccode.Code_UNAVAILABLE
+}
+
+//UpstreamRejectedError Error for request refused by upstream service. ErrorCode is the code returned by the service
+//(e.g. error codes of the EN Key server).
+type UpstreamRejectedError struct {
+	ErrorCode string
+	Msg       string
+}
+
+func (e *UpstreamRejectedError) Error() string {
+	return e.Msg
+}
+
+//Code Code of the error.
+func (e *UpstreamRejectedError) Code() rpccode.Code {
+	return rpccode.Code_INVALID_ARGUMENT
+}
+
+//InvalidVerificationCertificateError Error for verification certificate which is invalid, expired or not accepted.
+type InvalidVerificationCertificateError struct {
+	Msg string
+}
+
+func (e *InvalidVerificationCertificateError) Error() string {
+	return e.Msg
+}
+
+//Code Code of the error.
+func (e *InvalidVerificationCertificateError) Code() rpccode.Code {
+	// the Key server takes it for a bad request too
+	return rpccode.Code_INVALID_ARGUMENT
+}
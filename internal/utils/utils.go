@@ -18,6 +18,10 @@ var Validate *validator.Validate
 
 func init() {
 	Validate = validator.New()
+
+	if err := Validate.RegisterValidation("country", isCountry); err != nil {
+		panic(err)
+	}
 }
 
 //GenerateEHrid generates new eHrid
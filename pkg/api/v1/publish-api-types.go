@@ -13,7 +13,7 @@ The base of these structs is copied from https://github.com/google/exposure-noti
 
 // PublishKeysRequestDevice represents the body of the PublishInfectedIds API call. It's received from device.
 //
-// VisitedCountries: list (possibly empty) where the device has travelled to.
+// VisitedCountries: list (possibly empty) of ISO 3166-1 alpha-2 codes of countries where the device has travelled to.
 //
 // ReportType: type of report - is it self-report, confirmed diagnose, ...?
 //
@@ -21,7 +21,7 @@ The base of these structs is copied from https://github.com/google/exposure-noti
 type PublishKeysRequestDevice struct {
 	keyserverapi.Publish // embedded struct
 
-	VisitedCountries    []string   `json:"visitedCountries"`
+	VisitedCountries    []string   `json:"visitedCountries" validate:"dive,country"`
 	ReportType          ReportType `json:"reportType"`
 	ConsentToFederation bool       `json:"consentToFederation"`
 }
@@ -50,3 +50,12 @@ const (
 	Recursive                  = "Recursive"
 	Revoked                    = "Revoked"
 )
+
+// Error codes of PublishKeysResponseDevice, besides the ones of the Key server (e.g. `bad_request`) passed to device
+// as they are.
+const (
+	ErrorUpstreamUnavailable = "upstream_unavailable"
+	ErrorInternal            = keyserverapi.ErrorInternalError
+	ErrorBadRequest          = keyserverapi.ErrorBadRequest
+	ErrorCertificateInvalid  = keyserverapi.ErrorVerificationCertificateInvalid
+)
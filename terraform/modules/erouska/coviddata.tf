@@ -109,7 +109,18 @@ locals {
   publishkeys_roles = [
     "roles/cloudfunctions.serviceAgent",
     "roles/secretmanager.secretAccessor",
-    "roles/cloudsql.editor"
+    "roles/cloudsql.editor",
+    "roles/datastore.user",
+    "roles/pubsub.publisher"
+  ]
+
+  # PublishKeysAfterMath
+
+  publishkeysaftermath_roles = [
+    "roles/cloudfunctions.serviceAgent",
+    "roles/secretmanager.secretAccessor",
+    "roles/cloudsql.editor",
+    "roles/datastore.user"
   ]
 
   # SendWakeUpSignal
@@ -127,6 +138,21 @@ locals {
     "roles/cloudfunctions.serviceAgent",
     "roles/iam.serviceAccountUser"
   ]
+
+  # RelayOutbox
+
+  relayoutbox_roles = [
+    "roles/cloudfunctions.serviceAgent",
+    "roles/datastore.user",
+    "roles/pubsub.publisher"
+  ]
+
+  # RelayOutbox - invoker
+
+  relayoutbox_invoker_roles = [
+    "roles/cloudfunctions.serviceAgent",
+    "roles/iam.serviceAccountUser"
+  ]
 }
 
 # RegisterEhrid
@@ -416,6 +442,19 @@ resource "google_project_iam_member" "publishkeys" {
   member = "serviceAccount:${google_service_account.publishkeys.email}"
 }
 
+# PublishKeysAfterMath
+
+resource "google_service_account" "publishkeysaftermath" {
+  account_id   = "publish-keys-aftermath"
+  display_name = "PublishKeysAfterMath cloud function service account"
+}
+
+resource "google_project_iam_member" "publishkeysaftermath" {
+  count  = length(local.publishkeysaftermath_roles)
+  role   = local.publishkeysaftermath_roles[count.index]
+  member = "serviceAccount:${google_service_account.publishkeysaftermath.email}"
+}
+
 # SendWakeUpSignal
 
 data "google_cloudfunctions_function" "sendwakeupsignal" {
@@ -471,3 +510,59 @@ resource "google_cloud_scheduler_job" "sendwakeupsignal-worker" {
     google_project_service.services["cloudscheduler.googleapis.com"],
   ]
 }
+
+# RelayOutbox
+
+data "google_cloudfunctions_function" "relayoutbox" {
+  name    = "RelayOutbox"
+  project = var.project
+}
+
+resource "google_service_account" "relayoutbox" {
+  account_id   = "relay-outbox"
+  display_name = "RelayOutbox cloud function service account"
+}
+
+resource "google_project_iam_member" "relayoutbox" {
+  count  = length(local.relayoutbox_roles)
+  role   = local.relayoutbox_roles[count.index]
+  member = "serviceAccount:${google_service_account.relayoutbox.email}"
+}
+
+# RelayOutbox - invoker
+
+resource "google_service_account" "relayoutbox-invoker" {
+  account_id   = "relayoutbox-invoker-sa"
+  display_name = "RelayOutbox invoker"
+}
+
+resource "google_project_iam_member" "relayoutbox-invoker" {
+  count  = length(local.relayoutbox_invoker_roles)
+  role   = local.relayoutbox_invoker_roles[count.index]
+  member = "serviceAccount:${google_service_account.relayoutbox-invoker.email}"
+}
+
+resource "google_cloud_scheduler_job" "relayoutbox-worker" {
+  name             = "relayoutbox-worker"
+  region           = var.cloudscheduler_location
+  schedule         = "*/5 * * * *"
+  time_zone        = "Europe/Prague"
+  attempt_deadline = "300s"
+
+  retry_config {
+    retry_count = 1
+  }
+
+  http_target {
+    http_method = "GET"
+    uri         = data.google_cloudfunctions_function.relayoutbox.https_trigger_url
+    oidc_token {
+      audience              = data.google_cloudfunctions_function.relayoutbox.https_trigger_url
+      service_account_email = google_service_account.relayoutbox-invoker.email
+    }
+  }
+
+  depends_on = [
+    google_project_service.services["cloudscheduler.googleapis.com"],
+  ]
+}
@@ -21,6 +21,8 @@ locals {
     "roles/secretmanager.secretAccessor",
     "roles/redis.editor",
     "roles/pubsub.publisher",
+    "roles/datastore.user",
+    "roles/cloudsql.editor",
   ]
 
   # DownloadKeys - invoker
@@ -36,6 +38,8 @@ locals {
     "roles/cloudfunctions.serviceAgent",
     "roles/secretmanager.secretAccessor",
     "roles/pubsub.publisher",
+    "roles/datastore.user",
+    "roles/cloudsql.editor",
   ]
 
   # DownloadYesterdaysKeys - invoker
@@ -50,6 +54,41 @@ locals {
   efgsimportkeys_roles = [
     "roles/cloudfunctions.serviceAgent",
     "roles/secretmanager.secretAccessor",
+    "roles/cloudsql.editor",
+    "roles/pubsub.publisher",
+  ]
+
+  # RequeueImports
+
+  efgsrequeueimports_roles = [
+    "roles/cloudfunctions.serviceAgent",
+    "roles/secretmanager.secretAccessor",
+    "roles/cloudsql.editor",
+    "roles/pubsub.publisher",
+  ]
+
+  # RequeueImports - invoker
+
+  efgsrequeueimports_invoker_roles = [
+    "roles/cloudfunctions.serviceAgent",
+    "roles/iam.serviceAccountUser"
+  ]
+
+  # BatchCallback
+
+  efgsbatchcallback_roles = [
+    "roles/cloudfunctions.serviceAgent",
+    "roles/secretmanager.secretAccessor",
+    "roles/pubsub.publisher"
+  ]
+
+  # PersistKeys
+
+  efgspersistkeys_roles = [
+    "roles/cloudfunctions.serviceAgent",
+    "roles/secretmanager.secretAccessor",
+    "roles/cloudsql.editor",
+    "roles/datastore.user"
   ]
 
   # RemoveOldKeys
@@ -67,6 +106,21 @@ locals {
     "roles/iam.serviceAccountUser"
   ]
 
+  # CheckCertificates
+
+  efgscheckcertificates_roles = [
+    "roles/cloudfunctions.serviceAgent",
+    "roles/secretmanager.secretAccessor",
+    "roles/datastore.user",
+  ]
+
+  # CheckCertificates - invoker
+
+  efgscheckcertificates_invoker_roles = [
+    "roles/cloudfunctions.serviceAgent",
+    "roles/iam.serviceAccountUser"
+  ]
+
   # EfgsIssueTestingVerificationCode
 
   issuetestingverificationcode_roles = [
@@ -267,6 +321,60 @@ resource "google_project_iam_member" "efgsimportkeys" {
   member = "serviceAccount:${google_service_account.efgsimportkeys.email}"
 }
 
+# BatchCallback
+
+resource "google_service_account" "efgsbatchcallback" {
+  account_id   = "efgs-batch-callback"
+  display_name = "EfgsBatchCallback cloud function service account"
+}
+
+resource "google_project_iam_member" "efgsbatchcallback" {
+  count  = length(local.efgsbatchcallback_roles)
+  role   = local.efgsbatchcallback_roles[count.index]
+  member = "serviceAccount:${google_service_account.efgsbatchcallback.email}"
+}
+
+# BatchCallback - invoker
+#
+# Cloud Functions can't terminate mTLS, so EFGS calls a proxy which does. The proxy runs as this service account, the
+# only invoker of the function, and passes the verified client certificate subject in X-SSL-Client-DN header.
+
+data "google_cloudfunctions_function" "efgsbatchcallback" {
+  name    = "EfgsBatchCallback"
+  project = var.project
+}
+
+resource "google_service_account" "efgscallbackproxy" {
+  account_id   = "efgs-callback-proxy"
+  display_name = "Proxy terminating mTLS of EFGS callbacks"
+}
+
+resource "google_cloudfunctions_function_iam_member" "efgscallbackproxy" {
+  project        = var.project
+  region         = data.google_cloudfunctions_function.efgsbatchcallback.region
+  cloud_function = data.google_cloudfunctions_function.efgsbatchcallback.name
+  role           = "roles/cloudfunctions.invoker"
+  member         = "serviceAccount:${google_service_account.efgscallbackproxy.email}"
+}
+
+# PersistKeys
+
+data "google_cloudfunctions_function" "efgspersistkeys" {
+  name    = "EfgsPersistKeys"
+  project = var.project
+}
+
+resource "google_service_account" "efgspersistkeys" {
+  account_id   = "efgs-persist-keys"
+  display_name = "EfgsPersistKeys cloud function service account"
+}
+
+resource "google_project_iam_member" "efgspersistkeys" {
+  count  = length(local.efgspersistkeys_roles)
+  role   = local.efgspersistkeys_roles[count.index]
+  member = "serviceAccount:${google_service_account.efgspersistkeys.email}"
+}
+
 # RemoveOldKeys
 
 data "google_cloudfunctions_function" "efgsremoveoldkeys" {
@@ -325,6 +433,146 @@ resource "google_cloud_scheduler_job" "efgsremoveoldkeys-worker" {
   ]
 }
 
+# CheckCertificates
+
+data "google_cloudfunctions_function" "efgscheckcertificates" {
+  name    = "EfgsCheckCertificates"
+  project = var.project
+}
+
+resource "google_service_account" "efgscheckcertificates" {
+  account_id   = "efgs-check-certificates"
+  display_name = "EfgsCheckCertificates cloud function service account"
+}
+
+resource "google_project_iam_member" "efgscheckcertificates" {
+  count  = length(local.efgscheckcertificates_roles)
+  role   = local.efgscheckcertificates_roles[count.index]
+  member = "serviceAccount:${google_service_account.efgscheckcertificates.email}"
+}
+
+# CheckCertificates - invoker
+
+resource "google_service_account" "efgscheckcertificates-invoker" {
+  account_id   = "efgscheckcerts-invoker-sa"
+  display_name = "EfgsCheckCertificates invoker"
+}
+
+resource "google_project_iam_member" "efgscheckcertificates-invoker" {
+  count  = length(local.efgscheckcertificates_invoker_roles)
+  role   = local.efgscheckcertificates_invoker_roles[count.index]
+  member = "serviceAccount:${google_service_account.efgscheckcertificates-invoker.email}"
+}
+
+resource "google_cloud_scheduler_job" "efgscheckcertificates-worker" {
+  count = (data.google_cloudfunctions_function.efgscheckcertificates.https_trigger_url != null) ? 1 : 0
+
+  name             = "efgscheckcertificates-worker"
+  region           = var.cloudscheduler_location
+  schedule         = "0 8 * * *"
+  time_zone        = "Europe/Prague"
+  attempt_deadline = "120s"
+
+  retry_config {
+    retry_count = 1
+  }
+
+  http_target {
+    http_method = "GET"
+    uri         = data.google_cloudfunctions_function.efgscheckcertificates.https_trigger_url
+    oidc_token {
+      audience              = data.google_cloudfunctions_function.efgscheckcertificates.https_trigger_url
+      service_account_email = google_service_account.efgscheckcertificates-invoker.email
+    }
+  }
+
+  depends_on = [
+    google_project_service.services["cloudscheduler.googleapis.com"],
+  ]
+}
+
+# Problems found by CheckCertificates, to be used by an alerting policy
+resource "google_logging_metric" "efgscheckcertificates-problems" {
+  name   = "efgs-certificate-problems"
+  filter = "resource.type=\"cloud_function\" AND resource.labels.function_name=\"EfgsCheckCertificates\" AND severity>=ERROR"
+
+  metric_descriptor {
+    metric_kind = "DELTA"
+    value_type  = "INT64"
+  }
+}
+
+# RequeueImports
+
+data "google_cloudfunctions_function" "efgsrequeueimports" {
+  name    = "EfgsRequeueImports"
+  project = var.project
+}
+
+resource "google_service_account" "efgsrequeueimports" {
+  account_id   = "efgs-requeue-imports"
+  display_name = "EfgsRequeueImports cloud function service account"
+}
+
+resource "google_project_iam_member" "efgsrequeueimports" {
+  count  = length(local.efgsrequeueimports_roles)
+  role   = local.efgsrequeueimports_roles[count.index]
+  member = "serviceAccount:${google_service_account.efgsrequeueimports.email}"
+}
+
+# RequeueImports - invoker
+
+resource "google_service_account" "efgsrequeueimports-invoker" {
+  account_id   = "efgsrequeueimports-invoker-sa"
+  display_name = "EfgsRequeueImports invoker"
+}
+
+resource "google_project_iam_member" "efgsrequeueimports-invoker" {
+  count  = length(local.efgsrequeueimports_invoker_roles)
+  role   = local.efgsrequeueimports_invoker_roles[count.index]
+  member = "serviceAccount:${google_service_account.efgsrequeueimports-invoker.email}"
+}
+
+resource "google_cloud_scheduler_job" "efgsrequeueimports-worker" {
+  count = (data.google_cloudfunctions_function.efgsrequeueimports.https_trigger_url != null) ? 1 : 0
+
+  name             = "efgsrequeueimports-worker"
+  region           = var.cloudscheduler_location
+  schedule         = "*/5 * * * *"
+  time_zone        = "Europe/Prague"
+  attempt_deadline = "120s"
+
+  retry_config {
+    retry_count = 1
+  }
+
+  http_target {
+    http_method = "GET"
+    uri         = data.google_cloudfunctions_function.efgsrequeueimports.https_trigger_url
+    oidc_token {
+      audience              = data.google_cloudfunctions_function.efgsrequeueimports.https_trigger_url
+      service_account_email = google_service_account.efgsrequeueimports-invoker.email
+    }
+  }
+
+  depends_on = [
+    google_project_service.services["cloudscheduler.googleapis.com"],
+  ]
+}
+
+# Keys which could not be imported even after retries; kept for inspection and manual replay
+
+resource "google_pubsub_subscription" "efgs-import-keys-dead-letter" {
+  name                       = "efgs-import-keys-dead-letter"
+  topic                      = google_pubsub_topic.efgs-import-keys-dead-letter.name
+  message_retention_duration = "604800s"
+  ack_deadline_seconds       = 60
+
+  expiration_policy {
+    ttl = ""
+  }
+}
+
 # IssueTestingVerificationCode
 
 data "google_cloudfunctions_function" "issuetestingverificationcode" {
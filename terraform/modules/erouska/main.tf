@@ -2,7 +2,10 @@ locals {
 
   cloudbuild_roles = [
     "roles/cloudfunctions.developer",
-    "roles/iam.serviceAccountUser"
+    "roles/iam.serviceAccountUser",
+    # efgs-migrate is run before deploying the functions
+    "roles/secretmanager.secretAccessor",
+    "roles/cloudsql.editor"
   ]
 
 }
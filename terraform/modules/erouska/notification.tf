@@ -6,10 +6,26 @@ resource "google_pubsub_topic" "user-registered" {
   name = "user-registered"
 }
 
+resource "google_pubsub_topic" "keys-published" {
+  name = "keys-published"
+}
+
 resource "google_pubsub_topic" "efgs-import-keys" {
   name = "efgs-import-keys"
 }
 
+resource "google_pubsub_topic" "efgs-import-keys-dead-letter" {
+  name = "efgs-import-keys-dead-letter"
+}
+
 resource "google_pubsub_topic" "efgs-postponed-yesterdays-downloading" {
   name = "efgs-postponed-yesterdays-downloading"
 }
+
+resource "google_pubsub_topic" "efgs-persist-keys" {
+  name = "efgs-persist-keys"
+}
+
+resource "google_pubsub_topic" "efgs-download-batch" {
+  name = "efgs-download-batch"
+}